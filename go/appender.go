@@ -0,0 +1,392 @@
+package fastgcs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAppendFlushSize       = 4 << 20
+	defaultAppendFlushInterval   = 5 * time.Second
+	defaultAppendComposeInterval = 30 * time.Second
+	appendRetries                = 5
+
+	// appendMarkPrefix starts the custom metadata keys in which each
+	// Appender records, on every compose, the sequence number of the last
+	// chunk it appended, as "<seq>,<unix time>".
+	appendMarkPrefix = "fastgcs-append-"
+	// appendMarkTTL is how long the mark of an Appender that stopped
+	// composing is kept: long enough for any retry of its last compose.
+	appendMarkTTL = time.Hour
+
+	// maxComponents is the most components GCS allows a composite object.
+	maxComponents = 1024
+)
+
+// AppendOptions configures an Appender.
+type AppendOptions struct {
+	// ContentType is given to the target object. Defaults to a guess from
+	// its name.
+	ContentType string
+	// FlushSize is the amount of buffered data that makes Write upload a
+	// chunk. Defaults to 4MiB.
+	FlushSize int
+	// FlushInterval is how long written data may stay buffered in memory
+	// before it's uploaded as a chunk. Defaults to 5 seconds.
+	FlushInterval time.Duration
+	// ComposeInterval is how often uploaded chunks are composed onto the
+	// target. GCS only sustains about one write per second to an object, so
+	// chunks are batched. Defaults to 30 seconds.
+	ComposeInterval time.Duration
+}
+
+func (o AppendOptions) withDefaults() AppendOptions {
+	if o.FlushSize <= 0 {
+		o.FlushSize = defaultAppendFlushSize
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = defaultAppendFlushInterval
+	}
+	if o.ComposeInterval <= 0 {
+		o.ComposeInterval = defaultAppendComposeInterval
+	}
+	return o
+}
+
+// Appender keeps an append-only log in a GCS object. Writes are buffered
+// and uploaded as temporary chunk objects next to the target, which are
+// composed onto the target with a generation precondition and then
+// deleted. Composing happens every ComposeInterval, or sooner when enough
+// chunks are pending to fill a compose request.
+//
+// Several Appenders, even in different processes, may append to the same
+// target: a compose that loses a race is retried against the new
+// generation, so each chunk lands whole, in some order. Each compose marks
+// the target's metadata with the last chunk it appended, so that a compose
+// that went through but whose response was lost isn't appended twice.
+//
+// Before the target reaches the 1024 components GCS allows a composite
+// object, it's rewritten onto itself, which makes it a plain object again.
+//
+// Chunks are named <target>.append-<id>-<n>. If the process dies, chunks
+// that weren't composed yet are left behind and hold the missing data.
+type Appender struct {
+	fg     FastGCS
+	bucket string
+	object string
+	opts   AppendOptions
+	id     string
+
+	mu          sync.Mutex
+	buf         []byte
+	seq         int
+	chunks      []ObjectAttrs     // uploaded but not yet composed
+	generation  int64             // of the target, 0 if it doesn't exist
+	components  int               // of the target, 0 if it doesn't exist
+	metadata    map[string]string // of the target
+	lastCompose time.Time
+	err         error
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewAppender returns an Appender for the object at gsURL, which is
+// created on the first compose if it doesn't exist.
+func NewAppender(fg FastGCS, gsURL string, opts AppendOptions) (*Appender, error) {
+	bucket, object, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	if opts.ContentType == "" {
+		opts.ContentType = guessContentType(object)
+	}
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	a := &Appender{
+		fg:          fg,
+		bucket:      bucket,
+		object:      object,
+		opts:        opts,
+		id:          hex.EncodeToString(id),
+		lastCompose: time.Now(),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if err := a.refreshGeneration(); err != nil {
+		return nil, err
+	}
+	go a.loop()
+	return a, nil
+}
+
+func (a *Appender) url() string {
+	return fmt.Sprintf("gs://%s/%s", a.bucket, a.object)
+}
+
+func (a *Appender) refreshGeneration() error {
+	attrs, err := a.fg.Stat(a.url())
+	switch {
+	case IsStatus(err, http.StatusNotFound):
+		a.setTarget(nil)
+	case err != nil:
+		return err
+	default:
+		a.setTarget(attrs)
+	}
+	return nil
+}
+
+// setTarget records the state of the target, nil if it doesn't exist.
+func (a *Appender) setTarget(attrs *ObjectAttrs) {
+	if attrs == nil {
+		a.generation, a.components, a.metadata = 0, 0, nil
+		return
+	}
+	a.generation, a.components, a.metadata = attrs.Generation, attrs.ComponentCount, attrs.Metadata
+	if a.components == 0 {
+		// An object that wasn't composed is a single component.
+		a.components = 1
+	}
+}
+
+// composed reports whether the target already holds the chunks up to seq.
+func (a *Appender) composed(seq int) bool {
+	mark, ok := a.metadata[appendMarkPrefix+a.id]
+	if !ok {
+		return false
+	}
+	n, err := strconv.Atoi(strings.SplitN(mark, ",", 2)[0])
+	return err == nil && n >= seq
+}
+
+// markedMetadata returns the target's metadata with this Appender's mark
+// set to seq, leaving out the marks that outlived appendMarkTTL.
+func (a *Appender) markedMetadata(seq int) map[string]string {
+	now := time.Now()
+	metadata := map[string]string{}
+	for k, v := range a.metadata {
+		if strings.HasPrefix(k, appendMarkPrefix) {
+			parts := strings.SplitN(v, ",", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			t, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || now.Sub(time.Unix(t, 0)) > appendMarkTTL {
+				continue
+			}
+		}
+		metadata[k] = v
+	}
+	metadata[appendMarkPrefix+a.id] = fmt.Sprintf("%d,%d", seq, now.Unix())
+	return metadata
+}
+
+func (a *Appender) loop() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+		a.mu.Lock()
+		if a.err == nil {
+			a.err = a.flush(false)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// Write buffers p, uploading a chunk once FlushSize bytes are buffered.
+// After a failed upload or compose, the Appender stops accepting data and
+// every call returns the error.
+func (a *Appender) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return 0, a.err
+	}
+	a.buf = append(a.buf, p...)
+	if len(a.buf) >= a.opts.FlushSize {
+		a.err = a.flush(false)
+	}
+	return len(p), a.err
+}
+
+// Flush uploads buffered data and composes every pending chunk onto the
+// target, so that everything written so far is in the target when it
+// returns.
+func (a *Appender) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	a.err = a.flush(true)
+	return a.err
+}
+
+// Close flushes the Appender and stops its background uploads. Closing it
+// again only flushes.
+func (a *Appender) Close() error {
+	a.stopOnce.Do(func() { close(a.stop) })
+	<-a.done
+	return a.Flush()
+}
+
+// flush uploads the buffer as a chunk, and composes the pending chunks if
+// force is set, ComposeInterval has passed, or one more chunk wouldn't fit
+// in a compose request.
+func (a *Appender) flush(force bool) error {
+	if len(a.buf) > 0 {
+		if err := a.uploadChunk(); err != nil {
+			return err
+		}
+	}
+	if len(a.chunks) == 0 {
+		return nil
+	}
+	if force || time.Since(a.lastCompose) >= a.opts.ComposeInterval || len(a.chunks) >= MaxComposeSources-1 {
+		return a.compose()
+	}
+	return nil
+}
+
+func (a *Appender) uploadChunk() error {
+	var attrs *ObjectAttrs
+	err := withRetries(appendRetries, func() error {
+		// Every attempt gets a new name, in case a failed one was created
+		// after all.
+		a.seq++
+		zero := int64(0)
+		w, err := a.fg.Create(fmt.Sprintf("gs://%s/%s.append-%s-%06d", a.bucket, a.object, a.id, a.seq), WriteOptions{
+			ContentType:       a.opts.ContentType,
+			IfGenerationMatch: &zero,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(a.buf); err != nil {
+			w.Abort()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		attrs = w.Attrs()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "uploading append chunk")
+	}
+	a.chunks = append(a.chunks, *attrs)
+	a.buf = a.buf[:0]
+	return nil
+}
+
+// compose appends the pending chunks to the target in a single compose
+// request, then deletes them.
+func (a *Appender) compose() error {
+	// Every pending chunk was numbered up to a.seq, and every chunk composed
+	// before them lower.
+	seq := a.seq
+	for attempt := 0; ; attempt++ {
+		if a.composed(seq) {
+			// A compose whose response was lost went through.
+			break
+		}
+		if a.components+len(a.chunks) > maxComponents {
+			err := a.compact()
+			if (IsStatus(err, http.StatusPreconditionFailed) || IsStatus(err, http.StatusNotFound)) && attempt < appendRetries {
+				// The target changed under the rewrite.
+				if err := a.refreshGeneration(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return errors.Wrap(err, "compacting append target")
+			}
+			if a.components+len(a.chunks) > maxComponents {
+				return errors.Errorf("%s still has %d components after compacting", a.url(), a.components)
+			}
+		}
+
+		var sources []ObjectAttrs
+		if a.generation != 0 {
+			sources = append(sources, ObjectAttrs{Name: a.object, Generation: a.generation})
+		}
+		sources = append(sources, a.chunks...)
+		gen := a.generation
+
+		var attrs *ObjectAttrs
+		err := withRetries(appendRetries, func() error {
+			var err error
+			attrs, err = a.fg.Compose(a.url(), sources, ComposeOptions{
+				ContentType:       a.opts.ContentType,
+				Metadata:          a.markedMetadata(seq),
+				IfGenerationMatch: &gen,
+			})
+			return err
+		})
+		if IsStatus(err, http.StatusPreconditionFailed) && attempt < appendRetries {
+			// Another writer appended in the meantime, or an earlier try
+			// went through after all.
+			if err := a.refreshGeneration(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "appending chunks")
+		}
+		a.setTarget(attrs)
+		break
+	}
+
+	for i := range a.chunks {
+		// A chunk left behind only wastes space: its data is in the target.
+		a.fg.Delete(a.chunks[i].URL(), DeleteOptions{IfGenerationMatch: &a.chunks[i].Generation})
+	}
+	a.chunks = nil
+	a.lastCompose = time.Now()
+	return nil
+}
+
+// compact rewrites the target onto itself. Unlike composing, rewriting
+// copies the data, so the new generation is a single component.
+func (a *Appender) compact() error {
+	gen := a.generation
+	opts := RewriteOptions{SourceGeneration: gen, IfGenerationMatch: &gen}
+	for {
+		var status *RewriteStatus
+		err := withRetries(appendRetries, func() error {
+			var err error
+			status, err = a.fg.Rewrite(a.url(), a.url(), opts)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if status.Done {
+			a.setTarget(status.Resource)
+			return nil
+		}
+		opts.RewriteToken = status.RewriteToken
+	}
+}
@@ -0,0 +1,108 @@
+package fastgcs
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rewriteTransport calls hook before each rewrite request.
+type rewriteTransport struct {
+	base http.RoundTripper
+	hook func()
+}
+
+func (rt *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.Contains(req.URL.Path, "/rewriteTo/") {
+		rt.hook()
+	}
+	return rt.base.RoundTrip(req)
+}
+
+// appendBytes writes data to a new Appender for gs://b/log one byte at a
+// time, so that every byte is a chunk and every compose takes as many
+// chunks as a request holds.
+func appendBytes(t *testing.T, f *fastGCS, data []byte) {
+	t.Helper()
+	a, err := NewAppender(f, "gs://b/log", AppendOptions{FlushSize: 1, FlushInterval: time.Hour, ComposeInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		if _, err := a.Write(data[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppenderCompaction(t *testing.T) {
+	f, srv := newJSONTest(t)
+	// Compacting takes several rewrite calls.
+	srv.LimitRewrites(64)
+	var rewrites, compacted int
+	f.client = &http.Client{Transport: &rewriteTransport{base: srv.Client().Transport, hook: func() {
+		if rewrites == 0 {
+			log, _ := srv.Get("b", "log")
+			compacted = len(log)
+		}
+		rewrites++
+	}}}
+
+	// Enough chunks to go past the 1024 components a composite object may
+	// have.
+	data := textContent(2000)
+	appendBytes(t, f, data)
+	if got, _ := srv.Get("b", "log"); !bytes.Equal(got, data) {
+		t.Errorf("log holds %d bytes, want the %d appended in order", len(got), len(data))
+	}
+	attrs, err := f.Stat("gs://b/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The log was compacted once, just before it would have gone over.
+	if compacted <= maxComponents-MaxComposeSources || compacted > maxComponents {
+		t.Errorf("compacted at %d components, want just under %d", compacted, maxComponents)
+	}
+	if want := (compacted + 63) / 64; rewrites != want {
+		t.Errorf("%d rewrite calls, want %d to compact %d bytes 64 at a time", rewrites, want, compacted)
+	}
+	if want := 1 + len(data) - compacted; attrs.ComponentCount != want {
+		t.Errorf("log has %d components, want %d: one for what was compacted, one per later chunk", attrs.ComponentCount, want)
+	}
+	objects, err := f.List("gs://b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 {
+		t.Errorf("%d objects in the bucket, want chunks deleted once composed", len(objects))
+	}
+}
+
+func TestAppenderCompactionRace(t *testing.T) {
+	f, srv := newJSONTest(t)
+	// Another writer replaces the log while it's being compacted: the
+	// Appender appends its pending chunks to the new generation instead.
+	var replaced int
+	f.client = &http.Client{Transport: &rewriteTransport{base: srv.Client().Transport, hook: func() {
+		if replaced == 0 {
+			log, _ := srv.Get("b", "log")
+			replaced = len(log)
+			srv.Put("b", "log", []byte("replaced\n"))
+		}
+	}}}
+
+	data := textContent(1100)
+	appendBytes(t, f, data)
+	if replaced == 0 {
+		t.Fatal("log never compacted")
+	}
+	want := append([]byte("replaced\n"), data[replaced:]...)
+	if got, _ := srv.Get("b", "log"); !bytes.Equal(got, want) {
+		t.Errorf("log holds %q..., want %q...", got[:20], want[:20])
+	}
+}
@@ -0,0 +1,382 @@
+package fastgcs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Entries smaller than compressMinSize aren't worth compressing, and
+	// the rest are only kept compressed if that saves at least a tenth of
+	// their size, first estimated on a sample of compressSampleSize bytes.
+	compressMinSize    = 4 << 10
+	compressSampleSize = 128 << 10
+	compressMaxRatio   = 0.9
+
+	// Compressed entries are made of independent zstd frames of
+	// compressFrameSize bytes of content each, so that seeking only
+	// decompresses from the start of the frame it lands in.
+	compressFrameSize = 1 << 20
+)
+
+// WithCompressedCache stores each cache entry zstd-compressed if its
+// content compresses well, which suits text-heavy objects. Open and Read
+// decompress transparently, and Copy writes the decompressed content.
+// Readers from Open still implement io.Seeker.
+// Entries stored either way are read back correctly whether or not the
+// option is set.
+func WithCompressedCache() Option {
+	return func(f *fastGCS) {
+		f.compressCache = true
+	}
+}
+
+// cacheMeta describes the object generation held by a cache entry. It is
+// stored next to the entry, in the same way the Ruby client keeps its .etag
+// files.
+type cacheMeta struct {
+	URL             string `json:"url"`
+	ETag            string `json:"etag"`
+	Generation      int64  `json:"generation,string"`
+	CRC32C          string `json:"crc32c,omitempty"`
+	MD5Hash         string `json:"md5Hash,omitempty"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	// Compression is "zstd" if the entry is stored compressed, under the
+	// name given by entryPath. Frames then holds the offset in the file of
+	// each of its frames, and Length the size of its content.
+	Compression string    `json:"compression,omitempty"`
+	Frames      []int64   `json:"frames,omitempty"`
+	Length      int64     `json:"length,omitempty"`
+	Fetched     time.Time `json:"fetched"`
+
+	// The rest of the attributes of the generation cached, as sent with
+	// its content. Through the JSON API, Updated is to the second, and
+	// Metadata keys are in lower case, as headers carry them.
+	ContentType    string            `json:"contentType,omitempty"`
+	Size           int64             `json:"size,string"`
+	Metageneration int64             `json:"metageneration,string"`
+	Updated        time.Time         `json:"updated"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+
+	// Version is that of the format the metadata was written in.
+	Version int `json:"version,omitempty"`
+}
+
+// cacheMetaVersion is the version of the current metadata format: 1 added
+// the attributes other than the checksums and Content-Encoding.
+const cacheMetaVersion = 1
+
+// attrs returns the attributes of the object the entry holds.
+func (meta *cacheMeta) attrs() *ObjectAttrs {
+	bucket, name, _ := parseGSURL(meta.URL)
+	return &ObjectAttrs{
+		Bucket:          bucket,
+		Name:            name,
+		Size:            meta.Size,
+		Generation:      meta.Generation,
+		Metageneration:  meta.Metageneration,
+		ContentType:     meta.ContentType,
+		ContentEncoding: meta.ContentEncoding,
+		CRC32C:          meta.CRC32C,
+		MD5Hash:         meta.MD5Hash,
+		ETag:            meta.ETag,
+		Updated:         meta.Updated,
+		Metadata:        meta.Metadata,
+	}
+}
+
+// cacheEntry is a validated cache entry, as returned by update.
+type cacheEntry struct {
+	path string
+	meta cacheMeta
+	// hit is set when the cached copy was still current and nothing was
+	// downloaded.
+	hit bool
+}
+
+// entryPath returns where the content of the cache entry at path is stored:
+// compressed entries get a name of their own, so that a reader holding the
+// metadata of the previous generation never mistakes one kind of content for
+// the other. Like metadata, it's hidden, which keeps it from colliding with
+// the entry of another object.
+func entryPath(path string, meta *cacheMeta) string {
+	if meta.Compression == "zstd" {
+		return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".zst")
+	}
+	return path
+}
+
+// open returns a reader over the entry's content, decompressed. It
+// implements io.Seeker.
+func (e *cacheEntry) open() (io.ReadCloser, error) {
+	file, err := os.Open(e.path)
+	if err != nil || e.meta.Compression == "" {
+		return file, err
+	}
+	zr, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &zstdFile{dec: zr, file: file, frames: e.meta.Frames, length: e.meta.Length}, nil
+}
+
+// gone reports whether err is the failure to open the entry's content
+// because it was removed.
+func (e *cacheEntry) gone(err error) bool {
+	var perr *os.PathError
+	return errors.As(err, &perr) && perr.Path == e.path && os.IsNotExist(perr.Err)
+}
+
+// read returns the entry's content, decompressed.
+func (e *cacheEntry) read() ([]byte, error) {
+	if e.meta.Compression == "" {
+		return ioutil.ReadFile(e.path)
+	}
+	rc, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// copyTo writes the entry's content, decompressed, to path.
+func (e *cacheEntry) copyTo(path string, mode os.FileMode) error {
+	if e.meta.Compression == "" {
+		return copyFile(e.path, path, mode)
+	}
+	rc, err := e.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, rc)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// zstdFile reads a compressed entry, seeking by frame.
+type zstdFile struct {
+	dec    *zstd.Decoder
+	file   *os.File
+	frames []int64
+	length int64
+	pos    int64
+}
+
+func (z *zstdFile) Read(p []byte) (int, error) {
+	if z.pos >= z.length {
+		return 0, io.EOF
+	}
+	n, err := z.dec.Read(p)
+	z.pos += int64(n)
+	return n, err
+}
+
+func (z *zstdFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += z.pos
+	case io.SeekEnd:
+		offset += z.length
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the entry")
+	}
+	if offset >= z.length {
+		// Reads return io.EOF from there on.
+		z.pos = offset
+		return offset, nil
+	}
+	// Within the current frame, ahead, there's no need to start over.
+	if frame := offset / compressFrameSize; frame != z.pos/compressFrameSize || offset < z.pos || z.pos >= z.length {
+		if _, err := z.file.Seek(z.frames[frame], io.SeekStart); err != nil {
+			return 0, err
+		}
+		if err := z.dec.Reset(z.file); err != nil {
+			return 0, err
+		}
+		z.pos = frame * compressFrameSize
+	}
+	if _, err := io.CopyN(ioutil.Discard, z.dec, offset-z.pos); err != nil {
+		return 0, err
+	}
+	z.pos = offset
+	return offset, nil
+}
+
+func (z *zstdFile) Close() error {
+	z.dec.Close()
+	return z.file.Close()
+}
+
+// compressEntry writes a zstd-compressed copy of the file at path next to
+// it, records its layout in meta and returns its name, or "" if the
+// content doesn't compress well enough to be worth it.
+func compressEntry(path string, meta *cacheMeta) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() < compressMinSize {
+		return "", nil
+	}
+
+	sample := make([]byte, compressSampleSize)
+	n, err := io.ReadFull(src, sample)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return "", err
+	}
+	if float64(len(enc.EncodeAll(sample[:n], nil))) > compressMaxRatio*float64(n) {
+		return "", nil
+	}
+
+	dst, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".zst")
+	if err != nil {
+		return "", err
+	}
+	frames, size, err := compressFrames(enc, io.MultiReader(bytes.NewReader(sample[:n]), src), dst)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && float64(size) <= compressMaxRatio*float64(info.Size()) {
+		meta.Compression = "zstd"
+		meta.Frames = frames
+		meta.Length = info.Size()
+		return dst.Name(), nil
+	}
+	os.Remove(dst.Name())
+	return "", err
+}
+
+// compressFrames writes the content of r to w as zstd frames of
+// compressFrameSize bytes of content each, and returns where each starts
+// and the size of the whole.
+func compressFrames(enc *zstd.Encoder, r io.Reader, w io.Writer) ([]int64, int64, error) {
+	var frames []int64
+	var size int64
+	buf := make([]byte, compressFrameSize)
+	var out []byte
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			out = enc.EncodeAll(buf[:n], out[:0])
+			if _, err := w.Write(out); err != nil {
+				return nil, 0, err
+			}
+			frames = append(frames, size)
+			size += int64(len(out))
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return frames, size, nil
+		default:
+			return nil, 0, err
+		}
+	}
+}
+
+// describes reports whether meta, read next to the cache entry at path,
+// may vouch for it as a copy of the object at gsURL: it must be about that
+// object, since cachePath maps names like a/b and a-b to the same entry,
+// and the content it describes must still be there, since entries may be
+// deleted, or replaced by one stored the other way, behind its back. It
+// must also be in the current format, to hold all the attributes of the
+// object.
+func (meta *cacheMeta) describes(gsURL, path string) bool {
+	if meta.URL != gsURL || meta.Version < cacheMetaVersion {
+		return false
+	}
+	// Compressed entries written before they were made of frames can't
+	// seek.
+	if meta.Compression != "" && len(meta.Frames) == 0 {
+		return false
+	}
+	_, err := os.Stat(entryPath(path, meta))
+	return err == nil
+}
+
+func cacheMetaPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".meta")
+}
+
+func readCacheMeta(path string) *cacheMeta {
+	data, err := ioutil.ReadFile(cacheMetaPath(path))
+	if err != nil {
+		return nil
+	}
+	var meta cacheMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+func writeCacheMeta(path string, meta *cacheMeta) error {
+	meta.Version = cacheMetaVersion
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cacheMetaPath(path), data, 0644)
+}
+
+func cacheMetaFromResponse(gsURL string, res *http.Response) *cacheMeta {
+	meta := &cacheMeta{
+		URL:             gsURL,
+		ETag:            res.Header.Get("ETag"),
+		ContentEncoding: res.Header.Get("X-Goog-Stored-Content-Encoding"),
+		Fetched:         time.Now().UTC(),
+		ContentType:     res.Header.Get("Content-Type"),
+	}
+	meta.Generation, _ = strconv.ParseInt(res.Header.Get("X-Goog-Generation"), 10, 64)
+	meta.Metageneration, _ = strconv.ParseInt(res.Header.Get("X-Goog-Metageneration"), 10, 64)
+	meta.Size, _ = strconv.ParseInt(res.Header.Get("X-Goog-Stored-Content-Length"), 10, 64)
+	if updated, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		meta.Updated = updated.UTC()
+	}
+	for key, values := range res.Header {
+		if name := strings.TrimPrefix(strings.ToLower(key), "x-goog-meta-"); len(name) < len(key) && len(values) > 0 {
+			if meta.Metadata == nil {
+				meta.Metadata = map[string]string{}
+			}
+			meta.Metadata[name] = values[0]
+		}
+	}
+	if sum, ok := googHash(res.Header, "crc32c"); ok {
+		meta.CRC32C = base64.StdEncoding.EncodeToString(sum)
+	}
+	if sum, ok := googHash(res.Header, "md5"); ok {
+		meta.MD5Hash = base64.StdEncoding.EncodeToString(sum)
+	}
+	return meta
+}
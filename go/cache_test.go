@@ -0,0 +1,208 @@
+package fastgcs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// textContent returns n bytes that compress well, but differ throughout so
+// that a read from the wrong offset shows.
+func textContent(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "line %d\n", i)
+	}
+	return buf.Bytes()[:n]
+}
+
+// cachedCompressed reports whether the entry for gsURL is stored
+// compressed, failing if it isn't stored exactly one way.
+func cachedCompressed(t *testing.T, f *fastGCS, gsURL string) bool {
+	t.Helper()
+	path, err := f.cachePath(gsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, plainErr := os.Stat(path)
+	_, zstErr := os.Stat(entryPath(path, &cacheMeta{Compression: "zstd"}))
+	if (plainErr == nil) == (zstErr == nil) {
+		t.Fatalf("entry for %s stored plain: %v, compressed: %v, want one or the other", gsURL, plainErr == nil, zstErr == nil)
+	}
+	return zstErr == nil
+}
+
+func TestCompressedCacheRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    []byte
+		compressed bool
+	}{
+		{"text", textContent(3*compressFrameSize + 123), true},
+		{"single frame", textContent(64 << 10), true},
+		{"small", textContent(compressMinSize - 1), false},
+		{"random", randomContent(64 << 10), false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		f, srv := newJSONTest(t, WithCompressedCache())
+		srv.Put("b", "o", tt.content)
+
+		got, err := f.Read("gs://b/o")
+		if err != nil || !bytes.Equal(got, tt.content) {
+			t.Errorf("%s: Read = %d bytes, %v, want the %d of the object", tt.name, len(got), err, len(tt.content))
+		}
+		if c := cachedCompressed(t, f, "gs://b/o"); c != tt.compressed {
+			t.Errorf("%s: entry compressed: %v, want %v", tt.name, c, tt.compressed)
+		}
+		// Again, from the cache.
+		rc, err := f.Open("gs://b/o")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, tt.content) {
+			t.Errorf("%s: Open read %d bytes, %v, want the %d of the object", tt.name, len(got), err, len(tt.content))
+		}
+		dst := filepath.Join(t.TempDir(), "o")
+		if err := f.Copy("gs://b/o", dst); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(got, tt.content) {
+			t.Errorf("%s: Copy wrote %d bytes, %v, want the %d of the object", tt.name, len(got), err, len(tt.content))
+		}
+	}
+}
+
+func TestCompressedCacheSeek(t *testing.T) {
+	content := textContent(3*compressFrameSize + 123)
+	f, srv := newJSONTest(t, WithCompressedCache())
+	srv.Put("b", "o", content)
+	rc, err := f.Open("gs://b/o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if !cachedCompressed(t, f, "gs://b/o") {
+		t.Fatal("entry stored plain")
+	}
+	s, ok := rc.(io.ReadSeeker)
+	if !ok {
+		t.Fatalf("Open returned a %T, want an io.ReadSeeker", rc)
+	}
+
+	size := int64(len(content))
+	seeks := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{10, io.SeekStart, 10},
+		{compressFrameSize - 4, io.SeekStart, compressFrameSize - 4}, // across a frame boundary
+		{100, io.SeekCurrent, compressFrameSize + 104},               // ahead, in the same frame
+		{2*compressFrameSize + 1, io.SeekStart, 2*compressFrameSize + 1},
+		{5, io.SeekStart, 5}, // back
+		{-8, io.SeekEnd, size - 8},
+		{0, io.SeekEnd, size},
+		{10, io.SeekEnd, size + 10},
+		{3, io.SeekStart, 3}, // back from past the end
+	}
+	for _, sk := range seeks {
+		pos, err := s.Seek(sk.offset, sk.whence)
+		if err != nil || pos != sk.want {
+			t.Errorf("Seek(%d, %d) = %d, %v, want %d", sk.offset, sk.whence, pos, err, sk.want)
+			continue
+		}
+		buf := make([]byte, 8)
+		n, err := io.ReadFull(s, buf)
+		want := content[min64(pos, size):min64(pos+8, size)]
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("read %q after Seek(%d, %d), %v, want %q", buf[:n], sk.offset, sk.whence, err, want)
+		}
+	}
+	if _, err := s.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek before the start succeeded")
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestCompressedCacheServeRange(t *testing.T) {
+	content := textContent(2*compressFrameSize + 5)
+	f, srv := newJSONTest(t, WithCompressedCache())
+	srv.Put("b", "o.txt", content)
+	h, err := ServeHandler(f, ServeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ { // downloading, then from the cache
+		req := httptest.NewRequest("GET", "/b/o.txt", nil)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", compressFrameSize+7, compressFrameSize+20))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if want := content[compressFrameSize+7 : compressFrameSize+21]; rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), want) {
+			t.Errorf("GET of a range = %d %q, want 206 %q", rec.Code, rec.Body, want)
+		}
+	}
+}
+
+func TestCompressedCacheSwitch(t *testing.T) {
+	f, srv := newJSONTest(t, WithCompressedCache())
+	for i, content := range [][]byte{textContent(64 << 10), randomContent(64 << 10), textContent(32 << 10)} {
+		srv.Put("b", "o", content)
+		got, err := f.Read("gs://b/o")
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("read %d: %d bytes, %v, want the %d of generation %d", i, len(got), err, len(content), i)
+		}
+		if c, want := cachedCompressed(t, f, "gs://b/o"), i != 1; c != want {
+			t.Errorf("read %d: entry compressed: %v, want %v", i, c, want)
+		}
+	}
+}
+
+// TestCompressedCacheReplaced has another process replace an entry stored
+// compressed by a plain one, and back, between validating it and opening
+// it.
+func TestCompressedCacheReplaced(t *testing.T) {
+	f, srv := newJSONTest(t, WithCompressedCache())
+	other := newTestFastGCS(t, WithHTTPClient(srv.Client()), WithCompressedCache())
+	other.cacheRoot = f.cacheRoot
+
+	for i, content := range [][]byte{textContent(64 << 10), randomContent(64 << 10), textContent(32 << 10)} {
+		srv.Put("b", "o", content)
+		entry, err := f.update("gs://b/o")
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := randomContent(32 << 10)
+		if i%2 == 1 {
+			next = textContent(16 << 10)
+		}
+		srv.Put("b", "o", next)
+		if _, err := other.Read("gs://b/o"); err != nil {
+			t.Fatal(err)
+		}
+
+		rc, _, err := f.openEntry("gs://b/o", entry)
+		if err != nil {
+			t.Fatalf("opening a replaced entry: %v", err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, next) {
+			t.Errorf("replaced entry %d read %d bytes, %v, want the %d of the new generation", i, len(got), err, len(next))
+		}
+	}
+}
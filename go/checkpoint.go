@@ -0,0 +1,102 @@
+package fastgcs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// listCheckpoint is the content of a ResumeList state file.
+type listCheckpoint struct {
+	URL       string          `json:"url"`
+	Delimiter string          `json:"delimiter,omitempty"`
+	PageToken string          `json:"pageToken"`
+	State     json.RawMessage `json:"state,omitempty"`
+	Updated   time.Time       `json:"updated"`
+}
+
+// ResumeList is ListPages with progress persisted to statePath, so that an
+// interrupted listing of a huge prefix can pick up where it stopped rather
+// than starting over.
+//
+// After fn has returned successfully for a page, the token of the next page
+// is written to statePath along with state, which should point to whatever
+// the caller accumulates across pages (totals, counters, ...) or be nil. If
+// statePath already holds a checkpoint for the same listing, state is
+// restored from it and the listing resumes at the recorded page. The state
+// file is removed once the listing completes.
+//
+// A page that was being processed when the previous run stopped is handed to
+// fn again, so fn should tolerate seeing it twice.
+func ResumeList(fg FastGCS, gsURL string, opts ListOptions, statePath string, state interface{}, fn func(*ListPage) error) error {
+	cp, err := loadListCheckpoint(statePath)
+	if err != nil {
+		return err
+	}
+	if cp != nil {
+		if cp.URL != gsURL || cp.Delimiter != opts.Delimiter {
+			return errors.Errorf("%s holds a checkpoint for a different listing (%s)", statePath, cp.URL)
+		}
+		if state != nil && len(cp.State) > 0 {
+			if err := json.Unmarshal(cp.State, state); err != nil {
+				return errors.Wrapf(err, "restoring state from %s", statePath)
+			}
+		}
+		opts.PageToken = cp.PageToken
+	}
+
+	err = fg.ListPages(gsURL, opts, func(page *ListPage) error {
+		if err := fn(page); err != nil {
+			return err
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		return saveListCheckpoint(statePath, &listCheckpoint{
+			URL:       gsURL,
+			Delimiter: opts.Delimiter,
+			PageToken: page.NextPageToken,
+		}, state)
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func loadListCheckpoint(path string) (*listCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp listCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, errors.Wrapf(err, "parsing checkpoint %s", path)
+	}
+	return &cp, nil
+}
+
+func saveListCheckpoint(path string, cp *listCheckpoint, state interface{}) error {
+	if state != nil {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		cp.State = data
+	}
+	cp.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
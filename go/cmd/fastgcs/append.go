@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+// appendLog appends stdin to an object, uploading as data arrives.
+func appendLog(fg fastgcs.FastGCS, args []string) error {
+	flags := flag.NewFlagSet("append", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	var opts fastgcs.AppendOptions
+	flags.DurationVar(&opts.FlushInterval, "flush", 0, "upload buffered input at least this often (default 5s)")
+	flags.DurationVar(&opts.ComposeInterval, "compose", 0, "append uploaded input to the object at least this often (default 30s)")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	a, err := fastgcs.NewAppender(fg, flags.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(a, os.Stdin); err != nil {
+		a.Close()
+		return err
+	}
+	return a.Close()
+}
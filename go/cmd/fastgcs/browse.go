@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+const (
+	previewBytes = 64 << 10
+
+	browseHelp = "↑↓ move  → open  ← up  i info  p preview  g mark get  d mark delete  u unmark  x apply  r reload  q quit"
+)
+
+// Keys, as returned by readKey. Printable keys are returned as themselves.
+const (
+	keyUp = 0x100 + iota
+	keyDown
+	keyLeft
+	keyRight
+	keyPageUp
+	keyPageDown
+	keyEnter = '\r'
+	keyEsc   = 0x1b
+)
+
+// browse is an interactive browser for a bucket: it lists one level of a
+// prefix at a time and lets objects be inspected, previewed from the cache,
+// and marked for download or deletion.
+func browse(fg fastgcs.FastGCS, args []string) error {
+	if len(args) != 1 || !isGSURL(args[0]) {
+		return errUsage
+	}
+	u := strings.TrimPrefix(args[0], "gs://")
+	bucket, prefix := u, ""
+	if i := strings.Index(u, "/"); i >= 0 {
+		bucket, prefix = u[:i], u[i+1:]
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(out) {
+		return fmt.Errorf("browse needs a terminal")
+	}
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(in, state)
+	// Use the alternate screen and hide the cursor while browsing.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	b := &browser{
+		fg:     fg,
+		bucket: bucket,
+		prefix: prefix,
+		marks:  map[string]byte{},
+		keys:   bufio.NewReader(os.Stdin),
+		out:    os.Stdout,
+	}
+	b.load()
+	return b.run(func() (int, int) {
+		w, h, err := term.GetSize(out)
+		if err != nil {
+			return 80, 24
+		}
+		return w, h
+	})
+}
+
+type browseEntry struct {
+	name  string // relative to the current prefix
+	dir   bool
+	attrs *fastgcs.ObjectAttrs
+}
+
+type browser struct {
+	fg     fastgcs.FastGCS
+	bucket string
+	prefix string
+
+	entries []browseEntry
+	cursor  int
+	offset  int // first entry on screen
+
+	// marks maps object URLs to 'g' (download) or 'd' (delete).
+	marks map[string]byte
+
+	// pane, if set, replaces the listing with lines of text, scrolled by
+	// paneOffset.
+	pane       []string
+	paneTitle  string
+	paneOffset int
+
+	status        string
+	width, height int
+	keys          *bufio.Reader
+	out           io.Writer
+}
+
+func (b *browser) url(name string) string {
+	return fmt.Sprintf("gs://%s/%s%s", b.bucket, b.prefix, name)
+}
+
+func (b *browser) load() {
+	b.entries, b.cursor, b.offset = nil, 0, 0
+	l, err := b.fg.ListDir(fmt.Sprintf("gs://%s/%s", b.bucket, b.prefix))
+	if err != nil {
+		b.status = err.Error()
+		return
+	}
+	for _, p := range l.Prefixes {
+		b.entries = append(b.entries, browseEntry{name: strings.TrimPrefix(p, b.prefix), dir: true})
+	}
+	for i := range l.Objects {
+		attrs := &l.Objects[i]
+		if attrs.Name == b.prefix {
+			// The placeholder object some tools create for directories.
+			continue
+		}
+		b.entries = append(b.entries, browseEntry{name: strings.TrimPrefix(attrs.Name, b.prefix), attrs: attrs})
+	}
+	b.status = fmt.Sprintf("%d entries", len(b.entries))
+}
+
+func (b *browser) selected() *browseEntry {
+	if b.cursor < len(b.entries) {
+		return &b.entries[b.cursor]
+	}
+	return nil
+}
+
+func (b *browser) run(size func() (int, int)) error {
+	for {
+		b.width, b.height = size()
+		h := b.height
+		b.render()
+		key, err := b.readKey()
+		if err != nil {
+			return err
+		}
+		if b.pane != nil {
+			if !b.scrollPane(key, h-2) {
+				b.pane = nil
+			}
+			continue
+		}
+		switch key {
+		case 'q', 3: // ^C
+			return nil
+		case keyUp, 'k':
+			b.move(-1)
+		case keyDown, 'j':
+			b.move(1)
+		case keyPageUp:
+			b.move(-(h - 3))
+		case keyPageDown:
+			b.move(h - 3)
+		case keyRight, 'l', keyEnter:
+			if e := b.selected(); e != nil && e.dir {
+				b.prefix += e.name
+				b.load()
+			} else if e != nil {
+				b.preview(e)
+			}
+		case keyLeft, 'h', 0x7f:
+			if b.prefix != "" {
+				trimmed := strings.TrimSuffix(b.prefix, "/")
+				b.prefix = trimmed[:strings.LastIndex(trimmed, "/")+1]
+				b.load()
+			}
+		case 'i':
+			if e := b.selected(); e != nil && !e.dir {
+				b.info(e)
+			}
+		case 'p':
+			if e := b.selected(); e != nil && !e.dir {
+				b.preview(e)
+			}
+		case 'g', 'd':
+			if e := b.selected(); e != nil && !e.dir {
+				b.marks[b.url(e.name)] = byte(key)
+				b.move(1)
+			}
+		case 'u':
+			if e := b.selected(); e != nil {
+				delete(b.marks, b.url(e.name))
+				b.move(1)
+			}
+		case 'x':
+			b.apply()
+		case 'r':
+			b.load()
+		}
+	}
+}
+
+func (b *browser) move(n int) {
+	b.cursor += n
+	if b.cursor >= len(b.entries) {
+		b.cursor = len(b.entries) - 1
+	}
+	if b.cursor < 0 {
+		b.cursor = 0
+	}
+}
+
+// scrollPane handles a key while a pane is shown. It returns false if the
+// pane should be closed.
+func (b *browser) scrollPane(key, rows int) bool {
+	switch key {
+	case keyUp, 'k':
+		b.paneOffset--
+	case keyDown, 'j':
+		b.paneOffset++
+	case keyPageUp:
+		b.paneOffset -= rows
+	case keyPageDown, ' ':
+		b.paneOffset += rows
+	default:
+		return false
+	}
+	if max := len(b.pane) - rows; b.paneOffset > max {
+		b.paneOffset = max
+	}
+	if b.paneOffset < 0 {
+		b.paneOffset = 0
+	}
+	return true
+}
+
+func (b *browser) showPane(title string, lines []string) {
+	b.pane, b.paneTitle, b.paneOffset = lines, title, 0
+}
+
+func (b *browser) info(e *browseEntry) {
+	attrs, err := b.fg.Stat(b.url(e.name))
+	if err != nil {
+		b.status = err.Error()
+		return
+	}
+	lines := []string{
+		"Size:             " + fmt.Sprint(attrs.Size),
+		"Generation:       " + fmt.Sprint(attrs.Generation),
+		"Metageneration:   " + fmt.Sprint(attrs.Metageneration),
+		"Updated:          " + attrs.Updated.Local().Format("2006-01-02 15:04:05 MST"),
+		"Content-Type:     " + attrs.ContentType,
+		"Content-Encoding: " + attrs.ContentEncoding,
+		"CRC32C:           " + attrs.CRC32C,
+		"MD5:              " + attrs.MD5Hash,
+		"ETag:             " + attrs.ETag,
+	}
+	if attrs.ComponentCount > 0 {
+		lines = append(lines, "Components:       "+fmt.Sprint(attrs.ComponentCount))
+	}
+	var keys []string
+	for k := range attrs.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("Metadata %s: %s", k, attrs.Metadata[k]))
+	}
+	b.showPane(attrs.URL(), lines)
+}
+
+// preview shows the beginning of a text object. It reads only that much
+// with a range request, bypassing the cache, so that previewing a large
+// object doesn't download all of it.
+func (b *browser) preview(e *browseEntry) {
+	b.status = "fetching " + b.url(e.name) + "..."
+	b.render()
+	rc, err := b.fg.Stream(b.url(e.name), fastgcs.ReadAhead{ChunkSize: previewBytes, Window: 1})
+	if err != nil {
+		b.status = err.Error()
+		return
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, previewBytes))
+	if err != nil {
+		b.status = err.Error()
+		return
+	}
+	b.status = ""
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(trimPartialRune(data)) {
+		b.showPane(b.url(e.name), []string{"(binary content)"})
+		return
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\t", "    "), "\n")
+	for i := range lines {
+		lines[i] = printable(lines[i])
+	}
+	if e.attrs != nil && e.attrs.Size > previewBytes {
+		lines = append(lines, fmt.Sprintf("(first %d of %d bytes)", previewBytes, e.attrs.Size))
+	}
+	b.showPane(b.url(e.name), lines)
+}
+
+// printable replaces the control characters in s, which may come from
+// object names, metadata or content, so that they can't drive the
+// terminal.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r >= 0x7f && r < 0xa0 {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// trimPartialRune drops a rune cut in half at the end of data.
+func trimPartialRune(data []byte) []byte {
+	for i := 0; i < utf8.UTFMax && i < len(data); i++ {
+		if utf8.RuneStart(data[len(data)-1-i]) {
+			if !utf8.FullRune(data[len(data)-1-i:]) {
+				return data[:len(data)-1-i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+// apply downloads the objects marked with g into the working directory,
+// under the last element of their names, and deletes those marked with d,
+// after confirmation. Objects with no safe local name, or whose local file
+// already exists, aren't downloaded.
+func (b *browser) apply() {
+	var gets, dels []string
+	for u, m := range b.marks {
+		if m == 'g' {
+			gets = append(gets, u)
+		} else {
+			dels = append(dels, u)
+		}
+	}
+	if len(gets)+len(dels) == 0 {
+		b.status = "nothing marked"
+		return
+	}
+	sort.Strings(gets)
+	sort.Strings(dels)
+	b.status = fmt.Sprintf("download %d and delete %d objects? [y/N]", len(gets), len(dels))
+	b.render()
+	if key, err := b.readKey(); err != nil || key != 'y' {
+		b.status = "cancelled"
+		return
+	}
+
+	var failed []string
+	for _, u := range gets {
+		local, err := downloadPath(".", u)
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		if err := b.fg.Copy(u, local); err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		delete(b.marks, u)
+	}
+	for _, u := range dels {
+		if err := b.fg.Delete(u, fastgcs.DeleteOptions{}); err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		delete(b.marks, u)
+	}
+	b.load()
+	if len(failed) > 0 {
+		b.showPane("errors", failed)
+		return
+	}
+	b.status = fmt.Sprintf("downloaded %d and deleted %d objects", len(gets), len(dels))
+}
+
+// downloadPath returns where apply downloads the object at gsURL into dir:
+// the last element of its name, if that's a safe local name and nothing
+// is there yet.
+func downloadPath(dir, gsURL string) (string, error) {
+	local, err := fastgcs.LocalPath(dir, gsURL[strings.LastIndex(gsURL, "/")+1:])
+	if err != nil {
+		return "", errors.Wrap(err, gsURL)
+	}
+	if _, err := os.Lstat(local); err == nil {
+		return "", errors.Errorf("%s: %s already exists", gsURL, local)
+	}
+	return local, nil
+}
+
+func (b *browser) readKey() (int, error) {
+	c, err := b.keys.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if c != keyEsc || b.keys.Buffered() == 0 {
+		return int(c), nil
+	}
+	// An escape sequence: ESC [ A, or ESC [ 5 ~ for page keys.
+	seq := make([]byte, 0, 3)
+	for b.keys.Buffered() > 0 && len(seq) < cap(seq) {
+		c, _ := b.keys.ReadByte()
+		seq = append(seq, c)
+		if len(seq) > 1 && (c >= 'A' && c <= 'Z' || c == '~') {
+			break
+		}
+	}
+	switch string(seq) {
+	case "[A", "OA":
+		return keyUp, nil
+	case "[B", "OB":
+		return keyDown, nil
+	case "[C", "OC":
+		return keyRight, nil
+	case "[D", "OD":
+		return keyLeft, nil
+	case "[5~":
+		return keyPageUp, nil
+	case "[6~":
+		return keyPageDown, nil
+	}
+	return keyEsc, nil
+}
+
+func (b *browser) render() {
+	w, h := b.width, b.height
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H\x1b[2J")
+	// Everything shown goes through printable: names, metadata and error
+	// messages all come from GCS.
+	clip := func(s string) string {
+		s = printable(s)
+		if utf8.RuneCountInString(s) > w {
+			s = string([]rune(s)[:w])
+		}
+		return s
+	}
+	line := func(s string, attrs string) {
+		buf.WriteString(attrs + clip(s) + "\x1b[0m\r\n")
+	}
+	// The footer goes on the last row, without a newline that would scroll
+	// the screen.
+	footer := func(s string) {
+		buf.WriteString(fmt.Sprintf("\x1b[%d;1H\x1b[7m%s\x1b[0m", h, clip(s)))
+	}
+	rows := h - 3
+
+	if b.pane != nil {
+		line(b.paneTitle, "\x1b[1m")
+		for i := b.paneOffset; i < len(b.pane) && i < b.paneOffset+rows+1; i++ {
+			line(b.pane[i], "")
+		}
+		footer("↑↓ scroll  any other key closes")
+		b.out.Write(buf.Bytes())
+		return
+	}
+
+	line(fmt.Sprintf("gs://%s/%s  (%d marked)", b.bucket, b.prefix, len(b.marks)), "\x1b[1m")
+	if b.cursor < b.offset {
+		b.offset = b.cursor
+	}
+	if b.cursor >= b.offset+rows {
+		b.offset = b.cursor - rows + 1
+	}
+	for i := b.offset; i < len(b.entries) && i < b.offset+rows; i++ {
+		e := &b.entries[i]
+		mark := " "
+		if m, ok := b.marks[b.url(e.name)]; ok {
+			mark = strings.ToUpper(string(m))
+		}
+		var s string
+		if e.dir {
+			s = fmt.Sprintf("%s %12s  %16s  %s", mark, "", "", e.name)
+		} else {
+			s = fmt.Sprintf("%s %12d  %16s  %s", mark, e.attrs.Size, e.attrs.Updated.Local().Format("2006-01-02 15:04"), e.name)
+		}
+		attrs := ""
+		if i == b.cursor {
+			attrs = "\x1b[7m"
+		}
+		line(s, attrs)
+	}
+	buf.WriteString(fmt.Sprintf("\x1b[%d;1H", h-1))
+	line(b.status, "")
+	footer(browseHelp)
+	b.out.Write(buf.Bytes())
+}
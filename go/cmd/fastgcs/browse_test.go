@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadPath(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "exists.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		gsURL string
+		want  string // empty if refused
+	}{
+		{"gs://b/logs/app.log", "app.log"},
+		{"gs://b/top", "top"},
+		{"gs://b/dir/..", ""},
+		{"gs://b/dir/.", ""},
+		{"gs://b/dir/", ""},
+		{"gs://b/dir/a\x00b", ""},
+		{"gs://b/other/exists.txt", ""},
+	}
+	for _, tt := range tests {
+		got, err := downloadPath(dir, tt.gsURL)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("downloadPath(%q) = %q, want it refused", tt.gsURL, got)
+		case tt.want != "" && (err != nil || got != filepath.Join(dir, tt.want)):
+			t.Errorf("downloadPath(%q) = %q, %v, want %q", tt.gsURL, got, err, filepath.Join(dir, tt.want))
+		}
+	}
+}
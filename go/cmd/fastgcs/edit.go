@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+// edit opens an object in $EDITOR and uploads the result if it changed.
+// The upload only succeeds if nobody changed the object in the meantime;
+// otherwise their changes and ours are merged and the user decides what to
+// upload.
+func edit(fg fastgcs.FastGCS, args []string) error {
+	if len(args) != 1 || !isGSURL(args[0]) {
+		return errUsage
+	}
+	gsURL := args[0]
+
+	base, attrs, err := readStable(fg, gsURL)
+	if err != nil {
+		return err
+	}
+	opts := fastgcs.WriteOptions{}
+	if attrs != nil {
+		opts.ContentType = attrs.ContentType
+		opts.Metadata = attrs.Metadata
+		opts.Gzip = attrs.ContentEncoding == "gzip"
+	}
+
+	tmp, err := ioutil.TempFile("", "fastgcs-edit-*-"+path.Base(gsURL))
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	// The temp file is only removed once its content is safely uploaded
+	// or was never changed.
+	keep := true
+	defer func() {
+		if keep {
+			fmt.Fprintf(os.Stderr, "fastgcs: your version is in %s\n", tmp.Name())
+		} else {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	ours, err := editContent(tmp.Name(), base)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(ours, base) {
+		keep = false
+		fmt.Fprintln(os.Stderr, "fastgcs: no changes")
+		return nil
+	}
+
+	prompt := bufio.NewReader(os.Stdin)
+	gen := generationOf(attrs)
+	for {
+		opts.IfGenerationMatch = &gen
+		err := upload(fg, gsURL, ours, opts)
+		if err == nil {
+			keep = false
+			return nil
+		}
+		if !fastgcs.IsStatus(err, http.StatusPreconditionFailed) {
+			return err
+		}
+
+		// Someone else changed the object: merge their version into ours,
+		// and try again against their generation.
+		theirs, theirAttrs, err := readStable(fg, gsURL)
+		if err != nil {
+			return err
+		}
+		merged, conflicts, err := merge3(base, ours, theirs, "yours", fmt.Sprintf("theirs (generation %d)", generationOf(theirAttrs)))
+		if err != nil {
+			merged, conflicts = nil, -1
+		}
+		base, gen = theirs, generationOf(theirAttrs)
+
+		switch {
+		case conflicts < 0:
+			fmt.Fprintf(os.Stderr, "fastgcs: %s changed while you were editing, and %v\n", gsURL, err)
+		case conflicts == 0:
+			fmt.Fprintf(os.Stderr, "fastgcs: %s changed while you were editing; the changes merge cleanly\n", gsURL)
+		default:
+			fmt.Fprintf(os.Stderr, "fastgcs: %s changed while you were editing; %d conflicting changes\n", gsURL, conflicts)
+		}
+		if ours, err = resolve(prompt, tmp.Name(), ours, merged, conflicts); err != nil {
+			return err
+		}
+	}
+}
+
+var conflictMarker = regexp.MustCompile(`(?m)^(<<<<<<<|=======|>>>>>>>)( |$)`)
+
+// resolve asks what to upload after a conflicting change: the clean merge,
+// an edit of the merge, or our version as is. conflicts is negative if
+// there is no merge.
+func resolve(prompt *bufio.Reader, path string, ours, merged []byte, conflicts int) ([]byte, error) {
+	question := "[e]dit the merge, [o]verwrite their changes, [a]bort? "
+	switch {
+	case conflicts < 0:
+		question = "[o]verwrite their changes, [a]bort? "
+	case conflicts == 0:
+		question = "[u]pload the merge, [e]dit it, [o]verwrite their changes, [a]bort? "
+	}
+	for {
+		switch answer(prompt, question) {
+		case 'u':
+			if conflicts == 0 {
+				return merged, nil
+			}
+		case 'e':
+			if conflicts < 0 {
+				continue
+			}
+			edited, err := editContent(path, merged)
+			if err != nil {
+				return nil, err
+			}
+			if !conflictMarker.Match(edited) || answer(prompt, "conflict markers left in; upload anyway? [y/n] ") == 'y' {
+				return edited, nil
+			}
+			merged = edited
+		case 'o':
+			return ours, nil
+		case 'a', 0:
+			return nil, errors.New("aborted")
+		}
+	}
+}
+
+// readStable reads an object along with the attributes of the generation
+// read: the content read between two Stats that agree is that generation's.
+// A missing object reads as empty, with nil attributes.
+func readStable(fg fastgcs.FastGCS, gsURL string) ([]byte, *fastgcs.ObjectAttrs, error) {
+	for {
+		before, err := fg.Stat(gsURL)
+		if fastgcs.IsStatus(err, http.StatusNotFound) {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := fg.Read(gsURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		after, err := fg.Stat(gsURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		if before.Generation == after.Generation {
+			return data, after, nil
+		}
+	}
+}
+
+// generationOf returns the generation an upload must match to replace the
+// object, zero if it doesn't exist.
+func generationOf(attrs *fastgcs.ObjectAttrs) int64 {
+	if attrs == nil {
+		return 0
+	}
+	return attrs.Generation
+}
+
+func upload(fg fastgcs.FastGCS, gsURL string, data []byte, opts fastgcs.WriteOptions) error {
+	w, err := fg.Create(gsURL, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// editContent writes data to path, runs the user's editor on it and returns
+// the result.
+func editContent(path string, data []byte) ([]byte, error) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	// Go through the shell so that editors with arguments, like
+	// "code --wait", work.
+	cmd := exec.Command("/bin/sh", "-c", editor+` "$1"`, "sh", path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrap(err, "running editor")
+	}
+	return ioutil.ReadFile(path)
+}
+
+// answer asks question on stderr and returns the first letter of the reply.
+func answer(r *bufio.Reader, question string) byte {
+	fmt.Fprint(os.Stderr, question)
+	line, _ := r.ReadString('\n')
+	line = strings.TrimSpace(strings.ToLower(line))
+	if line == "" {
+		return 0
+	}
+	return line[0]
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+func find(fg fastgcs.FastGCS, args []string) error {
+	flags := flag.NewFlagSet("find", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	name := flags.String("name", "*", "only objects whose base name matches this pattern")
+	minSize := flags.Int64("min-size", 0, "only objects of at least this many bytes")
+	inventoryURL := flags.String("inventory", "", "answer from the newest inventory report under this gs:// URL")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	if _, err := path.Match(*name, ""); err != nil {
+		return err
+	}
+
+	var lister fastgcs.Lister = fg
+	if *inventoryURL != "" {
+		inv, err := fastgcs.LoadInventory(fg, *inventoryURL)
+		if err != nil {
+			return err
+		}
+		lister = inv
+	}
+
+	found, err := fastgcs.Find(lister, flags.Arg(0), func(o *fastgcs.ObjectAttrs) bool {
+		ok, _ := path.Match(*name, path.Base(o.Name))
+		return ok && o.Size >= *minSize
+	})
+	if err != nil {
+		return err
+	}
+	warnStale(found.Listed, found.Stale)
+	for i := range found.Objects {
+		fmt.Println(found.Objects[i].URL())
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+// lock summarizes an audit log into a lockfile on stdout.
+func lock(args []string) error {
+	flags := flag.NewFlagSet("lock", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	auditPath := flags.String("audit", "", "audit log to summarize (default: audit.log in the cache directory)")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	if *auditPath == "" {
+		root, err := fastgcs.CacheRoot()
+		if err != nil {
+			return err
+		}
+		*auditPath = filepath.Join(root, "audit.log")
+	}
+
+	recs, err := fastgcs.ReadAuditLog(*auditPath)
+	if err != nil {
+		return err
+	}
+	lockfile, changed := fastgcs.NewLockfile(recs)
+	for _, u := range changed {
+		fmt.Fprintf(os.Stderr, "fastgcs: warning: %s was read at several generations; locking the latest\n", u)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(lockfile)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+func ls(fg fastgcs.FastGCS, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	recursive := flags.Bool("r", false, "list all objects under the prefix")
+	statePath := flags.String("state", "", "checkpoint progress to this file and resume from it")
+	inventoryURL := flags.String("inventory", "", "answer from the newest inventory report under this gs:// URL")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	gsURL := flags.Arg(0)
+
+	if *inventoryURL != "" {
+		inv, err := fastgcs.LoadInventory(fg, *inventoryURL)
+		if err != nil {
+			return err
+		}
+		var l *fastgcs.Listing
+		if *recursive {
+			l, err = fastgcs.ListAll(inv, gsURL)
+		} else {
+			l, err = inv.ListDir(gsURL)
+		}
+		if err != nil {
+			return err
+		}
+		warnStale(l.Listed, l.Stale)
+		for _, prefix := range l.Prefixes {
+			fmt.Printf("gs://%s/%s\n", l.Bucket, prefix)
+		}
+		for i := range l.Objects {
+			fmt.Println(l.Objects[i].URL())
+		}
+		return nil
+	}
+
+	if strings.ContainsAny(gsURL, "*?[") {
+		matches, err := fastgcs.Glob(fg, gsURL)
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			fmt.Println(m)
+		}
+		return nil
+	}
+
+	opts := fastgcs.ListOptions{}
+	if !*recursive {
+		opts.Delimiter = "/"
+	}
+	printPage := func(page *fastgcs.ListPage) error {
+		for _, prefix := range page.Prefixes {
+			fmt.Printf("gs://%s/%s\n", page.Bucket, prefix)
+		}
+		for i := range page.Objects {
+			fmt.Println(page.Objects[i].URL())
+		}
+		return nil
+	}
+
+	if *statePath != "" {
+		return fastgcs.ResumeList(fg, gsURL, opts, *statePath, nil, printPage)
+	}
+	return fg.ListPages(gsURL, opts, printPage)
+}
+
+type duState struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func du(fg fastgcs.FastGCS, args []string) error {
+	flags := flag.NewFlagSet("du", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	statePath := flags.String("state", "", "checkpoint progress to this file and resume from it")
+	inventoryURL := flags.String("inventory", "", "answer from the newest inventory report under this gs:// URL")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	gsURL := flags.Arg(0)
+
+	if *inventoryURL != "" {
+		inv, err := fastgcs.LoadInventory(fg, *inventoryURL)
+		if err != nil {
+			return err
+		}
+		usage, err := fastgcs.DiskUsage(inv, gsURL)
+		if err != nil {
+			return err
+		}
+		warnStale(usage.Listed, usage.Stale)
+		fmt.Printf("%d\t%d objects\t%s\n", usage.Bytes, usage.Objects, gsURL)
+		return nil
+	}
+
+	var state duState
+	sum := func(page *fastgcs.ListPage) error {
+		for i := range page.Objects {
+			state.Objects++
+			state.Bytes += page.Objects[i].Size
+		}
+		return nil
+	}
+
+	var err error
+	if *statePath != "" {
+		err = fastgcs.ResumeList(fg, gsURL, fastgcs.ListOptions{}, *statePath, &state, sum)
+	} else {
+		err = fg.ListPages(gsURL, fastgcs.ListOptions{}, sum)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d\t%d objects\t%s\n", state.Bytes, state.Objects, gsURL)
+	return nil
+}
+
+// complete prints the entries one directory level below the directory of a
+// partial gs:// URL that start with it, for shell completion. It goes
+// through the listing cache, so repeated completions don't re-list the
+// bucket.
+func complete(fg fastgcs.FastGCS, args []string) error {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "gs://") {
+		return nil
+	}
+	partial := args[0]
+	if strings.Count(partial, "/") < 3 {
+		return nil // still typing the bucket name
+	}
+	dir := partial[:strings.LastIndex(partial, "/")+1]
+	l, err := fg.ListDirCached(dir)
+	if err != nil {
+		return err
+	}
+	for _, p := range l.Prefixes {
+		if u := "gs://" + l.Bucket + "/" + p; strings.HasPrefix(u, partial) {
+			fmt.Println(u)
+		}
+	}
+	for i := range l.Objects {
+		if u := l.Objects[i].URL(); u != dir && strings.HasPrefix(u, partial) {
+			fmt.Println(u)
+		}
+	}
+	return nil
+}
+
+// warnStale warns that results listed at the given time from a snapshot,
+// such as an inventory report, may be out of date.
+func warnStale(listed time.Time, stale bool) {
+	if stale {
+		fmt.Fprintf(os.Stderr, "fastgcs: results from the inventory snapshot of %s, possibly stale\n",
+			listed.Format(time.RFC3339))
+	}
+}
@@ -1,25 +1,189 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
 
 	fastgcs "github.com/Shopify/fastgcs/go"
 )
 
+var errUsage = errors.New("usage")
+
+const usage = `usage:
+  fastgcs cp gs://url ./path
+  fastgcs cp -r gs://bucket/prefix ./dir
+  fastgcs cp [-z ext,ext] [-m] ./path gs://url
+  fastgcs mv gs://url gs://url
+  fastgcs mv gs://bucket/folder/ gs://bucket/folder/
+  fastgcs cat gs://url
+  fastgcs edit gs://url
+  fastgcs append [-flush 5s] [-compose 30s] gs://url < input
+  fastgcs ls [-r] [-state file] [-inventory gs://reports] gs://bucket/prefix|pattern
+  fastgcs du [-state file] [-inventory gs://reports] gs://bucket/prefix
+  fastgcs find [-name pattern] [-min-size n] [-inventory gs://reports] gs://bucket/prefix
+  fastgcs pack ./dir gs://bucket/name.tar.zst
+  fastgcs extract gs://bucket/name.tar.zst ./dir
+  fastgcs lock [-audit file]
+  fastgcs complete gs://bucket/partial
+  fastgcs browse gs://bucket/prefix
+  fastgcs migrate [-state file] [-j n] [-delete] gs://bucket/prefix gs://bucket/prefix
+  fastgcs serve [-addr host:port] [-clients file] [-cert file -key file | -self-signed] [-client-ca file]
+  fastgcs sync [-state file] [-conflict copy|local|remote] ./dir gs://bucket/prefix
+  fastgcs watch [-interval 10s] [-debounce 2s] gs://url... -- command [args]
+
+Set FASTGCS_AUDIT_LOG to record every object read to an audit log (an
+empty value uses audit.log in the cache directory).
+
+Set FASTGCS_GRPC=1 to read and write object content through the gRPC API.
+
+Set FASTGCS_COMPRESS_CACHE=1 to store cached objects zstd-compressed when
+they compress well.
+
+Set FASTGCS_PROFILE to a workload name, e.g. that of a build step, to
+record the objects it reads and prefetch them in parallel on its next runs.
+`
+
 func main() {
-	fg, err := fastgcs.New()
+	log.SetFlags(0)
+	log.SetPrefix("fastgcs: ")
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var opts []fastgcs.Option
+	if path, ok := os.LookupEnv("FASTGCS_AUDIT_LOG"); ok {
+		opts = append(opts, fastgcs.WithAuditLog(path))
+	}
+	if os.Getenv("FASTGCS_GRPC") == "1" {
+		conn, err := fastgcs.DialGRPC()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		opts = append(opts, fastgcs.WithGRPC(conn))
+	}
+	if os.Getenv("FASTGCS_COMPRESS_CACHE") == "1" {
+		opts = append(opts, fastgcs.WithCompressedCache())
+	}
+	if workload := os.Getenv("FASTGCS_PROFILE"); workload != "" {
+		opts = append(opts, fastgcs.WithProfile(workload, fastgcs.ProfileOptions{}))
+	}
+	fg, err := fastgcs.New(opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	f, err := fg.Open("gs://shopify-dev/zodiac.constellations.json")
+
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "cat":
+		err = cat(fg, args)
+	case "cp":
+		err = cp(fg, args)
+	case "mv":
+		err = mv(fg, args)
+	case "edit":
+		err = edit(fg, args)
+	case "append":
+		err = appendLog(fg, args)
+	case "ls":
+		err = ls(fg, args)
+	case "du":
+		err = du(fg, args)
+	case "find":
+		err = find(fg, args)
+	case "pack":
+		err = pack(fg, args)
+	case "extract":
+		err = extract(fg, args)
+	case "lock":
+		err = lock(args)
+	case "complete":
+		err = complete(fg, args)
+	case "browse":
+		err = browse(fg, args)
+	case "migrate":
+		err = migrate(fg, args)
+	case "serve":
+		err = serve(fg, args)
+	case "sync":
+		err = syncDir(fg, args)
+	case "watch":
+		err = watch(fg, args)
+	default:
+		err = errUsage
+	}
+	// Stop prefetching before exiting, so that downloads in flight don't
+	// leave temporary files behind.
+	fg.Close()
+	if err == errUsage {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	data, err := ioutil.ReadAll(f)
+}
+
+func cat(fg fastgcs.FastGCS, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	f, err := fg.Open(args[0])
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	fmt.Println(string(data))
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+func cp(fg fastgcs.FastGCS, args []string) error {
+	flags := flag.NewFlagSet("cp", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	gzipExts := flags.String("z", "", "gzip uploads of files with these comma-separated extensions")
+	parallel := flags.Bool("m", false, "upload through an XML API multipart upload, in parallel parts")
+	recursive := flags.Bool("r", false, "copy every object under the prefix")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+	src, dst := flags.Arg(0), flags.Arg(1)
+
+	switch {
+	case *recursive && isGSURL(src) && !isGSURL(dst):
+		err := fastgcs.CopyPrefix(fg, src, dst)
+		if invalid, ok := err.(fastgcs.InvalidNamesError); ok {
+			for _, e := range invalid {
+				fmt.Fprintf(os.Stderr, "fastgcs: skipped %v\n", e)
+			}
+		}
+		return err
+	case *recursive:
+		return errUsage
+	case isGSURL(src) && !isGSURL(dst):
+		return fg.Copy(src, dst)
+	case !isGSURL(src) && isGSURL(dst):
+		if strings.HasSuffix(dst, "/") {
+			dst += filepath.Base(src)
+		}
+		opts := fastgcs.WriteOptions{Gzip: fastgcs.GzipExtensions(*gzipExts)(src)}
+		if *parallel {
+			opts.Multipart = &fastgcs.MultipartOptions{}
+		}
+		return fg.Upload(src, dst, opts)
+	}
+	return errUsage
+}
+
+func isGSURL(s string) bool {
+	return strings.HasPrefix(s, "gs://")
 }
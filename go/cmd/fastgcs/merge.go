@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+// maxMergeCells bounds the size of the table used to match lines, after
+// common leading and trailing lines are set aside.
+const maxMergeCells = 16 << 20
+
+var errMergeTooLarge = errors.New("changes too large to merge automatically")
+
+// merge3 does a line-based three-way merge of ours and theirs, two edits of
+// base, in the manner of diff3 -m. Changes made on only one side are
+// applied; overlapping changes that differ are left between conflict
+// markers, and counted in conflicts.
+func merge3(base, ours, theirs []byte, oursLabel, theirsLabel string) (merged []byte, conflicts int, err error) {
+	b, o, t := splitLines(base), splitLines(ours), splitLines(theirs)
+	mo, err := matchLines(b, o)
+	if err != nil {
+		return nil, 0, err
+	}
+	mt, err := matchLines(b, t)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var out bytes.Buffer
+	emit := func(lines [][]byte) {
+		for _, l := range lines {
+			out.Write(l)
+		}
+	}
+	i, oi, ti := 0, 0, 0
+	for i < len(b) || oi < len(o) || ti < len(t) {
+		// A stable line is a base line both sides kept.
+		if i < len(b) && mo[i] == oi && mt[i] == ti {
+			emit(b[i : i+1])
+			i, oi, ti = i+1, oi+1, ti+1
+			continue
+		}
+		// Otherwise the chunk runs up to the next stable line.
+		j := i
+		for j < len(b) && (mo[j] < 0 || mt[j] < 0) {
+			j++
+		}
+		oj, tj := len(o), len(t)
+		if j < len(b) {
+			oj, tj = mo[j], mt[j]
+		}
+		bc, oc, tc := b[i:j], o[oi:oj], t[ti:tj]
+		switch {
+		case equalLines(oc, bc):
+			emit(tc)
+		case equalLines(tc, bc), equalLines(oc, tc):
+			emit(oc)
+		default:
+			conflicts++
+			out.WriteString("<<<<<<< " + oursLabel + "\n")
+			emit(terminated(oc))
+			out.WriteString("=======\n")
+			emit(terminated(tc))
+			out.WriteString(">>>>>>> " + theirsLabel + "\n")
+		}
+		i, oi, ti = j, oj, tj
+	}
+	return out.Bytes(), conflicts, nil
+}
+
+// splitLines splits data after each newline, keeping the newlines so the
+// merge reproduces the input exactly.
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n') + 1
+		if n == 0 {
+			n = len(data)
+		}
+		lines = append(lines, data[:n])
+		data = data[n:]
+	}
+	return lines
+}
+
+// terminated makes sure the last line ends in a newline, so that conflict
+// markers start on lines of their own.
+func terminated(lines [][]byte) [][]byte {
+	if n := len(lines); n > 0 && !bytes.HasSuffix(lines[n-1], []byte("\n")) {
+		lines = append(lines[:n-1:n-1], append(append([]byte(nil), lines[n-1]...), '\n'))
+	}
+	return lines
+}
+
+func equalLines(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLines returns, for each line of a, the index of the line of b it is
+// matched with in a longest common subsequence, or -1.
+func matchLines(a, b [][]byte) ([]int, error) {
+	m := make([]int, len(a))
+	for i := range m {
+		m[i] = -1
+	}
+	// Common leading and trailing lines match trivially.
+	pre := 0
+	for pre < len(a) && pre < len(b) && bytes.Equal(a[pre], b[pre]) {
+		m[pre] = pre
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && bytes.Equal(a[len(a)-1-suf], b[len(b)-1-suf]) {
+		m[len(a)-1-suf] = len(b) - 1 - suf
+		suf++
+	}
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+	if len(a) == 0 || len(b) == 0 {
+		return m, nil
+	}
+	if len(a)*len(b) > maxMergeCells {
+		return nil, errMergeTooLarge
+	}
+
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:].
+	w := len(b) + 1
+	lcs := make([]int32, (len(a)+1)*w)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case bytes.Equal(a[i], b[j]):
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+				lcs[i*w+j] = lcs[(i+1)*w+j]
+			default:
+				lcs[i*w+j] = lcs[i*w+j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case bytes.Equal(a[i], b[j]):
+			m[pre+i] = pre + j
+			i, j = i+1, j+1
+		case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		wantConflicts      int
+	}{
+		{
+			name: "unchanged",
+			base: "a\nb\nc\n", ours: "a\nb\nc\n", theirs: "a\nb\nc\n",
+			want: "a\nb\nc\n",
+		},
+		{
+			name: "ours only",
+			base: "a\nb\nc\n", ours: "a\nB\nc\n", theirs: "a\nb\nc\n",
+			want: "a\nB\nc\n",
+		},
+		{
+			name: "theirs only",
+			base: "a\nb\nc\n", ours: "a\nb\nc\n", theirs: "a\nb\nC\n",
+			want: "a\nb\nC\n",
+		},
+		{
+			name: "separate changes",
+			base: "a\nb\nc\nd\ne\n", ours: "A\nb\nc\nd\ne\n", theirs: "a\nb\nc\nd\nE\n",
+			want: "A\nb\nc\nd\nE\n",
+		},
+		{
+			name: "insertions and deletions",
+			base: "a\nb\nc\nd\n", ours: "a\nnew\nb\nc\nd\n", theirs: "a\nb\nc\n",
+			want: "a\nnew\nb\nc\n",
+		},
+		{
+			name: "same change on both sides",
+			base: "a\nb\nc\n", ours: "a\nX\nc\n", theirs: "a\nX\nc\n",
+			want: "a\nX\nc\n",
+		},
+		{
+			name: "conflict",
+			base: "a\nb\nc\n", ours: "a\nours\nc\n", theirs: "a\ntheirs\nc\n",
+			want:          "a\n<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\nc\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "conflict on an unterminated last line",
+			base: "a\nb", ours: "a\nours", theirs: "a\ntheirs",
+			want:          "a\n<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "both add to an empty base",
+			base: "", ours: "ours\n", theirs: "theirs\n",
+			want:          "<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "deletion against a change",
+			base: "a\nb\nc\n", ours: "a\nc\n", theirs: "a\nB\nc\n",
+			want:          "a\n<<<<<<< ours\n=======\nB\n>>>>>>> theirs\nc\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "two conflicts",
+			base: "a\nb\nc\nd\ne\n", ours: "a\n1\nc\nd\n2\n", theirs: "a\nx\nc\nd\ny\n",
+			want:          "a\n<<<<<<< ours\n1\n=======\nx\n>>>>>>> theirs\nc\nd\n<<<<<<< ours\n2\n=======\ny\n>>>>>>> theirs\n",
+			wantConflicts: 2,
+		},
+	}
+	for _, tt := range tests {
+		got, conflicts, err := merge3([]byte(tt.base), []byte(tt.ours), []byte(tt.theirs), "ours", "theirs")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want || conflicts != tt.wantConflicts {
+			t.Errorf("%s: merge3 = %q, %d conflicts, want %q, %d", tt.name, got, conflicts, tt.want, tt.wantConflicts)
+		}
+	}
+}
+
+func TestMerge3TooLarge(t *testing.T) {
+	var ours, theirs strings.Builder
+	for i := 0; i < 5000; i++ {
+		ours.WriteString("ours\n")
+		theirs.WriteString("theirs\n")
+	}
+	base := strings.Repeat("base\n", 5000)
+	_, _, err := merge3([]byte(base), []byte(ours.String()), []byte(theirs.String()), "ours", "theirs")
+	if err != errMergeTooLarge {
+		t.Errorf("merge3 = %v, want errMergeTooLarge", err)
+	}
+}
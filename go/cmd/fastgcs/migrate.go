@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+// migrate copies a prefix to another bucket or prefix server side, printing
+// each object as it's done with.
+func migrate(fg fastgcs.FastGCS, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	var opts fastgcs.MigrateOptions
+	flags.StringVar(&opts.StatePath, "state", "", "persist progress to this file and resume from it")
+	flags.IntVar(&opts.Concurrency, "j", 0, "rewrite this many objects at once (default 8)")
+	flags.BoolVar(&opts.DeleteSource, "delete", false, "delete each source object once its copy is verified")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 || !isGSURL(flags.Arg(0)) || !isGSURL(flags.Arg(1)) {
+		return errUsage
+	}
+
+	opts.Progress = func(src *fastgcs.ObjectAttrs, dstURL string, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fastgcs: %s: %v\n", src.URL(), err)
+			return
+		}
+		fmt.Printf("%s -> %s\n", src.URL(), dstURL)
+	}
+	return fastgcs.Migrate(fg, flags.Arg(0), flags.Arg(1), opts)
+}
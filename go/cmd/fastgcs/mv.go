@@ -0,0 +1,13 @@
+package main
+
+import (
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+// mv moves an object, or a folder when the source ends with "/".
+func mv(fg fastgcs.FastGCS, args []string) error {
+	if len(args) != 2 || !isGSURL(args[0]) || !isGSURL(args[1]) {
+		return errUsage
+	}
+	return fastgcs.Move(fg, args[0], args[1])
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+func pack(fg fastgcs.FastGCS, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	attrs, err := fastgcs.Pack(fg, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%s\n", attrs.URL(), attrs.Metadata[fastgcs.PackHashMetadataKey])
+	return nil
+}
+
+func extract(fg fastgcs.FastGCS, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return fastgcs.Extract(fg, args[0], args[1])
+}
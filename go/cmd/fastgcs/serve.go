@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+// serve serves objects from the cache over HTTP. Anywhere but on a loopback
+// address, it insists on TLS and on a list of clients, read from a YAML
+// file like:
+//
+//	clients:
+//	  - name: ci
+//	    token: 9f0c...
+//	    allow: [gs://artifacts/builds/]
+//	  - name: alice
+//	    common_name: alice.example.com
+//	    allow: [gs://artifacts/]
+func serve(fg fastgcs.FastGCS, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	addr := flags.String("addr", "127.0.0.1:8080", "listen on this address")
+	clientsPath := flags.String("clients", "", "YAML file listing the clients and the prefixes each may read")
+	certFile := flags.String("cert", "", "serve TLS with this PEM certificate (requires -key)")
+	keyFile := flags.String("key", "", "PEM private key of -cert")
+	selfSigned := flags.Bool("self-signed", false, "serve TLS with a self-signed certificate made at startup")
+	clientCA := flags.String("client-ca", "", "verify TLS client certificates against the PEM CA certificates in this file")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	var opts fastgcs.ServeOptions
+	if *clientsPath != "" {
+		data, err := ioutil.ReadFile(*clientsPath)
+		if err != nil {
+			return err
+		}
+		var config struct {
+			Clients []fastgcs.ServeClient `yaml:"clients"`
+		}
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return errors.Wrapf(err, "parsing %s", *clientsPath)
+		}
+		if len(config.Clients) == 0 {
+			return errors.Errorf("%s lists no clients", *clientsPath)
+		}
+		opts.Clients = config.Clients
+	}
+	handler, err := fastgcs.ServeHandler(fg, opts)
+	if err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	switch {
+	case *certFile != "" || *keyFile != "":
+		if *selfSigned {
+			return errUsage
+		}
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case *selfSigned:
+		cert, err := selfSignedCertificate(*addr)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(cert.Certificate[0])
+		fmt.Fprintf(os.Stderr, "fastgcs: self-signed certificate, SHA-256 fingerprint %X\n", sum)
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if *clientCA != "" {
+		if tlsConfig == nil {
+			return errors.New("-client-ca requires TLS (-cert and -key, or -self-signed)")
+		}
+		pem, err := ioutil.ReadFile(*clientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificates in %s", *clientCA)
+		}
+		// Clients with a token may come without a certificate.
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if err := checkExposure(*addr, tlsConfig != nil, *clientCA != "", opts.Clients); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		tlsConfig.MinVersion = tls.VersionTLS12
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	fmt.Fprintf(os.Stderr, "fastgcs: serving on %s\n", ln.Addr())
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	return srv.Serve(ln)
+}
+
+// checkExposure refuses configurations that would serve objects or tokens
+// to whoever can reach addr: anywhere but on a loopback address, clients
+// must be listed and the connection encrypted.
+func checkExposure(addr string, useTLS, clientCA bool, clients []fastgcs.ServeClient) error {
+	for _, c := range clients {
+		if c.CommonName != "" && !clientCA {
+			return errors.Errorf("client %q is authenticated by certificate, which requires -client-ca", c.Name)
+		}
+		if c.Token != "" && !useTLS && !isLoopback(addr) {
+			return errors.Errorf("client %q would send its token in the clear: serve TLS", c.Name)
+		}
+	}
+	if !isLoopback(addr) {
+		switch {
+		case !useTLS:
+			return errors.Errorf("refusing to serve %s without TLS (-cert and -key, or -self-signed)", addr)
+		case len(clients) == 0:
+			return errors.Errorf("refusing to serve %s to anyone (-clients)", addr)
+		}
+	}
+	return nil
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// selfSignedCertificate makes a certificate for the host of addr, as well as
+// localhost and the machine's host name, valid for a year.
+func selfSignedCertificate(addr string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "fastgcs serve"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if !strings.EqualFold(host, "localhost") {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
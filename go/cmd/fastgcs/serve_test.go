@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+func TestCheckExposure(t *testing.T) {
+	token := []fastgcs.ServeClient{{Name: "ci", Token: "t", Allow: []string{"gs://b/"}}}
+	cert := []fastgcs.ServeClient{{Name: "alice", CommonName: "alice.example.com", Allow: []string{"gs://b/"}}}
+	tests := []struct {
+		name     string
+		addr     string
+		useTLS   bool
+		clientCA bool
+		clients  []fastgcs.ServeClient
+		wantErr  string // empty if it may serve
+	}{
+		{name: "loopback", addr: "127.0.0.1:8080"},
+		{name: "localhost", addr: "localhost:8080"},
+		{name: "IPv6 loopback", addr: "[::1]:8080"},
+		{name: "loopback token without TLS", addr: "127.0.0.1:8080", clients: token},
+		{name: "public without anything", addr: "0.0.0.0:8080", wantErr: "without TLS"},
+		{name: "public without TLS", addr: "10.0.0.1:8080", clients: token, wantErr: "in the clear"},
+		{name: "public without clients", addr: "10.0.0.1:8080", useTLS: true, wantErr: "to anyone"},
+		{name: "all interfaces", addr: ":8080", useTLS: true, wantErr: "to anyone"},
+		{name: "host name", addr: "fileserver:8080", useTLS: true, wantErr: "to anyone"},
+		{name: "public with TLS and tokens", addr: "10.0.0.1:8080", useTLS: true, clients: token},
+		{name: "certificates without a CA", addr: "10.0.0.1:8080", useTLS: true, clients: cert, wantErr: "-client-ca"},
+		{name: "certificates", addr: "10.0.0.1:8080", useTLS: true, clientCA: true, clients: cert},
+	}
+	for _, tt := range tests {
+		err := checkExposure(tt.addr, tt.useTLS, tt.clientCA, tt.clients)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v, want it served", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want one mentioning %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+// syncDir syncs a local directory with a prefix both ways, printing each
+// operation as it's done.
+func syncDir(fg fastgcs.FastGCS, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	var opts fastgcs.SyncOptions
+	flags.StringVar(&opts.StatePath, "state", "", "keep the state of the last sync in this file (default .fastgcs-sync.json in the directory)")
+	conflict := flags.String("conflict", string(fastgcs.ConflictKeepBoth), "resolve files changed on both sides: copy, local or remote")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 || isGSURL(flags.Arg(0)) || !isGSURL(flags.Arg(1)) {
+		return errUsage
+	}
+	opts.Conflict = fastgcs.ConflictPolicy(*conflict)
+
+	opts.Progress = func(op fastgcs.SyncOp, name string, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fastgcs: %s %s: %v\n", op, name, err)
+			return
+		}
+		fmt.Printf("%s %s\n", op, name)
+	}
+	err := fastgcs.Sync(fg, flags.Arg(1), flags.Arg(0), opts)
+	if invalid, ok := err.(fastgcs.InvalidNamesError); ok {
+		for _, e := range invalid {
+			fmt.Fprintf(os.Stderr, "fastgcs: skipped %v\n", e)
+		}
+	}
+	return err
+}
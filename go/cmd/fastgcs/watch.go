@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	fastgcs "github.com/Shopify/fastgcs/go"
+)
+
+// watch runs a command every time the watched objects change, with the
+// changed URLs, one per line, in FASTGCS_CHANGED, and those of deleted
+// objects in FASTGCS_DELETED too. A failing command is reported and the
+// watch goes on.
+func watch(fg fastgcs.FastGCS, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	var opts fastgcs.WatchOptions
+	flags.DurationVar(&opts.Interval, "interval", 0, "poll GCS this often (default 10s)")
+	flags.DurationVar(&opts.Debounce, "debounce", 0, "wait for changes to settle this long before running the command (default 2s)")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	rest := flags.Args()
+	sep := -1
+	for i, arg := range rest {
+		if arg == "--" {
+			sep = i
+			break
+		}
+	}
+	if sep < 1 || sep == len(rest)-1 {
+		return errUsage
+	}
+	urls, command := rest[:sep], rest[sep+1:]
+	for _, u := range urls {
+		if !isGSURL(u) {
+			return errUsage
+		}
+	}
+
+	return fastgcs.Watch(fg, urls, opts, func(changes []fastgcs.Change) error {
+		var changed, deleted []string
+		for _, c := range changes {
+			changed = append(changed, c.URL)
+			if c.Generation == 0 {
+				deleted = append(deleted, c.URL)
+			}
+		}
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(),
+			"FASTGCS_CHANGED="+strings.Join(changed, "\n"),
+			"FASTGCS_DELETED="+strings.Join(deleted, "\n"))
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "fastgcs: %s: %v\n", command[0], err)
+		}
+		return nil
+	})
+}
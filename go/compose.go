@@ -0,0 +1,114 @@
+package fastgcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// MaxComposeSources is the most source objects a single Compose accepts.
+const MaxComposeSources = 32
+
+// ComposeOptions configures Compose.
+type ComposeOptions struct {
+	// ContentType of the composed object.
+	ContentType string
+	// Metadata is the custom metadata of the composed object, which doesn't
+	// inherit any from the sources.
+	Metadata map[string]string
+	// IfGenerationMatch makes Compose fail unless the live generation of
+	// the destination is the given one. Zero means it must not exist.
+	IfGenerationMatch *int64
+}
+
+// Compose concatenates sources, which must be in the destination's bucket,
+// into the object at gsURL. A source with a non-zero Generation is read at
+// that generation. The destination may be one of the sources.
+func (f *fastGCS) Compose(gsURL string, sources []ObjectAttrs, opts ComposeOptions) (*ObjectAttrs, error) {
+	bucket, object, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 || len(sources) > MaxComposeSources {
+		return nil, errors.Errorf("compose takes 1 to %d sources, got %d", MaxComposeSources, len(sources))
+	}
+
+	type sourceObject struct {
+		Name       string `json:"name"`
+		Generation int64  `json:"generation,string,omitempty"`
+	}
+	var body struct {
+		SourceObjects []sourceObject `json:"sourceObjects"`
+		Destination   struct {
+			ContentType string            `json:"contentType,omitempty"`
+			Metadata    map[string]string `json:"metadata,omitempty"`
+		} `json:"destination"`
+	}
+	for _, src := range sources {
+		if src.Bucket != "" && src.Bucket != bucket {
+			return nil, errors.Errorf("can't compose %s into bucket %s", src.URL(), bucket)
+		}
+		body.SourceObjects = append(body.SourceObjects, sourceObject{Name: src.Name, Generation: src.Generation})
+	}
+	body.Destination.ContentType = opts.ContentType
+	body.Destination.Metadata = opts.Metadata
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	if opts.IfGenerationMatch != nil {
+		q.Set("ifGenerationMatch", fmt.Sprint(*opts.IfGenerationMatch))
+	}
+	req, err := http.NewRequest("POST", apiObjectURL(bucket, object)+"/compose?"+q.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := f.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "composing %s", gsURL)
+	}
+	defer res.Body.Close()
+	var attrs ObjectAttrs
+	if err := json.NewDecoder(res.Body).Decode(&attrs); err != nil {
+		return nil, errors.Wrap(err, "decoding compose response")
+	}
+	f.noteWrite(&attrs)
+	return &attrs, nil
+}
+
+// DeleteOptions configures Delete.
+type DeleteOptions struct {
+	// IfGenerationMatch makes Delete fail unless the live generation of the
+	// object is the given one.
+	IfGenerationMatch *int64
+}
+
+// Delete deletes the live generation of the object at gsURL.
+func (f *fastGCS) Delete(gsURL string, opts DeleteOptions) error {
+	bucket, object, err := parseGSURL(gsURL)
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	if opts.IfGenerationMatch != nil {
+		q.Set("ifGenerationMatch", fmt.Sprint(*opts.IfGenerationMatch))
+	}
+	req, err := http.NewRequest("DELETE", apiObjectURL(bucket, object)+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := f.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	f.noteDelete(bucket, object)
+	return nil
+}
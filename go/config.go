@@ -0,0 +1,185 @@
+package fastgcs
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigInterval = 30 * time.Second
+
+// ConfigOptions configures LoadConfig.
+type ConfigOptions struct {
+	// New returns a new value to decode the object into, typically a
+	// pointer to a struct: func() interface{} { return new(MyConfig) }.
+	New func() interface{}
+	// Validate, if set, rejects decoded values that are unfit for use.
+	Validate func(v interface{}) error
+	// Interval is how often the object is checked for a new generation.
+	// Defaults to 30 seconds.
+	Interval time.Duration
+	// OnChange, if set, is called with each new value after it's swapped
+	// in.
+	OnChange func(v interface{})
+	// OnError, if set, is called when a new generation can't be loaded.
+	// The last good value stays in use.
+	OnError func(err error)
+}
+
+// Config is a value decoded from a JSON or YAML object, kept up to date
+// with the object's live generation.
+type Config struct {
+	fg    FastGCS
+	gsURL string
+	opts  ConfigOptions
+
+	value atomic.Value // configValue
+
+	// failed is the last generation that couldn't be decoded or validated,
+	// so it's only reported once.
+	failed int64
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+type configValue struct {
+	v          interface{}
+	generation int64
+}
+
+// LoadConfig decodes the object at gsURL, which must be JSON or YAML as
+// told by its name (.json, .yaml or .yml) or content type, and watches it
+// for new generations. Each new generation is decoded and validated, and
+// swapped in atomically only if both succeed; otherwise, as on network
+// errors, the last good value stays in use.
+//
+// The first load must succeed.
+func LoadConfig(fg FastGCS, gsURL string, opts ConfigOptions) (*Config, error) {
+	if opts.New == nil {
+		return nil, errors.New("ConfigOptions.New is required")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultConfigInterval
+	}
+	c := &Config{
+		fg:    fg,
+		gsURL: gsURL,
+		opts:  opts,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	attrs, err := fg.Stat(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(attrs); err != nil {
+		return nil, err
+	}
+	go c.watch()
+	return c, nil
+}
+
+// Get returns the current value, as returned by ConfigOptions.New.
+func (c *Config) Get() interface{} {
+	return c.value.Load().(configValue).v
+}
+
+// Generation returns the generation of the object the current value was
+// decoded from.
+func (c *Config) Generation() int64 {
+	return c.value.Load().(configValue).generation
+}
+
+// Close stops watching the object. Get keeps returning the last value.
+func (c *Config) Close() {
+	c.once.Do(func() { close(c.stop) })
+	<-c.done
+}
+
+func (c *Config) watch() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		attrs, err := c.fg.Stat(c.gsURL)
+		if err != nil {
+			c.report(err)
+			continue
+		}
+		if attrs.Generation == c.Generation() || attrs.Generation == c.failed {
+			continue
+		}
+		if err := c.load(attrs); err != nil {
+			c.report(err)
+			continue
+		}
+		if c.opts.OnChange != nil {
+			c.opts.OnChange(c.Get())
+		}
+	}
+}
+
+func (c *Config) report(err error) {
+	if c.opts.OnError != nil {
+		c.opts.OnError(err)
+	}
+}
+
+// load reads, decodes and validates the generation described by attrs and
+// swaps it in.
+func (c *Config) load(attrs *ObjectAttrs) error {
+	var data []byte
+	for {
+		var err error
+		if data, err = c.fg.Read(c.gsURL); err != nil {
+			return err
+		}
+		// What was read is the generation that was stat'ed only if it's
+		// still live.
+		after, err := c.fg.Stat(c.gsURL)
+		if err != nil {
+			return err
+		}
+		if after.Generation == attrs.Generation {
+			break
+		}
+		attrs = after
+	}
+
+	v := c.opts.New()
+	if err := decodeConfig(attrs, data, v); err != nil {
+		c.failed = attrs.Generation
+		return errors.Wrapf(err, "decoding %s generation %d", c.gsURL, attrs.Generation)
+	}
+	if c.opts.Validate != nil {
+		if err := c.opts.Validate(v); err != nil {
+			c.failed = attrs.Generation
+			return errors.Wrapf(err, "validating %s generation %d", c.gsURL, attrs.Generation)
+		}
+	}
+	c.value.Store(configValue{v: v, generation: attrs.Generation})
+	return nil
+}
+
+func decodeConfig(attrs *ObjectAttrs, data []byte, v interface{}) error {
+	switch ext := strings.ToLower(path.Ext(attrs.Name)); {
+	case ext == ".yaml", ext == ".yml", strings.Contains(attrs.ContentType, "yaml"):
+		return yaml.Unmarshal(data, v)
+	case ext == ".json", strings.Contains(attrs.ContentType, "json"):
+		return json.Unmarshal(data, v)
+	}
+	return errors.Errorf("%s: can't tell whether it's JSON or YAML", attrs.URL())
+}
@@ -1,6 +1,9 @@
 package fastgcs
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,9 +14,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -22,21 +27,81 @@ const (
 
 type FastGCS interface {
 	Open(gsURL string) (io.ReadCloser, error)
+	OpenWithAttrs(gsURL string) (io.ReadCloser, *ObjectAttrs, error)
 	Copy(gsURL, path string) error
 	Read(gsURL string) ([]byte, error)
+	Stream(gsURL string, opts ReadAhead) (io.ReadCloser, error)
+	Create(gsURL string, opts WriteOptions) (*Writer, error)
+	Upload(path, gsURL string, opts WriteOptions) error
+	InitiateMultipartUpload(gsURL string, opts WriteOptions) (*MultipartUpload, error)
+	Compose(gsURL string, sources []ObjectAttrs, opts ComposeOptions) (*ObjectAttrs, error)
+	Rewrite(srcURL, dstURL string, opts RewriteOptions) (*RewriteStatus, error)
+	Delete(gsURL string, opts DeleteOptions) error
+	Stat(gsURL string) (*ObjectAttrs, error)
+	List(gsURL string) ([]ObjectAttrs, error)
+	ListPages(gsURL string, opts ListOptions, fn func(*ListPage) error) error
+	ListDir(gsURL string) (*Listing, error)
+	ListDirCached(gsURL string) (*Listing, error)
+	HierarchicalNamespace(bucket string) (bool, error)
+	CreateFolder(gsURL string, opts CreateFolderOptions) (*Folder, error)
+	GetFolder(gsURL string) (*Folder, error)
+	ListFolders(gsURL string) ([]Folder, error)
+	DeleteFolder(gsURL string) error
+	RenameFolder(srcURL, dstURL string) (*Folder, error)
+	SignedURL(gsURL string, opts SignedURLOptions) (string, error)
+	// Close stops the background work New started, such as prefetching
+	// the objects of a profile, abandoning downloads in flight. The
+	// FastGCS remains usable.
+	Close() error
 }
 
-func New() (FastGCS, error) {
+// Option configures a FastGCS returned by New.
+type Option func(*fastGCS)
+
+// WithHTTPClient makes FastGCS issue its requests through client instead of
+// a default http.Client. This is mostly useful in tests, e.g. to install a
+// faultinject.Transport.
+func WithHTTPClient(client *http.Client) Option {
+	return func(f *fastGCS) {
+		f.client = client
+	}
+}
+
+// CacheRoot returns the directory holding fastgcs's caches and logs.
+func CacheRoot() (string, error) {
 	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache", "fastgcs"), nil
+}
+
+func New(opts ...Option) (FastGCS, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	cacheRoot, err := CacheRoot()
 	if err != nil {
 		return nil, err
 	}
-	cacheRoot := filepath.Join(home, ".cache", "fastgcs")
 	os.MkdirAll(cacheRoot, os.ModePerm)
-	return &fastGCS{
+	f := &fastGCS{
 		cacheRoot:       cacheRoot,
 		gcloudConfigDir: filepath.Join(home, ".config", "gcloud"),
-	}, nil
+		client:          &http.Client{},
+		listCache: listCache{
+			dir: filepath.Join(cacheRoot, "listings"),
+			ttl: defaultListCacheTTL,
+		},
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.profile != nil {
+		f.startPrefetching()
+	}
+	return f, nil
 }
 
 type token struct {
@@ -47,11 +112,24 @@ type token struct {
 type fastGCS struct {
 	cacheRoot       string
 	gcloudConfigDir string
-
-	token *token
+	client          *http.Client
+	grpc            grpc.ClientConnInterface
+	listCache       listCache
+	hot             *hotTier
+	compressCache   bool
+	profile         *profile
+
+	auditPath string
+	auditMu   sync.Mutex
+
+	tokenMu sync.Mutex
+	token   *token
 }
 
 func (f *fastGCS) ensureCurrentToken() error {
+	f.tokenMu.Lock()
+	defer f.tokenMu.Unlock()
+
 	tok := f.token
 	if tok != nil && time.Now().Before(tok.Expiry) {
 		return nil
@@ -87,67 +165,324 @@ func (f *fastGCS) findTokenInCache() (*token, error) {
 }
 
 func (f *fastGCS) Open(gsURL string) (io.ReadCloser, error) {
-	f.ensureCurrentToken()
+	rc, _, err := f.open(gsURL)
+	return rc, err
+}
+
+// OpenWithAttrs is Open, also returning the attributes of the generation
+// whose content it returns, as recorded in its cache entry.
+func (f *fastGCS) OpenWithAttrs(gsURL string) (io.ReadCloser, *ObjectAttrs, error) {
+	rc, entry, err := f.open(gsURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rc, entry.meta.attrs(), nil
+}
 
-	cachePath, err := f.update(gsURL)
+func (f *fastGCS) open(gsURL string) (io.ReadCloser, *cacheEntry, error) {
+	if f.hot != nil {
+		data, entry, inMemory, err := f.readHot(gsURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		f.audit("open", gsURL, entry)
+		f.recordRead(gsURL)
+		if inMemory {
+			return ioutil.NopCloser(bytes.NewReader(data)), entry, nil
+		}
+		return f.openEntry(gsURL, entry)
+	}
+	entry, err := f.update(gsURL)
 	if err != nil {
+		return nil, nil, err
+	}
+	f.audit("open", gsURL, entry)
+	f.recordRead(gsURL)
+	return f.openEntry(gsURL, entry)
+}
+
+// openEntry opens the entry for gsURL, as retryGone.
+func (f *fastGCS) openEntry(gsURL string, entry *cacheEntry) (io.ReadCloser, *cacheEntry, error) {
+	var rc io.ReadCloser
+	entry, err := f.retryGone(gsURL, entry, func(e *cacheEntry) (err error) {
+		rc, err = e.open()
+		return err
+	})
+	return rc, entry, err
+}
+
+// retryGone calls use with entry, and once more with a fresh entry if the
+// content entry pointed to was gone by the time use opened it: another
+// process may have replaced it in between with the object's content stored
+// the other way, compressed or not.
+func (f *fastGCS) retryGone(gsURL string, entry *cacheEntry, use func(*cacheEntry) error) (*cacheEntry, error) {
+	err := use(entry)
+	if !entry.gone(err) {
+		return entry, err
+	}
+	if entry, err = f.refresh(context.Background(), gsURL); err != nil {
 		return nil, err
 	}
-	return os.Open(cachePath)
+	return entry, use(entry)
 }
 
 func (f *fastGCS) Copy(gsURL, path string) error {
-	cachePath, err := f.update(gsURL)
+	entry, err := f.update(gsURL)
 	if err != nil {
 		return err
 	}
-	return copyFile(cachePath, path, 0644)
+	f.audit("copy", gsURL, entry)
+	f.recordRead(gsURL)
+	_, err = f.retryGone(gsURL, entry, func(e *cacheEntry) error {
+		return e.copyTo(path, 0644)
+	})
+	return err
 }
 
 func (f *fastGCS) Read(gsURL string) ([]byte, error) {
-	cachePath, err := f.update(gsURL)
+	if f.hot != nil {
+		data, entry, inMemory, err := f.readHot(gsURL)
+		if err != nil {
+			return nil, err
+		}
+		f.audit("read", gsURL, entry)
+		f.recordRead(gsURL)
+		if inMemory {
+			// The caller may modify what it gets.
+			return append([]byte(nil), data...), nil
+		}
+		return f.readEntry(gsURL, entry)
+	}
+	entry, err := f.update(gsURL)
 	if err != nil {
 		return nil, err
 	}
-	return ioutil.ReadFile(cachePath)
+	f.audit("read", gsURL, entry)
+	f.recordRead(gsURL)
+	return f.readEntry(gsURL, entry)
 }
 
-func (f *fastGCS) update(gsURL string) (string, error) {
+// readEntry reads the entry for gsURL, as retryGone.
+func (f *fastGCS) readEntry(gsURL string, entry *cacheEntry) ([]byte, error) {
+	var data []byte
+	_, err := f.retryGone(gsURL, entry, func(e *cacheEntry) (err error) {
+		data, err = e.read()
+		return err
+	})
+	return data, err
+}
+
+// update makes sure the cache entry for gsURL holds the live generation of
+// the object, downloading it unless the cached copy is still current. An
+// entry prefetched for the profile counts as current.
+func (f *fastGCS) update(gsURL string) (*cacheEntry, error) {
+	if f.profile != nil {
+		if entry := f.profile.take(gsURL); entry != nil {
+			return entry, nil
+		}
+	}
+	return f.refresh(context.Background(), gsURL)
+}
+
+// refresh is update without the profile, abandoning the download if ctx
+// is cancelled.
+func (f *fastGCS) refresh(ctx context.Context, gsURL string) (*cacheEntry, error) {
 	path, err := f.cachePath(gsURL)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	bucket, object, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
 	}
-	_ = path
 
-	url, err := apiFetchURL(gsURL)
+	cached := readCacheMeta(path)
+	if cached != nil && !cached.describes(gsURL, path) {
+		os.Remove(cacheMetaPath(path))
+		cached = nil
+	}
+
+	// Download next to the cache entry and move it into place only once
+	// it's complete and verified, so that a failed download never leaves a
+	// truncated entry behind.
+	dst, err := ioutil.TempFile(f.cacheRoot, "."+filepath.Base(path)+".tmp")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer os.Remove(dst.Name())
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+	fetch := f.fetch
+	if f.grpc != nil {
+		fetch = f.grpcFetch
+	}
+	meta, err := fetch(ctx, gsURL, bucket, object, cached, dst)
 	if err != nil {
-		return "", err
+		dst.Close()
+		if err == errNotModified {
+			return &cacheEntry{path: entryPath(path, cached), meta: *cached, hit: true}, nil
+		}
+		return nil, errors.Wrapf(err, "downloading %s", gsURL)
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+	content := dst.Name()
+	if f.compressCache {
+		compressed, err := compressEntry(content, meta)
+		if err != nil {
+			return nil, err
+		}
+		if compressed != "" {
+			defer os.Remove(compressed)
+			content = compressed
+		}
+	}
+	if err := os.Chmod(content, 0644); err != nil {
+		return nil, err
+	}
+	// Drop the old metadata first: an entry without metadata is merely
+	// downloaded again, while stale metadata would vouch for new content.
+	os.Remove(cacheMetaPath(path))
+	target := entryPath(path, meta)
+	if err := os.Rename(content, target); err != nil {
+		return nil, err
+	}
+	// Whichever of the plain and compressed files isn't in use is stale. A
+	// reader that validated it just before finds it gone, and revalidates:
+	// see retryGone.
+	if target == path {
+		os.Remove(entryPath(path, &cacheMeta{Compression: "zstd"}))
+	} else {
+		os.Remove(path)
+	}
+	if err := writeCacheMeta(path, meta); err != nil {
+		return nil, err
+	}
+
+	return &cacheEntry{path: target, meta: *meta}, nil
+}
+
+func (f *fastGCS) Close() error {
+	if f.profile != nil {
+		f.profile.close()
+	}
+	return nil
+}
+
+// noteWrite records that attrs was just written, for the caches to stop
+// serving what they hold of the object.
+func (f *fastGCS) noteWrite(attrs *ObjectAttrs) {
+	f.listCache.noteWrite(attrs)
+	if f.hot != nil {
+		f.hot.drop(attrs.URL())
+	}
+	if f.profile != nil {
+		f.profile.drop(attrs.URL())
+	}
+}
+
+// noteDelete is noteWrite for a deleted object.
+func (f *fastGCS) noteDelete(bucket, name string) {
+	f.listCache.noteDelete(bucket, name)
+	if f.hot != nil {
+		f.hot.drop("gs://" + bucket + "/" + name)
+	}
+	if f.profile != nil {
+		f.profile.drop("gs://" + bucket + "/" + name)
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", f.token.Token))
-	res, err := client.Do(req)
+}
+
+// notePrefixChange is noteWrite for any object under prefix.
+func (f *fastGCS) notePrefixChange(bucket, prefix string) {
+	f.listCache.notePrefixChange(bucket, prefix)
+	if f.hot != nil {
+		f.hot.dropPrefix("gs://" + bucket + "/" + prefix)
+	}
+	if f.profile != nil {
+		f.profile.dropPrefix("gs://" + bucket + "/" + prefix)
+	}
+}
+
+// errNotModified is returned by fetch functions when the cached copy is
+// still current.
+var errNotModified = errors.New("not modified")
+
+// fetch downloads the live generation of an object to w through the JSON
+// API. If the cached copy's ETag still matches, it returns errNotModified
+// instead.
+func (f *fastGCS) fetch(ctx context.Context, gsURL, bucket, object string, cached *cacheMeta, w io.Writer) (*cacheMeta, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiObjectURL(bucket, object)+"?alt=media", nil)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	if cached != nil && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	res, err := f.do(req)
+	if IsStatus(err, http.StatusNotModified) {
+		return nil, errNotModified
+	}
+	if err != nil {
+		return nil, err
 	}
 	defer res.Body.Close()
 
-	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return "", err
+	if err := copyMedia(w, res); err != nil {
+		return nil, err
 	}
-	defer dst.Close()
+	return cacheMetaFromResponse(gsURL, res), nil
+}
+
+// HTTPError is returned when the GCS API answers with an unexpected status.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP error %d: %s", e.StatusCode, e.Body)
+}
 
-	_, err = io.Copy(dst, res.Body)
+// IsStatus reports whether err is an *HTTPError with the given status code.
+func IsStatus(err error, code int) bool {
+	var herr *HTTPError
+	return errors.As(err, &herr) && herr.StatusCode == code
+}
+
+// do sends an authenticated request to the GCS API. Any non-2xx response is
+// turned into an *HTTPError, so callers only ever see successful bodies.
+func (f *fastGCS) do(req *http.Request) (*http.Response, error) {
+	if err := f.ensureCurrentToken(); err != nil {
+		return nil, err
+	}
+	f.tokenMu.Lock()
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", f.token.Token))
+	f.tokenMu.Unlock()
+	res, err := f.client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, &HTTPError{StatusCode: res.StatusCode, Body: strings.TrimSpace(string(body))}
 	}
+	return res, nil
+}
 
-	return path, nil
+// getJSON fetches url from the GCS API and decodes the response into v.
+func (f *fastGCS) getJSON(url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := f.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
 }
 
 var gsURLRegexp = regexp.MustCompile("^gs://([^/]+)/(.*)$")
@@ -158,23 +493,21 @@ func (f *fastGCS) cachePath(gsURL string) (string, error) {
 		return "", err
 	}
 
-	return filepath.Join(
-		f.cacheRoot,
-		fmt.Sprintf("%s--%s", bucket, strings.ReplaceAll(object, "/", "-")),
-	), nil
-}
-
-func apiFetchURL(gsURL string) (string, error) {
-	bucket, object, err := parseGSURL(gsURL)
-	if err != nil {
-		return "", err
+	name := fmt.Sprintf("%s--%s", bucket, strings.ReplaceAll(object, "/", "-"))
+	// Object names may hold NULs and run to 1024 bytes, neither of which
+	// file names can. Those objects get a name derived from a hash instead,
+	// short enough for the metadata and temporary files next to it.
+	if len(name) > maxCacheNameLen || strings.ContainsRune(name, 0) {
+		sum := sha256.Sum256([]byte(object))
+		name = fmt.Sprintf("%s--%x", bucket, sum)
 	}
-	return fmt.Sprintf(
-		"https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media",
-		bucket, object,
-	), nil
+	return filepath.Join(f.cacheRoot, name), nil
 }
 
+// maxCacheNameLen leaves room for the prefixes and suffixes of the files
+// kept next to a cache entry within the usual 255-byte limit on file names.
+const maxCacheNameLen = 200
+
 func parseGSURL(gsURL string) (string, string, error) {
 	match := gsURLRegexp.FindStringSubmatch(gsURL)
 	if match == nil {
@@ -186,6 +519,27 @@ func parseGSURL(gsURL string) (string, string, error) {
 	return bucket, object, nil
 }
 
+// writeFileAtomic replaces path with data, so that concurrent readers never
+// observe a partially written file.
+func writeFileAtomic(path string, data []byte, mode fs.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 func copyFile(srcPath, dstPath string, mode fs.FileMode) error {
 	src, err := os.Open(srcPath)
 	if err != nil {
@@ -193,7 +547,7 @@ func copyFile(srcPath, dstPath string, mode fs.FileMode) error {
 	}
 	defer src.Close()
 
-	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE, mode)
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
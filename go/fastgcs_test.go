@@ -0,0 +1,46 @@
+package fastgcs
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/fastgcs/go/jsonfake"
+)
+
+// newTestFastGCS returns a FastGCS with its own cache, and a token that
+// outlives the test so that gcloud's is never looked up. HTTP requests fail
+// unless an option installs a client that serves them.
+func newTestFastGCS(t *testing.T, opts ...Option) *fastGCS {
+	root := t.TempDir()
+	f := &fastGCS{
+		cacheRoot: root,
+		client:    &http.Client{Transport: noNetwork{}},
+		listCache: listCache{
+			dir: filepath.Join(root, "listings"),
+			ttl: defaultListCacheTTL,
+		},
+		token: &token{Token: "test", Expiry: time.Now().Add(time.Hour)},
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// newJSONTest returns a FastGCS whose JSON API requests are served by a
+// jsonfake.Server holding an empty bucket b, and the server.
+func newJSONTest(t *testing.T, opts ...Option) (*fastGCS, *jsonfake.Server) {
+	srv := jsonfake.NewServer()
+	t.Cleanup(srv.Close)
+	srv.CreateBucket("b")
+	return newTestFastGCS(t, append([]Option{WithHTTPClient(srv.Client())}, opts...)...), srv
+}
+
+type noNetwork struct{}
+
+func (noNetwork) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("no network in tests: " + req.URL.String())
+}
@@ -0,0 +1,529 @@
+// Package fastgcsblob provides a gocloud.dev/blob driver backed by fastgcs,
+// so that code written against blob.Bucket gets fastgcs's credential
+// discovery and its local cache for reads.
+//
+// Use OpenBucket to wrap a FastGCS, or open a fastgcs:// URL, e.g.
+// fastgcs://my-bucket, with blob.OpenBucket once this package is imported.
+//
+// # As
+//
+// fastgcsblob exposes the following types for As:
+//   - Bucket: fastgcs.FastGCS
+//   - Error: *fastgcs.HTTPError
+//   - ListObject, Attributes: fastgcs.ObjectAttrs
+//   - ListOptions.BeforeList: *fastgcs.ListOptions
+//   - Reader, ReaderOptions.BeforeRead: fastgcs.ObjectAttrs
+//   - WriterOptions.BeforeWrite: *fastgcs.WriteOptions
+//   - CopyOptions.BeforeCopy: *fastgcs.RewriteOptions
+//   - SignedURLOptions.BeforeSign: *fastgcs.SignedURLOptions
+package fastgcsblob
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/fastgcs/go"
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/driver"
+	"gocloud.dev/gcerrors"
+)
+
+// Scheme is the URL scheme fastgcsblob registers its URLOpener under on
+// blob.DefaultURLMux.
+const Scheme = "fastgcs"
+
+func init() {
+	blob.DefaultURLMux().RegisterBucket(Scheme, new(lazyOpener))
+}
+
+// lazyOpener creates the FastGCS of the default URLOpener on first use.
+type lazyOpener struct {
+	init   sync.Once
+	opener *URLOpener
+	err    error
+}
+
+func (o *lazyOpener) OpenBucketURL(ctx context.Context, u *url.URL) (*blob.Bucket, error) {
+	o.init.Do(func() {
+		fg, err := fastgcs.New()
+		if err != nil {
+			o.err = err
+			return
+		}
+		o.opener = &URLOpener{FastGCS: fg}
+	})
+	if o.err != nil {
+		return nil, errors.Wrapf(o.err, "opening bucket %v", u)
+	}
+	return o.opener.OpenBucketURL(ctx, u)
+}
+
+// URLOpener opens fastgcs:// URLs, whose host is the bucket name. The
+// access_id query parameter sets Options.GoogleAccessID.
+type URLOpener struct {
+	FastGCS fastgcs.FastGCS
+	Options Options
+}
+
+// OpenBucketURL opens the bucket named by u.
+func (o *URLOpener) OpenBucketURL(ctx context.Context, u *url.URL) (*blob.Bucket, error) {
+	opts := o.Options
+	for k, v := range u.Query() {
+		switch k {
+		case "access_id":
+			opts.GoogleAccessID = v[0]
+		default:
+			return nil, errors.Errorf("opening bucket %v: invalid query parameter %q", u, k)
+		}
+	}
+	return OpenBucket(o.FastGCS, u.Host, &opts)
+}
+
+// Options configures OpenBucket.
+type Options struct {
+	// GoogleAccessID and SignBytes are passed to FastGCS.SignedURL. Without
+	// a GoogleAccessID, SignedURL is unimplemented.
+	GoogleAccessID string
+	SignBytes      func([]byte) ([]byte, error)
+}
+
+// OpenBucket returns a *blob.Bucket over the named bucket, going through
+// fg. opts may be nil.
+//
+// Reads go through the object cache: the first read of an object downloads
+// it whole, even for a small range, and later reads only check with GCS
+// that it's still current.
+func OpenBucket(fg fastgcs.FastGCS, bucketName string, opts *Options) (*blob.Bucket, error) {
+	if fg == nil {
+		return nil, errors.New("fastgcsblob.OpenBucket: FastGCS is required")
+	}
+	if bucketName == "" {
+		return nil, errors.New("fastgcsblob.OpenBucket: bucketName is required")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	return blob.NewBucket(&bucket{fg: fg, name: bucketName, opts: *opts}), nil
+}
+
+type bucket struct {
+	fg   fastgcs.FastGCS
+	name string
+	opts Options
+}
+
+func (b *bucket) url(key string) string {
+	return "gs://" + b.name + "/" + escapeKey(key)
+}
+
+// escapeKey maps a key to an object name GCS accepts, the same way as
+// gocloud.dev/blob/gcsblob, so that either driver reads what the other
+// wrote: newlines, and the slash of "../", are hex-escaped as "__0x2f__".
+func escapeKey(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if r == '\n' || r == '\r' || (i > 1 && r == '/' && runes[i-1] == '.' && runes[i-2] == '.') {
+			fmt.Fprintf(&b, "__%#x__", r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// hexEscapeRegexp matches what escapeKey, or gcsblob, escaped a rune to.
+var hexEscapeRegexp = regexp.MustCompile(`__0x([0-9a-fA-F]+)__`)
+
+// unescapeKey reverses escapeKey.
+func unescapeKey(name string) string {
+	return hexEscapeRegexp.ReplaceAllStringFunc(name, func(m string) string {
+		r, err := strconv.ParseInt(hexEscapeRegexp.FindStringSubmatch(m)[1], 16, 32)
+		if err != nil {
+			return m
+		}
+		return string(rune(r))
+	})
+}
+
+// quoteETag quotes a JSON API ETag, which comes bare, the way HTTP ETags
+// are.
+func quoteETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/"`) {
+		return etag
+	}
+	return strconv.Quote(etag)
+}
+
+// unimplementedError is returned for what fastgcs can't do, and has
+// ErrorCode return gcerrors.Unimplemented.
+type unimplementedError string
+
+func (e unimplementedError) Error() string {
+	return "fastgcsblob: " + string(e)
+}
+
+func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
+	var unimplemented unimplementedError
+	var herr *fastgcs.HTTPError
+	switch {
+	case errors.As(err, &unimplemented):
+		return gcerrors.Unimplemented
+	case errors.Is(err, context.Canceled):
+		return gcerrors.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return gcerrors.DeadlineExceeded
+	case !errors.As(err, &herr):
+		return gcerrors.Unknown
+	}
+	switch herr.StatusCode {
+	case http.StatusBadRequest:
+		return gcerrors.InvalidArgument
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return gcerrors.PermissionDenied
+	case http.StatusNotFound:
+		return gcerrors.NotFound
+	case http.StatusConflict:
+		return gcerrors.AlreadyExists
+	case http.StatusPreconditionFailed:
+		return gcerrors.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return gcerrors.ResourceExhausted
+	case http.StatusNotImplemented:
+		return gcerrors.Unimplemented
+	}
+	if herr.StatusCode >= 500 {
+		return gcerrors.Internal
+	}
+	return gcerrors.Unknown
+}
+
+func (b *bucket) As(i interface{}) bool {
+	p, ok := i.(*fastgcs.FastGCS)
+	if ok {
+		*p = b.fg
+	}
+	return ok
+}
+
+func (b *bucket) ErrorAs(err error, i interface{}) bool {
+	if _, ok := i.(**fastgcs.HTTPError); !ok {
+		return false
+	}
+	return errors.As(err, i)
+}
+
+// attrsAs is the AsFunc of what exposes attrs.
+func attrsAs(attrs *fastgcs.ObjectAttrs) func(interface{}) bool {
+	return func(i interface{}) bool {
+		p, ok := i.(*fastgcs.ObjectAttrs)
+		if ok {
+			*p = *attrs
+		}
+		return ok
+	}
+}
+
+// decodeMD5 decodes the base64 MD5 hash of attrs, which composite objects
+// don't have.
+func decodeMD5(attrs *fastgcs.ObjectAttrs) []byte {
+	md5, err := base64.StdEncoding.DecodeString(attrs.MD5Hash)
+	if err != nil || len(md5) == 0 {
+		return nil
+	}
+	return md5
+}
+
+func (b *bucket) Attributes(ctx context.Context, key string) (*driver.Attributes, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	attrs, err := b.fg.Stat(b.url(key))
+	if err != nil {
+		return nil, err
+	}
+	return &driver.Attributes{
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentType:        attrs.ContentType,
+		Metadata:           attrs.Metadata,
+		ModTime:            attrs.Updated,
+		Size:               attrs.Size,
+		MD5:                decodeMD5(attrs),
+		ETag:               quoteETag(attrs.ETag),
+		AsFunc:             attrsAs(attrs),
+	}, nil
+}
+
+// errStopListing ends ListPages after the page ListPaged asked for.
+var errStopListing = errors.New("stop listing")
+
+func (b *bucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driver.ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	listOpts := fastgcs.ListOptions{
+		Delimiter: escapeKey(opts.Delimiter),
+		PageToken: string(opts.PageToken),
+		PageSize:  opts.PageSize,
+	}
+	if opts.BeforeList != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**fastgcs.ListOptions)
+			if ok {
+				*p = &listOpts
+			}
+			return ok
+		}
+		if err := opts.BeforeList(asFunc); err != nil {
+			return nil, err
+		}
+	}
+
+	var page *fastgcs.ListPage
+	err := b.fg.ListPages(b.url(opts.Prefix), listOpts, func(p *fastgcs.ListPage) error {
+		page = p
+		return errStopListing
+	})
+	if err != nil && err != errStopListing {
+		return nil, err
+	}
+
+	res := &driver.ListPage{}
+	if page.NextPageToken != "" {
+		res.NextPageToken = []byte(page.NextPageToken)
+	}
+	for i := range page.Objects {
+		attrs := &page.Objects[i]
+		res.Objects = append(res.Objects, &driver.ListObject{
+			Key:     unescapeKey(attrs.Name),
+			ModTime: attrs.Updated,
+			Size:    attrs.Size,
+			MD5:     decodeMD5(attrs),
+			AsFunc:  attrsAs(attrs),
+		})
+	}
+	for _, prefix := range page.Prefixes {
+		res.Objects = append(res.Objects, &driver.ListObject{Key: unescapeKey(prefix), IsDir: true})
+	}
+	sort.Slice(res.Objects, func(i, j int) bool { return res.Objects[i].Key < res.Objects[j].Key })
+	return res, nil
+}
+
+func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// The attributes come from the cache entry read, so that they describe
+	// the same generation as the content.
+	rc, attrs, err := b.fg.OpenWithAttrs(b.url(key))
+	if err != nil {
+		return nil, err
+	}
+	if opts.BeforeRead != nil {
+		if err := opts.BeforeRead(attrsAs(attrs)); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	if err := skip(rc, offset); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	r := &reader{
+		ctx:   ctx,
+		r:     rc,
+		c:     rc,
+		attrs: attrs,
+		readerAttrs: driver.ReaderAttributes{
+			ContentType: attrs.ContentType,
+			ModTime:     attrs.Updated,
+			Size:        attrs.Size,
+		},
+	}
+	if length >= 0 {
+		r.r = io.LimitReader(rc, length)
+	}
+	return r, nil
+}
+
+// skip moves r offset bytes forward, seeking if it can: cache entries on
+// disk can, while content the hot tier holds in memory is read through.
+func skip(r io.Reader, offset int64) error {
+	if offset <= 0 {
+		return nil
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, r, offset)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+type reader struct {
+	ctx         context.Context
+	r           io.Reader
+	c           io.Closer
+	attrs       *fastgcs.ObjectAttrs
+	readerAttrs driver.ReaderAttributes
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (r *reader) Close() error {
+	return r.c.Close()
+}
+
+func (r *reader) Attributes() *driver.ReaderAttributes {
+	return &r.readerAttrs
+}
+
+func (r *reader) As(i interface{}) bool {
+	return attrsAs(r.attrs)(i)
+}
+
+func (b *bucket) NewTypedWriter(ctx context.Context, key, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	writeOpts := fastgcs.WriteOptions{
+		ContentType:        contentType,
+		ContentEncoding:    opts.ContentEncoding,
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		ContentLanguage:    opts.ContentLanguage,
+		Metadata:           opts.Metadata,
+	}
+	if opts.IfNotExist {
+		writeOpts.IfGenerationMatch = new(int64)
+	}
+	if opts.BeforeWrite != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**fastgcs.WriteOptions)
+			if ok {
+				*p = &writeOpts
+			}
+			return ok
+		}
+		if err := opts.BeforeWrite(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	w, err := b.fg.Create(b.url(key), writeOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{ctx: ctx, w: w}, nil
+}
+
+// writer aborts the upload if its context is canceled before Close.
+type writer struct {
+	ctx context.Context
+	w   *fastgcs.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+func (w *writer) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		w.w.Abort()
+		return err
+	}
+	return w.w.Close()
+}
+
+func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
+	rewriteOpts := fastgcs.RewriteOptions{}
+	if opts.BeforeCopy != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**fastgcs.RewriteOptions)
+			if ok {
+				*p = &rewriteOpts
+			}
+			return ok
+		}
+		if err := opts.BeforeCopy(asFunc); err != nil {
+			return err
+		}
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		status, err := b.fg.Rewrite(b.url(srcKey), b.url(dstKey), rewriteOpts)
+		if err != nil {
+			return err
+		}
+		if status.Done {
+			return nil
+		}
+		rewriteOpts.RewriteToken = status.RewriteToken
+	}
+}
+
+func (b *bucket) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.fg.Delete(b.url(key), fastgcs.DeleteOptions{})
+}
+
+func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
+	if b.opts.GoogleAccessID == "" {
+		return "", unimplementedError("SignedURL needs Options.GoogleAccessID")
+	}
+	if opts.EnforceAbsentContentType && opts.ContentType == "" {
+		return "", unimplementedError("SignedURL can't enforce the absence of a Content-Type")
+	}
+	signOpts := fastgcs.SignedURLOptions{
+		Method:         opts.Method,
+		Expiry:         opts.Expiry,
+		ContentType:    opts.ContentType,
+		GoogleAccessID: b.opts.GoogleAccessID,
+		SignBytes:      b.opts.SignBytes,
+	}
+	if opts.BeforeSign != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**fastgcs.SignedURLOptions)
+			if ok {
+				*p = &signOpts
+			}
+			return ok
+		}
+		if err := opts.BeforeSign(asFunc); err != nil {
+			return "", err
+		}
+	}
+	return b.fg.SignedURL(b.url(key), signOpts)
+}
+
+func (b *bucket) Close() error {
+	return nil
+}
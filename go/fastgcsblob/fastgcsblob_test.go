@@ -0,0 +1,173 @@
+package fastgcsblob
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/fastgcs/go"
+	"github.com/Shopify/fastgcs/go/jsonfake"
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/driver"
+	"gocloud.dev/blob/drivertest"
+)
+
+const bucketName = "conformance"
+
+type harness struct {
+	srv *jsonfake.Server
+	fg  fastgcs.FastGCS
+}
+
+// newHarness serves the bucket from a jsonfake.Server, through a FastGCS
+// whose home directory, and so caches and credentials, belong to the test.
+func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	gcloud := filepath.Join(home, ".config", "gcloud")
+	if err := os.MkdirAll(gcloud, 0755); err != nil {
+		return nil, err
+	}
+	tok, err := json.Marshal(map[string]interface{}{"Token": "test", "Expiry": time.Now().Add(time.Hour)})
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(gcloud, "com.shopify.fastgcs.json"), tok, 0600); err != nil {
+		return nil, err
+	}
+
+	srv := jsonfake.NewServer()
+	srv.CreateBucket(bucketName)
+	fg, err := fastgcs.New(fastgcs.WithHTTPClient(srv.Client()))
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return &harness{srv: srv, fg: fg}, nil
+}
+
+func (h *harness) MakeDriver(ctx context.Context) (driver.Bucket, error) {
+	return &bucket{fg: h.fg, name: bucketName}, nil
+}
+
+func (h *harness) MakeDriverForNonexistentBucket(ctx context.Context) (driver.Bucket, error) {
+	return &bucket{fg: h.fg, name: "nonexistent"}, nil
+}
+
+// HTTPClient returns nil: SignedURL is unimplemented without a
+// GoogleAccessID.
+func (h *harness) HTTPClient() *http.Client {
+	return nil
+}
+
+func (h *harness) Close() {
+	h.srv.Close()
+}
+
+func TestConformance(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness, []drivertest.AsTest{verifyAs{}})
+}
+
+// verifyAs checks the types the package documents for As.
+type verifyAs struct{}
+
+func (verifyAs) Name() string {
+	return "verify As types for fastgcsblob"
+}
+
+func (verifyAs) BucketCheck(b *blob.Bucket) error {
+	var fg fastgcs.FastGCS
+	if !b.As(&fg) || fg == nil {
+		return errors.New("Bucket.As failed")
+	}
+	return nil
+}
+
+func (verifyAs) ErrorCheck(b *blob.Bucket, err error) error {
+	var herr *fastgcs.HTTPError
+	if !b.ErrorAs(err, &herr) {
+		return errors.New("Bucket.ErrorAs failed")
+	}
+	if herr.StatusCode != http.StatusNotFound {
+		return errors.Errorf("Bucket.ErrorAs got status %d, want 404", herr.StatusCode)
+	}
+	return nil
+}
+
+func (verifyAs) BeforeRead(as func(interface{}) bool) error {
+	var attrs fastgcs.ObjectAttrs
+	if !as(&attrs) || attrs.Generation == 0 {
+		return errors.New("BeforeRead.As failed")
+	}
+	return nil
+}
+
+func (verifyAs) BeforeWrite(as func(interface{}) bool) error {
+	var opts *fastgcs.WriteOptions
+	if !as(&opts) {
+		return errors.New("BeforeWrite.As failed")
+	}
+	opts.Metadata = map[string]string{"as": "write"}
+	return nil
+}
+
+func (verifyAs) BeforeCopy(as func(interface{}) bool) error {
+	var opts *fastgcs.RewriteOptions
+	if !as(&opts) {
+		return errors.New("BeforeCopy.As failed")
+	}
+	return nil
+}
+
+func (verifyAs) BeforeList(as func(interface{}) bool) error {
+	var opts *fastgcs.ListOptions
+	if !as(&opts) {
+		return errors.New("BeforeList.As failed")
+	}
+	return nil
+}
+
+func (verifyAs) BeforeSign(as func(interface{}) bool) error {
+	var opts *fastgcs.SignedURLOptions
+	if !as(&opts) {
+		return errors.New("BeforeSign.As failed")
+	}
+	return nil
+}
+
+func (verifyAs) AttributesCheck(attrs *blob.Attributes) error {
+	var oa fastgcs.ObjectAttrs
+	if !attrs.As(&oa) {
+		return errors.New("Attributes.As failed")
+	}
+	if oa.Metadata["as"] != "write" {
+		return errors.Errorf("Attributes.As got metadata %v, want what BeforeWrite set", oa.Metadata)
+	}
+	return nil
+}
+
+func (verifyAs) ReaderCheck(r *blob.Reader) error {
+	var oa fastgcs.ObjectAttrs
+	if !r.As(&oa) || oa.Generation == 0 {
+		return errors.New("Reader.As failed")
+	}
+	return nil
+}
+
+func (verifyAs) ListObjectCheck(o *blob.ListObject) error {
+	if o.IsDir {
+		// Prefixes carry no attributes.
+		return nil
+	}
+	var oa fastgcs.ObjectAttrs
+	if !o.As(&oa) || oa.Name == "" {
+		return errors.New("ListObject.As failed")
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Package faultinject provides an http.RoundTripper that injects failures
+// into requests, for exercising fastgcs's behaviour against a misbehaving
+// network or storage backend:
+//
+//	t := faultinject.New(nil, faultinject.Rule{
+//		Pattern:     regexp.MustCompile(`/o/big-object`),
+//		Probability: 0.5,
+//		Kind:        faultinject.Reset,
+//		Offset:      1 << 20,
+//	})
+//	fg, err := fastgcs.New(fastgcs.WithHTTPClient(&http.Client{Transport: t}))
+package faultinject
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Kind is the type of failure a Rule injects.
+type Kind int
+
+const (
+	// Latency delays the request by Rule.Latency before it is sent.
+	Latency Kind = iota
+	// Status answers the request with Rule.StatusCode and a short text body
+	// without contacting the backend.
+	Status
+	// Reset delivers Rule.Offset bytes of the response body and then fails
+	// the read as if the peer had reset the connection.
+	Reset
+	// Truncate delivers Rule.Offset bytes of the response body and then
+	// reports a clean EOF, as if the object were shorter than it is.
+	Truncate
+	// BadChecksum replaces the X-Goog-Hash response header with checksums
+	// that don't match the body.
+	BadChecksum
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Latency:
+		return "latency"
+	case Status:
+		return "status"
+	case Reset:
+		return "reset"
+	case Truncate:
+		return "truncate"
+	case BadChecksum:
+		return "bad-checksum"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Rule describes one failure and the requests it applies to.
+type Rule struct {
+	// Pattern is matched against the full request URL. A nil Pattern
+	// matches every request.
+	Pattern *regexp.Regexp
+	// Probability is the chance, in [0, 1], that a matching request is
+	// affected.
+	Probability float64
+	Kind        Kind
+
+	Latency    time.Duration // for Latency
+	StatusCode int           // for Status
+	Offset     int64         // for Reset and Truncate
+}
+
+// badHash is a well-formed X-Goog-Hash value that will never match a
+// non-empty body (it's the crc32c and md5 of nothing).
+const badHash = "crc32c=AAAAAA==,md5=1B2M2Y8AsgTpgAmY7PhCfg=="
+
+// Transport wraps Base, applying every Rule that matches and wins its coin
+// toss, in order. Several rules may fire for a single request; a Status rule
+// short-circuits the remaining ones.
+type Transport struct {
+	// Base performs the actual requests. If nil, http.DefaultTransport is
+	// used.
+	Base  http.RoundTripper
+	Rules []Rule
+
+	// Rand is the source for the probability checks. If nil, the
+	// math/rand top-level functions are used. Set it to get a reproducible
+	// sequence of failures.
+	Rand *rand.Rand
+
+	mu sync.Mutex
+}
+
+// New returns a Transport wrapping base with the given rules.
+func New(base http.RoundTripper, rules ...Rule) *Transport {
+	return &Transport{Base: base, Rules: rules}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var fired []Rule
+	url := req.URL.String()
+	for _, rule := range t.Rules {
+		if rule.Pattern != nil && !rule.Pattern.MatchString(url) {
+			continue
+		}
+		if !t.roll(rule.Probability) {
+			continue
+		}
+		if rule.Kind == Status {
+			return statusResponse(req, rule.StatusCode), nil
+		}
+		fired = append(fired, rule)
+	}
+
+	for _, rule := range fired {
+		if rule.Kind != Latency {
+			continue
+		}
+		select {
+		case <-time.After(rule.Latency):
+		case <-req.Context().Done():
+			closeBody(req)
+			return nil, req.Context().Err()
+		}
+	}
+
+	res, err := t.base().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range fired {
+		switch rule.Kind {
+		case Reset:
+			res.Body = &faultyBody{body: res.Body, remaining: rule.Offset, err: resetError()}
+		case Truncate:
+			res.Body = &faultyBody{body: res.Body, remaining: rule.Offset, err: io.EOF}
+		case BadChecksum:
+			res.Header.Set("X-Goog-Hash", badHash)
+		}
+	}
+	return res, nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *Transport) roll(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+	if probability >= 1 {
+		return true
+	}
+	if t.Rand == nil {
+		return rand.Float64() < probability
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Rand.Float64() < probability
+}
+
+// statusResponse answers req with code without sending it, closing its
+// body as RoundTrippers must.
+func statusResponse(req *http.Request, code int) *http.Response {
+	closeBody(req)
+	body := []byte(http.StatusText(code))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+func resetError() error {
+	return &net.OpError{
+		Op:  "read",
+		Net: "tcp",
+		Err: os.NewSyscallError("read", syscall.ECONNRESET),
+	}
+}
+
+// faultyBody passes through up to remaining bytes of body and then returns
+// err on every subsequent read.
+type faultyBody struct {
+	body      io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *faultyBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *faultyBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,200 @@
+package faultinject
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const body = "0123456789"
+
+// newBackend returns a server answering every request with body, and a
+// checksum header, counting the requests it gets.
+func newBackend(t *testing.T) (*httptest.Server, *int) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-Goog-Hash", "crc32c=good")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func get(t *testing.T, tr http.RoundTripper, url string) (*http.Response, string, error) {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	return res, string(data), err
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name         string
+		rule         Rule
+		wantStatus   int
+		wantBody     string
+		wantErr      func(error) bool
+		wantHash     string
+		wantRequests int
+	}{
+		{
+			name:       "status",
+			rule:       Rule{Probability: 1, Kind: Status, StatusCode: http.StatusServiceUnavailable},
+			wantStatus: http.StatusServiceUnavailable, wantBody: "Service Unavailable",
+		},
+		{
+			name:       "reset",
+			rule:       Rule{Probability: 1, Kind: Reset, Offset: 4},
+			wantStatus: http.StatusOK, wantBody: "0123",
+			wantErr:      func(err error) bool { return errors.Is(err, syscall.ECONNRESET) },
+			wantHash:     "crc32c=good",
+			wantRequests: 1,
+		},
+		{
+			name:       "truncate",
+			rule:       Rule{Probability: 1, Kind: Truncate, Offset: 4},
+			wantStatus: http.StatusOK, wantBody: "0123",
+			wantHash:     "crc32c=good",
+			wantRequests: 1,
+		},
+		{
+			name:       "bad checksum",
+			rule:       Rule{Probability: 1, Kind: BadChecksum},
+			wantStatus: http.StatusOK, wantBody: body,
+			wantHash:     badHash,
+			wantRequests: 1,
+		},
+		{
+			name:       "pattern not matching",
+			rule:       Rule{Pattern: regexp.MustCompile(`/other`), Probability: 1, Kind: Status, StatusCode: http.StatusNotFound},
+			wantStatus: http.StatusOK, wantBody: body,
+			wantHash:     "crc32c=good",
+			wantRequests: 1,
+		},
+		{
+			name:       "pattern matching",
+			rule:       Rule{Pattern: regexp.MustCompile(`/o/obj`), Probability: 1, Kind: Status, StatusCode: http.StatusNotFound},
+			wantStatus: http.StatusNotFound, wantBody: "Not Found",
+		},
+		{
+			name:       "never",
+			rule:       Rule{Probability: 0, Kind: Reset},
+			wantStatus: http.StatusOK, wantBody: body,
+			wantHash:     "crc32c=good",
+			wantRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		srv, requests := newBackend(t)
+		res, data, err := get(t, New(srv.Client().Transport, tt.rule), srv.URL+"/o/obj")
+		switch {
+		case tt.wantErr == nil && err != nil, tt.wantErr != nil && !tt.wantErr(err):
+			t.Errorf("%s: error %v", tt.name, err)
+		case res == nil:
+			continue
+		case res.StatusCode != tt.wantStatus || data != tt.wantBody:
+			t.Errorf("%s: %d %q, want %d %q", tt.name, res.StatusCode, data, tt.wantStatus, tt.wantBody)
+		case res.Header.Get("X-Goog-Hash") != tt.wantHash:
+			t.Errorf("%s: X-Goog-Hash %q, want %q", tt.name, res.Header.Get("X-Goog-Hash"), tt.wantHash)
+		}
+		if *requests != tt.wantRequests {
+			t.Errorf("%s: backend got %d requests, want %d", tt.name, *requests, tt.wantRequests)
+		}
+	}
+}
+
+func TestStatusShortCircuits(t *testing.T) {
+	srv, requests := newBackend(t)
+	tr := New(srv.Client().Transport,
+		Rule{Probability: 1, Kind: Latency, Latency: time.Hour},
+		Rule{Probability: 1, Kind: Status, StatusCode: http.StatusTooManyRequests},
+		Rule{Probability: 1, Kind: Reset},
+	)
+	res, _, err := get(t, tr, srv.URL)
+	if err != nil || res.StatusCode != http.StatusTooManyRequests || *requests != 0 {
+		t.Errorf("got %v, %v after %d requests, want a 429 without the latency or the backend", res, err, *requests)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	srv, _ := newBackend(t)
+	tr := New(srv.Client().Transport, Rule{Probability: 1, Kind: Latency, Latency: 50 * time.Millisecond})
+	start := time.Now()
+	if _, data, err := get(t, tr, srv.URL); err != nil || data != body {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("request took %v, want at least the latency", d)
+	}
+
+	// A cancelled request doesn't wait it out.
+	tr.Rules[0].Latency = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", srv.URL, strings.NewReader("body"))
+	body := &closeRecorder{Reader: strings.NewReader("body")}
+	req.Body = body
+	if _, err := tr.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled request: %v, want the context's error", err)
+	}
+	if !body.closed {
+		t.Error("request body of a cancelled request left open")
+	}
+}
+
+type closeRecorder struct {
+	*strings.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestProbability(t *testing.T) {
+	srv, _ := newBackend(t)
+	outcomes := func(seed int64) []int {
+		tr := New(srv.Client().Transport, Rule{Probability: 0.5, Kind: Status, StatusCode: http.StatusInternalServerError})
+		tr.Rand = rand.New(rand.NewSource(seed))
+		var codes []int
+		for i := 0; i < 200; i++ {
+			res, _, err := get(t, tr, srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			codes = append(codes, res.StatusCode)
+		}
+		return codes
+	}
+	first, again := outcomes(1), outcomes(1)
+	failed := 0
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatalf("request %d: %d, then %d with the same seed", i, first[i], again[i])
+		}
+		if first[i] == http.StatusInternalServerError {
+			failed++
+		}
+	}
+	if failed < 60 || failed > 140 {
+		t.Errorf("%d of 200 requests failed with a probability of 0.5", failed)
+	}
+}
@@ -0,0 +1,251 @@
+package fastgcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	operationPollMin = 500 * time.Millisecond
+	operationPollMax = 10 * time.Second
+)
+
+// Folder is a folder of a bucket with hierarchical namespace enabled. Unlike
+// the prefixes of a flat bucket, folders exist on their own, empty or not,
+// and can be renamed atomically.
+type Folder struct {
+	Bucket string `json:"bucket"`
+	// Name is the folder's path in the bucket, ending with "/".
+	Name           string    `json:"name"`
+	Metageneration int64     `json:"metageneration,string"`
+	CreateTime     time.Time `json:"createTime"`
+	UpdateTime     time.Time `json:"updateTime"`
+}
+
+// URL returns the gs:// URL of the folder.
+func (f *Folder) URL() string {
+	return fmt.Sprintf("gs://%s/%s", f.Bucket, f.Name)
+}
+
+// CreateFolderOptions configures CreateFolder.
+type CreateFolderOptions struct {
+	// Recursive creates missing parent folders too.
+	Recursive bool
+}
+
+// parseFolderURL is parseGSURL for folders, whose names end with "/".
+func parseFolderURL(gsURL string) (string, string, error) {
+	bucket, name, err := parseGSURL(gsURL)
+	if err != nil {
+		return "", "", err
+	}
+	if name == "" || name == "/" {
+		return "", "", errors.Errorf("%s is not a folder", gsURL)
+	}
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	return bucket, name, nil
+}
+
+func apiFolderURL(bucket, folder string) string {
+	return fmt.Sprintf("%s/b/%s/folders/%s", apiBase, url.PathEscape(bucket), url.PathEscape(folder))
+}
+
+// sendJSON sends body, if any, to url as JSON, and decodes the response
+// into v, if any.
+func (f *fastGCS) sendJSON(method, url string, body, v interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := f.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// HierarchicalNamespace reports whether bucket has hierarchical namespace
+// enabled, and so supports the folder operations.
+func (f *fastGCS) HierarchicalNamespace(bucket string) (bool, error) {
+	var res struct {
+		HierarchicalNamespace struct {
+			Enabled bool `json:"enabled"`
+		} `json:"hierarchicalNamespace"`
+	}
+	u := fmt.Sprintf("%s/b/%s?fields=hierarchicalNamespace", apiBase, url.PathEscape(bucket))
+	if err := f.getJSON(u, &res); err != nil {
+		return false, errors.Wrapf(err, "getting bucket %s", bucket)
+	}
+	return res.HierarchicalNamespace.Enabled, nil
+}
+
+// CreateFolder creates the folder at gsURL.
+func (f *fastGCS) CreateFolder(gsURL string, opts CreateFolderOptions) (*Folder, error) {
+	bucket, name, err := parseFolderURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("%s/b/%s/folders", apiBase, url.PathEscape(bucket))
+	if opts.Recursive {
+		u += "?recursive=true"
+	}
+	var folder Folder
+	if err := f.sendJSON("POST", u, map[string]string{"name": name}, &folder); err != nil {
+		return nil, errors.Wrapf(err, "creating folder %s", gsURL)
+	}
+	return &folder, nil
+}
+
+// GetFolder returns the folder at gsURL.
+func (f *fastGCS) GetFolder(gsURL string) (*Folder, error) {
+	bucket, name, err := parseFolderURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	var folder Folder
+	if err := f.getJSON(apiFolderURL(bucket, name), &folder); err != nil {
+		return nil, errors.Wrapf(err, "getting folder %s", gsURL)
+	}
+	return &folder, nil
+}
+
+// ListFolders lists every folder under the gs:// prefix, at any depth.
+func (f *fastGCS) ListFolders(gsURL string) ([]Folder, error) {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	var folders []Folder
+	q := url.Values{}
+	q.Set("prefix", prefix)
+	for {
+		var page struct {
+			Items         []Folder `json:"items"`
+			NextPageToken string   `json:"nextPageToken"`
+		}
+		u := fmt.Sprintf("%s/b/%s/folders?%s", apiBase, url.PathEscape(bucket), q.Encode())
+		if err := f.getJSON(u, &page); err != nil {
+			return nil, errors.Wrapf(err, "listing folders under %s", gsURL)
+		}
+		folders = append(folders, page.Items...)
+		if page.NextPageToken == "" {
+			return folders, nil
+		}
+		q.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// DeleteFolder deletes the folder at gsURL, which must be empty.
+func (f *fastGCS) DeleteFolder(gsURL string) error {
+	bucket, name, err := parseFolderURL(gsURL)
+	if err != nil {
+		return err
+	}
+	if err := f.sendJSON("DELETE", apiFolderURL(bucket, name), nil, nil); err != nil {
+		return errors.Wrapf(err, "deleting folder %s", gsURL)
+	}
+	return nil
+}
+
+// RenameFolder atomically renames the folder at srcURL, along with
+// everything in it, to dstURL in the same bucket, waiting for the rename to
+// complete.
+func (f *fastGCS) RenameFolder(srcURL, dstURL string) (*Folder, error) {
+	bucket, src, err := parseFolderURL(srcURL)
+	if err != nil {
+		return nil, err
+	}
+	dstBucket, dst, err := parseFolderURL(dstURL)
+	if err != nil {
+		return nil, err
+	}
+	if dstBucket != bucket {
+		return nil, errors.Errorf("can't rename %s to another bucket (%s)", srcURL, dstURL)
+	}
+
+	var op operation
+	u := apiFolderURL(bucket, src) + "/renameTo/folders/" + url.PathEscape(dst)
+	if err := f.sendJSON("POST", u, nil, &op); err != nil {
+		return nil, errors.Wrapf(err, "renaming %s to %s", srcURL, dstURL)
+	}
+	// Whatever the outcome, listings of either folder may be out of date.
+	defer f.notePrefixChange(bucket, src)
+	defer f.notePrefixChange(bucket, dst)
+
+	var folder Folder
+	if err := f.waitOperation(bucket, &op, &folder); err != nil {
+		return nil, errors.Wrapf(err, "renaming %s to %s", srcURL, dstURL)
+	}
+	return &folder, nil
+}
+
+// operation is a long-running operation of the JSON API.
+type operation struct {
+	Name  string `json:"name"`
+	Done  bool   `json:"done"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Response json.RawMessage `json:"response"`
+}
+
+// waitOperation polls op until it's done and decodes its response into v.
+// A failed operation's error, which carries a gRPC status code, is turned
+// into an *HTTPError like those of the calls themselves.
+func (f *fastGCS) waitOperation(bucket string, op *operation, v interface{}) error {
+	i := strings.LastIndex(op.Name, "/operations/")
+	if i < 0 {
+		return errors.Errorf("unexpected operation name %q", op.Name)
+	}
+	u := fmt.Sprintf("%s/b/%s/operations/%s", apiBase, url.PathEscape(bucket), url.PathEscape(op.Name[i+len("/operations/"):]))
+
+	wait := operationPollMin
+	for !op.Done {
+		sleep(wait)
+		if wait *= 2; wait > operationPollMax {
+			wait = operationPollMax
+		}
+		err := withRetries(3, func() error {
+			return f.getJSON(u, op)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if op.Error != nil {
+		status, ok := grpcStatusCodes[codes.Code(op.Error.Code)]
+		if !ok {
+			status = http.StatusInternalServerError
+		}
+		return &HTTPError{StatusCode: status, Body: op.Error.Message}
+	}
+	if v == nil || len(op.Response) == 0 {
+		return nil
+	}
+	return json.Unmarshal(op.Response, v)
+}
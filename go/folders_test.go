@@ -0,0 +1,148 @@
+package fastgcs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/fastgcs/go/jsonfake"
+)
+
+// newAPITest returns a FastGCS whose JSON API requests are served by handle
+// if it accepts them, and by a jsonfake.Server holding an empty bucket b
+// otherwise, and the server.
+func newAPITest(t *testing.T, handle func(w http.ResponseWriter, r *http.Request) bool) (*fastGCS, *jsonfake.Server) {
+	fake := jsonfake.NewServer()
+	t.Cleanup(fake.Close)
+	fake.CreateBucket("b")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !handle(w, r) {
+			fake.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client := &http.Client{Transport: &hostTransport{base: srv.Client().Transport, host: srv.Listener.Addr().String()}}
+	return newTestFastGCS(t, WithHTTPClient(client)), fake
+}
+
+// hostTransport sends every request to host.
+type hostTransport struct {
+	base http.RoundTripper
+	host string
+}
+
+func (h *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = h.host
+	return h.base.RoundTrip(req)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestRenameFolder(t *testing.T) {
+	waits := useFakeClock(t, func(int) {})
+	const opName = "projects/_/buckets/b/operations/op 1"
+	var renames, polls int
+	f, _ := newAPITest(t, func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.Method == "POST" && r.URL.EscapedPath() == "/storage/v1/b/b/folders/src%2Fdir%2F/renameTo/folders/dst%2F":
+			renames++
+			writeJSON(w, map[string]interface{}{"name": opName})
+		case r.Method == "GET" && r.URL.EscapedPath() == "/storage/v1/b/b/operations/op%201":
+			polls++
+			if polls < 3 {
+				writeJSON(w, map[string]interface{}{"name": opName, "done": false})
+				return true
+			}
+			writeJSON(w, map[string]interface{}{
+				"name":     opName,
+				"done":     true,
+				"response": map[string]interface{}{"bucket": "b", "name": "dst/", "metageneration": "1"},
+			})
+		default:
+			return false
+		}
+		return true
+	})
+
+	folder, err := f.RenameFolder("gs://b/src/dir", "gs://b/dst/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.URL() != "gs://b/dst/" || folder.Metageneration != 1 {
+		t.Errorf("renamed to %s, metageneration %d, want gs://b/dst/, 1", folder.URL(), folder.Metageneration)
+	}
+	if renames != 1 || polls != 3 {
+		t.Errorf("%d renames and %d polls, want 1 and 3", renames, polls)
+	}
+	want := []time.Duration{operationPollMin, 2 * operationPollMin, 4 * operationPollMin}
+	if got := waits(); !reflect.DeepEqual(got, want) {
+		t.Errorf("waited %v between polls, want %v", got, want)
+	}
+
+	if _, err := f.RenameFolder("gs://b/src/", "gs://c/dst/"); err == nil {
+		t.Error("rename to another bucket succeeded")
+	}
+}
+
+func TestWaitOperation(t *testing.T) {
+	useFakeClock(t, func(int) {})
+	opError := func(code int, message string) *operation {
+		op := &operation{Name: "projects/_/buckets/b/operations/op", Done: true}
+		op.Error = &struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}{code, message}
+		return op
+	}
+	tests := []struct {
+		name       string
+		op         *operation
+		wantStatus int // of the *HTTPError, or 0 for another error
+	}{
+		{"name without operations", &operation{Name: "projects/_/buckets/b/op"}, 0},
+		{"not found", opError(5, "no such folder"), http.StatusNotFound},
+		{"already exists", opError(6, "destination exists"), http.StatusConflict},
+		{"failed precondition", opError(9, "not empty"), http.StatusPreconditionFailed},
+		{"unknown code", opError(99, "odd"), http.StatusInternalServerError},
+	}
+	f, _ := newAPITest(t, func(w http.ResponseWriter, r *http.Request) bool {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		return false
+	})
+	for _, tt := range tests {
+		err := f.waitOperation("b", tt.op, nil)
+		var herr *HTTPError
+		if tt.wantStatus == 0 {
+			if err == nil || errors.As(err, &herr) {
+				t.Errorf("%s: %v, want an error of fastgcs's own", tt.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &herr) || herr.StatusCode != tt.wantStatus || herr.Body != tt.op.Error.Message {
+			t.Errorf("%s: %v, want an *HTTPError with status %d and the operation's message", tt.name, err, tt.wantStatus)
+		}
+	}
+
+	// An error may also turn up while polling.
+	f, _ = newAPITest(t, func(w http.ResponseWriter, r *http.Request) bool {
+		writeJSON(w, map[string]interface{}{
+			"name":  "projects/_/buckets/b/operations/op",
+			"done":  true,
+			"error": map[string]interface{}{"code": 7, "message": "denied"},
+		})
+		return true
+	})
+	err := f.waitOperation("b", &operation{Name: "projects/_/buckets/b/operations/op"}, nil)
+	if !IsStatus(err, http.StatusForbidden) {
+		t.Errorf("operation failing while polled: %v, want a 403", err)
+	}
+}
@@ -0,0 +1,220 @@
+package fastgcs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FS returns a read-only fs.FS over the objects under the gs:// prefix,
+// treating "/" as the directory separator. Directory reads go through the
+// listing cache (see ListDirCached) and files are served from the object cache, so the result
+// works well with fs.Glob and fs.WalkDir.
+func FS(fg FastGCS, gsURL string) (fs.FS, error) {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &gcsFS{fg: fg, bucket: bucket, prefix: prefix}, nil
+}
+
+// Glob returns the gs:// URLs of the objects matching pattern, a gs:// URL
+// whose object part uses path.Match syntax, e.g. gs://bucket/logs/*/*.json.
+func Glob(fg FastGCS, pattern string) ([]string, error) {
+	bucket, objPattern, err := parseGSURL(pattern)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err := FS(fg, "gs://"+bucket+"/")
+	if err != nil {
+		return nil, err
+	}
+	matches, err := fs.Glob(fsys, objPattern)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range matches {
+		matches[i] = "gs://" + bucket + "/" + m
+	}
+	return matches, nil
+}
+
+type gcsFS struct {
+	fg     FastGCS
+	bucket string
+	prefix string
+}
+
+func (g *gcsFS) url(name string) string {
+	if name == "." {
+		return "gs://" + g.bucket + "/" + g.prefix
+	}
+	return "gs://" + g.bucket + "/" + g.prefix + name
+}
+
+func (g *gcsFS) Open(name string) (fs.File, error) {
+	info, err := g.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &gcsDir{fsys: g, name: name, info: info}, nil
+	}
+	rc, err := g.fg.Open(g.url(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &gcsFile{ReadCloser: rc, info: info}, nil
+}
+
+func (g *gcsFS) Stat(name string) (fs.FileInfo, error) {
+	return g.stat("stat", name)
+}
+
+func (g *gcsFS) stat(op, name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return dirInfo("."), nil
+	}
+
+	dir, base := path.Split(name)
+	l, err := g.fg.ListDirCached("gs://" + g.bucket + "/" + g.prefix + dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	// A directory shadows an object of the same name, as in ReadDir.
+	for _, p := range l.Prefixes {
+		if p == l.Prefix+base+"/" {
+			return dirInfo(base), nil
+		}
+	}
+	for i := range l.Objects {
+		if l.Objects[i].Name == l.Prefix+base {
+			return &objectInfo{attrs: l.Objects[i]}, nil
+		}
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (g *gcsFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	u := g.url(name)
+	if name != "." {
+		u += "/"
+	}
+	l, err := g.fg.ListDirCached(u)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if name != "." && len(l.Objects) == 0 && len(l.Prefixes) == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	// Names that aren't valid path elements, like the directory's own
+	// placeholder object or "..", can't be opened and are left out. So is
+	// an object with the name of a directory.
+	var entries []fs.DirEntry
+	dirs := map[string]bool{}
+	for _, p := range l.Prefixes {
+		base := strings.TrimSuffix(strings.TrimPrefix(p, l.Prefix), "/")
+		if !fs.ValidPath(base) || base == "." {
+			continue
+		}
+		dirs[base] = true
+		entries = append(entries, fs.FileInfoToDirEntry(dirInfo(base)))
+	}
+	for i := range l.Objects {
+		base := strings.TrimPrefix(l.Objects[i].Name, l.Prefix)
+		if !fs.ValidPath(base) || base == "." || dirs[base] {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(&objectInfo{attrs: l.Objects[i]}))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+type gcsFile struct {
+	io.ReadCloser
+	info fs.FileInfo
+}
+
+func (f *gcsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+type gcsDir struct {
+	fsys    *gcsFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *gcsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *gcsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *gcsDir) Close() error {
+	return nil
+}
+
+func (d *gcsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type objectInfo struct {
+	attrs ObjectAttrs
+}
+
+func (i *objectInfo) Name() string       { return path.Base(i.attrs.Name) }
+func (i *objectInfo) Size() int64        { return i.attrs.Size }
+func (i *objectInfo) Mode() fs.FileMode  { return 0444 }
+func (i *objectInfo) ModTime() time.Time { return i.attrs.Updated }
+func (i *objectInfo) IsDir() bool        { return false }
+func (i *objectInfo) Sys() interface{}   { return &i.attrs }
+
+type dirInfo string
+
+func (d dirInfo) Name() string       { return string(d) }
+func (d dirInfo) Size() int64        { return 0 }
+func (d dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d dirInfo) ModTime() time.Time { return time.Time{} }
+func (d dirInfo) IsDir() bool        { return true }
+func (d dirInfo) Sys() interface{}   { return nil }
@@ -3,3 +3,19 @@ module github.com/Shopify/fastgcs/go
 go 1.17
 
 require github.com/pkg/errors v0.9.1
+
+require (
+	github.com/klauspost/compress v1.15.15
+	golang.org/x/term v0.7.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.9.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+)
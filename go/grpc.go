@@ -0,0 +1,586 @@
+package fastgcs
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/Shopify/fastgcs/go/internal/storagev2"
+)
+
+// GRPCEndpoint is the address of the GCS gRPC API.
+const GRPCEndpoint = "storage.googleapis.com:443"
+
+// WithGRPC makes Open, Copy, Read, Create and Upload move object content
+// through the gRPC storage API over conn, rather than the JSON API: reads
+// stream from ReadObject, and writes are resumable writes streamed to
+// BidiWriteObject, which are flushed as they go and resumed where GCS
+// persisted them if a stream breaks. Every chunk is sent and checked against
+// its crc32c, and whole objects against their crc32c and MD5.
+//
+// Metadata calls, listings, Stream and multipart uploads still go through
+// the JSON and XML APIs. conn is typically made by DialGRPC, or connected to
+// a grpcfake.Server in tests.
+func WithGRPC(conn grpc.ClientConnInterface) Option {
+	return func(f *fastGCS) {
+		f.grpc = conn
+	}
+}
+
+// DialGRPC connects to the GCS gRPC API.
+func DialGRPC() (*grpc.ClientConn, error) {
+	return grpc.Dial(GRPCEndpoint,
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})),
+		// Content is chunked to 2MiB, plus a little room for the rest of
+		// the message.
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(storagev2.MaxChunkBytes+1<<20)),
+	)
+}
+
+var grpcCodec = grpc.ForceCodec(storagev2.Codec{})
+
+// grpcContext returns a context carrying the credentials and routing
+// header of a call on bucket.
+func (f *fastGCS) grpcContext(ctx context.Context, bucket string) (context.Context, error) {
+	if err := f.ensureCurrentToken(); err != nil {
+		return nil, err
+	}
+	f.tokenMu.Lock()
+	tok := f.token.Token
+	f.tokenMu.Unlock()
+	return metadata.AppendToOutgoingContext(ctx,
+		"authorization", "Bearer "+tok,
+		"x-goog-request-params", "bucket="+url.QueryEscape(storagev2.BucketName(bucket)),
+	), nil
+}
+
+// grpcStatusCodes maps gRPC status codes to the HTTP statuses the JSON API
+// answers with in the same situations, so that IsStatus and retries work
+// the same with either transport.
+var grpcStatusCodes = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.FailedPrecondition: http.StatusPreconditionFailed,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+// grpcError turns a gRPC status error into an *HTTPError.
+func grpcError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	if code, ok := grpcStatusCodes[st.Code()]; ok {
+		return &HTTPError{StatusCode: code, Body: st.Message()}
+	}
+	return err
+}
+
+func crc32cPtr(v uint32) *uint32 {
+	return &v
+}
+
+// grpcFetch downloads the live generation of an object to w through
+// ReadObject. If cached still holds that generation, it returns
+// errNotModified instead.
+func (f *fastGCS) grpcFetch(ctx context.Context, gsURL, bucket, object string, cached *cacheMeta, w io.Writer) (*cacheMeta, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx, err := f.grpcContext(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := f.grpc.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, storagev2.ReadObjectMethod, grpcCodec)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	req := &storagev2.ReadObjectRequest{
+		Bucket: storagev2.BucketName(bucket),
+		Object: object,
+	}
+	if cached != nil && cached.Generation != 0 {
+		req.IfGenerationNotMatch = &cached.Generation
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, grpcError(err)
+	}
+
+	r := &grpcObjectReader{stream: stream, crc: crc32.New(castagnoli), md5: md5.New()}
+	if err := r.start(); err != nil {
+		if req.IfGenerationNotMatch != nil && IsStatus(err, http.StatusPreconditionFailed) {
+			return nil, errNotModified
+		}
+		return nil, err
+	}
+
+	// Like the XML and JSON APIs when asked for gzip, ReadObject sends the
+	// bytes as stored.
+	if r.attrs.ContentEncoding == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding gzip content")
+		}
+		if _, err := io.Copy(w, zr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return nil, err
+		}
+	} else if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+
+	meta := &cacheMeta{
+		URL:             gsURL,
+		ETag:            r.attrs.ETag,
+		Generation:      r.attrs.Generation,
+		ContentEncoding: r.attrs.ContentEncoding,
+		Fetched:         time.Now().UTC(),
+		ContentType:     r.attrs.ContentType,
+		Size:            r.attrs.Size,
+		Metageneration:  r.attrs.Metageneration,
+		Updated:         r.attrs.UpdateTime,
+		Metadata:        r.attrs.Metadata,
+	}
+	meta.CRC32C, meta.MD5Hash = checksumStrings(r.sums)
+	return meta, nil
+}
+
+// grpcObjectReader reads the content of a ReadObject stream, verifying each
+// chunk as it arrives and the whole object at the end.
+type grpcObjectReader struct {
+	stream grpc.ClientStream
+	attrs  *storagev2.Object
+	sums   *storagev2.ObjectChecksums
+	buf    []byte
+	crc    hash.Hash32
+	md5    hash.Hash
+	err    error
+}
+
+// start receives the first message, which carries the object's metadata.
+func (r *grpcObjectReader) start() error {
+	if err := r.recv(); err != nil {
+		if err == io.EOF {
+			err = errors.New("ReadObject sent no metadata")
+		}
+		return err
+	}
+	if r.attrs == nil {
+		return errors.New("ReadObject sent no metadata")
+	}
+	if r.sums == nil {
+		r.sums = r.attrs.Checksums
+	}
+	return nil
+}
+
+func (r *grpcObjectReader) recv() error {
+	var res storagev2.ReadObjectResponse
+	if err := r.stream.RecvMsg(&res); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return grpcError(err)
+	}
+	if res.Metadata != nil {
+		r.attrs = res.Metadata
+	}
+	if res.ObjectChecksums != nil {
+		r.sums = res.ObjectChecksums
+	}
+	if d := res.ChecksummedData; d != nil {
+		if d.CRC32C != nil {
+			if got := crc32.Checksum(d.Content, castagnoli); got != *d.CRC32C {
+				return errors.Errorf("chunk crc32c mismatch: got %08x, want %08x", got, *d.CRC32C)
+			}
+		}
+		r.crc.Write(d.Content)
+		r.md5.Write(d.Content)
+		r.buf = d.Content
+	}
+	return nil
+}
+
+func (r *grpcObjectReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if err := r.recv(); err != nil {
+			if err == io.EOF {
+				err = r.verify()
+			}
+			r.err = err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// verify checks the content against the object's checksums. It returns
+// io.EOF if they match.
+func (r *grpcObjectReader) verify() error {
+	if r.sums == nil {
+		return io.EOF
+	}
+	if want := r.sums.CRC32C; want != nil {
+		if got := r.crc.Sum32(); got != *want {
+			return errors.Errorf("crc32c mismatch: got %08x, want %08x", got, *want)
+		}
+	}
+	if want := r.sums.MD5Hash; len(want) > 0 {
+		if got := r.md5.Sum(nil); string(got) != string(want) {
+			return errors.Errorf("md5 mismatch: got %x, want %x", got, want)
+		}
+	}
+	return io.EOF
+}
+
+const (
+	// grpcFlushBytes is how much content is sent between flushes. What GCS
+	// hasn't reported persisted is held in memory, to be sent again on a new
+	// stream if the one carrying it breaks.
+	grpcFlushBytes = 8 * storagev2.MaxChunkBytes
+	// grpcWriteAttempts is the number of times a write is tried on a new
+	// stream before giving up.
+	grpcWriteAttempts = 5
+)
+
+// grpcUpload is the uploader that streams content to a resumable write
+// through BidiWriteObject, in chunks of storagev2.MaxChunkBytes. It flushes
+// every grpcFlushBytes, and resumes from the persisted size on a new stream
+// if a stream fails with a retryable error.
+type grpcUpload struct {
+	f        *fastGCS
+	bucket   string
+	uploadID string
+
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	// opened is whether the first message of stream, which names the
+	// upload, was sent.
+	opened bool
+
+	// pending holds the content from offset persisted on, of which the
+	// content up to offset sent was sent on stream.
+	pending   []byte
+	persisted int64
+	sent      int64
+	crc       hash.Hash32
+	md5       hash.Hash
+	attrs     *ObjectAttrs
+	err       error
+}
+
+func (f *fastGCS) startGRPCUpload(bucket, object string, opts WriteOptions) (*grpcUpload, error) {
+	resource := &storagev2.Object{
+		Name:               object,
+		Bucket:             storagev2.BucketName(bucket),
+		ContentType:        opts.ContentType,
+		ContentEncoding:    opts.contentEncoding(),
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		ContentLanguage:    opts.ContentLanguage,
+		Metadata:           opts.Metadata,
+	}
+	req := &storagev2.StartResumableWriteRequest{
+		WriteObjectSpec: &storagev2.WriteObjectSpec{Resource: resource, IfGenerationMatch: opts.IfGenerationMatch},
+	}
+	var res storagev2.StartResumableWriteResponse
+	err := withRetries(grpcWriteAttempts, func() error {
+		ctx, err := f.grpcContext(context.Background(), bucket)
+		if err != nil {
+			return err
+		}
+		return grpcError(f.grpc.Invoke(ctx, storagev2.StartResumableWriteMethod, req, &res, grpcCodec))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &grpcUpload{
+		f:        f,
+		bucket:   bucket,
+		uploadID: res.UploadID,
+		pending:  make([]byte, 0, grpcFlushBytes+storagev2.MaxChunkBytes),
+		crc:      crc32.New(castagnoli),
+		md5:      md5.New(),
+	}, nil
+}
+
+func (u *grpcUpload) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if u.err != nil {
+			return written, u.err
+		}
+		n := len(p)
+		if n > storagev2.MaxChunkBytes {
+			n = storagev2.MaxChunkBytes
+		}
+		u.pending = append(u.pending, p[:n]...)
+		u.crc.Write(p[:n])
+		u.md5.Write(p[:n])
+		p = p[n:]
+		written += n
+		if u.unsent() >= storagev2.MaxChunkBytes {
+			u.err = u.push(false)
+		}
+	}
+	return written, u.err
+}
+
+// unsent returns the number of bytes pending but not sent.
+func (u *grpcUpload) unsent() int {
+	return len(u.pending) - int(u.sent-u.persisted)
+}
+
+// push sends the pending content in full chunks, or all of it and finishes
+// the write if finish is set, moving to a new stream as needed.
+func (u *grpcUpload) push(finish bool) error {
+	return withRetries(grpcWriteAttempts, func() error {
+		if u.stream == nil {
+			if err := u.connect(); err != nil {
+				return err
+			}
+		}
+		if u.attrs != nil {
+			// The write was finished before the last stream broke.
+			return nil
+		}
+		err := u.send(finish)
+		if err != nil {
+			u.cancel()
+			u.stream = nil
+		}
+		return err
+	})
+}
+
+// connect opens a new stream for the upload. If there was a stream before,
+// it asks how much of the content sent GCS persisted, to send the rest
+// again, or whether the write was finished.
+func (u *grpcUpload) connect() error {
+	resuming := u.cancel != nil
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, err := u.f.grpcContext(ctx, u.bucket)
+	if err != nil {
+		cancel()
+		return err
+	}
+	stream, err := u.f.grpc.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, storagev2.BidiWriteObjectMethod, grpcCodec)
+	if err != nil {
+		cancel()
+		return grpcError(err)
+	}
+	u.stream, u.cancel, u.opened = stream, cancel, false
+	if !resuming {
+		return nil
+	}
+
+	if err := u.stream.SendMsg(&storagev2.BidiWriteObjectRequest{UploadID: u.uploadID, StateLookup: true}); err != nil {
+		err = u.failure(err)
+	} else {
+		u.opened = true
+		err = u.receive()
+	}
+	if err != nil {
+		cancel()
+		u.stream = nil
+		return err
+	}
+	u.sent = u.persisted
+	return nil
+}
+
+// send sends the pending content on the current stream.
+func (u *grpcUpload) send(finish bool) error {
+	for {
+		n := u.unsent()
+		if n > storagev2.MaxChunkBytes {
+			n = storagev2.MaxChunkBytes
+		}
+		last := finish && n == u.unsent()
+		if !last && n < storagev2.MaxChunkBytes {
+			return nil
+		}
+
+		req := &storagev2.BidiWriteObjectRequest{
+			WriteOffset: u.sent,
+			FinishWrite: last,
+		}
+		if !u.opened {
+			req.UploadID = u.uploadID
+		}
+		if n > 0 {
+			chunk := u.pending[u.sent-u.persisted:][:n]
+			req.ChecksummedData = &storagev2.ChecksummedData{
+				Content: chunk,
+				CRC32C:  crc32cPtr(crc32.Checksum(chunk, castagnoli)),
+			}
+		}
+		flush := !last && u.sent+int64(n)-u.persisted >= grpcFlushBytes
+		if flush {
+			req.Flush, req.StateLookup = true, true
+		}
+		if last {
+			req.ObjectChecksums = &storagev2.ObjectChecksums{
+				CRC32C:  crc32cPtr(u.crc.Sum32()),
+				MD5Hash: u.md5.Sum(nil),
+			}
+		}
+		if err := u.stream.SendMsg(req); err != nil {
+			return u.failure(err)
+		}
+		u.opened = true
+		u.sent += int64(n)
+
+		if last {
+			if err := u.stream.CloseSend(); err != nil {
+				return grpcError(err)
+			}
+			if err := u.receive(); err != nil {
+				return err
+			}
+			if u.attrs == nil {
+				return errors.New("BidiWriteObject didn't return the created object")
+			}
+			return nil
+		}
+		if flush {
+			if err := u.receive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receive receives the response to a state lookup or to the end of the
+// write, and drops the content GCS reports persisted.
+func (u *grpcUpload) receive() error {
+	var res storagev2.BidiWriteObjectResponse
+	if err := u.stream.RecvMsg(&res); err != nil {
+		if err == io.EOF {
+			return errors.New("BidiWriteObject ended early")
+		}
+		return grpcError(err)
+	}
+	if res.Resource != nil {
+		u.attrs = objectAttrsFromGRPC(res.Resource)
+		return nil
+	}
+	size := res.PersistedSize
+	if size < u.persisted || size > u.sent {
+		return errors.Errorf("BidiWriteObject persisted %d bytes, of %d sent and %d persisted before", size, u.sent, u.persisted)
+	}
+	u.pending = append(u.pending[:0], u.pending[size-u.persisted:]...)
+	u.persisted = size
+	return nil
+}
+
+// failure returns the status the call ended with, which explains why
+// SendMsg failed.
+func (u *grpcUpload) failure(err error) error {
+	if err == io.EOF {
+		err = u.stream.RecvMsg(&storagev2.BidiWriteObjectResponse{})
+		if err == nil {
+			err = errors.New("BidiWriteObject ended early")
+		}
+	}
+	return grpcError(err)
+}
+
+func (u *grpcUpload) finish() (*ObjectAttrs, error) {
+	if u.err != nil {
+		u.abort()
+		return nil, u.err
+	}
+	err := u.push(true)
+	if u.cancel != nil {
+		u.cancel()
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.f.noteWrite(u.attrs)
+	return u.attrs, nil
+}
+
+func (u *grpcUpload) abort() {
+	if u.cancel != nil {
+		u.cancel()
+	}
+	// Cancelling the upload before it's finished leaves the object
+	// untouched, and frees what was persisted. If the upload can't be
+	// cancelled now, it expires in a week.
+	ctx, err := u.f.grpcContext(context.Background(), u.bucket)
+	if err != nil {
+		return
+	}
+	req := &storagev2.CancelResumableWriteRequest{UploadID: u.uploadID}
+	u.f.grpc.Invoke(ctx, storagev2.CancelResumableWriteMethod, req, &storagev2.CancelResumableWriteResponse{}, grpcCodec)
+}
+
+func objectAttrsFromGRPC(o *storagev2.Object) *ObjectAttrs {
+	attrs := &ObjectAttrs{
+		Bucket:          storagev2.BucketID(o.Bucket),
+		Name:            o.Name,
+		Size:            o.Size,
+		Generation:      o.Generation,
+		Metageneration:  o.Metageneration,
+		ContentType:     o.ContentType,
+		ContentEncoding: o.ContentEncoding,
+		ETag:            o.ETag,
+		Updated:         o.UpdateTime,
+		Metadata:        o.Metadata,
+
+		CacheControl:       o.CacheControl,
+		ContentDisposition: o.ContentDisposition,
+		ContentLanguage:    o.ContentLanguage,
+	}
+	attrs.CRC32C, attrs.MD5Hash = checksumStrings(o.Checksums)
+	return attrs
+}
+
+// checksumStrings encodes sums as the JSON API does.
+func checksumStrings(sums *storagev2.ObjectChecksums) (crc32c, md5Hash string) {
+	if sums == nil {
+		return "", ""
+	}
+	if sums.CRC32C != nil {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], *sums.CRC32C)
+		crc32c = base64.StdEncoding.EncodeToString(b[:])
+	}
+	if len(sums.MD5Hash) > 0 {
+		md5Hash = base64.StdEncoding.EncodeToString(sums.MD5Hash)
+	}
+	return crc32c, md5Hash
+}
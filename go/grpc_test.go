@@ -0,0 +1,229 @@
+package fastgcs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+
+	"github.com/Shopify/fastgcs/go/grpcfake"
+	"github.com/Shopify/fastgcs/go/internal/storagev2"
+)
+
+func newGRPCTest(t *testing.T) (*fastGCS, *grpcfake.Server) {
+	srv := grpcfake.NewServer()
+	t.Cleanup(srv.Close)
+	conn, err := srv.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newTestFastGCS(t, WithGRPC(conn)), srv
+}
+
+// randomContent returns n bytes that don't compress.
+func randomContent(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestGRPCRead(t *testing.T) {
+	f, srv := newGRPCTest(t)
+	big := randomContent(2*storagev2.MaxChunkBytes + 3)
+	srv.Put("b", "big", big)
+	srv.Put("b", "empty", nil)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("hello"))
+	zw.Close()
+	srv.PutEncoded("b", "hello.txt", gz.Bytes(), "gzip")
+
+	tests := []struct {
+		url  string
+		want []byte
+	}{
+		{"gs://b/big", big},
+		{"gs://b/empty", []byte{}},
+		{"gs://b/hello.txt", []byte("hello")},
+	}
+	for _, tt := range tests {
+		for _, pass := range []string{"fetch", "revalidate"} {
+			got, err := f.Read(tt.url)
+			if err != nil {
+				t.Fatalf("%s: Read(%s): %v", pass, tt.url, err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("%s: Read(%s) = %d bytes, want %d", pass, tt.url, len(got), len(tt.want))
+			}
+		}
+	}
+
+	if _, err := f.Read("gs://b/missing"); !IsStatus(err, http.StatusNotFound) {
+		t.Errorf("Read of a missing object: %v, want a 404", err)
+	}
+}
+
+func TestGRPCReadSeesNewGeneration(t *testing.T) {
+	f, srv := newGRPCTest(t)
+	srv.Put("b", "o", []byte("one"))
+	if _, err := f.Read("gs://b/o"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Put("b", "o", []byte("two"))
+	got, err := f.Read("gs://b/o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "two" {
+		t.Errorf("Read after an overwrite = %q, want %q", got, "two")
+	}
+}
+
+func TestGRPCWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		breaks []int
+	}{
+		{"empty", 0, nil},
+		{"one chunk", 100, nil},
+		{"several flushes", 2*grpcFlushBytes + 5, nil},
+		{"broken before the first flush", grpcFlushBytes + 5, []int{3}},
+		{"broken after a flush", 2*grpcFlushBytes + 5, []int{grpcFlushBytes/storagev2.MaxChunkBytes + 1}},
+		{"broken twice on the first chunk", 3 * storagev2.MaxChunkBytes, []int{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, srv := newGRPCTest(t)
+			srv.BreakWrites(tt.breaks...)
+			data := randomContent(tt.size)
+
+			w, err := f.Create("gs://b/o", WriteOptions{Metadata: map[string]string{"k": "v"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Odd-sized writes, so chunks straddle them.
+			for rest := data; len(rest) > 0; {
+				n := 1<<20 + 7
+				if n > len(rest) {
+					n = len(rest)
+				}
+				if _, err := w.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+			// Only what GCS hasn't reported persisted is held.
+			if n := len(w.upload.(*grpcUpload).pending); n > grpcFlushBytes+storagev2.MaxChunkBytes {
+				t.Errorf("holding %d bytes before Close", n)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, ok := srv.Get("b", "o")
+			if !ok || !bytes.Equal(got, data) {
+				t.Errorf("stored %d bytes, want %d", len(got), len(data))
+			}
+			attrs := w.Attrs()
+			if attrs.Bucket != "b" || attrs.Name != "o" || attrs.Size != int64(len(data)) || attrs.Metadata["k"] != "v" {
+				t.Errorf("Attrs() = %+v", attrs)
+			}
+			if n := srv.Uploads(); n != 0 {
+				t.Errorf("%d uploads left unfinished", n)
+			}
+		})
+	}
+}
+
+func TestGRPCWriteGzip(t *testing.T) {
+	f, _ := newGRPCTest(t)
+	w, err := f.Create("gs://b/o.txt", WriteOptions{Gzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("compressed"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if enc := w.Attrs().ContentEncoding; enc != "gzip" {
+		t.Errorf("ContentEncoding = %q, want gzip", enc)
+	}
+	got, err := f.Read("gs://b/o.txt")
+	if err != nil || string(got) != "compressed" {
+		t.Errorf("Read = %q, %v", got, err)
+	}
+}
+
+func TestGRPCWritePrecondition(t *testing.T) {
+	f, srv := newGRPCTest(t)
+	srv.Put("b", "o", []byte("existing"))
+	zero := int64(0)
+	w, err := f.Create("gs://b/o", WriteOptions{IfGenerationMatch: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new"))
+	if err := w.Close(); !IsStatus(err, http.StatusPreconditionFailed) {
+		t.Errorf("Close: %v, want a 412", err)
+	}
+	if got, _ := srv.Get("b", "o"); string(got) != "existing" {
+		t.Errorf("object overwritten with %q", got)
+	}
+}
+
+func TestGRPCWriteAbort(t *testing.T) {
+	f, srv := newGRPCTest(t)
+	w, err := f.Create("gs://b/o", WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(randomContent(storagev2.MaxChunkBytes + 1))
+	w.Abort()
+	if _, ok := srv.Get("b", "o"); ok {
+		t.Error("aborted write created the object")
+	}
+	if n := srv.Uploads(); n != 0 {
+		t.Errorf("%d uploads left after Abort", n)
+	}
+}
+
+func TestGRPCUploadFile(t *testing.T) {
+	f, srv := newGRPCTest(t)
+	data := randomContent(storagev2.MaxChunkBytes + 10)
+	path := t.TempDir() + "/file"
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Upload(path, "gs://b/file", WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.Get("b", "file"); !bytes.Equal(got, data) {
+		t.Errorf("stored %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestGRPCOpenWithAttrs(t *testing.T) {
+	f, srv := newGRPCTest(t)
+	for i, content := range []string{"first", "second generation"} {
+		gen := srv.Put("b", "o", []byte(content))
+		rc, attrs, err := f.OpenWithAttrs("gs://b/o")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("%d: content %q, want %q", i, got, content)
+		}
+		if attrs.Generation != gen || attrs.Size != int64(len(content)) || attrs.Bucket != "b" || attrs.Name != "o" || attrs.Updated.IsZero() {
+			t.Errorf("%d: attrs %+v, want generation %d of %d bytes", i, attrs, gen, len(content))
+		}
+	}
+}
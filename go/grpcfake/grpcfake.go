@@ -0,0 +1,358 @@
+// Package grpcfake is an in-process stand-in for the ReadObject call and
+// the resumable writes of the GCS gRPC API, holding objects in memory. It
+// checks checksums, offsets and preconditions the way GCS does, and can
+// break write streams, so fastgcs's gRPC transport can be exercised without
+// a network:
+//
+//	srv := grpcfake.NewServer()
+//	defer srv.Close()
+//	srv.Put("bucket", "object", []byte("hello"))
+//	conn, err := srv.Dial()
+//	fg, err := fastgcs.New(fastgcs.WithGRPC(conn))
+package grpcfake
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Shopify/fastgcs/go/internal/storagev2"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Server serves the stand-in over an in-memory listener.
+type Server struct {
+	lis *bufconn.Listener
+	srv *grpc.Server
+
+	mu         sync.Mutex
+	objects    map[string]*storagev2.Object
+	content    map[string][]byte
+	nextGen    int64
+	uploads    map[string]*upload
+	nextUpload int
+	breaks     []int
+}
+
+// upload is a resumable write. Content is persisted when the client
+// flushes or finishes the write; content received on a stream after its
+// last flush is lost if the stream breaks.
+type upload struct {
+	spec      *storagev2.WriteObjectSpec
+	persisted []byte
+	object    *storagev2.Object
+}
+
+// NewServer starts a Server with no objects.
+func NewServer() *Server {
+	s := &Server{
+		lis:     bufconn.Listen(4 << 20),
+		srv:     grpc.NewServer(grpc.ForceServerCodec(storagev2.Codec{})),
+		objects: map[string]*storagev2.Object{},
+		content: map[string][]byte{},
+		nextGen: time.Now().UnixNano() / 1000,
+		uploads: map[string]*upload{},
+	}
+	s.srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: storagev2.ServiceName,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{MethodName: "StartResumableWrite", Handler: s.startResumableWrite},
+			{MethodName: "CancelResumableWrite", Handler: s.cancelResumableWrite},
+		},
+		Streams: []grpc.StreamDesc{
+			{StreamName: "ReadObject", Handler: s.readObject, ServerStreams: true},
+			{StreamName: "BidiWriteObject", Handler: s.bidiWriteObject, ClientStreams: true, ServerStreams: true},
+		},
+		Metadata: "google/storage/v2/storage.proto",
+	}, s)
+	go s.srv.Serve(s.lis)
+	return s
+}
+
+// Dial connects to the server.
+func (s *Server) Dial() (*grpc.ClientConn, error) {
+	return grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return s.lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Stop()
+}
+
+func key(bucket, name string) string {
+	return bucket + "/" + name
+}
+
+// Put stores an object and returns its generation.
+func (s *Server) Put(bucket, name string, data []byte) int64 {
+	return s.PutEncoded(bucket, name, data, "")
+}
+
+// PutEncoded is Put for content stored with a Content-Encoding, such as
+// gzip.
+func (s *Server) PutEncoded(bucket, name string, data []byte, contentEncoding string) int64 {
+	obj, _ := s.store(&storagev2.Object{
+		Name:            name,
+		Bucket:          storagev2.BucketName(bucket),
+		ContentEncoding: contentEncoding,
+	}, data, nil)
+	return obj.Generation
+}
+
+// Get returns the content of an object.
+func (s *Server) Get(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.content[key(bucket, name)]
+	return data, ok
+}
+
+// BreakWrites makes the next BidiWriteObject streams fail, one for each
+// argument, with codes.Unavailable once they've received the given number of
+// chunks of content.
+func (s *Server) BreakWrites(chunks ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.breaks = append(s.breaks, chunks...)
+}
+
+// Uploads returns the number of resumable writes neither finished nor
+// cancelled.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, up := range s.uploads {
+		if up.object == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// store creates a new generation of an object from resource and data,
+// unless ifGenerationMatch is set and isn't the live generation.
+func (s *Server) store(resource *storagev2.Object, data []byte, ifGenerationMatch *int64) (*storagev2.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.storeLocked(resource, data, ifGenerationMatch)
+}
+
+func (s *Server) storeLocked(resource *storagev2.Object, data []byte, ifGenerationMatch *int64) (*storagev2.Object, error) {
+	k := key(storagev2.BucketID(resource.Bucket), resource.Name)
+	if ifGenerationMatch != nil {
+		var gen int64
+		if obj := s.objects[k]; obj != nil {
+			gen = obj.Generation
+		}
+		if gen != *ifGenerationMatch {
+			return nil, status.Error(codes.FailedPrecondition, "ifGenerationMatch")
+		}
+	}
+	s.nextGen++
+	sum := md5.Sum(data)
+	crc := crc32.Checksum(data, castagnoli)
+	obj := *resource
+	obj.Generation = s.nextGen
+	obj.Metageneration = 1
+	obj.Size = int64(len(data))
+	obj.ETag = strconv.FormatInt(s.nextGen, 36)
+	obj.UpdateTime = time.Now().UTC()
+	obj.Checksums = &storagev2.ObjectChecksums{CRC32C: &crc, MD5Hash: sum[:]}
+	s.objects[k] = &obj
+	s.content[k] = append([]byte(nil), data...)
+	return &obj, nil
+}
+
+func (s *Server) lookup(bucket, name string) (*storagev2.Object, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(storagev2.BucketID(bucket), name)
+	return s.objects[k], s.content[k]
+}
+
+func (s *Server) readObject(_ interface{}, stream grpc.ServerStream) error {
+	var req storagev2.ReadObjectRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	obj, data := s.lookup(req.Bucket, req.Object)
+	if obj == nil || (req.Generation != 0 && req.Generation != obj.Generation) {
+		return status.Errorf(codes.NotFound, "No such object: %s/%s", storagev2.BucketID(req.Bucket), req.Object)
+	}
+	if req.IfGenerationNotMatch != nil && *req.IfGenerationNotMatch == obj.Generation {
+		return status.Error(codes.FailedPrecondition, "ifGenerationNotMatch")
+	}
+
+	// The first message carries the metadata, even for an empty object.
+	res := &storagev2.ReadObjectResponse{Metadata: obj, ObjectChecksums: obj.Checksums}
+	for first := true; first || len(data) > 0; first = false {
+		n := len(data)
+		if n > storagev2.MaxChunkBytes {
+			n = storagev2.MaxChunkBytes
+		}
+		if n > 0 {
+			crc := crc32.Checksum(data[:n], castagnoli)
+			res.ChecksummedData = &storagev2.ChecksummedData{Content: data[:n], CRC32C: &crc}
+		}
+		if err := stream.SendMsg(res); err != nil {
+			return err
+		}
+		data = data[n:]
+		res = &storagev2.ReadObjectResponse{}
+	}
+	return nil
+}
+
+func (s *Server) startResumableWrite(_ interface{}, _ context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req storagev2.StartResumableWriteRequest
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	if req.WriteObjectSpec == nil || req.WriteObjectSpec.Resource == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing write_object_spec")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextUpload++
+	id := fmt.Sprintf("upload-%d", s.nextUpload)
+	s.uploads[id] = &upload{spec: req.WriteObjectSpec}
+	return &storagev2.StartResumableWriteResponse{UploadID: id}, nil
+}
+
+func (s *Server) cancelResumableWrite(_ interface{}, _ context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req storagev2.CancelResumableWriteRequest
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	up := s.uploads[req.UploadID]
+	if up == nil || up.object != nil {
+		return nil, status.Errorf(codes.NotFound, "no upload %s", req.UploadID)
+	}
+	delete(s.uploads, req.UploadID)
+	return &storagev2.CancelResumableWriteResponse{}, nil
+}
+
+func (s *Server) bidiWriteObject(_ interface{}, stream grpc.ServerStream) error {
+	s.mu.Lock()
+	breakAfter := -1
+	if len(s.breaks) > 0 {
+		breakAfter, s.breaks = s.breaks[0], s.breaks[1:]
+	}
+	s.mu.Unlock()
+
+	var (
+		up       *upload
+		received []byte
+		chunks   int
+	)
+	for {
+		var req storagev2.BidiWriteObjectRequest
+		if err := stream.RecvMsg(&req); err != nil {
+			if err == io.EOF {
+				return status.Error(codes.InvalidArgument, "stream ended without finish_write")
+			}
+			return err
+		}
+		if up == nil {
+			s.mu.Lock()
+			up = s.uploads[req.UploadID]
+			s.mu.Unlock()
+			if up == nil {
+				return status.Errorf(codes.NotFound, "no upload %q", req.UploadID)
+			}
+		}
+		if req.ChecksummedData != nil {
+			if chunks == breakAfter {
+				return status.Error(codes.Unavailable, "stream broken")
+			}
+			chunks++
+		}
+		res, err := s.write(up, &received, &req)
+		if err != nil {
+			return err
+		}
+		if res != nil {
+			if err := stream.SendMsg(res); err != nil {
+				return err
+			}
+			if res.Resource != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// write applies a message of a BidiWriteObject stream to up, given the
+// content received on the stream since its last flush, and returns the
+// response to send, if any.
+func (s *Server) write(up *upload, received *[]byte, req *storagev2.BidiWriteObjectRequest) (*storagev2.BidiWriteObjectResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if up.object != nil {
+		// The write was finished on an earlier stream.
+		return &storagev2.BidiWriteObjectResponse{Resource: up.object}, nil
+	}
+	offset := int64(len(up.persisted) + len(*received))
+	if d := req.ChecksummedData; d != nil || req.FinishWrite {
+		if req.WriteOffset != offset {
+			return nil, status.Errorf(codes.InvalidArgument, "write_offset %d, want %d", req.WriteOffset, offset)
+		}
+	}
+	if d := req.ChecksummedData; d != nil {
+		if len(d.Content) > storagev2.MaxChunkBytes {
+			return nil, status.Errorf(codes.InvalidArgument, "chunk of %d bytes exceeds the maximum", len(d.Content))
+		}
+		if d.CRC32C != nil && crc32.Checksum(d.Content, castagnoli) != *d.CRC32C {
+			return nil, status.Error(codes.InvalidArgument, "chunk crc32c mismatch")
+		}
+		*received = append(*received, d.Content...)
+	}
+	if req.Flush || req.FinishWrite {
+		up.persisted = append(up.persisted, *received...)
+		*received = nil
+	}
+	if sums := req.ObjectChecksums; sums != nil {
+		if sums.CRC32C != nil && crc32.Checksum(up.persisted, castagnoli) != *sums.CRC32C {
+			return nil, status.Error(codes.InvalidArgument, "object crc32c mismatch")
+		}
+		if len(sums.MD5Hash) > 0 {
+			if sum := md5.Sum(up.persisted); string(sum[:]) != string(sums.MD5Hash) {
+				return nil, status.Error(codes.InvalidArgument, "object md5 mismatch")
+			}
+		}
+	}
+	if req.FinishWrite {
+		obj, err := s.storeLocked(up.spec.Resource, up.persisted, up.spec.IfGenerationMatch)
+		if err != nil {
+			return nil, err
+		}
+		up.object, up.persisted = obj, nil
+		return &storagev2.BidiWriteObjectResponse{Resource: obj}, nil
+	}
+	if req.StateLookup {
+		return &storagev2.BidiWriteObjectResponse{PersistedSize: int64(len(up.persisted))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,226 @@
+package fastgcs
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHotTierMaxBytes      = 64 << 20
+	defaultHotTierMaxObjectSize = 1 << 20
+
+	// hotEntryOverhead approximates what an entry costs besides its
+	// content, URL and hashes: the map and list bookkeeping and the
+	// fixed-size fields.
+	hotEntryOverhead = 256
+)
+
+// HotTierOptions configures the in-memory tier installed by WithHotTier.
+type HotTierOptions struct {
+	// MaxBytes bounds the memory held by the tier, counting each object's
+	// content along with its URL, hashes and bookkeeping. The least
+	// recently read objects are evicted first. Defaults to 64MiB.
+	MaxBytes int64
+	// MaxObjectSize is the size above which objects are left to the disk
+	// cache. Defaults to 1MiB.
+	MaxObjectSize int64
+	// MaxAge is how long an object is served from memory before GCS is
+	// asked again whether it's still current. Zero asks on every read, as
+	// the disk cache does, which saves the disk read but not the round
+	// trip.
+	MaxAge time.Duration
+}
+
+// WithHotTier keeps small objects read through Read and Open in memory, in
+// front of the disk cache. Writes and deletes made through this FastGCS
+// evict the objects they change; changes made elsewhere are seen once the
+// copy in memory is revalidated, after opts.MaxAge.
+func WithHotTier(opts HotTierOptions) Option {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultHotTierMaxBytes
+	}
+	if opts.MaxObjectSize <= 0 {
+		opts.MaxObjectSize = defaultHotTierMaxObjectSize
+	}
+	return func(f *fastGCS) {
+		f.hot = &hotTier{
+			opts:    opts,
+			entries: map[string]*list.Element{},
+			lru:     list.New(),
+		}
+	}
+}
+
+// hotTier is a bounded LRU of object contents, keyed by gs:// URL.
+type hotTier struct {
+	opts HotTierOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *hotEntry
+	lru     *list.List               // most recently read first
+	size    int64
+	// drops counts evictions made for writes, so that a read that raced
+	// with one doesn't store what it read.
+	drops uint64
+}
+
+type hotEntry struct {
+	url  string
+	data []byte
+	meta cacheMeta
+	// checked is when GCS last confirmed data was current.
+	checked time.Time
+}
+
+func (e *hotEntry) cost() int64 {
+	return int64(len(e.data)+len(e.url)+len(e.meta.ETag)+len(e.meta.CRC32C)+len(e.meta.MD5Hash)) + hotEntryOverhead
+}
+
+// get returns the entry for gsURL, or nil, along with the number of drops
+// so far to pass to put. Entries are never modified once stored, so the
+// result can be used without holding the lock.
+func (h *hotTier) get(gsURL string) (*hotEntry, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	el, ok := h.entries[gsURL]
+	if !ok {
+		return nil, h.drops
+	}
+	h.lru.MoveToFront(el)
+	return el.Value.(*hotEntry), h.drops
+}
+
+// put stores e, replacing any entry for the same URL, unless something was
+// dropped since get returned drops. It then evicts the least recently read
+// entries until the tier fits in MaxBytes.
+func (h *hotTier) put(e *hotEntry, drops uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.drops != drops || int64(len(e.data)) > h.opts.MaxObjectSize || e.cost() > h.opts.MaxBytes {
+		return
+	}
+	if el, ok := h.entries[e.url]; ok {
+		h.remove(el)
+	}
+	h.entries[e.url] = h.lru.PushFront(e)
+	h.size += e.cost()
+	for h.size > h.opts.MaxBytes {
+		h.remove(h.lru.Back())
+	}
+}
+
+func (h *hotTier) remove(el *list.Element) {
+	e := h.lru.Remove(el).(*hotEntry)
+	delete(h.entries, e.url)
+	h.size -= e.cost()
+}
+
+func (h *hotTier) drop(gsURL string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drops++
+	if el, ok := h.entries[gsURL]; ok {
+		h.remove(el)
+	}
+}
+
+// dropPrefix drops the entries of every object under the gs:// prefix.
+func (h *hotTier) dropPrefix(gsURL string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drops++
+	for u, el := range h.entries {
+		if strings.HasPrefix(u, gsURL) {
+			h.remove(el)
+		}
+	}
+}
+
+// errHotTooLarge stops a download into memory once it outgrows the tier.
+var errHotTooLarge = errors.New("too large for the hot tier")
+
+// limitedBuffer is a buffer that refuses to grow past max bytes. The buffer
+// isn't embedded so that io.Copy can't get around Write through ReadFrom.
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if int64(b.buf.Len()+len(p)) > b.max {
+		return 0, errHotTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+// readHot returns the content of the object at gsURL through the hot tier,
+// along with the cache entry describing it. Data held in memory is
+// revalidated against GCS directly, without touching the disk cache; a
+// change is downloaded into memory as long as it's small enough.
+// Otherwise the object goes through the disk cache and is kept in memory
+// if it fits; if it doesn't, readHot returns false, and the content is to
+// be read from the entry.
+//
+// The returned data is shared with the tier and must not be modified.
+func (f *fastGCS) readHot(gsURL string) ([]byte, *cacheEntry, bool, error) {
+	e, drops := f.hot.get(gsURL)
+	if e != nil {
+		if time.Since(e.checked) < f.hot.opts.MaxAge {
+			return e.data, &cacheEntry{meta: e.meta, hit: true}, true, nil
+		}
+		bucket, object, err := parseGSURL(gsURL)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		fetch := f.fetch
+		if f.grpc != nil {
+			fetch = f.grpcFetch
+		}
+		checked := time.Now()
+		buf := &limitedBuffer{max: f.hot.opts.MaxObjectSize}
+		meta, err := fetch(context.Background(), gsURL, bucket, object, &e.meta, buf)
+		switch {
+		case err == errNotModified:
+			f.hot.put(&hotEntry{url: gsURL, data: e.data, meta: e.meta, checked: checked}, drops)
+			return e.data, &cacheEntry{meta: e.meta, hit: true}, true, nil
+		case err == nil:
+			// The disk cache is left behind, and catches up on its own
+			// next use since it revalidates every time.
+			data := buf.buf.Bytes()
+			f.hot.put(&hotEntry{url: gsURL, data: data, meta: *meta, checked: checked}, drops)
+			return data, &cacheEntry{meta: *meta}, true, nil
+		case !errors.Is(err, errHotTooLarge):
+			return nil, nil, false, errors.Wrapf(err, "downloading %s", gsURL)
+		}
+		f.hot.drop(gsURL)
+		drops++
+	}
+
+	checked := time.Now()
+	entry, err := f.update(gsURL)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	rc, entry, err := f.openEntry(gsURL, entry)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(rc, f.hot.opts.MaxObjectSize+1))
+	rc.Close()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if int64(len(data)) > f.hot.opts.MaxObjectSize {
+		return nil, entry, false, nil
+	}
+	f.hot.put(&hotEntry{url: gsURL, data: data, meta: entry.meta, checked: checked}, drops)
+	return data, entry, true, nil
+}
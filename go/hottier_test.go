@@ -0,0 +1,220 @@
+package fastgcs
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestHotTier(opts HotTierOptions) *hotTier {
+	f := &fastGCS{}
+	WithHotTier(opts)(f)
+	return f.hot
+}
+
+func hotEntryOf(gsURL string, size int) *hotEntry {
+	return &hotEntry{url: gsURL, data: make([]byte, size), meta: cacheMeta{ETag: "etag"}}
+}
+
+// urls returns the URLs in the tier, most recently read first.
+func (h *hotTier) urls() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var urls []string
+	for el := h.lru.Front(); el != nil; el = el.Next() {
+		urls = append(urls, el.Value.(*hotEntry).url)
+	}
+	return urls
+}
+
+func TestHotTierLRU(t *testing.T) {
+	cost := hotEntryOf("gs://b/a", 100).cost()
+	h := newTestHotTier(HotTierOptions{MaxBytes: 3 * cost, MaxObjectSize: 1000})
+	checkSize := func(want int64) {
+		t.Helper()
+		var sum int64
+		for el := h.lru.Front(); el != nil; el = el.Next() {
+			sum += el.Value.(*hotEntry).cost()
+		}
+		if h.size != want || h.size != sum {
+			t.Errorf("size %d, entries costing %d, want %d", h.size, sum, want)
+		}
+		if len(h.entries) != h.lru.Len() {
+			t.Errorf("%d entries in the map, %d in the list", len(h.entries), h.lru.Len())
+		}
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		_, drops := h.get("gs://b/" + name)
+		h.put(hotEntryOf("gs://b/"+name, 100), drops)
+	}
+	checkSize(3 * cost)
+	if e, _ := h.get("gs://b/a"); e == nil {
+		t.Fatal("entry missing")
+	}
+	// Adding d evicts the least recently read, b.
+	_, drops := h.get("gs://b/d")
+	h.put(hotEntryOf("gs://b/d", 100), drops)
+	if got, want := h.urls(), []string{"gs://b/d", "gs://b/a", "gs://b/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tier holds %q, want %q", got, want)
+	}
+	checkSize(3 * cost)
+
+	// Replacing an entry accounts for the difference, evicting as needed.
+	_, drops = h.get("gs://b/a")
+	h.put(hotEntryOf("gs://b/a", 150), drops)
+	if got, want := h.urls(), []string{"gs://b/a", "gs://b/d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tier holds %q after growing an entry, want %q", got, want)
+	}
+	checkSize(2*cost + 50)
+
+	// Entries over MaxObjectSize, or that don't fit at all, aren't kept.
+	_, drops = h.get("gs://b/big")
+	h.put(hotEntryOf("gs://b/big", 1001), drops)
+	h.put(&hotEntry{url: "gs://b/huge-url", meta: cacheMeta{ETag: string(make([]byte, 3*cost))}}, drops)
+	if e, _ := h.get("gs://b/big"); e != nil {
+		t.Error("entry over MaxObjectSize kept")
+	}
+	if e, _ := h.get("gs://b/huge-url"); e != nil {
+		t.Error("entry over MaxBytes kept")
+	}
+	checkSize(2*cost + 50)
+
+	h.drop("gs://b/a")
+	h.dropPrefix("gs://b/")
+	checkSize(0)
+}
+
+func TestHotTierDrops(t *testing.T) {
+	h := newTestHotTier(HotTierOptions{})
+	for _, drop := range []func(){
+		func() { h.drop("gs://b/other") },
+		func() { h.dropPrefix("gs://b/") },
+	} {
+		// A read gets its number of drops, then a write drops an entry
+		// before the read stores what it read, which may predate the
+		// write.
+		_, drops := h.get("gs://b/a")
+		drop()
+		h.put(hotEntryOf("gs://b/a", 10), drops)
+		if e, _ := h.get("gs://b/a"); e != nil {
+			t.Error("read that raced with a write stored what it read")
+		}
+	}
+	_, drops := h.get("gs://b/a")
+	h.put(hotEntryOf("gs://b/a", 10), drops)
+	if e, _ := h.get("gs://b/a"); e == nil {
+		t.Error("read without a write in between not stored")
+	}
+}
+
+func TestHotTierRead(t *testing.T) {
+	f, srv := newJSONTest(t, WithHotTier(HotTierOptions{MaxAge: time.Hour}))
+	srv.Put("b", "o", []byte("v1"))
+	read := func(want string, wantRequests int) {
+		t.Helper()
+		before := srv.Requests()
+		got, err := f.Read("gs://b/o")
+		if err != nil || string(got) != want {
+			t.Errorf("Read = %q, %v, want %q", got, err, want)
+		}
+		if n := srv.Requests() - before; n != wantRequests {
+			t.Errorf("Read made %d requests, want %d", n, wantRequests)
+		}
+	}
+	read("v1", 1)
+	read("v1", 0)
+	// Changes made elsewhere are only seen once MaxAge has passed.
+	srv.Put("b", "o", []byte("v2"))
+	read("v1", 0)
+	f.hot.opts.MaxAge = 0
+	read("v2", 1)
+	read("v2", 1) // not modified
+
+	// Data from the tier can't be modified through what Read returns.
+	got, _ := f.Read("gs://b/o")
+	got[0] = 'x'
+	read("v2", 1)
+
+	// Writes through this FastGCS evict the object.
+	f.hot.opts.MaxAge = time.Hour
+	w, err := f.Create("gs://b/o", WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("v3"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	read("v3", 1)
+	read("v3", 0)
+}
+
+func TestHotTierMaxObjectSize(t *testing.T) {
+	f, srv := newJSONTest(t, WithHotTier(HotTierOptions{MaxObjectSize: 16}))
+	big := randomContent(17)
+	srv.Put("b", "big", big)
+	for i := 0; i < 2; i++ {
+		got, err := f.Read("gs://b/big")
+		if err != nil || !bytes.Equal(got, big) {
+			t.Errorf("Read of an object over MaxObjectSize = %d bytes, %v", len(got), err)
+		}
+	}
+	if len(f.hot.urls()) != 0 {
+		t.Errorf("tier holds %q, want objects over MaxObjectSize left to the disk cache", f.hot.urls())
+	}
+
+	// An object held in memory that outgrows the tier on revalidation is
+	// served from the disk cache instead.
+	srv.Put("b", "o", []byte("small"))
+	if _, err := f.Read("gs://b/o"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.hot.urls(), []string{"gs://b/o"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tier holds %q, want %q", got, want)
+	}
+	srv.Put("b", "o", big)
+	rc, err := f.Open("gs://b/o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(bytes.Buffer)
+	got.ReadFrom(rc)
+	rc.Close()
+	if !bytes.Equal(got.Bytes(), big) {
+		t.Errorf("Open of an object that outgrew the tier read %d bytes, want %d", got.Len(), len(big))
+	}
+	if len(f.hot.urls()) != 0 {
+		t.Errorf("tier holds %q after the object outgrew it", f.hot.urls())
+	}
+}
+
+// hookTransport calls hook before each media download.
+type hookTransport struct {
+	base http.RoundTripper
+	hook func()
+}
+
+func (h *hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("alt") == "media" {
+		h.hook()
+	}
+	return h.base.RoundTrip(req)
+}
+
+func TestHotTierReadRacingWrite(t *testing.T) {
+	f, srv := newJSONTest(t, WithHotTier(HotTierOptions{MaxAge: time.Hour}))
+	srv.Put("b", "o", []byte("v1"))
+	f.client = &http.Client{Transport: &hookTransport{
+		base: srv.Client().Transport,
+		hook: func() { f.noteWrite(&ObjectAttrs{Bucket: "b", Name: "o", Generation: 99}) },
+	}}
+	if got, err := f.Read("gs://b/o"); err != nil || string(got) != "v1" {
+		t.Fatalf("Read = %q, %v, want v1", got, err)
+	}
+	if urls := f.hot.urls(); len(urls) != 0 {
+		t.Errorf("tier holds %q, read while the object was written", urls)
+	}
+}
@@ -0,0 +1,215 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errTruncated = errors.New("parquet: truncated page")
+
+// readHybrid decodes n values of the given bit width in the RLE/bit-packing
+// hybrid encoding, used for levels and dictionary indices.
+func readHybrid(data []byte, width, n int) ([]uint32, error) {
+	if width < 0 || width > 32 {
+		return nil, fmt.Errorf("parquet: bit width %d", width)
+	}
+	out := make([]uint32, 0, n)
+	byteWidth := (width + 7) / 8
+	for len(out) < n {
+		header, k := binary.Uvarint(data)
+		if k <= 0 {
+			return nil, errTruncated
+		}
+		data = data[k:]
+		if header&1 == 0 {
+			// A run of the same value.
+			count := int(header >> 1)
+			if len(data) < byteWidth {
+				return nil, errTruncated
+			}
+			var v uint32
+			for i := 0; i < byteWidth; i++ {
+				v |= uint32(data[i]) << (8 * i)
+			}
+			data = data[byteWidth:]
+			for i := 0; i < count && len(out) < n; i++ {
+				out = append(out, v)
+			}
+			continue
+		}
+		// Groups of 8 bit-packed values.
+		count := int(header>>1) * 8
+		size := count * width / 8
+		if len(data) < size {
+			return nil, errTruncated
+		}
+		out = unpack(out, data[:size], width, count, n)
+		data = data[size:]
+	}
+	return out, nil
+}
+
+// unpack appends count values of the given width, packed least significant
+// bit first, to out, stopping once it holds n.
+func unpack(out []uint32, data []byte, width, count, n int) []uint32 {
+	bit := 0
+	for i := 0; i < count && len(out) < n; i++ {
+		var v uint64
+		for b := 0; b < width; b++ {
+			if data[(bit+b)/8]&(1<<uint((bit+b)%8)) != 0 {
+				v |= 1 << uint(b)
+			}
+		}
+		bit += width
+		out = append(out, uint32(v))
+	}
+	return out
+}
+
+// readLevels decodes n definition levels stored without a length prefix.
+func readLevels(data []byte, maxLevel, n int) ([]uint32, error) {
+	width := 0
+	for l := maxLevel; l > 0; l >>= 1 {
+		width++
+	}
+	return readHybrid(data, width, n)
+}
+
+// readDeltaBinaryPacked decodes n integers in the DELTA_BINARY_PACKED
+// encoding, and returns them along with the rest of data.
+func readDeltaBinaryPacked(data []byte, n int) ([]int64, []byte, error) {
+	var fields [3]uint64
+	for i := range fields {
+		v, k := binary.Uvarint(data)
+		if k <= 0 {
+			return nil, nil, errTruncated
+		}
+		fields[i] = v
+		data = data[k:]
+	}
+	blockSize, miniBlocks, total := int(fields[0]), int(fields[1]), int(fields[2])
+	if miniBlocks <= 0 || blockSize <= 0 || blockSize%miniBlocks != 0 || (blockSize/miniBlocks)%8 != 0 {
+		return nil, nil, fmt.Errorf("parquet: bad delta block of %d values in %d miniblocks", blockSize, miniBlocks)
+	}
+	if total < n {
+		return nil, nil, errTruncated
+	}
+	first, k := binary.Varint(data)
+	if k <= 0 {
+		return nil, nil, errTruncated
+	}
+	data = data[k:]
+
+	perMiniBlock := blockSize / miniBlocks
+	out := make([]int64, 0, total)
+	if total > 0 {
+		out = append(out, first)
+	}
+	deltas := make([]uint32, 0, perMiniBlock)
+	for len(out) < total {
+		minDelta, k := binary.Varint(data)
+		if k <= 0 || len(data) < k+miniBlocks {
+			return nil, nil, errTruncated
+		}
+		widths := data[k : k+miniBlocks]
+		data = data[k+miniBlocks:]
+		for _, width := range widths {
+			if len(out) == total {
+				// Miniblocks past the last value have no data.
+				break
+			}
+			if width > 64 {
+				return nil, nil, fmt.Errorf("parquet: bit width %d", width)
+			}
+			size := perMiniBlock * int(width) / 8
+			if len(data) < size {
+				return nil, nil, errTruncated
+			}
+			if width > 32 {
+				vs, err := unpack64(data[:size], int(width), perMiniBlock)
+				if err != nil {
+					return nil, nil, err
+				}
+				for _, d := range vs {
+					if len(out) == total {
+						break
+					}
+					out = append(out, out[len(out)-1]+minDelta+int64(d))
+				}
+			} else {
+				deltas = unpack(deltas[:0], data[:size], int(width), perMiniBlock, perMiniBlock)
+				for _, d := range deltas {
+					if len(out) == total {
+						break
+					}
+					out = append(out, out[len(out)-1]+minDelta+int64(d))
+				}
+			}
+			data = data[size:]
+		}
+	}
+	return out[:n], data, nil
+}
+
+// unpack64 is unpack for widths of up to 64 bits.
+func unpack64(data []byte, width, count int) ([]uint64, error) {
+	if count*width > len(data)*8 {
+		return nil, errTruncated
+	}
+	out := make([]uint64, count)
+	bit := 0
+	for i := range out {
+		for b := 0; b < width; b++ {
+			if data[(bit+b)/8]&(1<<uint((bit+b)%8)) != 0 {
+				out[i] |= 1 << uint(b)
+			}
+		}
+		bit += width
+	}
+	return out, nil
+}
+
+// readDeltaLengthByteArray decodes n byte arrays in the
+// DELTA_LENGTH_BYTE_ARRAY encoding, and returns them along with the rest
+// of data.
+func readDeltaLengthByteArray(data []byte, n int) ([][]byte, []byte, error) {
+	lengths, data, err := readDeltaBinaryPacked(data, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	out := make([][]byte, n)
+	for i, l := range lengths {
+		if l < 0 || l > int64(len(data)) {
+			return nil, nil, errTruncated
+		}
+		out[i], data = data[:l], data[l:]
+	}
+	return out, data, nil
+}
+
+// readDeltaByteArray decodes n byte arrays in the DELTA_BYTE_ARRAY
+// encoding, in which each value is stored as the length of the prefix it
+// shares with the previous one and the rest.
+func readDeltaByteArray(data []byte, n int) ([][]byte, error) {
+	prefixes, data, err := readDeltaBinaryPacked(data, n)
+	if err != nil {
+		return nil, err
+	}
+	suffixes, _, err := readDeltaLengthByteArray(data, n)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, n)
+	var prev []byte
+	for i := range out {
+		p := prefixes[i]
+		if p < 0 || p > int64(len(prev)) {
+			return nil, fmt.Errorf("parquet: prefix of %d bytes of a %d byte value", p, len(prev))
+		}
+		v := make([]byte, 0, int(p)+len(suffixes[i]))
+		v = append(append(v, prev[:p]...), suffixes[i]...)
+		out[i], prev = v, v
+	}
+	return out, nil
+}
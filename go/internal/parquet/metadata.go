@@ -0,0 +1,296 @@
+package parquet
+
+// Physical types.
+const (
+	typeBoolean           = 0
+	typeInt32             = 1
+	typeInt64             = 2
+	typeInt96             = 3
+	typeFloat             = 4
+	typeDouble            = 5
+	typeByteArray         = 6
+	typeFixedLenByteArray = 7
+)
+
+// Repetition types.
+const (
+	required = 0
+	optional = 1
+	repeated = 2
+)
+
+// Converted types, the predecessors of logical types, which writers still
+// set alongside them.
+const (
+	convertedNone            = -1
+	convertedDate            = 6
+	convertedTimestampMillis = 9
+	convertedTimestampMicros = 10
+	convertedUint8           = 11
+	convertedUint64          = 14
+)
+
+// Time units of timestamps, as numbered in the TimeUnit union.
+const (
+	unitNone   = 0
+	unitMillis = 1
+	unitMicros = 2
+	unitNanos  = 3
+)
+
+// Compression codecs.
+const (
+	codecUncompressed = 0
+	codecSnappy       = 1
+	codecGzip         = 2
+	codecZstd         = 6
+)
+
+// Page types.
+const (
+	pageData       = 0
+	pageDictionary = 2
+	pageDataV2     = 3
+)
+
+// Encodings.
+const (
+	encodingPlain                = 0
+	encodingPlainDictionary      = 2
+	encodingRLE                  = 3
+	encodingDeltaBinaryPacked    = 5
+	encodingDeltaLengthByteArray = 6
+	encodingDeltaByteArray       = 7
+	encodingRLEDictionary        = 8
+)
+
+type fileMetaData struct {
+	schema    []schemaElement
+	numRows   int64
+	rowGroups []rowGroup
+}
+
+type schemaElement struct {
+	typ           int32
+	typeLength    int32
+	repetition    int32
+	name          string
+	numChildren   int32
+	convertedType int32
+	// Of the logical type, only what changes how values are shown.
+	date          bool
+	timestampUnit int
+	unsigned      bool
+}
+
+type rowGroup struct {
+	columns []columnChunk
+	numRows int64
+}
+
+type columnChunk struct {
+	typ                  int32
+	path                 []string
+	codec                int32
+	numValues            int64
+	totalCompressedSize  int64
+	dataPageOffset       int64
+	dictionaryPageOffset int64
+}
+
+type pageHeader struct {
+	typ                  int32
+	uncompressedPageSize int32
+	compressedPageSize   int32
+	// Of the data and dictionary page headers.
+	numValues int32
+	encoding  int32
+	// Of data page headers v2.
+	defLevelsLength int32
+	repLevelsLength int32
+	isCompressed    bool
+}
+
+func (r *thriftReader) fileMetaData() *fileMetaData {
+	m := &fileMetaData{}
+	r.readStruct(func(id int16, typ byte) {
+		switch {
+		case id == 2 && typ == tList:
+			_, n := r.list()
+			for i := 0; i < n && r.err == nil; i++ {
+				m.schema = append(m.schema, r.schemaElement())
+			}
+		case id == 3 && typ == tI64:
+			m.numRows = r.varint()
+		case id == 4 && typ == tList:
+			_, n := r.list()
+			for i := 0; i < n && r.err == nil; i++ {
+				m.rowGroups = append(m.rowGroups, r.rowGroup())
+			}
+		default:
+			r.skip(typ)
+		}
+	})
+	return m
+}
+
+func (r *thriftReader) schemaElement() schemaElement {
+	e := schemaElement{typ: -1, convertedType: convertedNone}
+	r.readStruct(func(id int16, typ byte) {
+		switch {
+		case id == 1 && typ == tI32:
+			e.typ = r.i32()
+		case id == 2 && typ == tI32:
+			e.typeLength = r.i32()
+		case id == 3 && typ == tI32:
+			e.repetition = r.i32()
+		case id == 4 && typ == tBinary:
+			e.name = r.string()
+		case id == 5 && typ == tI32:
+			e.numChildren = r.i32()
+		case id == 6 && typ == tI32:
+			e.convertedType = r.i32()
+		case id == 10 && typ == tStruct:
+			r.logicalType(&e)
+		default:
+			r.skip(typ)
+		}
+	})
+	return e
+}
+
+// logicalType reads the LogicalType union into e.
+func (r *thriftReader) logicalType(e *schemaElement) {
+	r.readStruct(func(id int16, typ byte) {
+		switch {
+		case id == 6 && typ == tStruct:
+			e.date = true
+			r.skip(typ)
+		case id == 8 && typ == tStruct:
+			// TimestampType: isAdjustedToUTC, then the TimeUnit union.
+			r.readStruct(func(id int16, typ byte) {
+				if id != 2 || typ != tStruct {
+					r.skip(typ)
+					return
+				}
+				r.readStruct(func(id int16, typ byte) {
+					if id >= unitMillis && id <= unitNanos {
+						e.timestampUnit = int(id)
+					}
+					r.skip(typ)
+				})
+			})
+		case id == 10 && typ == tStruct:
+			// IntType: bitWidth, then isSigned.
+			r.readStruct(func(id int16, typ byte) {
+				if id == 2 && (typ == tTrue || typ == tFalse) {
+					e.unsigned = !boolValue(typ)
+					return
+				}
+				r.skip(typ)
+			})
+		default:
+			r.skip(typ)
+		}
+	})
+}
+
+func (r *thriftReader) rowGroup() rowGroup {
+	var g rowGroup
+	r.readStruct(func(id int16, typ byte) {
+		switch {
+		case id == 1 && typ == tList:
+			_, n := r.list()
+			for i := 0; i < n && r.err == nil; i++ {
+				g.columns = append(g.columns, r.columnChunk())
+			}
+		case id == 3 && typ == tI64:
+			g.numRows = r.varint()
+		default:
+			r.skip(typ)
+		}
+	})
+	return g
+}
+
+func (r *thriftReader) columnChunk() columnChunk {
+	c := columnChunk{dictionaryPageOffset: -1}
+	r.readStruct(func(id int16, typ byte) {
+		if id != 3 || typ != tStruct {
+			r.skip(typ)
+			return
+		}
+		// ColumnMetaData.
+		r.readStruct(func(id int16, typ byte) {
+			switch {
+			case id == 1 && typ == tI32:
+				c.typ = r.i32()
+			case id == 3 && typ == tList:
+				_, n := r.list()
+				for i := 0; i < n && r.err == nil; i++ {
+					c.path = append(c.path, r.string())
+				}
+			case id == 4 && typ == tI32:
+				c.codec = r.i32()
+			case id == 5 && typ == tI64:
+				c.numValues = r.varint()
+			case id == 7 && typ == tI64:
+				c.totalCompressedSize = r.varint()
+			case id == 9 && typ == tI64:
+				c.dataPageOffset = r.varint()
+			case id == 11 && typ == tI64:
+				c.dictionaryPageOffset = r.varint()
+			default:
+				r.skip(typ)
+			}
+		})
+	})
+	return c
+}
+
+func (r *thriftReader) pageHeader() *pageHeader {
+	h := &pageHeader{isCompressed: true}
+	r.readStruct(func(id int16, typ byte) {
+		switch {
+		case id == 1 && typ == tI32:
+			h.typ = r.i32()
+		case id == 2 && typ == tI32:
+			h.uncompressedPageSize = r.i32()
+		case id == 3 && typ == tI32:
+			h.compressedPageSize = r.i32()
+		case (id == 5 || id == 7) && typ == tStruct:
+			// DataPageHeader and DictionaryPageHeader both start with
+			// num_values and encoding.
+			r.readStruct(func(id int16, typ byte) {
+				switch {
+				case id == 1 && typ == tI32:
+					h.numValues = r.i32()
+				case id == 2 && typ == tI32:
+					h.encoding = r.i32()
+				default:
+					r.skip(typ)
+				}
+			})
+		case id == 8 && typ == tStruct:
+			r.readStruct(func(id int16, typ byte) {
+				switch {
+				case id == 1 && typ == tI32:
+					h.numValues = r.i32()
+				case id == 4 && typ == tI32:
+					h.encoding = r.i32()
+				case id == 5 && typ == tI32:
+					h.defLevelsLength = r.i32()
+				case id == 6 && typ == tI32:
+					h.repLevelsLength = r.i32()
+				case id == 7 && (typ == tTrue || typ == tFalse):
+					h.isCompressed = boolValue(typ)
+				default:
+					r.skip(typ)
+				}
+			})
+		default:
+			r.skip(typ)
+		}
+	})
+	return h
+}
@@ -0,0 +1,478 @@
+// Package parquet is a minimal reader of Parquet files, enough to read GCS
+// inventory reports: it reads the top-level columns of primitive type, in
+// any of the standard encodings, compressed with Snappy, gzip or zstd, and
+// returns their values as text. Nested columns are left out.
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const magic = "PAR1"
+
+// File is an open Parquet file.
+type File struct {
+	r       io.ReaderAt
+	size    int64
+	meta    *fileMetaData
+	columns []column
+}
+
+// column is a top-level column of primitive type.
+type column struct {
+	schemaElement
+	// maxDef is the definition level of non-null values: 1 for optional
+	// columns, 0 for required ones.
+	maxDef int
+}
+
+// Open reads the metadata of the Parquet file of the given size in r.
+func Open(r io.ReaderAt, size int64) (*File, error) {
+	if size < int64(2*len(magic)+4) {
+		return nil, fmt.Errorf("parquet: not a parquet file")
+	}
+	var tail [8]byte
+	if _, err := r.ReadAt(tail[:], size-8); err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != magic {
+		return nil, fmt.Errorf("parquet: not a parquet file")
+	}
+	n := int64(binary.LittleEndian.Uint32(tail[:4]))
+	if n > size-int64(2*len(magic)+4) {
+		return nil, fmt.Errorf("parquet: metadata of %d bytes in a %d byte file", n, size)
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, size-8-n); err != nil {
+		return nil, err
+	}
+	tr := &thriftReader{buf: buf}
+	meta := tr.fileMetaData()
+	if tr.err != nil {
+		return nil, tr.err
+	}
+	if len(meta.schema) == 0 {
+		return nil, fmt.Errorf("parquet: no schema")
+	}
+
+	f := &File{r: r, size: size, meta: meta}
+	// The schema is flattened depth first, under a root element.
+	i := 1
+	for child := 0; child < int(meta.schema[0].numChildren) && i < len(meta.schema); child++ {
+		e := meta.schema[i]
+		if e.numChildren > 0 || e.repetition == repeated {
+			i = skipSubtree(meta.schema, i)
+			continue
+		}
+		i++
+		c := column{schemaElement: e}
+		if e.repetition == optional {
+			c.maxDef = 1
+		}
+		f.columns = append(f.columns, c)
+	}
+	return f, nil
+}
+
+// skipSubtree returns the index of the schema element following the
+// subtree of the one at i.
+func skipSubtree(schema []schemaElement, i int) int {
+	for pending := 1; pending > 0 && i < len(schema); i++ {
+		pending--
+		if n := schema[i].numChildren; n > 0 {
+			pending += int(n)
+		}
+	}
+	return i
+}
+
+// NumRows returns the number of rows in the file.
+func (f *File) NumRows() int64 {
+	return f.meta.numRows
+}
+
+// Columns returns the names of the columns Rows can read.
+func (f *File) Columns() []string {
+	names := make([]string, len(f.columns))
+	for i := range f.columns {
+		names[i] = f.columns[i].name
+	}
+	return names
+}
+
+// Rows calls fn with every row of the file, holding the values of the named
+// columns as text. Integers are shown in decimal, timestamps and INT96
+// values in RFC 3339 in UTC, dates as YYYY-MM-DD, and byte arrays as is.
+// Null values are empty. fn must not keep row, which is reused.
+func (f *File) Rows(names []string, fn func(row []string) error) error {
+	cols := make([]*column, len(names))
+	for i, name := range names {
+		for j := range f.columns {
+			if f.columns[j].name == name {
+				cols[i] = &f.columns[j]
+				break
+			}
+		}
+		if cols[i] == nil {
+			return fmt.Errorf("parquet: no column %q", name)
+		}
+	}
+
+	row := make([]string, len(cols))
+	values := make([][]string, len(cols))
+	for g := range f.meta.rowGroups {
+		group := &f.meta.rowGroups[g]
+		for i, c := range cols {
+			var chunk *columnChunk
+			for j := range group.columns {
+				if p := group.columns[j].path; len(p) == 1 && p[0] == c.name {
+					chunk = &group.columns[j]
+					break
+				}
+			}
+			if chunk == nil {
+				return fmt.Errorf("parquet: no column %q in row group %d", c.name, g)
+			}
+			var err error
+			if values[i], err = f.readColumn(c, chunk, group.numRows); err != nil {
+				return err
+			}
+		}
+		for r := int64(0); r < group.numRows; r++ {
+			for i := range cols {
+				row[i] = values[i][r]
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readColumn returns the values of a column chunk.
+func (f *File) readColumn(c *column, chunk *columnChunk, numRows int64) ([]string, error) {
+	start := chunk.dataPageOffset
+	if chunk.dictionaryPageOffset > 0 && chunk.dictionaryPageOffset < start {
+		start = chunk.dictionaryPageOffset
+	}
+	if start < 0 || chunk.totalCompressedSize < 0 || start+chunk.totalCompressedSize > f.size {
+		return nil, fmt.Errorf("parquet: column %q lies outside the file", c.name)
+	}
+	data := make([]byte, chunk.totalCompressedSize)
+	if _, err := f.r.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+
+	values := make([]string, 0, numRows)
+	var dict []string
+	for int64(len(values)) < chunk.numValues {
+		tr := &thriftReader{buf: data}
+		h := tr.pageHeader()
+		if tr.err != nil {
+			return nil, tr.err
+		}
+		data = data[tr.pos:]
+		if h.compressedPageSize < 0 || int(h.compressedPageSize) > len(data) || h.uncompressedPageSize < 0 {
+			return nil, errTruncated
+		}
+		page := data[:h.compressedPageSize]
+		data = data[h.compressedPageSize:]
+
+		var err error
+		switch h.typ {
+		case pageDictionary:
+			var buf []byte
+			if buf, err = decompress(chunk.codec, page, int(h.uncompressedPageSize)); err == nil {
+				dict, err = c.plain(buf, int(h.numValues))
+			}
+		case pageData:
+			var buf []byte
+			var defs []uint32
+			buf, err = decompress(chunk.codec, page, int(h.uncompressedPageSize))
+			if err == nil && c.maxDef > 0 {
+				var levels []byte
+				if levels, buf, err = lengthPrefixed(buf); err == nil {
+					defs, err = readLevels(levels, c.maxDef, int(h.numValues))
+				}
+			}
+			if err == nil {
+				values, err = c.appendValues(values, buf, h, defs, dict)
+			}
+		case pageDataV2:
+			levels := int(h.repLevelsLength) + int(h.defLevelsLength)
+			if h.repLevelsLength < 0 || h.defLevelsLength < 0 || levels > len(page) {
+				return nil, errTruncated
+			}
+			var defs []uint32
+			if c.maxDef > 0 {
+				defs, err = readLevels(page[h.repLevelsLength:levels], c.maxDef, int(h.numValues))
+			}
+			buf := page[levels:]
+			if err == nil && h.isCompressed {
+				buf, err = decompress(chunk.codec, buf, int(h.uncompressedPageSize)-levels)
+			}
+			if err == nil {
+				values, err = c.appendValues(values, buf, h, defs, dict)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parquet: column %q: %v", c.name, err)
+		}
+	}
+	if int64(len(values)) != numRows {
+		return nil, fmt.Errorf("parquet: column %q has %d values in a row group of %d rows", c.name, len(values), numRows)
+	}
+	return values, nil
+}
+
+// lengthPrefixed splits data after the length-prefixed value it starts
+// with.
+func lengthPrefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errTruncated
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, nil, errTruncated
+	}
+	return data[4 : 4+n], data[4+n:], nil
+}
+
+// appendValues appends the values of a data page to values, placing nulls
+// where the definition levels say so.
+func (c *column) appendValues(values []string, data []byte, h *pageHeader, defs []uint32, dict []string) ([]string, error) {
+	n := int(h.numValues)
+	if defs != nil {
+		n = 0
+		for _, d := range defs {
+			if int(d) == c.maxDef {
+				n++
+			}
+		}
+	}
+	vals, err := c.decode(data, h.encoding, n, dict)
+	if err != nil {
+		return nil, err
+	}
+	if defs == nil {
+		return append(values, vals...), nil
+	}
+	for _, d := range defs {
+		if int(d) == c.maxDef {
+			values = append(values, vals[0])
+			vals = vals[1:]
+		} else {
+			values = append(values, "")
+		}
+	}
+	return values, nil
+}
+
+// decode decodes n values in the given encoding.
+func (c *column) decode(data []byte, encoding int32, n int, dict []string) ([]string, error) {
+	switch encoding {
+	case encodingPlain:
+		return c.plain(data, n)
+	case encodingPlainDictionary, encodingRLEDictionary:
+		if n == 0 {
+			return nil, nil
+		}
+		if dict == nil {
+			return nil, fmt.Errorf("dictionary-encoded page without a dictionary")
+		}
+		if len(data) == 0 {
+			return nil, errTruncated
+		}
+		indices, err := readHybrid(data[1:], int(data[0]), n)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]string, n)
+		for i, idx := range indices {
+			if int(idx) >= len(dict) {
+				return nil, fmt.Errorf("dictionary index %d out of %d", idx, len(dict))
+			}
+			out[i] = dict[idx]
+		}
+		return out, nil
+	case encodingRLE:
+		if c.typ != typeBoolean {
+			break
+		}
+		data, _, err := lengthPrefixed(data)
+		if err != nil {
+			return nil, err
+		}
+		bits, err := readHybrid(data, 1, n)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]string, n)
+		for i, b := range bits {
+			out[i] = strconv.FormatBool(b != 0)
+		}
+		return out, nil
+	case encodingDeltaBinaryPacked:
+		if c.typ != typeInt32 && c.typ != typeInt64 {
+			break
+		}
+		ints, _, err := readDeltaBinaryPacked(data, n)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]string, n)
+		for i, v := range ints {
+			if c.typ == typeInt32 {
+				v = int64(int32(v))
+			}
+			out[i] = c.formatInt(v)
+		}
+		return out, nil
+	case encodingDeltaLengthByteArray, encodingDeltaByteArray:
+		var arrays [][]byte
+		var err error
+		if encoding == encodingDeltaByteArray {
+			arrays, err = readDeltaByteArray(data, n)
+		} else {
+			arrays, _, err = readDeltaLengthByteArray(data, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out := make([]string, n)
+		for i, a := range arrays {
+			out[i] = string(a)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %d", encoding)
+}
+
+// plain decodes n values in the PLAIN encoding.
+func (c *column) plain(data []byte, n int) ([]string, error) {
+	if n < 0 {
+		return nil, errTruncated
+	}
+	size := map[int32]int{typeInt32: 4, typeInt64: 8, typeInt96: 12, typeFloat: 4, typeDouble: 8}[c.typ]
+	if c.typ == typeFixedLenByteArray {
+		if c.typeLength <= 0 {
+			return nil, fmt.Errorf("fixed-length byte array of %d bytes", c.typeLength)
+		}
+		size = int(c.typeLength)
+	}
+	if size > 0 && len(data)/size < n {
+		return nil, errTruncated
+	}
+
+	out := make([]string, n)
+	for i := range out {
+		switch c.typ {
+		case typeBoolean:
+			if len(data) < (n+7)/8 {
+				return nil, errTruncated
+			}
+			out[i] = strconv.FormatBool(data[i/8]&(1<<uint(i%8)) != 0)
+		case typeInt32:
+			out[i] = c.formatInt(int64(int32(binary.LittleEndian.Uint32(data[4*i:]))))
+		case typeInt64:
+			out[i] = c.formatInt(int64(binary.LittleEndian.Uint64(data[8*i:])))
+		case typeInt96:
+			v := data[12*i:]
+			nanos := int64(binary.LittleEndian.Uint64(v))
+			day := int64(binary.LittleEndian.Uint32(v[8:]))
+			// Days are Julian days, nanoseconds count from midnight.
+			out[i] = formatTime(time.Unix((day-2440588)*86400, nanos))
+		case typeFloat:
+			out[i] = strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))), 'g', -1, 32)
+		case typeDouble:
+			out[i] = strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:])), 'g', -1, 64)
+		case typeByteArray:
+			v, rest, err := lengthPrefixed(data)
+			if err != nil {
+				return nil, err
+			}
+			out[i], data = string(v), rest
+		case typeFixedLenByteArray:
+			out[i] = string(data[size*i : size*(i+1)])
+		default:
+			return nil, fmt.Errorf("unknown type %d", c.typ)
+		}
+	}
+	return out, nil
+}
+
+func (c *column) formatInt(v int64) string {
+	unit := c.timestampUnit
+	switch c.convertedType {
+	case convertedTimestampMillis:
+		unit = unitMillis
+	case convertedTimestampMicros:
+		unit = unitMicros
+	}
+	switch {
+	case unit == unitMillis:
+		return formatTime(time.Unix(v/1e3, v%1e3*1e6))
+	case unit == unitMicros:
+		return formatTime(time.Unix(v/1e6, v%1e6*1e3))
+	case unit == unitNanos:
+		return formatTime(time.Unix(0, v))
+	case c.date || c.convertedType == convertedDate:
+		return time.Unix(v*86400, 0).UTC().Format("2006-01-02")
+	case c.unsigned || c.convertedType >= convertedUint8 && c.convertedType <= convertedUint64:
+		if c.typ == typeInt32 {
+			return strconv.FormatUint(uint64(uint32(v)), 10)
+		}
+		return strconv.FormatUint(uint64(v), 10)
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func decompress(codec int32, data []byte, size int) ([]byte, error) {
+	switch codec {
+	case codecUncompressed:
+		return data, nil
+	case codecSnappy:
+		return snappy.Decode(nil, data)
+	case codecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(zr)
+	case codecZstd:
+		zstdOnce.Do(func() {
+			zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		})
+		if zstdErr != nil {
+			return nil, zstdErr
+		}
+		if size < 0 {
+			size = 0
+		}
+		return zstdDecoder.DecodeAll(data, make([]byte, 0, size))
+	}
+	return nil, fmt.Errorf("unsupported compression codec %d", codec)
+}
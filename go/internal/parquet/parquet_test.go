@@ -0,0 +1,140 @@
+package parquet
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The files in testdata were written by another implementation,
+// github.com/xitongsys/parquet-go, with each codec. They hold 300 rows in
+// two row groups of small pages, made by wantRow, and a nested column.
+var testColumns = []string{
+	"bucket",          // dictionary encoded
+	"name",            // DELTA_BYTE_ARRAY
+	"size",            // DELTA_BINARY_PACKED
+	"generation",      // PLAIN
+	"metageneration",  // optional INT32
+	"updated",         // TIMESTAMP_MILLIS
+	"timeCreated",     // logical timestamp in microseconds
+	"timeDeleted",     // optional INT96
+	"contentType",     // optional, dictionary encoded
+	"contentEncoding", // optional, DELTA_LENGTH_BYTE_ARRAY
+	"eventBasedHold",  // optional BOOLEAN
+	"ratio",           // DOUBLE
+	"day",             // DATE
+}
+
+func wantRow(i int) []string {
+	updated := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Minute)
+	row := []string{
+		fmt.Sprintf("bucket-%d", i%3),
+		fmt.Sprintf("logs/2026/%04d/part-%05d.json", i/100, i),
+		strconv.Itoa(i*i*37 - 5),
+		strconv.FormatInt(1700000000000000+int64(i)*7919, 10),
+		"",
+		updated.Format(time.RFC3339Nano),
+		updated.Add(-time.Duration(i)*time.Microsecond - time.Hour).Format(time.RFC3339Nano),
+		"", "", "", "",
+		strconv.FormatFloat(float64(i)/8, 'g', -1, 64),
+		time.Date(2024, 10, 4, 0, 0, 0, 0, time.UTC).AddDate(0, 0, i%50).Format("2006-01-02"),
+	}
+	if i%4 != 0 {
+		row[4] = strconv.Itoa(i % 9)
+	}
+	if i%5 == 0 {
+		row[7] = updated.Add(123456 * time.Microsecond).Format(time.RFC3339Nano)
+	}
+	if i%3 != 0 {
+		row[8] = []string{"text/plain", "application/json"}[i%2]
+	}
+	if i%7 == 1 {
+		row[9] = "gzip"
+	}
+	if i%2 == 0 {
+		row[10] = strconv.FormatBool(i%4 == 0)
+	}
+	return row
+}
+
+func TestRows(t *testing.T) {
+	for _, codec := range []string{"none", "snappy", "gzip", "zstd"} {
+		t.Run(codec, func(t *testing.T) {
+			file, err := os.Open(filepath.Join("testdata", codec+".parquet"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			info, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := Open(file, info.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.NumRows(); got != 300 {
+				t.Errorf("NumRows() = %d, want 300", got)
+			}
+			if got := f.Columns(); fmt.Sprint(got) != fmt.Sprint(testColumns) {
+				t.Errorf("Columns() = %q, want %q", got, testColumns)
+			}
+
+			i := 0
+			err = f.Rows(testColumns, func(row []string) error {
+				want := wantRow(i)
+				for j := range row {
+					if row[j] != want[j] {
+						t.Errorf("row %d, %s = %q, want %q", i, testColumns[j], row[j], want[j])
+					}
+				}
+				i++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i != 300 {
+				t.Errorf("Rows read %d rows, want 300", i)
+			}
+		})
+	}
+}
+
+func TestRowsUnknownColumn(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "none.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(file, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Rows([]string{"tags"}, func([]string) error { return nil }); err == nil {
+		t.Error("Rows of a nested column succeeded")
+	}
+}
+
+func TestOpenTruncated(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "snappy.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 4, 12, len(data) / 2, len(data) - 1} {
+		if f, err := Open(bytes.NewReader(data[:n]), int64(n)); err == nil {
+			if err := f.Rows(testColumns, func([]string) error { return nil }); err == nil {
+				t.Errorf("reading the first %d bytes succeeded", n)
+			}
+		}
+	}
+}
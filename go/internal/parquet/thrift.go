@@ -0,0 +1,175 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Types of the Thrift compact protocol.
+const (
+	tStop       = 0
+	tTrue       = 1
+	tFalse      = 2
+	tByte       = 3
+	tI16        = 4
+	tI32        = 5
+	tI64        = 6
+	tDouble     = 7
+	tBinary     = 8
+	tList       = 9
+	tSet        = 10
+	tMap        = 11
+	tStruct     = 12
+	maxNesting  = 64
+	maxListSize = 1 << 24
+)
+
+// thriftReader decodes the Thrift compact protocol, in which Parquet
+// encodes its metadata. The first error sticks: later reads return zero
+// values, and err tells what went wrong.
+type thriftReader struct {
+	buf   []byte
+	pos   int
+	depth int
+	err   error
+}
+
+func (r *thriftReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("parquet: "+format, args...)
+	}
+	r.pos = len(r.buf)
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.buf) {
+		r.fail("truncated metadata")
+		return 0
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		r.fail("bad varint in metadata")
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+// varint reads a zigzag-encoded integer, as i16, i32 and i64 are.
+func (r *thriftReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) i32() int32 {
+	return int32(r.varint())
+}
+
+func (r *thriftReader) binary() []byte {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)-r.pos) {
+		r.fail("truncated metadata")
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+func (r *thriftReader) string() string {
+	return string(r.binary())
+}
+
+// list reads a list or set header, and returns the type and number of
+// its elements.
+func (r *thriftReader) list() (byte, int) {
+	h := r.byte()
+	n := uint64(h >> 4)
+	if n == 15 {
+		n = r.uvarint()
+	}
+	if n > maxListSize {
+		r.fail("list of %d elements", n)
+		return tStop, 0
+	}
+	return h & 0x0f, int(n)
+}
+
+// readStruct calls field with the id and type of each field of a struct,
+// for it to read the value, or skip it. Boolean fields carry their value in
+// their type: see boolValue.
+func (r *thriftReader) readStruct(field func(id int16, typ byte)) {
+	if r.depth++; r.depth > maxNesting {
+		r.fail("metadata nested too deeply")
+		return
+	}
+	defer func() { r.depth-- }()
+	var id int16
+	for r.err == nil {
+		h := r.byte()
+		typ := h & 0x0f
+		if typ == tStop {
+			return
+		}
+		if delta := h >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			id = int16(r.varint())
+		}
+		field(id, typ)
+	}
+}
+
+// boolValue returns the value of a boolean struct field.
+func boolValue(typ byte) bool {
+	return typ == tTrue
+}
+
+// skip skips a value of type typ.
+func (r *thriftReader) skip(typ byte) {
+	switch typ {
+	case tTrue, tFalse:
+	case tByte:
+		r.byte()
+	case tI16, tI32, tI64:
+		r.uvarint()
+	case tDouble:
+		if len(r.buf)-r.pos < 8 {
+			r.fail("truncated metadata")
+			return
+		}
+		r.pos += 8
+	case tBinary:
+		r.binary()
+	case tList, tSet:
+		etyp, n := r.list()
+		for i := 0; i < n && r.err == nil; i++ {
+			if etyp == tTrue || etyp == tFalse {
+				// Booleans in lists take a byte each.
+				r.byte()
+				continue
+			}
+			r.skip(etyp)
+		}
+	case tMap:
+		n := r.uvarint()
+		if n == 0 {
+			return
+		}
+		types := r.byte()
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			r.skip(types >> 4)
+			r.skip(types & 0x0f)
+		}
+	case tStruct:
+		r.readStruct(func(id int16, typ byte) { r.skip(typ) })
+	default:
+		r.fail("unknown metadata type %d", typ)
+	}
+}
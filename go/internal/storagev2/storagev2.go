@@ -0,0 +1,620 @@
+// Package storagev2 is a hand-written subset of the google.storage.v2 gRPC
+// API: the messages used by ReadObject and by resumable writes, and a codec
+// that encodes them in the protobuf wire format. Only the fields fastgcs
+// needs are modelled; unknown fields are skipped when decoding.
+package storagev2
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	ServiceName                = "google.storage.v2.Storage"
+	ReadObjectMethod           = "/" + ServiceName + "/ReadObject"
+	BidiWriteObjectMethod      = "/" + ServiceName + "/BidiWriteObject"
+	StartResumableWriteMethod  = "/" + ServiceName + "/StartResumableWrite"
+	CancelResumableWriteMethod = "/" + ServiceName + "/CancelResumableWrite"
+
+	// MaxChunkBytes is the most content a single ReadObject or
+	// BidiWriteObject message carries.
+	MaxChunkBytes = 2 << 20
+
+	bucketPrefix = "projects/_/buckets/"
+)
+
+// BucketName returns the resource name of a bucket, as the v2 API expects
+// it.
+func BucketName(bucket string) string {
+	return bucketPrefix + bucket
+}
+
+// BucketID is the inverse of BucketName.
+func BucketID(name string) string {
+	return strings.TrimPrefix(name, bucketPrefix)
+}
+
+// Message is implemented by every message in this package.
+type Message interface {
+	Marshal() []byte
+	Unmarshal(data []byte) error
+}
+
+// Codec encodes Messages for grpc. It registers nothing: pass it with
+// grpc.ForceCodec and grpc.ForceServerCodec.
+type Codec struct{}
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(Message)
+	if !ok {
+		return nil, fmt.Errorf("storagev2: can't marshal %T", v)
+	}
+	return m.Marshal(), nil
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(Message)
+	if !ok {
+		return fmt.Errorf("storagev2: can't unmarshal into %T", v)
+	}
+	return m.Unmarshal(data)
+}
+
+// Name is the content subtype the messages are sent as.
+func (Codec) Name() string {
+	return "proto"
+}
+
+// Object is a subset of google.storage.v2.Object.
+type Object struct {
+	Name               string
+	Bucket             string
+	ETag               string
+	Generation         int64
+	Metageneration     int64
+	Size               int64
+	ContentEncoding    string
+	ContentDisposition string
+	CacheControl       string
+	ContentLanguage    string
+	ContentType        string
+	Checksums          *ObjectChecksums
+	UpdateTime         time.Time
+	Metadata           map[string]string
+}
+
+// ObjectChecksums holds the checksums of a whole object.
+type ObjectChecksums struct {
+	CRC32C  *uint32
+	MD5Hash []byte
+}
+
+// ChecksummedData is a chunk of content with its own crc32c.
+type ChecksummedData struct {
+	Content []byte
+	CRC32C  *uint32
+}
+
+type ReadObjectRequest struct {
+	Bucket               string
+	Object               string
+	Generation           int64
+	IfGenerationNotMatch *int64
+}
+
+type ReadObjectResponse struct {
+	ChecksummedData *ChecksummedData
+	ObjectChecksums *ObjectChecksums
+	Metadata        *Object
+}
+
+type WriteObjectSpec struct {
+	Resource          *Object
+	IfGenerationMatch *int64
+}
+
+type StartResumableWriteRequest struct {
+	WriteObjectSpec *WriteObjectSpec
+}
+
+type StartResumableWriteResponse struct {
+	UploadID string
+}
+
+type CancelResumableWriteRequest struct {
+	UploadID string
+}
+
+type CancelResumableWriteResponse struct{}
+
+type BidiWriteObjectRequest struct {
+	// UploadID is only set on the first message of a stream.
+	UploadID        string
+	WriteOffset     int64
+	ChecksummedData *ChecksummedData
+	// ObjectChecksums may be set on the last message, to have the whole
+	// object verified before it's created.
+	ObjectChecksums *ObjectChecksums
+	// StateLookup asks for a response with the persisted size.
+	StateLookup bool
+	// Flush asks for the content sent so far to be persisted.
+	Flush       bool
+	FinishWrite bool
+}
+
+// BidiWriteObjectResponse holds the size persisted so far, or the created
+// object once the write is finished.
+type BidiWriteObjectResponse struct {
+	PersistedSize int64
+	Resource      *Object
+}
+
+// encoding helpers
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendOptionalInt64(b []byte, num protowire.Number, v *int64) []byte {
+	if v == nil {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(*v))
+}
+
+func appendOptionalFixed32(b []byte, num protowire.Number, v *uint32) []byte {
+	if v == nil {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, *v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendMessage(b []byte, num protowire.Number, m Message) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.Marshal())
+}
+
+// field is a decoded field: v holds varints and fixed32s, data holds
+// length-delimited values.
+type field struct {
+	num  protowire.Number
+	typ  protowire.Type
+	v    uint64
+	data []byte
+}
+
+// fields decodes the top-level fields of a message.
+func fields(b []byte, fn func(field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.v = uint64(v)
+		case protowire.BytesType:
+			f.data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f field) int64() *int64 {
+	v := int64(f.v)
+	return &v
+}
+
+func (f field) uint32() *uint32 {
+	v := uint32(f.v)
+	return &v
+}
+
+// Object
+
+func (o *Object) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, o.Name)
+	b = appendString(b, 2, o.Bucket)
+	b = appendInt64(b, 3, o.Generation)
+	b = appendInt64(b, 4, o.Metageneration)
+	b = appendInt64(b, 6, o.Size)
+	b = appendString(b, 7, o.ContentEncoding)
+	b = appendString(b, 8, o.ContentDisposition)
+	b = appendString(b, 9, o.CacheControl)
+	b = appendString(b, 11, o.ContentLanguage)
+	b = appendString(b, 13, o.ContentType)
+	if o.Checksums != nil {
+		b = appendMessage(b, 16, o.Checksums)
+	}
+	if !o.UpdateTime.IsZero() {
+		var ts []byte
+		ts = appendInt64(ts, 1, o.UpdateTime.Unix())
+		ts = appendInt64(ts, 2, int64(o.UpdateTime.Nanosecond()))
+		b = protowire.AppendTag(b, 17, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	for k, v := range o.Metadata {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, v)
+		b = protowire.AppendTag(b, 22, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	b = appendString(b, 27, o.ETag)
+	return b
+}
+
+func (o *Object) Unmarshal(data []byte) error {
+	*o = Object{}
+	return fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			o.Name = string(f.data)
+		case 2:
+			o.Bucket = string(f.data)
+		case 3:
+			o.Generation = int64(f.v)
+		case 4:
+			o.Metageneration = int64(f.v)
+		case 6:
+			o.Size = int64(f.v)
+		case 7:
+			o.ContentEncoding = string(f.data)
+		case 8:
+			o.ContentDisposition = string(f.data)
+		case 9:
+			o.CacheControl = string(f.data)
+		case 11:
+			o.ContentLanguage = string(f.data)
+		case 13:
+			o.ContentType = string(f.data)
+		case 16:
+			o.Checksums = &ObjectChecksums{}
+			return o.Checksums.Unmarshal(f.data)
+		case 17:
+			var sec, nsec int64
+			err := fields(f.data, func(f field) error {
+				switch f.num {
+				case 1:
+					sec = int64(f.v)
+				case 2:
+					nsec = int64(f.v)
+				}
+				return nil
+			})
+			o.UpdateTime = time.Unix(sec, nsec).UTC()
+			return err
+		case 22:
+			var k, v string
+			err := fields(f.data, func(f field) error {
+				switch f.num {
+				case 1:
+					k = string(f.data)
+				case 2:
+					v = string(f.data)
+				}
+				return nil
+			})
+			if o.Metadata == nil {
+				o.Metadata = map[string]string{}
+			}
+			o.Metadata[k] = v
+			return err
+		case 27:
+			o.ETag = string(f.data)
+		}
+		return nil
+	})
+}
+
+// ObjectChecksums
+
+func (c *ObjectChecksums) Marshal() []byte {
+	var b []byte
+	b = appendOptionalFixed32(b, 1, c.CRC32C)
+	b = appendBytes(b, 2, c.MD5Hash)
+	return b
+}
+
+func (c *ObjectChecksums) Unmarshal(data []byte) error {
+	*c = ObjectChecksums{}
+	return fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			c.CRC32C = f.uint32()
+		case 2:
+			c.MD5Hash = append([]byte(nil), f.data...)
+		}
+		return nil
+	})
+}
+
+// ChecksummedData
+
+func (d *ChecksummedData) Marshal() []byte {
+	var b []byte
+	b = appendBytes(b, 1, d.Content)
+	b = appendOptionalFixed32(b, 2, d.CRC32C)
+	return b
+}
+
+func (d *ChecksummedData) Unmarshal(data []byte) error {
+	*d = ChecksummedData{}
+	return fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			// grpc may reuse the buffer being decoded.
+			d.Content = append([]byte(nil), f.data...)
+		case 2:
+			d.CRC32C = f.uint32()
+		}
+		return nil
+	})
+}
+
+// ReadObjectRequest
+
+func (r *ReadObjectRequest) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, r.Bucket)
+	b = appendString(b, 2, r.Object)
+	b = appendInt64(b, 3, r.Generation)
+	b = appendOptionalInt64(b, 7, r.IfGenerationNotMatch)
+	return b
+}
+
+func (r *ReadObjectRequest) Unmarshal(data []byte) error {
+	*r = ReadObjectRequest{}
+	return fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			r.Bucket = string(f.data)
+		case 2:
+			r.Object = string(f.data)
+		case 3:
+			r.Generation = int64(f.v)
+		case 7:
+			r.IfGenerationNotMatch = f.int64()
+		}
+		return nil
+	})
+}
+
+// ReadObjectResponse
+
+func (r *ReadObjectResponse) Marshal() []byte {
+	var b []byte
+	if r.ChecksummedData != nil {
+		b = appendMessage(b, 1, r.ChecksummedData)
+	}
+	if r.ObjectChecksums != nil {
+		b = appendMessage(b, 2, r.ObjectChecksums)
+	}
+	if r.Metadata != nil {
+		b = appendMessage(b, 4, r.Metadata)
+	}
+	return b
+}
+
+func (r *ReadObjectResponse) Unmarshal(data []byte) error {
+	*r = ReadObjectResponse{}
+	return fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			r.ChecksummedData = &ChecksummedData{}
+			return r.ChecksummedData.Unmarshal(f.data)
+		case 2:
+			r.ObjectChecksums = &ObjectChecksums{}
+			return r.ObjectChecksums.Unmarshal(f.data)
+		case 4:
+			r.Metadata = &Object{}
+			return r.Metadata.Unmarshal(f.data)
+		}
+		return nil
+	})
+}
+
+// WriteObjectSpec
+
+func (s *WriteObjectSpec) Marshal() []byte {
+	var b []byte
+	if s.Resource != nil {
+		b = appendMessage(b, 1, s.Resource)
+	}
+	b = appendOptionalInt64(b, 3, s.IfGenerationMatch)
+	return b
+}
+
+func (s *WriteObjectSpec) Unmarshal(data []byte) error {
+	*s = WriteObjectSpec{}
+	return fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			s.Resource = &Object{}
+			return s.Resource.Unmarshal(f.data)
+		case 3:
+			s.IfGenerationMatch = f.int64()
+		}
+		return nil
+	})
+}
+
+// StartResumableWriteRequest
+
+func (r *StartResumableWriteRequest) Marshal() []byte {
+	var b []byte
+	if r.WriteObjectSpec != nil {
+		b = appendMessage(b, 1, r.WriteObjectSpec)
+	}
+	return b
+}
+
+func (r *StartResumableWriteRequest) Unmarshal(data []byte) error {
+	*r = StartResumableWriteRequest{}
+	return fields(data, func(f field) error {
+		if f.num == 1 {
+			r.WriteObjectSpec = &WriteObjectSpec{}
+			return r.WriteObjectSpec.Unmarshal(f.data)
+		}
+		return nil
+	})
+}
+
+// StartResumableWriteResponse
+
+func (r *StartResumableWriteResponse) Marshal() []byte {
+	return appendString(nil, 1, r.UploadID)
+}
+
+func (r *StartResumableWriteResponse) Unmarshal(data []byte) error {
+	*r = StartResumableWriteResponse{}
+	return fields(data, func(f field) error {
+		if f.num == 1 {
+			r.UploadID = string(f.data)
+		}
+		return nil
+	})
+}
+
+// CancelResumableWriteRequest
+
+func (r *CancelResumableWriteRequest) Marshal() []byte {
+	return appendString(nil, 1, r.UploadID)
+}
+
+func (r *CancelResumableWriteRequest) Unmarshal(data []byte) error {
+	*r = CancelResumableWriteRequest{}
+	return fields(data, func(f field) error {
+		if f.num == 1 {
+			r.UploadID = string(f.data)
+		}
+		return nil
+	})
+}
+
+// CancelResumableWriteResponse
+
+func (r *CancelResumableWriteResponse) Marshal() []byte {
+	return nil
+}
+
+func (r *CancelResumableWriteResponse) Unmarshal(data []byte) error {
+	return fields(data, func(field) error { return nil })
+}
+
+// BidiWriteObjectRequest
+
+func (r *BidiWriteObjectRequest) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, r.UploadID)
+	b = appendInt64(b, 3, r.WriteOffset)
+	if r.ChecksummedData != nil {
+		b = appendMessage(b, 4, r.ChecksummedData)
+	}
+	if r.ObjectChecksums != nil {
+		b = appendMessage(b, 6, r.ObjectChecksums)
+	}
+	b = appendBool(b, 7, r.StateLookup)
+	b = appendBool(b, 8, r.Flush)
+	b = appendBool(b, 9, r.FinishWrite)
+	return b
+}
+
+func (r *BidiWriteObjectRequest) Unmarshal(data []byte) error {
+	*r = BidiWriteObjectRequest{}
+	return fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			r.UploadID = string(f.data)
+		case 3:
+			r.WriteOffset = int64(f.v)
+		case 4:
+			r.ChecksummedData = &ChecksummedData{}
+			return r.ChecksummedData.Unmarshal(f.data)
+		case 6:
+			r.ObjectChecksums = &ObjectChecksums{}
+			return r.ObjectChecksums.Unmarshal(f.data)
+		case 7:
+			r.StateLookup = f.v != 0
+		case 8:
+			r.Flush = f.v != 0
+		case 9:
+			r.FinishWrite = f.v != 0
+		}
+		return nil
+	})
+}
+
+// BidiWriteObjectResponse
+
+func (r *BidiWriteObjectResponse) Marshal() []byte {
+	var b []byte
+	if r.Resource != nil {
+		return appendMessage(b, 2, r.Resource)
+	}
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(r.PersistedSize))
+}
+
+func (r *BidiWriteObjectResponse) Unmarshal(data []byte) error {
+	*r = BidiWriteObjectResponse{}
+	return fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			r.PersistedSize = int64(f.v)
+		case 2:
+			r.Resource = &Object{}
+			return r.Resource.Unmarshal(f.data)
+		}
+		return nil
+	})
+}
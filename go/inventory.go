@@ -0,0 +1,343 @@
+package fastgcs
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Shopify/fastgcs/go/internal/parquet"
+)
+
+// Lister is a source of complete listings. FastGCS lists the bucket itself;
+// Inventory answers from a Storage Insights inventory report.
+type Lister interface {
+	List(gsURL string) ([]ObjectAttrs, error)
+	ListDir(gsURL string) (*Listing, error)
+}
+
+// Inventory is the content of a Storage Insights inventory report. Listing
+// an enormous bucket from its inventory is fast and free, but the result is
+// only as current as the report's snapshot: ListDir, ListAll, DiskUsage and
+// Find mark what they get from an Inventory as Stale.
+type Inventory struct {
+	// SnapshotTime is when the report's snapshot of the bucket was taken.
+	SnapshotTime time.Time
+	// Objects holds every object in the report, sorted by bucket and name.
+	Objects []ObjectAttrs
+}
+
+type inventoryManifest struct {
+	SnapshotTime          time.Time `json:"snapshot_time"`
+	ReportShardsFileNames []string  `json:"report_shards_file_names"`
+	ReportConfig          struct {
+		CSVOptions struct {
+			Delimiter string `json:"delimiter"`
+		} `json:"csv_options"`
+	} `json:"report_config"`
+}
+
+// LoadInventory reads the newest inventory report written under reportURL,
+// the gs:// destination configured for the report. Reports are located
+// through their manifest files, and their shards, in CSV or Parquet, are
+// read through the object cache.
+func LoadInventory(fg FastGCS, reportURL string) (*Inventory, error) {
+	reportBucket, _, err := parseGSURL(reportURL)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := fg.List(reportURL)
+	if err != nil {
+		return nil, err
+	}
+	var newest *ObjectAttrs
+	for i := range objects {
+		if !strings.HasSuffix(objects[i].Name, "_manifest.json") {
+			continue
+		}
+		if newest == nil || objects[i].Updated.After(newest.Updated) {
+			newest = &objects[i]
+		}
+	}
+	if newest == nil {
+		return nil, errors.Errorf("no inventory report manifest under %s", reportURL)
+	}
+
+	data, err := fg.Read(newest.URL())
+	if err != nil {
+		return nil, err
+	}
+	var manifest inventoryManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", newest.URL())
+	}
+
+	inv := &Inventory{SnapshotTime: manifest.SnapshotTime}
+	for _, shard := range manifest.ReportShardsFileNames {
+		name := shard
+		if !strings.Contains(shard, "/") {
+			name = path.Join(path.Dir(newest.Name), shard)
+		}
+		shardURL := "gs://" + reportBucket + "/" + name
+		if strings.HasSuffix(shard, ".parquet") {
+			err = inv.readParquetShard(fg, shardURL)
+		} else {
+			err = inv.readShard(fg, shardURL, manifest.ReportConfig.CSVOptions.Delimiter)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", shardURL)
+		}
+	}
+	sort.Slice(inv.Objects, func(i, j int) bool {
+		a, b := &inv.Objects[i], &inv.Objects[j]
+		if a.Bucket != b.Bucket {
+			return a.Bucket < b.Bucket
+		}
+		return a.Name < b.Name
+	})
+	return inv, nil
+}
+
+func (inv *Inventory) readShard(fg FastGCS, shardURL, delimiter string) error {
+	rc, err := fg.Open(shardURL)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	r := csv.NewReader(rc)
+	if delimiter != "" {
+		r.Comma = []rune(delimiter)[0]
+	}
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cols := make(map[string]int, len(header))
+	for i, h := range header {
+		cols[h] = i
+	}
+	if _, ok := cols["name"]; !ok {
+		return errors.New("report has no header row with a name column")
+	}
+
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		inv.Objects = append(inv.Objects, inventoryAttrs(func(col string) string {
+			if i, ok := cols[col]; ok && i < len(rec) {
+				return rec[i]
+			}
+			return ""
+		}))
+	}
+}
+
+// inventoryColumns are the columns of a report that make ObjectAttrs.
+var inventoryColumns = []string{
+	"bucket", "name", "size", "generation", "metageneration", "updated",
+	"contentType", "contentEncoding", "crc32c", "md5Hash", "etag",
+}
+
+// inventoryAttrs makes the ObjectAttrs of a report row, given the value of
+// each column, as text.
+func inventoryAttrs(field func(col string) string) ObjectAttrs {
+	attrs := ObjectAttrs{
+		Bucket:          field("bucket"),
+		Name:            field("name"),
+		ContentType:     field("contentType"),
+		ContentEncoding: field("contentEncoding"),
+		CRC32C:          field("crc32c"),
+		MD5Hash:         field("md5Hash"),
+		ETag:            field("etag"),
+	}
+	attrs.Size, _ = strconv.ParseInt(field("size"), 10, 64)
+	attrs.Generation, _ = strconv.ParseInt(field("generation"), 10, 64)
+	attrs.Metageneration, _ = strconv.ParseInt(field("metageneration"), 10, 64)
+	attrs.Updated, _ = time.Parse(time.RFC3339Nano, field("updated"))
+	return attrs
+}
+
+// readParquetShard reads a shard of a Parquet report. Parquet needs random
+// access, which plain cache entries allow; others are read into memory.
+func (inv *Inventory) readParquetShard(fg FastGCS, shardURL string) error {
+	rc, err := fg.Open(shardURL)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var r io.ReaderAt
+	var size int64
+	if file, ok := rc.(*os.File); ok {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		r, size = file, info.Size()
+	} else {
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+	pf, err := parquet.Open(r, size)
+	if err != nil {
+		return err
+	}
+
+	have := map[string]bool{}
+	for _, col := range pf.Columns() {
+		have[col] = true
+	}
+	if !have["name"] {
+		return errors.New("report has no name column")
+	}
+	var cols []string
+	index := map[string]int{}
+	for _, col := range inventoryColumns {
+		if have[col] {
+			index[col] = len(cols)
+			cols = append(cols, col)
+		}
+	}
+	return pf.Rows(cols, func(row []string) error {
+		inv.Objects = append(inv.Objects, inventoryAttrs(func(col string) string {
+			if i, ok := index[col]; ok {
+				return row[i]
+			}
+			return ""
+		}))
+		return nil
+	})
+}
+
+// span returns the objects in bucket whose names start with prefix.
+func (inv *Inventory) span(bucket, prefix string) []ObjectAttrs {
+	lo := sort.Search(len(inv.Objects), func(i int) bool {
+		o := &inv.Objects[i]
+		return o.Bucket > bucket || (o.Bucket == bucket && o.Name >= prefix)
+	})
+	hi := lo
+	for hi < len(inv.Objects) && inv.Objects[hi].Bucket == bucket && strings.HasPrefix(inv.Objects[hi].Name, prefix) {
+		hi++
+	}
+	return inv.Objects[lo:hi]
+}
+
+// List returns the objects under the gs:// prefix as of the snapshot. Use
+// ListAll for a result that says how old it is.
+func (inv *Inventory) List(gsURL string) ([]ObjectAttrs, error) {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	return inv.span(bucket, prefix), nil
+}
+
+// ListDir lists a single level of the gs:// prefix as of the snapshot. The
+// listing is marked Stale.
+func (inv *Inventory) ListDir(gsURL string) (*Listing, error) {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listing{
+		Bucket:    bucket,
+		Prefix:    prefix,
+		Delimiter: "/",
+		Listed:    inv.SnapshotTime,
+		Stale:     true,
+	}
+	for _, o := range inv.span(bucket, prefix) {
+		rel := strings.TrimPrefix(o.Name, prefix)
+		if i := strings.Index(rel, "/"); i >= 0 {
+			sub := prefix + rel[:i+1]
+			if n := len(l.Prefixes); n == 0 || l.Prefixes[n-1] != sub {
+				l.Prefixes = append(l.Prefixes, sub)
+			}
+			continue
+		}
+		l.Objects = append(l.Objects, o)
+	}
+	return l, nil
+}
+
+// ListAll lists every object under the gs:// prefix through l. The listing
+// is marked Stale if it comes from an Inventory, with the snapshot time as
+// its Listed time.
+func ListAll(l Lister, gsURL string) (*Listing, error) {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	listing := &Listing{Bucket: bucket, Prefix: prefix, Listed: time.Now()}
+	if inv, ok := l.(*Inventory); ok {
+		listing.Listed, listing.Stale = inv.SnapshotTime, true
+	}
+	if listing.Objects, err = l.List(gsURL); err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
+
+// Usage is the result of DiskUsage.
+type Usage struct {
+	Objects int64
+	Bytes   int64
+	// Listed and Stale are those of the listing the usage was summed from.
+	Listed time.Time
+	Stale  bool
+}
+
+// DiskUsage returns the number and total size of the objects under the gs://
+// prefix.
+func DiskUsage(l Lister, gsURL string) (*Usage, error) {
+	listing, err := ListAll(l, gsURL)
+	if err != nil {
+		return nil, err
+	}
+	usage := &Usage{Listed: listing.Listed, Stale: listing.Stale}
+	for i := range listing.Objects {
+		usage.Objects++
+		usage.Bytes += listing.Objects[i].Size
+	}
+	return usage, nil
+}
+
+// Find lists the objects under the gs:// prefix for which match returns
+// true.
+func Find(l Lister, gsURL string, match func(*ObjectAttrs) bool) (*Listing, error) {
+	listing, err := ListAll(l, gsURL)
+	if err != nil {
+		return nil, err
+	}
+	var found []ObjectAttrs
+	for i := range listing.Objects {
+		if match(&listing.Objects[i]) {
+			found = append(found, listing.Objects[i])
+		}
+	}
+	listing.Objects = found
+	return listing, nil
+}
@@ -0,0 +1,811 @@
+// Package jsonfake is an in-process stand-in for the object endpoints of
+// the GCS JSON API: metadata and media downloads, listings, uploads,
+// deletes, composes and rewrites. It holds objects in memory, keeps every
+// generation it creates, and checks preconditions and ranges the way GCS
+// does, so that fastgcs and what's built on it can be exercised without a
+// network:
+//
+//	srv := jsonfake.NewServer()
+//	defer srv.Close()
+//	srv.Put("bucket", "object", []byte("hello"))
+//	fg, err := fastgcs.New(fastgcs.WithHTTPClient(srv.Client()))
+//
+// Requests must carry a bearer token, but any token is accepted.
+package jsonfake
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	// maxComponents is the most components a composite object can have.
+	maxComponents = 1024
+	// maxComposeSources is the most sources a single compose takes.
+	maxComposeSources = 32
+	// maxPageSize is the most objects and prefixes on a listing page.
+	maxPageSize = 1000
+)
+
+// Server serves the stand-in over a local HTTP listener.
+type Server struct {
+	srv *httptest.Server
+
+	mu           sync.Mutex
+	buckets      map[string]*bucket
+	nextGen      int64
+	rewriteChunk int64
+	requests     int
+}
+
+type bucket struct {
+	live map[string]*object
+	// generations holds every generation created in the bucket, live or
+	// not, as GCS keeps noncurrent versions in a versioned bucket.
+	generations map[int64]*object
+}
+
+// object is a generation of an object. It's never modified once stored.
+type object struct {
+	bucket          string
+	name            string
+	contentType     string
+	contentEncoding string
+	// headers holds the Cache-Control, Content-Disposition and
+	// Content-Language set on upload, by their JSON API names.
+	headers    map[string]string
+	metadata   map[string]string
+	data       []byte
+	generation int64
+	components int
+	updated    time.Time
+	crc32c     uint32
+	// md5 is nil for composite objects, which GCS doesn't hash.
+	md5 []byte
+}
+
+// NewServer starts a Server with no buckets.
+func NewServer() *Server {
+	s := &Server{
+		buckets: map[string]*bucket{},
+		nextGen: time.Now().UnixNano() / 1000,
+	}
+	s.srv = httptest.NewServer(s)
+	return s
+}
+
+// Client returns a client that sends requests meant for the GCS JSON API to
+// the server instead.
+func (s *Server) Client() *http.Client {
+	return &http.Client{Transport: &transport{base: s.srv.Client().Transport, host: s.srv.Listener.Addr().String()}}
+}
+
+type transport struct {
+	base http.RoundTripper
+	host string
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host
+	return t.base.RoundTrip(req)
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// CreateBucket creates an empty bucket, unless it exists.
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bucketLocked(name)
+}
+
+func (s *Server) bucketLocked(name string) *bucket {
+	b := s.buckets[name]
+	if b == nil {
+		b = &bucket{live: map[string]*object{}, generations: map[int64]*object{}}
+		s.buckets[name] = b
+	}
+	return b
+}
+
+// Put stores an object, creating its bucket if needed, and returns its
+// generation.
+func (s *Server) Put(bucket, name string, data []byte) int64 {
+	return s.PutEncoded(bucket, name, data, "")
+}
+
+// PutEncoded is Put for content stored with a Content-Encoding, such as
+// gzip.
+func (s *Server) PutEncoded(bucket, name string, data []byte, contentEncoding string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := &object{
+		bucket:          bucket,
+		name:            name,
+		contentType:     "application/octet-stream",
+		contentEncoding: contentEncoding,
+		data:            append([]byte(nil), data...),
+	}
+	s.storeLocked(o)
+	return o.generation
+}
+
+// Get returns the content of the live generation of an object.
+func (s *Server) Get(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b := s.buckets[bucket]; b != nil && b.live[name] != nil {
+		return b.live[name].data, true
+	}
+	return nil, false
+}
+
+// Delete deletes the live generation of an object, reporting whether there
+// was one.
+func (s *Server) Delete(bucket, name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[bucket]
+	if b == nil || b.live[name] == nil {
+		return false
+	}
+	delete(b.live, name)
+	return true
+}
+
+// LimitRewrites makes rewrites copy at most n bytes per call, returning a
+// token to continue with, as GCS does for large objects. Zero, the default,
+// has them copy everything at once.
+func (s *Server) LimitRewrites(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rewriteChunk = n
+}
+
+// Requests returns the number of requests the server has received.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// storeLocked makes o the live generation of its object, giving it a new
+// generation number and its checksums.
+func (s *Server) storeLocked(o *object) {
+	s.nextGen++
+	o.generation = s.nextGen
+	o.updated = time.Now().UTC()
+	o.crc32c = crc32.Checksum(o.data, castagnoli)
+	if o.components == 0 {
+		sum := md5.Sum(o.data)
+		o.md5 = sum[:]
+	}
+	b := s.bucketLocked(o.bucket)
+	b.live[o.name] = o
+	b.generations[o.generation] = o
+}
+
+// lookupLocked returns the given generation of an object, or its live one
+// if generation is zero.
+func (s *Server) lookupLocked(bucketName, name string, generation int64) *object {
+	b := s.buckets[bucketName]
+	if b == nil {
+		return nil
+	}
+	if generation == 0 {
+		return b.live[name]
+	}
+	if o := b.generations[generation]; o != nil && o.name == name {
+		return o
+	}
+	return nil
+}
+
+// checkGenerationLocked reports whether the live generation of an object, zero if
+// there's none, satisfies the ifGenerationMatch query parameter.
+func (s *Server) checkGenerationLocked(q url.Values, bucketName, name string) bool {
+	want := q.Get("ifGenerationMatch")
+	if want == "" {
+		return true
+	}
+	var gen int64
+	if o := s.lookupLocked(bucketName, name, 0); o != nil {
+		gen = o.generation
+	}
+	return want == strconv.FormatInt(gen, 10)
+}
+
+func (o *object) etag() string {
+	return strconv.FormatInt(o.generation, 36)
+}
+
+// resource is the JSON API representation of an object.
+type resource struct {
+	Kind               string            `json:"kind"`
+	Bucket             string            `json:"bucket"`
+	Name               string            `json:"name"`
+	Size               int64             `json:"size,string"`
+	Generation         int64             `json:"generation,string"`
+	Metageneration     int64             `json:"metageneration,string"`
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ContentLanguage    string            `json:"contentLanguage,omitempty"`
+	CRC32C             string            `json:"crc32c"`
+	MD5Hash            string            `json:"md5Hash,omitempty"`
+	ETag               string            `json:"etag"`
+	Updated            string            `json:"updated"`
+	ComponentCount     int               `json:"componentCount,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+func (o *object) resource() *resource {
+	return &resource{
+		Kind:               "storage#object",
+		Bucket:             o.bucket,
+		Name:               o.name,
+		Size:               int64(len(o.data)),
+		Generation:         o.generation,
+		Metageneration:     1,
+		ContentType:        o.contentType,
+		ContentEncoding:    o.contentEncoding,
+		CacheControl:       o.headers["cacheControl"],
+		ContentDisposition: o.headers["contentDisposition"],
+		ContentLanguage:    o.headers["contentLanguage"],
+		CRC32C:             o.crc32cBase64(),
+		MD5Hash:            base64.StdEncoding.EncodeToString(o.md5),
+		ETag:               o.etag(),
+		Updated:            o.updated.Format(time.RFC3339Nano),
+		ComponentCount:     o.components,
+		Metadata:           o.metadata,
+	}
+}
+
+func (o *object) crc32cBase64() string {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], o.crc32c)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// fail answers with a JSON API error.
+func fail(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	var body struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body.Error.Code = code
+	body.Error.Message = fmt.Sprintf(format, args...)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&body)
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// ServeHTTP serves a request for the JSON API, whatever its host.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		fail(w, http.StatusUnauthorized, "Anonymous caller does not have access.")
+		return
+	}
+	// Object names are escaped, slashes included, so each segment of the
+	// raw path is one name.
+	var segs []string
+	for _, seg := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/") {
+		seg, err := url.PathUnescape(seg)
+		if err != nil {
+			fail(w, http.StatusBadRequest, "Invalid path: %v", err)
+			return
+		}
+		segs = append(segs, seg)
+	}
+	route := func(method string, pattern ...string) bool {
+		if r.Method != method || len(segs) != len(pattern) {
+			return false
+		}
+		for i, p := range pattern {
+			if p != "*" && p != segs[i] {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case route("POST", "upload", "storage", "v1", "b", "*", "o"):
+		s.upload(w, r, segs[4])
+	case route("GET", "storage", "v1", "b", "*", "o"):
+		s.list(w, r, segs[3])
+	case route("GET", "storage", "v1", "b", "*", "o", "*"):
+		s.get(w, r, segs[3], segs[5])
+	case route("DELETE", "storage", "v1", "b", "*", "o", "*"):
+		s.delete(w, r, segs[3], segs[5])
+	case route("POST", "storage", "v1", "b", "*", "o", "*", "compose"):
+		s.compose(w, r, segs[3], segs[5])
+	case route("POST", "storage", "v1", "b", "*", "o", "*", "rewriteTo", "b", "*", "o", "*"):
+		s.rewrite(w, r, segs[3], segs[5], segs[8], segs[10])
+	default:
+		fail(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, bucketName, name string) {
+	q := r.URL.Query()
+	var generation int64
+	if g := q.Get("generation"); g != "" {
+		var err error
+		if generation, err = strconv.ParseInt(g, 10, 64); err != nil {
+			fail(w, http.StatusBadRequest, "Invalid generation %q", g)
+			return
+		}
+	}
+	s.mu.Lock()
+	_, bucketExists := s.buckets[bucketName]
+	o := s.lookupLocked(bucketName, name, generation)
+	s.mu.Unlock()
+	switch {
+	case !bucketExists:
+		fail(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	case o == nil:
+		fail(w, http.StatusNotFound, "No such object: %s/%s", bucketName, name)
+		return
+	}
+	if q.Get("alt") == "media" {
+		s.download(w, r, o)
+		return
+	}
+	reply(w, o.resource())
+}
+
+// download sends the content of o. Content stored gzip-encoded is sent as
+// stored to clients that accept gzip, and decompressed for the others,
+// ignoring any Range, as GCS does.
+func (s *Server) download(w http.ResponseWriter, r *http.Request, o *object) {
+	h := w.Header()
+	h.Set("ETag", o.etag())
+	if r.Header.Get("If-None-Match") == o.etag() {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", o.contentType)
+	h.Set("Last-Modified", o.updated.Format(http.TimeFormat))
+	h.Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+	h.Set("X-Goog-Metageneration", "1")
+	h.Set("X-Goog-Stored-Content-Length", strconv.Itoa(len(o.data)))
+	h.Set("X-Goog-Stored-Content-Encoding", "identity")
+	h.Set("X-Goog-Hash", "crc32c="+o.crc32cBase64())
+	if o.md5 != nil {
+		h.Add("X-Goog-Hash", "md5="+base64.StdEncoding.EncodeToString(o.md5))
+	}
+	for k, v := range o.metadata {
+		h.Set("X-Goog-Meta-"+k, v)
+	}
+	for k, v := range map[string]string{
+		"Cache-Control":       o.headers["cacheControl"],
+		"Content-Disposition": o.headers["contentDisposition"],
+		"Content-Language":    o.headers["contentLanguage"],
+	} {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+	data := o.data
+	if o.contentEncoding == "gzip" {
+		h.Set("X-Goog-Stored-Content-Encoding", "gzip")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err == nil {
+				data, err = ioutil.ReadAll(zr)
+			}
+			if err != nil {
+				fail(w, http.StatusInternalServerError, "Can't transcode: %v", err)
+				return
+			}
+			h.Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+			return
+		}
+		h.Set("Content-Encoding", "gzip")
+	}
+
+	rng := r.Header.Get("Range")
+	if rng == "" {
+		h.Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		return
+	}
+	start, end, ok := parseRange(rng, int64(len(data)))
+	if !ok {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+		fail(w, http.StatusRequestedRangeNotSatisfiable, "The requested range cannot be satisfied.")
+		return
+	}
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+	h.Set("Content-Length", strconv.FormatInt(end-start, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(data[start:end])
+}
+
+// parseRange parses a single byte range such as "bytes=0-99", "bytes=100-"
+// or "bytes=-100" into the half-open range it covers of size bytes.
+func parseRange(rng string, size int64) (int64, int64, bool) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	dash := strings.Index(spec, "-")
+	if spec == rng || dash < 0 || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last := spec[:dash], spec[dash+1:]
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return 0, 0, false
+		}
+		if n+1 < end {
+			end = n + 1
+		}
+	}
+	return start, end, true
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bucketName string) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	pageSize := maxPageSize
+	if n, err := strconv.Atoi(q.Get("maxResults")); err == nil && n > 0 && n < pageSize {
+		pageSize = n
+	}
+	var start string
+	if tok := q.Get("pageToken"); tok != "" {
+		data, err := base64.RawURLEncoding.DecodeString(tok)
+		if err != nil {
+			fail(w, http.StatusBadRequest, "Invalid page token")
+			return
+		}
+		start = string(data)
+	}
+
+	s.mu.Lock()
+	b := s.buckets[bucketName]
+	if b == nil {
+		s.mu.Unlock()
+		fail(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	// Objects and prefixes share the pages, in name order.
+	type entry struct {
+		name   string
+		object *object
+	}
+	var entries []entry
+	seen := map[string]bool{}
+	for name, o := range b.live {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				p := name[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					entries = append(entries, entry{name: p})
+				}
+				continue
+			}
+		}
+		entries = append(entries, entry{name: name, object: o})
+	}
+	s.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	var page struct {
+		Kind          string      `json:"kind"`
+		Items         []*resource `json:"items,omitempty"`
+		Prefixes      []string    `json:"prefixes,omitempty"`
+		NextPageToken string      `json:"nextPageToken,omitempty"`
+	}
+	page.Kind = "storage#objects"
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].name >= start })
+	for n := 0; i < len(entries) && n < pageSize; i, n = i+1, n+1 {
+		if e := entries[i]; e.object != nil {
+			page.Items = append(page.Items, e.object.resource())
+		} else {
+			page.Prefixes = append(page.Prefixes, e.name)
+		}
+	}
+	if i < len(entries) {
+		page.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(entries[i].name))
+	}
+	reply(w, &page)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, bucketName, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[bucketName]
+	if b == nil || b.live[name] == nil {
+		fail(w, http.StatusNotFound, "No such object: %s/%s", bucketName, name)
+		return
+	}
+	if !s.checkGenerationLocked(r.URL.Query(), bucketName, name) {
+		fail(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+	delete(b.live, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// upload serves a multipart upload: a part with the object's metadata
+// followed by one with its content.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, bucketName string) {
+	q := r.URL.Query()
+	if q.Get("uploadType") != "multipart" {
+		fail(w, http.StatusBadRequest, "Unsupported upload type %q", q.Get("uploadType"))
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		fail(w, http.StatusBadRequest, "Expected multipart/related content")
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var meta struct {
+		Name               string            `json:"name"`
+		ContentType        string            `json:"contentType"`
+		ContentEncoding    string            `json:"contentEncoding"`
+		CacheControl       string            `json:"cacheControl"`
+		ContentDisposition string            `json:"contentDisposition"`
+		ContentLanguage    string            `json:"contentLanguage"`
+		Metadata           map[string]string `json:"metadata"`
+	}
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&meta)
+	}
+	var data []byte
+	if err == nil {
+		part, err = mr.NextPart()
+	}
+	if err == nil {
+		data, err = ioutil.ReadAll(part)
+	}
+	if err != nil {
+		fail(w, http.StatusBadRequest, "Malformed multipart body: %v", err)
+		return
+	}
+	if !validName(meta.Name) {
+		fail(w, http.StatusBadRequest, "Invalid object name %q", meta.Name)
+		return
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucketName] == nil {
+		fail(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	if !s.checkGenerationLocked(q, bucketName, meta.Name) {
+		fail(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+	o := &object{
+		bucket:          bucketName,
+		name:            meta.Name,
+		contentType:     meta.ContentType,
+		contentEncoding: meta.ContentEncoding,
+		headers: map[string]string{
+			"cacheControl":       meta.CacheControl,
+			"contentDisposition": meta.ContentDisposition,
+			"contentLanguage":    meta.ContentLanguage,
+		},
+		metadata: meta.Metadata,
+		data:     data,
+	}
+	s.storeLocked(o)
+	reply(w, o.resource())
+}
+
+// validName reports whether GCS accepts name as an object name.
+func validName(name string) bool {
+	return name != "" && len(name) <= 1024 && utf8.ValidString(name) &&
+		!strings.ContainsAny(name, "\r\n") && name != "." && name != ".."
+}
+
+func (s *Server) compose(w http.ResponseWriter, r *http.Request, bucketName, name string) {
+	var body struct {
+		SourceObjects []struct {
+			Name       string `json:"name"`
+			Generation int64  `json:"generation,string"`
+		} `json:"sourceObjects"`
+		Destination struct {
+			ContentType string            `json:"contentType"`
+			Metadata    map[string]string `json:"metadata"`
+		} `json:"destination"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fail(w, http.StatusBadRequest, "Malformed compose request: %v", err)
+		return
+	}
+	if n := len(body.SourceObjects); n == 0 || n > maxComposeSources {
+		fail(w, http.StatusBadRequest, "The number of source components provided (%d) exceeds the maximum (%d).", n, maxComposeSources)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucketName] == nil {
+		fail(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	if !s.checkGenerationLocked(r.URL.Query(), bucketName, name) {
+		fail(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+	o := &object{
+		bucket:      bucketName,
+		name:        name,
+		contentType: body.Destination.ContentType,
+		metadata:    body.Destination.Metadata,
+	}
+	for _, src := range body.SourceObjects {
+		so := s.lookupLocked(bucketName, src.Name, src.Generation)
+		if so == nil {
+			fail(w, http.StatusNotFound, "Object %s (generation: %d) not found.", src.Name, src.Generation)
+			return
+		}
+		o.data = append(o.data, so.data...)
+		if so.components > 0 {
+			o.components += so.components
+		} else {
+			o.components++
+		}
+	}
+	if o.components > maxComponents {
+		fail(w, http.StatusBadRequest, "The number of components in the composed object (%d) exceeds the maximum (%d).", o.components, maxComponents)
+		return
+	}
+	if o.contentType == "" {
+		o.contentType = "application/octet-stream"
+	}
+	s.storeLocked(o)
+	reply(w, o.resource())
+}
+
+// rewriteToken is what a rewrite token encodes: the rewrite it continues
+// and how far it got.
+type rewriteToken struct {
+	Source      string `json:"s"`
+	Generation  int64  `json:"g"`
+	Destination string `json:"d"`
+	Done        int64  `json:"n"`
+}
+
+func (s *Server) rewrite(w http.ResponseWriter, r *http.Request, srcBucket, srcName, dstBucket, dstName string) {
+	q := r.URL.Query()
+	var generation int64
+	if g := q.Get("sourceGeneration"); g != "" {
+		var err error
+		if generation, err = strconv.ParseInt(g, 10, 64); err != nil {
+			fail(w, http.StatusBadRequest, "Invalid sourceGeneration %q", g)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[dstBucket] == nil {
+		fail(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	src := s.lookupLocked(srcBucket, srcName, generation)
+	if src == nil {
+		fail(w, http.StatusNotFound, "No such object: %s/%s", srcBucket, srcName)
+		return
+	}
+	if !s.checkGenerationLocked(q, dstBucket, dstName) {
+		fail(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+	tok := rewriteToken{Source: srcBucket + "/" + srcName, Generation: src.generation, Destination: dstBucket + "/" + dstName}
+	if t := q.Get("rewriteToken"); t != "" {
+		var prev rewriteToken
+		data, err := base64.RawURLEncoding.DecodeString(t)
+		if err == nil {
+			err = json.Unmarshal(data, &prev)
+		}
+		if err != nil || prev.Source != tok.Source || prev.Generation != tok.Generation || prev.Destination != tok.Destination {
+			fail(w, http.StatusBadRequest, "Invalid rewrite token.")
+			return
+		}
+		tok.Done = prev.Done
+	}
+
+	size := int64(len(src.data))
+	if s.rewriteChunk > 0 && tok.Done+s.rewriteChunk < size {
+		tok.Done += s.rewriteChunk
+	} else {
+		tok.Done = size
+	}
+	var status struct {
+		Kind                string    `json:"kind"`
+		TotalBytesRewritten int64     `json:"totalBytesRewritten,string"`
+		ObjectSize          int64     `json:"objectSize,string"`
+		Done                bool      `json:"done"`
+		RewriteToken        string    `json:"rewriteToken,omitempty"`
+		Resource            *resource `json:"resource,omitempty"`
+	}
+	status.Kind = "storage#rewriteResponse"
+	status.TotalBytesRewritten = tok.Done
+	status.ObjectSize = size
+	if tok.Done < size {
+		data, _ := json.Marshal(&tok)
+		status.RewriteToken = base64.RawURLEncoding.EncodeToString(data)
+		reply(w, &status)
+		return
+	}
+	// Rewriting copies the data, so the result isn't composite.
+	o := &object{
+		bucket:          dstBucket,
+		name:            dstName,
+		contentType:     src.contentType,
+		contentEncoding: src.contentEncoding,
+		headers:         src.headers,
+		metadata:        src.metadata,
+		data:            src.data,
+	}
+	s.storeLocked(o)
+	status.Done = true
+	status.Resource = o.resource()
+	reply(w, &status)
+}
@@ -0,0 +1,173 @@
+package fastgcs
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const apiBase = "https://storage.googleapis.com/storage/v1"
+
+// ObjectAttrs is the subset of a GCS object resource that fastgcs uses.
+type ObjectAttrs struct {
+	Bucket          string    `json:"bucket"`
+	Name            string    `json:"name"`
+	Size            int64     `json:"size,string"`
+	Generation      int64     `json:"generation,string"`
+	Metageneration  int64     `json:"metageneration,string"`
+	ContentType     string    `json:"contentType,omitempty"`
+	ContentEncoding string    `json:"contentEncoding,omitempty"`
+	CRC32C          string    `json:"crc32c,omitempty"`
+	MD5Hash         string    `json:"md5Hash,omitempty"`
+	ETag            string    `json:"etag,omitempty"`
+	Updated         time.Time `json:"updated"`
+
+	CacheControl       string `json:"cacheControl,omitempty"`
+	ContentDisposition string `json:"contentDisposition,omitempty"`
+	ContentLanguage    string `json:"contentLanguage,omitempty"`
+	// ComponentCount is the number of source objects a composite object
+	// was made of.
+	ComponentCount int `json:"componentCount,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// URL returns the gs:// URL of the object.
+func (a *ObjectAttrs) URL() string {
+	return fmt.Sprintf("gs://%s/%s", a.Bucket, a.Name)
+}
+
+type listResponse struct {
+	Items         []ObjectAttrs `json:"items"`
+	Prefixes      []string      `json:"prefixes"`
+	NextPageToken string        `json:"nextPageToken"`
+}
+
+func (f *fastGCS) Stat(gsURL string) (*ObjectAttrs, error) {
+	bucket, object, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	var attrs ObjectAttrs
+	if err := f.getJSON(apiObjectURL(bucket, object), &attrs); err != nil {
+		return nil, err
+	}
+	return &attrs, nil
+}
+
+// List returns every object whose name starts with the object part of
+// gsURL, e.g. gs://bucket/some/prefix/.
+func (f *fastGCS) List(gsURL string) ([]ObjectAttrs, error) {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	l, err := f.listAll(bucket, prefix, "", false)
+	if err != nil {
+		return nil, err
+	}
+	return l.Objects, nil
+}
+
+// ListDir lists a single level of the gs:// prefix, using "/" as the
+// delimiter.
+func (f *fastGCS) ListDir(gsURL string) (*Listing, error) {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	return f.listAll(bucket, prefix, "/", false)
+}
+
+// ListDirCached is ListDir served from the listing cache when it holds a
+// recent listing that reflects every write and delete made through
+// fastgcs since. Changes made by other clients may take up to the cache's
+// TTL to show up, so it suits browsing, globbing and completion rather than
+// deciding what to copy or delete.
+func (f *fastGCS) ListDirCached(gsURL string) (*Listing, error) {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	return f.listAll(bucket, prefix, "/", true)
+}
+
+// ListOptions configures ListPages.
+type ListOptions struct {
+	// Delimiter, if set, groups names containing it after the prefix into
+	// ListPage.Prefixes, e.g. "/" to list a single directory level.
+	Delimiter string
+	// PageToken resumes a listing at the page a previous ListPage's
+	// NextPageToken pointed to.
+	PageToken string
+	// PageSize, if positive, caps the number of objects and prefixes on
+	// each page. GCS picks the size otherwise, up to 1000.
+	PageSize int
+}
+
+// ListPage is one page of a listing.
+type ListPage struct {
+	Bucket   string
+	Objects  []ObjectAttrs
+	Prefixes []string
+	// NextPageToken is the token to pass as ListOptions.PageToken to
+	// continue after this page. It is empty on the last page.
+	NextPageToken string
+}
+
+// ListPages lists the objects under the gs:// prefix, calling fn with each
+// page in order. It stops at the first error fn returns.
+func (f *fastGCS) ListPages(gsURL string, opts ListOptions, fn func(*ListPage) error) error {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := f.listPage(bucket, prefix, opts)
+		if err != nil {
+			return err
+		}
+		page := &ListPage{
+			Bucket:        bucket,
+			Objects:       res.Items,
+			Prefixes:      res.Prefixes,
+			NextPageToken: res.NextPageToken,
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		opts.PageToken = page.NextPageToken
+	}
+}
+
+func (f *fastGCS) listPage(bucket, prefix string, opts ListOptions) (*listResponse, error) {
+	q := url.Values{}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if opts.Delimiter != "" {
+		q.Set("delimiter", opts.Delimiter)
+	}
+	if opts.PageToken != "" {
+		q.Set("pageToken", opts.PageToken)
+	}
+	if opts.PageSize > 0 {
+		q.Set("maxResults", fmt.Sprint(opts.PageSize))
+	}
+	u := fmt.Sprintf("%s/b/%s/o?%s", apiBase, url.PathEscape(bucket), q.Encode())
+
+	var page listResponse
+	if err := f.getJSON(u, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// apiObjectURL returns the JSON API URL of an object's metadata.
+func apiObjectURL(bucket, object string) string {
+	return fmt.Sprintf("%s/b/%s/o/%s", apiBase, url.PathEscape(bucket), url.PathEscape(object))
+}
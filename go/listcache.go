@@ -0,0 +1,298 @@
+package fastgcs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultListCacheTTL = time.Minute
+
+	// listJournalMaxSize is the size above which a bucket's write journal
+	// is compacted down to the records that can still affect a cached
+	// listing.
+	listJournalMaxSize = 256 << 10
+)
+
+// WithListCacheTTL sets how long listings from ListDirCached, which FS,
+// Glob and shell completion use, are served from the listing cache before
+// the bucket is listed again. Zero disables the cache. The default is one
+// minute. List and ListDir always list the bucket.
+func WithListCacheTTL(ttl time.Duration) Option {
+	return func(f *fastGCS) {
+		f.listCache.ttl = ttl
+	}
+}
+
+// Listing is the complete listing of a prefix, possibly served from the
+// listing cache.
+type Listing struct {
+	Bucket    string        `json:"bucket"`
+	Prefix    string        `json:"prefix"`
+	Delimiter string        `json:"delimiter,omitempty"`
+	Objects   []ObjectAttrs `json:"objects"`
+	Prefixes  []string      `json:"prefixes,omitempty"`
+	// Listed is when the listing was started.
+	Listed time.Time `json:"listed"`
+	// Stale is set when the listing comes from a snapshot, such as an
+	// inventory report, and may not reflect recent changes.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// listCache stores complete listings under the cache root, keyed by bucket,
+// prefix and delimiter, so they are shared by every process using the same
+// cache root.
+//
+// Writes and deletes made through fastgcs are appended to a per-bucket
+// journal rather than rewriting cached listings. A cached listing is only
+// used if it reflects every journaled change under its prefix since it was
+// listed, i.e. it contains the written generation (or a newer one) and none
+// of the deleted objects. This keeps concurrent processes from caching a
+// listing that raced with a write.
+type listCache struct {
+	dir string
+	ttl time.Duration
+}
+
+type listJournalRecord struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation,omitempty"`
+	Deleted    bool   `json:"deleted,omitempty"`
+	// Prefix marks a change to every object under Name, such as a folder
+	// rename.
+	Prefix bool      `json:"prefix,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// bucketNameRegexp matches the characters of bucket names, which are safe
+// to use as a directory name: no separators, and never "." or "..". It's
+// looser than GCS about length, leaving that to the API.
+var bucketNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,220}[a-z0-9])?$`)
+
+func (c *listCache) enabled() bool {
+	return c.ttl > 0
+}
+
+// caches reports whether listings of bucket can be cached.
+func (c *listCache) caches(bucket string) bool {
+	return c.enabled() && bucketNameRegexp.MatchString(bucket)
+}
+
+func (c *listCache) bucketDir(bucket string) string {
+	return filepath.Join(c.dir, bucket)
+}
+
+func (c *listCache) entryPath(bucket, prefix, delimiter string) string {
+	sum := sha1.Sum([]byte(prefix + "\x00" + delimiter))
+	return filepath.Join(c.bucketDir(bucket), hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *listCache) journalPath(bucket string) string {
+	return filepath.Join(c.bucketDir(bucket), "journal")
+}
+
+// get returns the cached listing, or nil if there is no usable one.
+func (c *listCache) get(bucket, prefix, delimiter string) *Listing {
+	if !c.caches(bucket) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.entryPath(bucket, prefix, delimiter))
+	if err != nil {
+		return nil
+	}
+	var l Listing
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil
+	}
+	if l.Prefix != prefix || l.Delimiter != delimiter || time.Since(l.Listed) > c.ttl {
+		return nil
+	}
+	for _, rec := range c.journal(bucket) {
+		if rec.Time.Before(l.Listed) {
+			continue
+		}
+		if rec.Prefix && (strings.HasPrefix(rec.Name, prefix) || strings.HasPrefix(prefix, rec.Name)) {
+			return nil
+		}
+		if rec.Prefix || !strings.HasPrefix(rec.Name, prefix) {
+			continue
+		}
+		if !l.reflects(rec) {
+			return nil
+		}
+	}
+	return &l
+}
+
+func (c *listCache) put(l *Listing) error {
+	if !c.caches(l.Bucket) {
+		return errors.Errorf("listings of bucket %q aren't cached", l.Bucket)
+	}
+	if err := os.MkdirAll(c.bucketDir(l.Bucket), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.entryPath(l.Bucket, l.Prefix, l.Delimiter), data, 0644)
+}
+
+// noteWrite records that attrs was just written, invalidating cached
+// listings that don't include it.
+func (c *listCache) noteWrite(attrs *ObjectAttrs) {
+	c.appendJournal(attrs.Bucket, listJournalRecord{Name: attrs.Name, Generation: attrs.Generation})
+}
+
+// noteDelete records that an object was just deleted, invalidating cached
+// listings that still include it.
+func (c *listCache) noteDelete(bucket, name string) {
+	c.appendJournal(bucket, listJournalRecord{Name: name, Deleted: true})
+}
+
+// notePrefixChange records that any object under prefix may have just
+// changed, invalidating every cached listing that overlaps it.
+func (c *listCache) notePrefixChange(bucket, prefix string) {
+	c.appendJournal(bucket, listJournalRecord{Name: prefix, Prefix: true})
+}
+
+func (c *listCache) appendJournal(bucket string, rec listJournalRecord) {
+	if !c.caches(bucket) {
+		return
+	}
+	if err := os.MkdirAll(c.bucketDir(bucket), 0755); err != nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	path := c.journalPath(bucket)
+	jf, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	jf.Write(append(data, '\n'))
+	info, err := jf.Stat()
+	jf.Close()
+	if err == nil && info.Size() > listJournalMaxSize {
+		c.compactJournal(bucket)
+	}
+}
+
+func (c *listCache) journal(bucket string) []listJournalRecord {
+	data, err := ioutil.ReadFile(c.journalPath(bucket))
+	if err != nil {
+		return nil
+	}
+	var recs []listJournalRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var rec listJournalRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+// compactJournal drops records older than the TTL: any listing listed
+// before them has expired anyway. If the rest still takes more than half
+// the maximum size, the bucket's cached listings are dropped along with the
+// whole journal, rather than compacting again on every write. A record
+// appended by another process while compacting may be lost, which at worst
+// leaves a stale listing in use until it expires.
+func (c *listCache) compactJournal(bucket string) {
+	cutoff := time.Now().Add(-c.ttl)
+	var buf bytes.Buffer
+	for _, rec := range c.journal(bucket) {
+		if rec.Time.Before(cutoff) {
+			continue
+		}
+		data, _ := json.Marshal(rec)
+		buf.Write(append(data, '\n'))
+	}
+	if buf.Len() > listJournalMaxSize/2 {
+		entries, _ := filepath.Glob(filepath.Join(c.bucketDir(bucket), "*.json"))
+		for _, entry := range entries {
+			os.Remove(entry)
+		}
+		buf.Reset()
+	}
+	writeFileAtomic(c.journalPath(bucket), buf.Bytes(), 0644)
+}
+
+// reflects reports whether the listing already accounts for rec.
+func (l *Listing) reflects(rec listJournalRecord) bool {
+	rel := strings.TrimPrefix(rec.Name, l.Prefix)
+	if l.Delimiter != "" {
+		if i := strings.Index(rel, l.Delimiter); i >= 0 {
+			// The change is below one of this listing's prefixes. A write
+			// must show up as that prefix; a delete may or may not have
+			// emptied it, so we can't tell.
+			if rec.Deleted {
+				return false
+			}
+			sub := l.Prefix + rel[:i+len(l.Delimiter)]
+			for _, p := range l.Prefixes {
+				if p == sub {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	for i := range l.Objects {
+		if l.Objects[i].Name == rec.Name {
+			return !rec.Deleted && l.Objects[i].Generation >= rec.Generation
+		}
+	}
+	return rec.Deleted
+}
+
+// listAll returns the complete listing of prefix, from the listing cache if
+// cached is set and it has a usable one.
+func (f *fastGCS) listAll(bucket, prefix, delimiter string, cached bool) (*Listing, error) {
+	if cached {
+		if l := f.listCache.get(bucket, prefix, delimiter); l != nil {
+			return l, nil
+		}
+	}
+
+	l := &Listing{
+		Bucket:    bucket,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		Listed:    time.Now().UTC(),
+	}
+	opts := ListOptions{Delimiter: delimiter}
+	for {
+		page, err := f.listPage(bucket, prefix, opts)
+		if err != nil {
+			return nil, err
+		}
+		l.Objects = append(l.Objects, page.Items...)
+		l.Prefixes = append(l.Prefixes, page.Prefixes...)
+		if page.NextPageToken == "" {
+			break
+		}
+		opts.PageToken = page.NextPageToken
+	}
+
+	if cached {
+		f.listCache.put(l)
+	}
+	return l, nil
+}
@@ -0,0 +1,235 @@
+package fastgcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestListCache(t *testing.T) *listCache {
+	return &listCache{dir: t.TempDir(), ttl: time.Minute}
+}
+
+func TestListCacheJournal(t *testing.T) {
+	listing := func() *Listing {
+		return &Listing{
+			Bucket: "b",
+			Prefix: "p/",
+			Objects: []ObjectAttrs{
+				{Bucket: "b", Name: "p/a", Generation: 5},
+				{Bucket: "b", Name: "p/b", Generation: 5},
+			},
+			Listed: time.Now().UTC().Add(-time.Second),
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(c *listCache)
+		usable bool
+	}{
+		{"no change", func(c *listCache) {}, true},
+		{"write it reflects", func(c *listCache) {
+			c.noteWrite(&ObjectAttrs{Bucket: "b", Name: "p/a", Generation: 5})
+		}, true},
+		{"newer write", func(c *listCache) {
+			c.noteWrite(&ObjectAttrs{Bucket: "b", Name: "p/a", Generation: 6})
+		}, false},
+		{"new object", func(c *listCache) {
+			c.noteWrite(&ObjectAttrs{Bucket: "b", Name: "p/c", Generation: 1})
+		}, false},
+		{"delete of a listed object", func(c *listCache) { c.noteDelete("b", "p/a") }, false},
+		{"delete of an unlisted object", func(c *listCache) { c.noteDelete("b", "p/z") }, true},
+		{"write outside the prefix", func(c *listCache) {
+			c.noteWrite(&ObjectAttrs{Bucket: "b", Name: "q/a", Generation: 1})
+		}, true},
+		{"write to another bucket", func(c *listCache) {
+			c.noteWrite(&ObjectAttrs{Bucket: "other", Name: "p/c", Generation: 1})
+		}, true},
+		{"prefix change below", func(c *listCache) { c.notePrefixChange("b", "p/sub/") }, false},
+		{"prefix change above", func(c *listCache) { c.notePrefixChange("b", "") }, false},
+		{"prefix change elsewhere", func(c *listCache) { c.notePrefixChange("b", "q/") }, true},
+	}
+	for _, tt := range tests {
+		c := newTestListCache(t)
+		if err := c.put(listing()); err != nil {
+			t.Fatal(err)
+		}
+		tt.change(c)
+		if got := c.get("b", "p/", "") != nil; got != tt.usable {
+			t.Errorf("%s: cached listing usable = %v, want %v", tt.name, got, tt.usable)
+		}
+	}
+}
+
+func TestListCacheDelimiter(t *testing.T) {
+	listing := &Listing{
+		Bucket:    "b",
+		Prefix:    "p/",
+		Delimiter: "/",
+		Objects:   []ObjectAttrs{{Bucket: "b", Name: "p/a", Generation: 1}},
+		Prefixes:  []string{"p/dir/"},
+		Listed:    time.Now().UTC().Add(-time.Second),
+	}
+	tests := []struct {
+		name   string
+		change func(c *listCache)
+		usable bool
+	}{
+		{"write under a listed prefix", func(c *listCache) {
+			c.noteWrite(&ObjectAttrs{Bucket: "b", Name: "p/dir/x", Generation: 1})
+		}, true},
+		{"write under a new prefix", func(c *listCache) {
+			c.noteWrite(&ObjectAttrs{Bucket: "b", Name: "p/new/x", Generation: 1})
+		}, false},
+		{"delete under a listed prefix", func(c *listCache) { c.noteDelete("b", "p/dir/x") }, false},
+	}
+	for _, tt := range tests {
+		c := newTestListCache(t)
+		if err := c.put(listing); err != nil {
+			t.Fatal(err)
+		}
+		tt.change(c)
+		if got := c.get("b", "p/", "/") != nil; got != tt.usable {
+			t.Errorf("%s: cached listing usable = %v, want %v", tt.name, got, tt.usable)
+		}
+		if c.get("b", "p/", "") != nil {
+			t.Errorf("%s: listing served for another delimiter", tt.name)
+		}
+	}
+}
+
+func TestListCacheExpiry(t *testing.T) {
+	c := newTestListCache(t)
+	c.put(&Listing{Bucket: "b", Prefix: "p/", Listed: time.Now().UTC().Add(-2 * c.ttl)})
+	if c.get("b", "p/", "") != nil {
+		t.Error("expired listing served")
+	}
+	// Changes journaled before a listing started don't affect it.
+	c.noteDelete("b", "p/a")
+	c.put(&Listing{
+		Bucket:  "b",
+		Prefix:  "p/",
+		Objects: []ObjectAttrs{{Bucket: "b", Name: "p/a", Generation: 2}},
+		Listed:  time.Now().UTC().Add(time.Second),
+	})
+	if c.get("b", "p/", "") == nil {
+		t.Error("listing invalidated by a change made before it")
+	}
+}
+
+// fillJournal writes records of the given age to the journal of bucket "b"
+// until it's about to be compacted.
+func fillJournal(t *testing.T, c *listCache, age time.Duration) {
+	t.Helper()
+	if err := os.MkdirAll(c.bucketDir("b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < listJournalMaxSize; i++ {
+		data, err := json.Marshal(listJournalRecord{Name: fmt.Sprintf("p/%d", i), Deleted: true, Time: time.Now().Add(-age)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(append(data, '\n'))
+	}
+	if err := ioutil.WriteFile(c.journalPath("b"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListCacheCompaction(t *testing.T) {
+	c := newTestListCache(t)
+	fillJournal(t, c, 2*c.ttl)
+	c.put(&Listing{Bucket: "b", Prefix: "q/", Listed: time.Now().UTC().Add(-time.Second)})
+	c.noteWrite(&ObjectAttrs{Bucket: "b", Name: "p/new", Generation: 1})
+
+	recs := c.journal("b")
+	if len(recs) != 1 || recs[0].Name != "p/new" {
+		t.Errorf("compacted journal holds %d records, want only the recent one", len(recs))
+	}
+	if c.get("b", "q/", "") == nil {
+		t.Error("compaction dropped a cached listing")
+	}
+}
+
+func TestListCacheCompactionOfRecentWrites(t *testing.T) {
+	c := newTestListCache(t)
+	fillJournal(t, c, 0)
+	c.put(&Listing{Bucket: "b", Prefix: "q/", Listed: time.Now().UTC().Add(-time.Second)})
+	c.noteWrite(&ObjectAttrs{Bucket: "b", Name: "p/new", Generation: 1})
+
+	if recs := c.journal("b"); len(recs) != 0 {
+		t.Errorf("journal holds %d records, want it emptied", len(recs))
+	}
+	if c.get("b", "q/", "") != nil {
+		t.Error("cached listing kept after its journal was emptied")
+	}
+}
+
+func TestListDirCached(t *testing.T) {
+	f, srv := newJSONTest(t)
+	srv.Put("b", "p/a", []byte("a"))
+
+	listings := func(list func(string) (*Listing, error)) int {
+		t.Helper()
+		before := srv.Requests()
+		if _, err := list("gs://b/p/"); err != nil {
+			t.Fatal(err)
+		}
+		return srv.Requests() - before
+	}
+	for i := 0; i < 2; i++ {
+		if n := listings(f.ListDir); n != 1 {
+			t.Errorf("ListDir made %d requests, want it to list the bucket every time", n)
+		}
+	}
+	if n := listings(f.ListDirCached); n != 1 {
+		t.Errorf("first ListDirCached made %d requests, want 1", n)
+	}
+	if n := listings(f.ListDirCached); n != 0 {
+		t.Errorf("second ListDirCached made %d requests, want it served from the cache", n)
+	}
+
+	w, err := f.Create("gs://b/p/b", WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("b"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := f.ListDirCached("gs://b/p/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Objects) != 2 {
+		t.Errorf("ListDirCached after a write listed %d objects, want 2", len(l.Objects))
+	}
+}
+
+func TestListCacheBucketNames(t *testing.T) {
+	root := t.TempDir()
+	c := &listCache{dir: filepath.Join(root, "listings"), ttl: time.Minute}
+	for _, bucket := range []string{".", "..", "a..", "-b", "B", "a\\b"} {
+		if err := c.put(&Listing{Bucket: bucket, Listed: time.Now().UTC()}); err == nil {
+			t.Errorf("listing of bucket %q cached", bucket)
+		}
+		c.noteDelete(bucket, "o")
+		if c.get(bucket, "", "") != nil {
+			t.Errorf("listing of bucket %q served", bucket)
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("cache wrote %d entries for invalid bucket names, want none", len(entries))
+	}
+	for _, bucket := range []string{"b", "my-bucket", "my_bucket.example.com"} {
+		if err := c.put(&Listing{Bucket: bucket, Listed: time.Now().UTC()}); err != nil {
+			t.Errorf("listing of bucket %q not cached: %v", bucket, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package fastgcs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxNameElem is the longest file name most local filesystems accept, in
+// bytes.
+const maxNameElem = 255
+
+// InvalidNameError reports an object name that has no safe local path.
+type InvalidNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidNameError) Error() string {
+	return fmt.Sprintf("%q has no safe local path: %s", e.Name, e.Reason)
+}
+
+// InvalidNamesError lists the objects a recursive copy skipped because they
+// have no safe local path.
+type InvalidNamesError []*InvalidNameError
+
+func (e InvalidNamesError) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("skipped %d objects with no safe local path, the first: %v", len(e), e[0])
+}
+
+// LocalPath maps name, an object name relative to the prefix being copied,
+// to a path under dir, with "/" as the directory separator. It refuses,
+// with an *InvalidNameError, names that would land outside dir or anywhere
+// but under their own name: names with empty, "." or ".." elements, names
+// starting with "/", directory placeholders ending with "/", and names
+// with elements the local filesystem can't hold (NUL characters, elements
+// over 255 bytes, and on Windows reserved characters and device names).
+func LocalPath(dir, name string) (string, error) {
+	path, reason := localPath(dir, name)
+	if reason != "" {
+		return "", &InvalidNameError{Name: name, Reason: reason}
+	}
+	return path, nil
+}
+
+// localPath is LocalPath, returning why name has no safe path instead of
+// an error.
+func localPath(dir, name string) (path, reason string) {
+	switch {
+	case name == "":
+		return "", "empty name"
+	case strings.HasPrefix(name, "/"):
+		return "", "absolute path"
+	case strings.HasSuffix(name, "/"):
+		return "", "directory placeholder"
+	}
+	elems := strings.Split(name, "/")
+	for _, elem := range elems {
+		if reason := invalidNameElem(elem); reason != "" {
+			return "", reason
+		}
+	}
+	return filepath.Join(append([]string{dir}, elems...)...), ""
+}
+
+func invalidNameElem(elem string) string {
+	switch {
+	case elem == "":
+		return "empty path element"
+	case elem == "." || elem == "..":
+		return fmt.Sprintf("%q path element", elem)
+	case len(elem) > maxNameElem:
+		return fmt.Sprintf("path element longer than %d bytes", maxNameElem)
+	case strings.IndexByte(elem, 0) >= 0:
+		return "NUL character"
+	}
+	if runtime.GOOS == "windows" {
+		return invalidWindowsNameElem(elem)
+	}
+	return ""
+}
+
+func invalidWindowsNameElem(elem string) string {
+	for _, r := range elem {
+		if r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r) {
+			return fmt.Sprintf("character %q isn't allowed on Windows", r)
+		}
+	}
+	if strings.HasSuffix(elem, ".") || strings.HasSuffix(elem, " ") {
+		return "trailing dot or space isn't allowed on Windows"
+	}
+	device := strings.ToUpper(elem)
+	if i := strings.IndexByte(device, '.'); i >= 0 {
+		device = device[:i]
+	}
+	switch device {
+	case "CON", "PRN", "AUX", "NUL",
+		"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+		"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9":
+		return fmt.Sprintf("%s is a reserved device name on Windows", device)
+	}
+	return ""
+}
+
+// caseInsensitiveFS reports whether local file names are usually compared
+// without regard to case, as on macOS and Windows.
+var caseInsensitiveFS = runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+
+// localTree maps objects under a prefix to paths under a local directory,
+// setting aside those that have no safe path or that collide with one
+// another.
+type localTree struct {
+	// Files maps local paths to the objects copied there, and Dirs lists
+	// the directories to create for placeholders, both in name order.
+	Files   []localFile
+	Dirs    []string
+	Invalid InvalidNamesError
+}
+
+type localFile struct {
+	Path  string
+	Attrs ObjectAttrs
+}
+
+// mapLocalTree maps objects, whose names all start with prefix, to paths
+// under dir. Besides the names LocalPath refuses, it sets aside objects
+// whose name is also a directory (the object "a" next to "a/b" or to the
+// placeholder "a/"), and, on case-insensitive filesystems, objects whose names only
+// differ in case, keeping the first in name order.
+func mapLocalTree(dir, prefix string, objects []ObjectAttrs) *localTree {
+	fold := func(s string) string {
+		if caseInsensitiveFS {
+			return strings.ToLower(s)
+		}
+		return s
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+
+	t := &localTree{}
+	rels := make([]string, len(objects))
+	parents := map[string]bool{}
+	for i := range objects {
+		rel := strings.TrimPrefix(objects[i].Name, prefix)
+		rels[i] = rel
+		if strings.HasSuffix(rel, "/") {
+			parents[fold(strings.TrimSuffix(rel, "/"))] = true
+		}
+		for d := strings.TrimSuffix(rel, "/"); ; {
+			j := strings.LastIndexByte(d, '/')
+			if j < 0 {
+				break
+			}
+			d = d[:j]
+			parents[fold(d)] = true
+		}
+	}
+
+	seen := map[string]string{}
+	for i, rel := range rels {
+		if rel == "" {
+			continue // the placeholder of the prefix itself
+		}
+		name := objects[i].Name
+		placeholder := strings.HasSuffix(rel, "/")
+		path, reason := localPath(dir, strings.TrimSuffix(rel, "/"))
+		key := fold(rel)
+		switch {
+		case reason != "":
+		case placeholder:
+			t.Dirs = append(t.Dirs, path)
+			continue
+		case parents[key]:
+			reason = "also a directory of other objects"
+		case seen[key] != "":
+			reason = fmt.Sprintf("collides with %q", seen[key])
+		default:
+			seen[key] = name
+			t.Files = append(t.Files, localFile{Path: path, Attrs: objects[i]})
+			continue
+		}
+		t.Invalid = append(t.Invalid, &InvalidNameError{Name: name, Reason: reason})
+	}
+	return t
+}
+
+// CopyPrefix copies every object under the gs:// prefix to the same
+// relative path under dir, treating "/" as the directory separator and
+// placeholder objects ending with "/" as directories. Objects without a
+// safe local path, as defined by LocalPath, or that collide with others are
+// skipped, and reported in an InvalidNamesError once everything else is
+// copied.
+func CopyPrefix(fg FastGCS, gsURL, dir string) error {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	objects, err := fg.List("gs://" + bucket + "/" + prefix)
+	if err != nil {
+		return err
+	}
+
+	t := mapLocalTree(dir, prefix, objects)
+	for _, d := range t.Dirs {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	for _, f := range t.Files {
+		if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+			return err
+		}
+		if err := fg.Copy(f.Attrs.URL(), f.Path); err != nil {
+			return errors.Wrapf(err, "copying %s", f.Attrs.URL())
+		}
+	}
+	if len(t.Invalid) > 0 {
+		return t.Invalid
+	}
+	return nil
+}
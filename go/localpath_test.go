@@ -0,0 +1,115 @@
+package fastgcs
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	dir := filepath.Join("tmp", "dst")
+	tests := []struct {
+		name string
+		want string // empty if name has no safe path
+	}{
+		{"a", filepath.Join(dir, "a")},
+		{"a/b/c.txt", filepath.Join(dir, "a", "b", "c.txt")},
+		{"..a/b..", filepath.Join(dir, "..a", "b..")},
+		{strings.Repeat("x", maxNameElem), filepath.Join(dir, strings.Repeat("x", maxNameElem))},
+		{"", ""},
+		{"/etc/passwd", ""},
+		{"a/", ""},
+		{"a//b", ""},
+		{".", ""},
+		{"a/./b", ""},
+		{"..", ""},
+		{"../a", ""},
+		{"a/../../b", ""},
+		{"a\x00b", ""},
+		{strings.Repeat("x", maxNameElem+1), ""},
+	}
+	for _, tt := range tests {
+		got, err := LocalPath(dir, tt.name)
+		if tt.want == "" {
+			if _, ok := err.(*InvalidNameError); !ok {
+				t.Errorf("LocalPath(%q) = %q, %v, want an *InvalidNameError", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("LocalPath(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestInvalidWindowsNameElem(t *testing.T) {
+	for _, elem := range []string{"a:b", "a?", "a|b", "a\x01", "trailing.", "trailing ", "CON", "con.txt", "Lpt1.log"} {
+		if invalidWindowsNameElem(elem) == "" {
+			t.Errorf("invalidWindowsNameElem(%q) accepts it", elem)
+		}
+	}
+	for _, elem := range []string{"a.b", "CONFIG", "console.txt", "COM10", ".hidden"} {
+		if reason := invalidWindowsNameElem(elem); reason != "" {
+			t.Errorf("invalidWindowsNameElem(%q) = %q, want it accepted", elem, reason)
+		}
+	}
+}
+
+func TestMapLocalTree(t *testing.T) {
+	var objects []ObjectAttrs
+	for _, name := range []string{
+		"p/",
+		"p/a.txt",
+		"p/dir/",
+		"p/dir/b.txt",
+		"p/file",
+		"p/file/c.txt",
+		"p/empty/",
+		"p/x/../../escape",
+	} {
+		objects = append(objects, ObjectAttrs{Bucket: "b", Name: name})
+	}
+	dir := filepath.Join("tmp", "dst")
+	tr := mapLocalTree(dir, "p/", objects)
+
+	var files []string
+	for _, f := range tr.Files {
+		files = append(files, f.Path)
+	}
+	wantFiles := []string{
+		filepath.Join(dir, "a.txt"),
+		filepath.Join(dir, "dir", "b.txt"),
+		filepath.Join(dir, "file", "c.txt"),
+	}
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Errorf("Files = %q, want %q", files, wantFiles)
+	}
+	wantDirs := []string{filepath.Join(dir, "dir"), filepath.Join(dir, "empty")}
+	if !reflect.DeepEqual(tr.Dirs, wantDirs) {
+		t.Errorf("Dirs = %q, want %q", tr.Dirs, wantDirs)
+	}
+	var invalid []string
+	for _, e := range tr.Invalid {
+		invalid = append(invalid, e.Name)
+	}
+	wantInvalid := []string{"p/file", "p/x/../../escape"}
+	if !reflect.DeepEqual(invalid, wantInvalid) {
+		t.Errorf("Invalid = %q, want %q", invalid, wantInvalid)
+	}
+}
+
+func TestMapLocalTreeCase(t *testing.T) {
+	objects := []ObjectAttrs{{Name: "README"}, {Name: "readme"}}
+	tr := mapLocalTree("dst", "", objects)
+	wantFiles, wantInvalid := 2, 0
+	if caseInsensitiveFS {
+		wantFiles, wantInvalid = 1, 1
+	}
+	if len(tr.Files) != wantFiles || len(tr.Invalid) != wantInvalid {
+		t.Errorf("got %d files and %d invalid names, want %d and %d", len(tr.Files), len(tr.Invalid), wantFiles, wantInvalid)
+	}
+	if caseInsensitiveFS && tr.Files[0].Attrs.Name != "README" {
+		t.Errorf("kept %q, want the first in name order", tr.Files[0].Attrs.Name)
+	}
+}
@@ -0,0 +1,78 @@
+package fastgcs
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// copyMedia writes the content of an object download to w.
+//
+// Media requests are sent with Accept-Encoding: gzip, so objects stored
+// gzip-encoded arrive as stored and are decompressed here. If something
+// along the way dropped that header, GCS decompressively transcodes the
+// object instead and the body is already plain. Either way w receives the
+// decoded content.
+//
+// The body is verified against the crc32c in X-Goog-Hash, which covers the
+// stored bytes; a transcoded body can't be verified.
+func copyMedia(w io.Writer, res *http.Response) error {
+	crc := crc32.New(castagnoli)
+	body := io.TeeReader(res.Body, crc)
+
+	gzipped := strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip")
+	if gzipped {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return errors.Wrap(err, "decoding gzip content")
+		}
+		if _, err := io.Copy(w, zr); err != nil {
+			return err
+		}
+		// Hash whatever follows the gzip stream, too.
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return err
+		}
+	} else if _, err := io.Copy(w, body); err != nil {
+		return err
+	}
+
+	transcoded := !gzipped && strings.EqualFold(res.Header.Get("X-Goog-Stored-Content-Encoding"), "gzip")
+	if want, ok := googHash(res.Header, "crc32c"); ok && !transcoded {
+		if len(want) != 4 {
+			return errors.Errorf("malformed crc32c in X-Goog-Hash")
+		}
+		if got := crc.Sum32(); got != binary.BigEndian.Uint32(want) {
+			return errors.Errorf("crc32c mismatch: got %08x, want %08x", got, binary.BigEndian.Uint32(want))
+		}
+	}
+	return nil
+}
+
+// googHash extracts one of the checksums from the X-Goog-Hash headers of a
+// response, which look like "crc32c=n03x6A==,md5=Ojk9c3dhfxgoKVVHYwFbHQ==".
+func googHash(h http.Header, kind string) ([]byte, bool) {
+	for _, v := range h.Values("X-Goog-Hash") {
+		for _, field := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 || kv[0] != kind {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, false
+			}
+			return sum, true
+		}
+	}
+	return nil, false
+}
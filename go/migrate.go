@@ -0,0 +1,430 @@
+package fastgcs
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMigrateConcurrency = 8
+	migrateRetries            = 5
+	// migrateSaveInterval bounds how often the state file is rewritten. Work
+	// lost to a crash in between is only redone, never wrong: a destination
+	// that already matches its source is recognized as migrated.
+	migrateSaveInterval = 2 * time.Second
+)
+
+// MigrateOptions configures Migrate.
+type MigrateOptions struct {
+	// StatePath, if set, is where progress is persisted, so that an
+	// interrupted migration can resume where it stopped.
+	StatePath string
+	// Concurrency is the number of objects rewritten at once. Defaults
+	// to 8.
+	Concurrency int
+	// DeleteSource deletes each source object once its copy is verified.
+	DeleteSource bool
+	// Progress, if set, is called as each object is done with, with the
+	// error that stopped it if any. It may be called concurrently.
+	Progress func(src *ObjectAttrs, dstURL string, err error)
+}
+
+// migrateState is what a Migrate state file holds besides the token of the
+// page being migrated, in the format of ResumeList's. Each page is migrated
+// in full before the next is listed, so none of it grows with the number of
+// objects already migrated.
+type migrateState struct {
+	Dst string `json:"dst"`
+	// Done maps the names of the current page's migrated objects to the
+	// generation that was migrated.
+	Done map[string]int64 `json:"done,omitempty"`
+	// InFlight holds the tokens of unfinished rewrites, by source name.
+	InFlight map[string]inFlightRewrite `json:"inFlight,omitempty"`
+	// Failed maps the names of objects that failed to migrate to their
+	// generation, so that a later run retries them.
+	Failed map[string]int64 `json:"failed,omitempty"`
+	// Listed is set once every page has been migrated, after which only
+	// Failed are left.
+	Listed bool `json:"listed,omitempty"`
+}
+
+type inFlightRewrite struct {
+	Generation int64  `json:"generation"`
+	Token      string `json:"token"`
+}
+
+// Migrate copies every object under the gs:// prefix src to the prefix dst,
+// server side and in parallel, replacing src with dst in their names. The
+// buckets may be in different locations or projects. Each copy is checked
+// against its source's size and hashes before it counts as migrated and,
+// with DeleteSource, before the source is deleted, provided it's still the
+// generation that was copied.
+//
+// With a StatePath, the listing's page token, the objects of the current
+// page that are done, the tokens of rewrites under way and the objects that
+// failed are recorded as they progress; a later call with the same src, dst
+// and StatePath retries the failed objects, then resumes the listing at the
+// recorded page, skipping what was done and resuming the rewrites. The state
+// file is removed once every object has been migrated.
+//
+// A failure to migrate an object doesn't stop the others; Migrate returns an
+// error if any failed.
+func Migrate(fg FastGCS, src, dst string, opts MigrateOptions) error {
+	srcBucket, srcPrefix, err := parseGSURL(src)
+	if err != nil {
+		return err
+	}
+	dstBucket, dstPrefix, err := parseGSURL(dst)
+	if err != nil {
+		return err
+	}
+	if srcBucket == dstBucket && strings.HasPrefix(dstPrefix, srcPrefix) {
+		return errors.Errorf("can't migrate %s into itself (%s)", src, dst)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultMigrateConcurrency
+	}
+
+	m := &migration{
+		fg:        fg,
+		opts:      opts,
+		src:       src,
+		srcPrefix: srcPrefix,
+		dstBucket: dstBucket,
+		dstPrefix: dstPrefix,
+		state:     &migrateState{Dst: dst},
+	}
+	if opts.StatePath != "" {
+		cp, err := loadListCheckpoint(opts.StatePath)
+		if err != nil {
+			return err
+		}
+		if cp != nil {
+			var state migrateState
+			if len(cp.State) > 0 {
+				if err := json.Unmarshal(cp.State, &state); err != nil {
+					return errors.Wrapf(err, "parsing migration state %s", opts.StatePath)
+				}
+			}
+			if cp.URL != src || state.Dst != dst {
+				return errors.Errorf("%s holds the state of a different migration (%s to %s)", opts.StatePath, cp.URL, state.Dst)
+			}
+			m.pageToken = cp.PageToken
+			m.state = &state
+		}
+	}
+	if m.state.Done == nil {
+		m.state.Done = map[string]int64{}
+	}
+	if m.state.InFlight == nil {
+		m.state.InFlight = map[string]inFlightRewrite{}
+	}
+	if m.state.Failed == nil {
+		m.state.Failed = map[string]int64{}
+	}
+
+	objects := make(chan ObjectAttrs)
+	var workers, pending sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for attrs := range objects {
+				attrs := attrs
+				dstURL := m.dstURL(attrs.Name)
+				err := m.migrate(&attrs, dstURL)
+				m.finish(&attrs, err)
+				if opts.Progress != nil {
+					opts.Progress(&attrs, dstURL, err)
+				}
+				pending.Done()
+			}
+		}()
+	}
+	// migrateAll migrates a batch of objects, returning once all are done
+	// with.
+	migrateAll := func(batch []ObjectAttrs) {
+		pending.Add(len(batch))
+		for _, attrs := range batch {
+			objects <- attrs
+		}
+		pending.Wait()
+	}
+
+	listErr := m.retryFailed(srcBucket, migrateAll)
+	if listErr == nil && !m.state.Listed {
+		listErr = fg.ListPages(src, ListOptions{PageToken: m.pageToken}, func(page *ListPage) error {
+			var batch []ObjectAttrs
+			for _, attrs := range page.Objects {
+				if !m.isDone(&attrs) {
+					batch = append(batch, attrs)
+				}
+			}
+			migrateAll(batch)
+			m.nextPage(page.NextPageToken)
+			return m.save(true)
+		})
+	}
+	close(objects)
+	workers.Wait()
+
+	saveErr := m.save(true)
+	switch {
+	case listErr != nil:
+		return errors.Wrapf(listErr, "listing %s", src)
+	case m.failed > 0:
+		return errors.Wrapf(m.firstErr, "%d objects failed to migrate, the first", m.failed)
+	case saveErr != nil:
+		return saveErr
+	}
+	if opts.StatePath != "" {
+		if err := os.Remove(opts.StatePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type migration struct {
+	fg        FastGCS
+	opts      MigrateOptions
+	src       string
+	srcPrefix string
+	dstBucket string
+	dstPrefix string
+
+	mu        sync.Mutex
+	pageToken string
+	state     *migrateState
+	saved     time.Time
+	failed    int
+	firstErr  error
+}
+
+func (m *migration) dstURL(name string) string {
+	return "gs://" + m.dstBucket + "/" + m.dstPrefix + strings.TrimPrefix(name, m.srcPrefix)
+}
+
+// isDone reports whether this generation of an object has been migrated, or
+// has failed to be: every failure recorded was retried by retryFailed at the
+// start of this run, if not made in it.
+func (m *migration) isDone(attrs *ObjectAttrs) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if gen, ok := m.state.Done[attrs.Name]; ok && gen == attrs.Generation {
+		return true
+	}
+	gen, ok := m.state.Failed[attrs.Name]
+	return ok && gen == attrs.Generation
+}
+
+// retryFailed migrates the objects that a previous run failed to, at their
+// current generation.
+func (m *migration) retryFailed(bucket string, migrateAll func([]ObjectAttrs)) error {
+	var batch []ObjectAttrs
+	for name := range m.state.Failed {
+		attrs, err := m.fg.Stat("gs://" + bucket + "/" + name)
+		if IsStatus(err, http.StatusNotFound) {
+			m.mu.Lock()
+			delete(m.state.Failed, name)
+			delete(m.state.InFlight, name)
+			m.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		batch = append(batch, *attrs)
+	}
+	migrateAll(batch)
+	return nil
+}
+
+// nextPage moves the checkpoint past a page that has been migrated, to the
+// page at token, or to the end of the listing if there's none.
+func (m *migration) nextPage(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pageToken = token
+	m.state.Done = map[string]int64{}
+	m.state.Listed = token == ""
+}
+
+// migrate copies one source object, verifies the copy, and deletes the
+// source if asked to.
+func (m *migration) migrate(src *ObjectAttrs, dstURL string) error {
+	m.mu.Lock()
+	token := ""
+	if r, ok := m.state.InFlight[src.Name]; ok && r.Generation == src.Generation {
+		token = r.Token
+	}
+	m.mu.Unlock()
+	resumed := token != ""
+
+	var copied *ObjectAttrs
+	if token == "" {
+		// The previous run may have finished this copy without getting to
+		// record it.
+		existing, err := m.fg.Stat(dstURL)
+		if err != nil && !IsStatus(err, http.StatusNotFound) {
+			return err
+		}
+		if err == nil && verifyCopy(src, existing) == nil {
+			copied = existing
+		}
+	}
+
+	for copied == nil {
+		var status *RewriteStatus
+		err := withRetries(migrateRetries, func() error {
+			var err error
+			status, err = m.fg.Rewrite(src.URL(), dstURL, RewriteOptions{
+				SourceGeneration: src.Generation,
+				RewriteToken:     token,
+			})
+			return err
+		})
+		if resumed && IsStatus(err, http.StatusBadRequest) {
+			// The token from the previous run has expired: start over.
+			token, resumed = "", false
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		resumed = false
+		if status.Done {
+			copied = status.Resource
+			break
+		}
+		token = status.RewriteToken
+		m.mu.Lock()
+		m.state.InFlight[src.Name] = inFlightRewrite{Generation: src.Generation, Token: token}
+		m.mu.Unlock()
+		if err := m.save(false); err != nil {
+			return err
+		}
+	}
+
+	if err := verifyCopy(src, copied); err != nil {
+		return err
+	}
+	if m.opts.DeleteSource {
+		gen := src.Generation
+		err := withRetries(migrateRetries, func() error {
+			return m.fg.Delete(src.URL(), DeleteOptions{IfGenerationMatch: &gen})
+		})
+		if IsStatus(err, http.StatusPreconditionFailed) {
+			return errors.Errorf("not deleting %s: it changed while being migrated", src.URL())
+		}
+		if err != nil && !IsStatus(err, http.StatusNotFound) {
+			return errors.Wrapf(err, "deleting %s", src.URL())
+		}
+	}
+	return nil
+}
+
+// verifyCopy checks that copied has the content of src.
+func verifyCopy(src, copied *ObjectAttrs) error {
+	switch {
+	case copied.Size != src.Size:
+		return errors.Errorf("%s has %d bytes, but its source %s has %d", copied.URL(), copied.Size, src.URL(), src.Size)
+	case copied.CRC32C != src.CRC32C:
+		return errors.Errorf("%s has CRC32C %s, but its source %s has %s", copied.URL(), copied.CRC32C, src.URL(), src.CRC32C)
+	// Composite objects have no MD5.
+	case copied.MD5Hash != "" && src.MD5Hash != "" && copied.MD5Hash != src.MD5Hash:
+		return errors.Errorf("%s has MD5 %s, but its source %s has %s", copied.URL(), copied.MD5Hash, src.URL(), src.MD5Hash)
+	}
+	return nil
+}
+
+func (m *migration) finish(src *ObjectAttrs, err error) {
+	m.mu.Lock()
+	if err != nil {
+		m.failed++
+		m.state.Failed[src.Name] = src.Generation
+		if m.firstErr == nil {
+			m.firstErr = errors.Wrap(err, src.URL())
+		}
+	} else {
+		delete(m.state.InFlight, src.Name)
+		delete(m.state.Failed, src.Name)
+		m.state.Done[src.Name] = src.Generation
+	}
+	m.mu.Unlock()
+	m.save(false)
+}
+
+// save writes the state file, unless it was written recently and force
+// isn't set.
+func (m *migration) save(force bool) error {
+	if m.opts.StatePath == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !force && time.Since(m.saved) < migrateSaveInterval {
+		return nil
+	}
+	m.saved = time.Now()
+	return saveListCheckpoint(m.opts.StatePath, &listCheckpoint{URL: m.src, PageToken: m.pageToken}, m.state)
+}
+
+// Move moves the object at src to dst, or, if src ends with "/", everything
+// under the prefix src to the prefix dst. Within a bucket with hierarchical
+// namespace enabled, a prefix is a folder and is renamed atomically.
+// Otherwise objects are copied server side, verified and deleted one by
+// one, as by Migrate with DeleteSource.
+func Move(fg FastGCS, src, dst string) error {
+	srcBucket, srcName, err := parseGSURL(src)
+	if err != nil {
+		return err
+	}
+	dstBucket, _, err := parseGSURL(dst)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasSuffix(src, "/") {
+		if strings.HasSuffix(dst, "/") {
+			dst += path.Base(srcName)
+		}
+		attrs, err := fg.Stat(src)
+		if err != nil {
+			return err
+		}
+		m := &migration{
+			fg:   fg,
+			opts: MigrateOptions{DeleteSource: true},
+			state: &migrateState{
+				InFlight: map[string]inFlightRewrite{},
+				Failed:   map[string]int64{},
+			},
+		}
+		return m.migrate(attrs, dst)
+	}
+
+	if !strings.HasSuffix(dst, "/") {
+		dst += "/"
+	}
+	if srcBucket == dstBucket {
+		hns, err := fg.HierarchicalNamespace(srcBucket)
+		// Reading the bucket's settings takes more than reading its
+		// objects; without permission, copying works all the same.
+		if err != nil && !IsStatus(err, http.StatusForbidden) {
+			return err
+		}
+		if hns {
+			_, err := fg.RenameFolder(src, dst)
+			return err
+		}
+	}
+	return Migrate(fg, src, dst, MigrateOptions{DeleteSource: true})
+}
@@ -0,0 +1,266 @@
+package fastgcs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/fastgcs/go/jsonfake"
+)
+
+// migrateTest serves a bucket b holding src/a to src/e, 20 bytes each, over
+// an API that lists them two at a time and rewrites them 8 bytes at a time.
+type migrateTest struct {
+	f   *fastGCS
+	srv *jsonfake.Server
+
+	failList    bool   // fail listing any page but the first
+	failRewrite string // fail the second rewrite call for this object
+	// rewrites holds the token each rewrite call carried, by source name.
+	rewrites map[string][]string
+}
+
+func newMigrateTest(t *testing.T) *migrateTest {
+	m := &migrateTest{rewrites: map[string][]string{}}
+	m.f, m.srv = newAPITest(t, func(w http.ResponseWriter, r *http.Request) bool {
+		q := r.URL.Query()
+		segs := strings.Split(r.URL.EscapedPath(), "/")
+		switch {
+		case r.Method == "GET" && r.URL.EscapedPath() == "/storage/v1/b/b/o":
+			if m.failList && q.Get("pageToken") != "" {
+				http.Error(w, "denied", http.StatusForbidden)
+				return true
+			}
+			q.Set("maxResults", "2")
+			r.URL.RawQuery = q.Encode()
+		case len(segs) > 7 && segs[7] == "rewriteTo":
+			name, _ := url.PathUnescape(segs[6])
+			m.rewrites[name] = append(m.rewrites[name], q.Get("rewriteToken"))
+			if name == m.failRewrite && len(m.rewrites[name]) == 2 {
+				http.Error(w, "denied", http.StatusForbidden)
+				return true
+			}
+		}
+		return false
+	})
+	m.srv.LimitRewrites(8)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		m.srv.Put("b", "src/"+name, []byte(strings.Repeat(name, 20)))
+	}
+	return m
+}
+
+// readMigrateState returns the migration state recorded at path.
+func readMigrateState(t *testing.T, path string) (*listCheckpoint, *migrateState) {
+	t.Helper()
+	cp, err := loadListCheckpoint(path)
+	if err != nil || cp == nil {
+		t.Fatalf("no state recorded: %v", err)
+	}
+	var state migrateState
+	if err := json.Unmarshal(cp.State, &state); err != nil {
+		t.Fatal(err)
+	}
+	return cp, &state
+}
+
+func TestMigrateResume(t *testing.T) {
+	m := newMigrateTest(t)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	opts := MigrateOptions{StatePath: statePath, Concurrency: 1}
+
+	// The first run migrates src/a, fails src/b part way, and stops at the
+	// second page.
+	m.failList, m.failRewrite = true, "src/b"
+	if err := Migrate(m.f, "gs://b/src/", "gs://b/dst/", opts); err == nil {
+		t.Fatal("interrupted migration succeeded")
+	}
+	cp, state := readMigrateState(t, statePath)
+	token := m.rewrites["src/b"][1]
+	if cp.PageToken == "" || state.Listed || len(state.Done) != 0 {
+		t.Errorf("recorded page %q, listed %v, done %v, want the second page", cp.PageToken, state.Listed, state.Done)
+	}
+	if _, ok := state.Failed["src/b"]; !ok || len(state.Failed) != 1 {
+		t.Errorf("recorded failures %v, want src/b", state.Failed)
+	}
+	if r := state.InFlight["src/b"]; r.Token != token || len(state.InFlight) != 1 {
+		t.Errorf("recorded rewrites %v, want src/b's with token %q", state.InFlight, token)
+	}
+	if err := Migrate(m.f, "gs://b/src/", "gs://b/other/", opts); err == nil {
+		t.Error("migration to another destination resumed from the state")
+	}
+
+	// The second run resumes src/b's rewrite, then the listing.
+	m.failList, m.failRewrite = false, ""
+	m.rewrites = map[string][]string{}
+	if err := Migrate(m.f, "gs://b/src/", "gs://b/dst/", opts); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"src/b": {token, m.rewrites["src/b"][1]},
+		"src/c": {"", m.rewrites["src/c"][1], m.rewrites["src/c"][2]},
+		"src/d": {"", m.rewrites["src/d"][1], m.rewrites["src/d"][2]},
+		"src/e": {"", m.rewrites["src/e"][1], m.rewrites["src/e"][2]},
+	}
+	if !reflect.DeepEqual(m.rewrites, want) {
+		t.Errorf("second run's rewrite calls carried %q, want %q", m.rewrites, want)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if got, _ := m.srv.Get("b", "dst/"+name); string(got) != strings.Repeat(name, 20) {
+			t.Errorf("dst/%s holds %q", name, got)
+		}
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("state left behind: %v", err)
+	}
+}
+
+func TestMigrateResumeRestart(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		change func(m *migrateTest, statePath string)
+	}{
+		{"expired token", func(m *migrateTest, statePath string) {
+			cp, state := readMigrateState(t, statePath)
+			r := state.InFlight["src/b"]
+			r.Token = "expired"
+			state.InFlight["src/b"] = r
+			if err := saveListCheckpoint(statePath, cp, state); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"source replaced", func(m *migrateTest, statePath string) {
+			m.srv.Put("b", "src/b", []byte(strings.Repeat("B", 20)))
+		}},
+	} {
+		m := newMigrateTest(t)
+		statePath := filepath.Join(t.TempDir(), "state.json")
+		opts := MigrateOptions{StatePath: statePath, Concurrency: 1}
+		m.failRewrite = "src/b"
+		if err := Migrate(m.f, "gs://b/src/", "gs://b/dst/", opts); err == nil {
+			t.Fatalf("%s: migration with a failure succeeded", tt.name)
+		}
+		tt.change(m, statePath)
+
+		m.failRewrite = ""
+		m.rewrites = map[string][]string{}
+		if err := Migrate(m.f, "gs://b/src/", "gs://b/dst/", opts); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		src, _ := m.srv.Get("b", "src/b")
+		if got, _ := m.srv.Get("b", "dst/b"); string(got) != string(src) {
+			t.Errorf("%s: dst/b holds %q, want %q", tt.name, got, src)
+		}
+		// The rewrite starts over; only src/b is left to migrate.
+		if calls := m.rewrites["src/b"]; len(m.rewrites) != 1 || len(calls) < 3 || calls[len(calls)-3] != "" {
+			t.Errorf("%s: rewrite calls carried %q, want src/b's to start over", tt.name, m.rewrites)
+		}
+	}
+}
+
+func TestMovePrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int  // of the request for the bucket's settings
+		hns    bool // whether they have hierarchical namespace enabled
+		want   string
+	}{
+		{name: "flat bucket", status: http.StatusOK, want: "copy"},
+		{name: "settings forbidden", status: http.StatusForbidden, want: "copy"},
+		{name: "settings failing", status: http.StatusInternalServerError, want: "fail"},
+		{name: "hierarchical namespace", status: http.StatusOK, hns: true, want: "rename"},
+	}
+	for _, tt := range tests {
+		var gets, renames int
+		f, srv := newAPITest(t, func(w http.ResponseWriter, r *http.Request) bool {
+			switch {
+			case r.Method == "GET" && r.URL.EscapedPath() == "/storage/v1/b/b":
+				gets++
+				if tt.status != http.StatusOK {
+					http.Error(w, http.StatusText(tt.status), tt.status)
+					return true
+				}
+				writeJSON(w, map[string]interface{}{"hierarchicalNamespace": map[string]bool{"enabled": tt.hns}})
+			case r.Method == "POST" && r.URL.EscapedPath() == "/storage/v1/b/b/folders/src%2F/renameTo/folders/dst%2F":
+				renames++
+				writeJSON(w, map[string]interface{}{
+					"name":     "projects/_/buckets/b/operations/op",
+					"done":     true,
+					"response": map[string]interface{}{"bucket": "b", "name": "dst/"},
+				})
+			default:
+				return false
+			}
+			return true
+		})
+		srv.Put("b", "src/a", []byte("a"))
+		srv.Put("b", "src/sub/b", []byte("b"))
+		srv.Put("b", "srcs/c", []byte("c"))
+
+		err := Move(f, "gs://b/src/", "gs://b/dst")
+		if (err != nil) != (tt.want == "fail") {
+			t.Errorf("%s: Move: %v", tt.name, err)
+		}
+		if gets != 1 {
+			t.Errorf("%s: read the bucket's settings %d times, want once", tt.name, gets)
+		}
+		if renamed := tt.want == "rename"; renames != 0 != renamed || renames > 1 {
+			t.Errorf("%s: %d folder renames, want one: %v", tt.name, renames, renamed)
+		}
+		// The fake doesn't rename folders, so only copies move objects.
+		moved := tt.want == "copy"
+		for name, data := range map[string]string{"src/a": "a", "src/sub/b": "b"} {
+			if _, ok := srv.Get("b", name); ok == moved {
+				t.Errorf("%s: %s left: %v, want %v", tt.name, name, ok, !moved)
+			}
+			dst := "dst" + name[len("src"):]
+			if got, ok := srv.Get("b", dst); ok != moved || moved && string(got) != data {
+				t.Errorf("%s: %s holds %q, %v, want it copied: %v", tt.name, dst, got, ok, moved)
+			}
+		}
+		if _, ok := srv.Get("b", "srcs/c"); !ok {
+			t.Errorf("%s: object sharing the prefix's name moved", tt.name)
+		}
+	}
+}
+
+func TestMoveObject(t *testing.T) {
+	var gets int
+	f, srv := newAPITest(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.EscapedPath() == "/storage/v1/b/b" {
+			gets++
+		}
+		return false
+	})
+	srv.CreateBucket("c")
+	srv.Put("b", "src/a", []byte("a"))
+	srv.Put("b", "src/b", []byte("b"))
+
+	if err := Move(f, "gs://b/src/a", "gs://c/dst/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Move(f, "gs://b/src/b", "gs://b/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []struct{ bucket, name, want string }{{"c", "dst/a", "a"}, {"b", "renamed", "b"}} {
+		if got, ok := srv.Get(o.bucket, o.name); !ok || string(got) != o.want {
+			t.Errorf("gs://%s/%s holds %q, %v, want %q", o.bucket, o.name, got, ok, o.want)
+		}
+	}
+	for _, name := range []string{"src/a", "src/b"} {
+		if _, ok := srv.Get("b", name); ok {
+			t.Errorf("%s left behind", name)
+		}
+	}
+	if gets != 0 {
+		t.Errorf("moving objects read the bucket's settings %d times", gets)
+	}
+	if err := Move(f, "gs://b/missing", "gs://b/x"); !IsStatus(err, http.StatusNotFound) {
+		t.Errorf("moving a missing object: %v, want a 404", err)
+	}
+}
@@ -0,0 +1,381 @@
+package fastgcs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	xmlAPIBase = "https://storage.googleapis.com"
+
+	defaultPartSize    = 16 << 20
+	minPartSize        = 5 << 20
+	defaultPartWorkers = 4
+	defaultPartRetries = 3
+)
+
+// MultipartOptions configures an XML API multipart upload.
+type MultipartOptions struct {
+	// PartSize is the size of every part but the last. Defaults to 16MiB;
+	// GCS requires at least 5MiB.
+	PartSize int64
+	// Concurrency is the number of parts uploaded in parallel, which also
+	// bounds the memory used to PartSize*(Concurrency+1). Defaults to 4.
+	Concurrency int
+	// Retries is the number of attempts made for each part. Defaults to 3.
+	Retries int
+}
+
+func (o MultipartOptions) withDefaults() MultipartOptions {
+	if o.PartSize <= 0 {
+		o.PartSize = defaultPartSize
+	}
+	if o.PartSize < minPartSize {
+		o.PartSize = minPartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultPartWorkers
+	}
+	if o.Retries <= 0 {
+		o.Retries = defaultPartRetries
+	}
+	return o
+}
+
+// MultipartUpload is an upload in progress through the XML API multipart
+// upload protocol, the GCS counterpart of S3 multipart uploads.
+type MultipartUpload struct {
+	f        *fastGCS
+	bucket   string
+	object   string
+	UploadID string
+}
+
+// Part is an uploaded part of a MultipartUpload.
+type Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+// InitiateMultipartUpload starts a multipart upload to gsURL. Nothing is
+// visible at gsURL until Complete succeeds.
+func (f *fastGCS) InitiateMultipartUpload(gsURL string, opts WriteOptions) (*MultipartUpload, error) {
+	bucket, object, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = guessContentType(object)
+	}
+	return f.initiateMultipartUpload(bucket, object, opts)
+}
+
+func (f *fastGCS) initiateMultipartUpload(bucket, object string, opts WriteOptions) (*MultipartUpload, error) {
+	m := &MultipartUpload{f: f, bucket: bucket, object: object}
+	req, err := http.NewRequest("POST", m.url("uploads"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", opts.ContentType)
+	for k, v := range map[string]string{
+		"Content-Encoding":    opts.contentEncoding(),
+		"Cache-Control":       opts.CacheControl,
+		"Content-Disposition": opts.ContentDisposition,
+		"Content-Language":    opts.ContentLanguage,
+	} {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	for k, v := range opts.Metadata {
+		req.Header.Set("X-Goog-Meta-"+k, v)
+	}
+	if opts.IfGenerationMatch != nil {
+		req.Header.Set("X-Goog-If-Generation-Match", fmt.Sprint(*opts.IfGenerationMatch))
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := m.doXML(req, &result); err != nil {
+		return nil, errors.Wrap(err, "initiating multipart upload")
+	}
+	m.UploadID = result.UploadID
+	return m, nil
+}
+
+func (m *MultipartUpload) url(query string) string {
+	u := &url.URL{Path: "/" + m.bucket + "/" + m.object}
+	return xmlAPIBase + u.EscapedPath() + "?" + query
+}
+
+func (m *MultipartUpload) doXML(req *http.Request, v interface{}) error {
+	res, err := m.f.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return xml.NewDecoder(res.Body).Decode(v)
+}
+
+// UploadPart uploads part number n (starting at 1), replacing any earlier
+// upload of the same part. The part is integrity-checked by GCS against its
+// MD5.
+func (m *MultipartUpload) UploadPart(n int, data []byte) (*Part, error) {
+	sum := md5.Sum(data)
+	req, err := http.NewRequest("PUT", m.url(url.Values{
+		"partNumber": {strconv.Itoa(n)},
+		"uploadId":   {m.UploadID},
+	}.Encode()), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	res, err := m.f.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "uploading part %d", n)
+	}
+	res.Body.Close()
+	return &Part{PartNumber: n, ETag: res.Header.Get("ETag"), Size: int64(len(data))}, nil
+}
+
+// ListParts returns the parts uploaded so far, in order.
+func (m *MultipartUpload) ListParts() ([]Part, error) {
+	var parts []Part
+	marker := ""
+	for {
+		q := url.Values{"uploadId": {m.UploadID}}
+		if marker != "" {
+			q.Set("part-number-marker", marker)
+		}
+		req, err := http.NewRequest("GET", m.url(q.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Parts                []Part `xml:"Part"`
+			IsTruncated          bool   `xml:"IsTruncated"`
+			NextPartNumberMarker string `xml:"NextPartNumberMarker"`
+		}
+		if err := m.doXML(req, &result); err != nil {
+			return nil, errors.Wrap(err, "listing parts")
+		}
+		parts = append(parts, result.Parts...)
+		if !result.IsTruncated || result.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// Complete assembles the parts into the object and returns its attributes.
+func (m *MultipartUpload) Complete(parts []Part) (*ObjectAttrs, error) {
+	if err := m.complete(parts); err != nil {
+		return nil, err
+	}
+	return m.attrs()
+}
+
+func (m *MultipartUpload) attrs() (*ObjectAttrs, error) {
+	attrs, err := m.f.Stat(fmt.Sprintf("gs://%s/%s", m.bucket, m.object))
+	if err != nil {
+		return nil, err
+	}
+	m.f.noteWrite(attrs)
+	return attrs, nil
+}
+
+func (m *MultipartUpload) complete(parts []Part) error {
+	sorted := append([]Part(nil), parts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PartNumber < sorted[j].PartNumber })
+	type completePart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	body := struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{}
+	for _, p := range sorted {
+		body.Parts = append(body.Parts, completePart{PartNumber: p.PartNumber, ETag: p.ETag})
+	}
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", m.url(url.Values{"uploadId": {m.UploadID}}.Encode()), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	if err := m.doXML(req, nil); err != nil {
+		return errors.Wrap(err, "completing multipart upload")
+	}
+	return nil
+}
+
+// Abort cancels the upload and deletes the parts uploaded so far.
+func (m *MultipartUpload) Abort() error {
+	req, err := http.NewRequest("DELETE", m.url(url.Values{"uploadId": {m.UploadID}}.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	return m.doXML(req, nil)
+}
+
+// multipartWriter is the uploader behind WriteOptions.Multipart: it cuts
+// the content into parts and uploads up to Concurrency of them at once.
+// Whatever goes wrong, the upload is either completed or aborted.
+type multipartWriter struct {
+	m    *MultipartUpload
+	opts MultipartOptions
+
+	buf   []byte
+	next  int // number of the next part
+	size  int64
+	crc   hash.Hash32 // of the content written so far
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu    sync.Mutex
+	parts []Part
+	err   error
+}
+
+func (f *fastGCS) startMultipartUpload(bucket, object string, opts WriteOptions) (*multipartWriter, error) {
+	m, err := f.initiateMultipartUpload(bucket, object, opts)
+	if err != nil {
+		return nil, err
+	}
+	mo := opts.Multipart.withDefaults()
+	return &multipartWriter{
+		m:     m,
+		opts:  mo,
+		buf:   make([]byte, 0, mo.PartSize),
+		next:  1,
+		crc:   crc32.New(castagnoli),
+		slots: make(chan struct{}, mo.Concurrency),
+	}, nil
+}
+
+func (w *multipartWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *multipartWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if err := w.failed(); err != nil {
+			return written, err
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.crc.Write(p[:n])
+		w.size += int64(n)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			w.flush()
+		}
+	}
+	return written, nil
+}
+
+// flush hands the buffered part to an upload goroutine, waiting for a free
+// slot first.
+func (w *multipartWriter) flush() {
+	data, n := w.buf, w.next
+	w.next++
+	w.buf = make([]byte, 0, w.opts.PartSize)
+
+	w.slots <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() { <-w.slots }()
+
+		var part *Part
+		err := withRetries(w.opts.Retries, func() error {
+			var err error
+			part, err = w.m.UploadPart(n, data)
+			return err
+		})
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return
+		}
+		w.parts = append(w.parts, *part)
+	}()
+}
+
+func (w *multipartWriter) finish() (*ObjectAttrs, error) {
+	if len(w.buf) > 0 || w.next == 1 {
+		w.flush()
+	}
+	w.wg.Wait()
+	if err := w.failed(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	attempts := 0
+	err := withRetries(w.opts.Retries, func() error {
+		attempts++
+		return w.m.complete(w.parts)
+	})
+	if IsStatus(err, http.StatusNotFound) && attempts > 1 {
+		// An earlier attempt may have completed the upload, and only its
+		// response was lost: the upload is gone, but the object is there.
+		attrs, statErr := w.m.attrs()
+		if statErr == nil && attrs.Size == w.size && attrs.CRC32C == base64.StdEncoding.EncodeToString(w.crc.Sum(nil)) {
+			return attrs, nil
+		}
+	}
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w.m.attrs()
+}
+
+func (w *multipartWriter) abort() {
+	w.wg.Wait()
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = errors.New("upload aborted")
+	}
+	w.mu.Unlock()
+	// Best effort, but try hard: parts left behind are billed until the
+	// bucket's lifecycle rules clean them up.
+	withRetries(w.opts.Retries, func() error {
+		err := w.m.Abort()
+		if IsStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	})
+}
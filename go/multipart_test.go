@@ -0,0 +1,127 @@
+package fastgcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeXMLUploads serves multipart uploads to bucket "b" and stats of the
+// objects they create.
+type fakeXMLUploads struct {
+	mu      sync.Mutex
+	parts   map[int][]byte
+	open    bool
+	objects map[string][]byte
+	// completeStatus, if set, is returned after completing an upload, as
+	// if the response was lost.
+	completeStatus int
+}
+
+func (s *fakeXMLUploads) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := httptest.NewRecorder()
+	q := req.URL.Query()
+	name := strings.TrimPrefix(req.URL.Path, "/b/")
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/storage/v1/"):
+		name = strings.TrimPrefix(req.URL.Path, "/storage/v1/b/b/o/")
+		data, ok := s.objects[name]
+		if !ok {
+			rec.WriteHeader(http.StatusNotFound)
+			break
+		}
+		json.NewEncoder(rec).Encode(map[string]string{
+			"bucket":     "b",
+			"name":       name,
+			"size":       strconv.Itoa(len(data)),
+			"generation": "1",
+			"crc32c":     testCRC32C(data),
+		})
+	case req.Method == "POST" && q.Has("uploads"):
+		s.open, s.parts = true, map[int][]byte{}
+		fmt.Fprint(rec, "<InitiateMultipartUploadResult><UploadId>u</UploadId></InitiateMultipartUploadResult>")
+	case !s.open:
+		rec.WriteHeader(http.StatusNotFound)
+	case req.Method == "PUT":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		s.parts[n], _ = ioutil.ReadAll(req.Body)
+		rec.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+	case req.Method == "POST":
+		var numbers []int
+		for n := range s.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, s.parts[n]...)
+		}
+		s.objects[name], s.open = data, false
+		if s.completeStatus != 0 {
+			rec.WriteHeader(s.completeStatus)
+		}
+	case req.Method == "DELETE":
+		s.open = false
+		rec.WriteHeader(http.StatusNoContent)
+	}
+	return rec.Result(), nil
+}
+
+func TestMultipartLostCompletion(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), minPartSize/10+1)
+	tests := []struct {
+		name     string
+		replaced bool // whether someone else replaces the object right after
+		wantErr  bool
+	}{
+		{name: "completed"},
+		{name: "replaced", replaced: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		srv := &fakeXMLUploads{objects: map[string][]byte{}, completeStatus: http.StatusServiceUnavailable}
+		f := newTestFastGCS(t, WithHTTPClient(&http.Client{Transport: srv}))
+		w, err := f.Create("gs://b/obj", WriteOptions{Multipart: &MultipartOptions{PartSize: minPartSize}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+		if tt.replaced {
+			srv.completeStatus = 0
+			f.client.Transport = replacingTransport{srv}
+		}
+		err = w.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Close = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && w.Attrs().Size != int64(len(content)) {
+			t.Errorf("%s: Attrs().Size = %d, want %d", tt.name, w.Attrs().Size, len(content))
+		}
+	}
+}
+
+// replacingTransport loses the response to the completion of an upload,
+// and has someone else replace the object before the retry.
+type replacingTransport struct {
+	srv *fakeXMLUploads
+}
+
+func (t replacingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.srv.RoundTrip(req)
+	if req.Method == "POST" && req.URL.Query().Has("uploadId") && err == nil && res.StatusCode == http.StatusOK {
+		t.srv.mu.Lock()
+		t.srv.objects["obj"] = []byte("someone else's")
+		t.srv.mu.Unlock()
+		res.StatusCode = http.StatusServiceUnavailable
+	}
+	return res, err
+}
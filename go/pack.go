@@ -0,0 +1,308 @@
+package fastgcs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// PackHashMetadataKey is the custom metadata key under which Pack records
+// the SHA-256 of the uncompressed tar stream.
+const PackHashMetadataKey = "fastgcs-tar-sha256"
+
+// packEpoch is the modification time given to every archive entry.
+var packEpoch = time.Unix(0, 0).UTC()
+
+// Pack uploads a reproducible tar archive of dir to gsURL: entries are
+// sorted, timestamps and ownership are normalized, and permissions are
+// reduced to 0755 or 0644 (0755 for directories and executables), so the
+// same tree always produces the same bytes. The archive is compressed
+// according to the URL's extension (.tar, .tar.gz, .tgz or .tar.zst) and
+// streamed straight to the upload.
+//
+// The SHA-256 of the tar stream is recorded in the object's metadata so
+// Extract can verify it. Since metadata has to be sent before the content,
+// dir is read twice: if it changes in between, the upload is aborted.
+func Pack(fg FastGCS, dir, gsURL string) (*ObjectAttrs, error) {
+	hash := sha256.New()
+	if err := writeTar(hash, dir); err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	w, err := fg.Create(gsURL, WriteOptions{
+		ContentType: archiveContentType(gsURL),
+		Metadata:    map[string]string{PackHashMetadataKey: sum},
+	})
+	if err != nil {
+		return nil, err
+	}
+	cw, err := compressor(gsURL, w)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	hash.Reset()
+	if err := writeTar(io.MultiWriter(cw, hash), dir); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != sum {
+		w.Abort()
+		return nil, errors.Errorf("%s changed while being packed", dir)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Attrs(), nil
+}
+
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			ModTime: packEpoch,
+			Mode:    0644,
+		}
+		switch {
+		case d.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0755
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = filepath.ToSlash(target)
+			hdr.Mode = 0777
+		case info.Mode().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = info.Size()
+			if info.Mode()&0111 != 0 {
+				hdr.Mode = 0755
+			}
+		default:
+			return errors.Errorf("%s: can't pack %s", path, info.Mode().Type())
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+			return errors.Wrapf(err, "packing %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Extract unpacks an archive made by Pack (or any tar archive with the same
+// naming) into dir. If the object records a tar hash, the archive is
+// verified against it before anything is written.
+func Extract(fg FastGCS, gsURL, dir string) error {
+	rc, attrs, err := fg.OpenWithAttrs(gsURL)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	want := attrs.Metadata[PackHashMetadataKey]
+	if want == "" {
+		return readArchive(gsURL, rc, func(r io.Reader) error {
+			return untar(r, dir)
+		})
+	}
+
+	// The archive is read once, into a temporary file that's extracted
+	// once verified: reading the object again could get another
+	// generation than the one whose hash was checked.
+	tmp, err := ioutil.TempFile("", "fastgcs-extract-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	content := io.TeeReader(rc, tmp)
+	if err := readArchive(gsURL, content, func(r io.Reader) error {
+		_, err := io.Copy(hash, r)
+		return err
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, content); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return errors.Errorf("%s: tar hash mismatch: got %s, want %s", gsURL, got, want)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return readArchive(gsURL, tmp, func(r io.Reader) error {
+		return untar(r, dir)
+	})
+}
+
+// readArchive calls fn with the tar stream of r, an archive named gsURL.
+func readArchive(gsURL string, r io.Reader, fn func(io.Reader) error) error {
+	dr, err := decompressor(gsURL, r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	return fn(dr)
+}
+
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	links := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(strings.TrimSuffix(hdr.Name, "/"))
+		if name == "." {
+			continue
+		}
+		dst, err := LocalPath(dir, name)
+		if err != nil {
+			return errors.Wrapf(err, "refusing to extract into %s", dir)
+		}
+		// Writing below a link extracted earlier could land anywhere.
+		for d := path.Dir(name); d != "."; d = path.Dir(d) {
+			if links[d] {
+				return errors.Errorf("refusing to extract %q through the symlink %q", hdr.Name, d)
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, fs.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links[name] = true
+			os.Remove(dst)
+			if err := os.Symlink(filepath.FromSlash(hdr.Linkname), dst); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if links[name] {
+				// Replace the link rather than write to its target.
+				os.Remove(dst)
+				delete(links, name)
+			}
+			f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("%s: unsupported tar entry type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+func archiveContentType(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"):
+		return "application/zstd"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "application/gzip"
+	}
+	return "application/x-tar"
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressor wraps w in the compression named by the extension of name.
+// Closing it flushes the compressor but not w.
+func compressor(name string, w io.Writer) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"):
+		// A single encoder goroutine keeps the output deterministic.
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return gzip.NewWriter(w), nil
+	case strings.HasSuffix(name, ".tar"):
+		return nopWriteCloser{w}, nil
+	}
+	return nil, errors.Errorf("%s: archive name must end in .tar, .tar.gz, .tgz or .tar.zst", name)
+}
+
+// decompressor is the reading counterpart of compressor.
+func decompressor(name string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(name, ".tar"):
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, errors.Errorf("%s: archive name must end in .tar, .tar.gz, .tgz or .tar.zst", name)
+}
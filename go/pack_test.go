@@ -0,0 +1,131 @@
+package fastgcs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// writeTree creates the given files, and their directories, under dir.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPackExtract(t *testing.T) {
+	f, _ := newJSONTest(t)
+	src := t.TempDir()
+	files := map[string]string{"a.txt": "a", "dir/b.txt": "b", "dir/sub/c.txt": "c"}
+	writeTree(t, src, files)
+
+	for _, name := range []string{"x.tar", "x.tar.gz", "x.tgz", "x.tar.zst"} {
+		gsURL := "gs://b/" + name
+		if _, err := Pack(f, src, gsURL); err != nil {
+			t.Fatalf("Pack(%s): %v", name, err)
+		}
+		dst := t.TempDir()
+		if err := Extract(f, gsURL, dst); err != nil {
+			t.Fatalf("Extract(%s): %v", name, err)
+		}
+		if got := readTree(t, dst); !reflect.DeepEqual(got, files) {
+			t.Errorf("%s: extracted %v, want %v", name, got, files)
+		}
+	}
+}
+
+func TestExtractHashMismatch(t *testing.T) {
+	f, _ := newJSONTest(t)
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "a"})
+	attrs, err := Pack(f, src, "gs://b/x.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Record another tree's hash for the archive.
+	writeTree(t, src, map[string]string{"a.txt": "changed"})
+	if _, err := Pack(f, src, "gs://b/y.tar"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := f.Read(attrs.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := f.Stat("gs://b/y.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := f.Create("gs://b/x.tar", WriteOptions{Metadata: other.Metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := Extract(f, "gs://b/x.tar", dst); err == nil {
+		t.Fatal("Extract of an archive not matching its hash succeeded")
+	}
+	if got := readTree(t, dst); len(got) != 0 {
+		t.Errorf("Extract wrote %v before verifying the archive", got)
+	}
+}
+
+// swappingFastGCS replaces the object once the first read of it is under
+// way, as if someone packed another tree to it at that moment.
+type swappingFastGCS struct {
+	FastGCS
+	once sync.Once
+	swap func()
+}
+
+func (s *swappingFastGCS) OpenWithAttrs(gsURL string) (io.ReadCloser, *ObjectAttrs, error) {
+	defer s.once.Do(s.swap)
+	return s.FastGCS.OpenWithAttrs(gsURL)
+}
+
+func (s *swappingFastGCS) Open(gsURL string) (io.ReadCloser, error) {
+	defer s.once.Do(s.swap)
+	return s.FastGCS.Open(gsURL)
+}
+
+func (s *swappingFastGCS) Stat(gsURL string) (*ObjectAttrs, error) {
+	defer s.once.Do(s.swap)
+	return s.FastGCS.Stat(gsURL)
+}
+
+func TestExtractGenerationSwap(t *testing.T) {
+	f, _ := newJSONTest(t)
+	first, second := t.TempDir(), t.TempDir()
+	writeTree(t, first, map[string]string{"a.txt": "first"})
+	writeTree(t, second, map[string]string{"a.txt": "second", "b.txt": "second"})
+	if _, err := Pack(f, first, "gs://b/x.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	fg := &swappingFastGCS{FastGCS: f, swap: func() {
+		if _, err := Pack(f, second, "gs://b/x.tar.gz"); err != nil {
+			t.Error(err)
+		}
+	}}
+
+	dst := t.TempDir()
+	if err := Extract(fg, "gs://b/x.tar.gz", dst); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if got, want := readTree(t, dst), map[string]string{"a.txt": "first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("extracted %v, want the generation first read, %v", got, want)
+	}
+}
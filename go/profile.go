@@ -0,0 +1,262 @@
+package fastgcs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProfileMaxAge      = 7 * 24 * time.Hour
+	defaultProfileParallelism = 16
+	defaultProfileTrustFor    = 5 * time.Second
+)
+
+// ProfileOptions configures the prefetching installed by WithProfile.
+type ProfileOptions struct {
+	// MaxAge is how long an object stays in the profile without being
+	// read. Defaults to a week.
+	MaxAge time.Duration
+	// Parallelism is the number of objects prefetched at once. Defaults to
+	// 16.
+	Parallelism int
+	// TrustFor is how long after a prefetch completes its entry is used
+	// without asking GCS again. Defaults to 5 seconds.
+	TrustFor time.Duration
+}
+
+// WithProfile records the objects read through Open, Copy and Read in a
+// profile of the named workload, e.g. a command or a test target, kept in
+// the cache root. New then starts prefetching the objects of the profile
+// in the background, in the order they were last read, so that the first
+// read of each finds its cache entry downloaded and revalidated already.
+//
+// A prefetched entry is used as is once, without asking GCS again, if it
+// was prefetched within TrustFor; reads after that revalidate as usual.
+// Writes and deletes made through this FastGCS discard what was prefetched
+// of the objects they change, but changes made elsewhere within TrustFor
+// of a prefetch are only seen on the next read. Close stops prefetching.
+//
+// Processes sharing a workload name share its profile, so a workload made
+// of many short-lived processes is profiled as a whole.
+func WithProfile(workload string, opts ProfileOptions) Option {
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = defaultProfileMaxAge
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = defaultProfileParallelism
+	}
+	if opts.TrustFor <= 0 {
+		opts.TrustFor = defaultProfileTrustFor
+	}
+	return func(f *fastGCS) {
+		f.profile = &profile{
+			path:       filepath.Join(f.cacheRoot, "profiles", url.QueryEscape(workload)+".log"),
+			opts:       opts,
+			recorded:   map[string]bool{},
+			prefetches: map[string]*prefetch{},
+		}
+	}
+}
+
+// profile is the access log of a workload, and what was prefetched from it.
+type profile struct {
+	path string
+	opts ProfileOptions
+
+	mu sync.Mutex
+	// recorded holds the URLs already appended to the log by this process.
+	recorded map[string]bool
+	// prefetches holds the prefetches not yet taken or dropped.
+	prefetches map[string]*prefetch
+
+	// stop cancels the prefetches, and workers tracks the goroutines
+	// running them.
+	stop    context.CancelFunc
+	workers sync.WaitGroup
+}
+
+type prefetch struct {
+	done  chan struct{}
+	entry *cacheEntry
+	err   error
+	// completed is when the entry was revalidated.
+	completed time.Time
+}
+
+// profileRecord is one line of a profile.
+type profileRecord struct {
+	URL  string    `json:"url"`
+	Time time.Time `json:"time"`
+}
+
+// startPrefetching prefetches the objects of the profile. Reads of objects
+// still being prefetched wait for the prefetch rather than duplicate it.
+func (f *fastGCS) startPrefetching() {
+	urls := f.profile.load()
+	if len(urls) == 0 {
+		return
+	}
+	type job struct {
+		url string
+		p   *prefetch
+	}
+	queue := make(chan job, len(urls))
+	f.profile.mu.Lock()
+	for _, u := range urls {
+		p := &prefetch{done: make(chan struct{})}
+		f.profile.prefetches[u] = p
+		queue <- job{u, p}
+	}
+	f.profile.mu.Unlock()
+	close(queue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.profile.stop = cancel
+	workers := f.profile.opts.Parallelism
+	if workers > len(urls) {
+		workers = len(urls)
+	}
+	f.profile.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer f.profile.workers.Done()
+			// A dropped prefetch still runs: it's merely not used. Once
+			// stopped, the rest fail at once, for reads waiting on them
+			// to fetch the object themselves.
+			for j := range queue {
+				if j.p.err = ctx.Err(); j.p.err == nil {
+					j.p.entry, j.p.err = f.refresh(ctx, j.url)
+					j.p.completed = time.Now()
+				}
+				close(j.p.done)
+			}
+		}()
+	}
+}
+
+// close stops prefetching, abandoning the downloads in flight, and waits
+// for them to clean up after themselves.
+func (p *profile) close() {
+	if p.stop != nil {
+		p.stop()
+		p.workers.Wait()
+	}
+}
+
+// load returns the URLs of the profile read within MaxAge, in the order
+// they were last read, and compacts the log if it's mostly old records. A
+// record appended by another process while the log is compacted may be
+// lost, which merely leaves the object out of the next prefetch.
+func (p *profile) load() []string {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil
+	}
+	var recs []profileRecord
+	last := map[string]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var rec profileRecord
+		// A line torn by a crash is skipped.
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || rec.URL == "" {
+			continue
+		}
+		last[rec.URL] = len(recs)
+		recs = append(recs, rec)
+	}
+
+	var kept []profileRecord
+	cutoff := time.Now().Add(-p.opts.MaxAge)
+	for i, rec := range recs {
+		if last[rec.URL] == i && rec.Time.After(cutoff) {
+			kept = append(kept, rec)
+		}
+	}
+	if len(kept) < len(recs)/2 {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, rec := range kept {
+			enc.Encode(rec)
+		}
+		writeFileAtomic(p.path, buf.Bytes(), 0644)
+	}
+
+	urls := make([]string, len(kept))
+	for i, rec := range kept {
+		urls[i] = rec.URL
+	}
+	return urls
+}
+
+// recordRead appends gsURL to the profile, unless this process already
+// did.
+func (f *fastGCS) recordRead(gsURL string) {
+	if f.profile == nil {
+		return
+	}
+	p := f.profile
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.recorded[gsURL] {
+		return
+	}
+	p.recorded[gsURL] = true
+	data, err := json.Marshal(profileRecord{URL: gsURL, Time: time.Now().UTC()})
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(p.path), os.ModePerm)
+	// As in the audit log, a single append-mode write keeps lines from
+	// concurrent processes whole.
+	pf, err := os.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer pf.Close()
+	pf.Write(append(data, '\n'))
+}
+
+// take returns the prefetched entry for gsURL, waiting for the prefetch if
+// it's still running, and forgets it. It returns nil if gsURL wasn't
+// prefetched, if the prefetch failed, or if it completed more than
+// TrustFor ago, for the caller to fetch it as usual.
+func (p *profile) take(gsURL string) *cacheEntry {
+	p.mu.Lock()
+	pf := p.prefetches[gsURL]
+	delete(p.prefetches, gsURL)
+	p.mu.Unlock()
+	if pf == nil {
+		return nil
+	}
+	<-pf.done
+	if pf.err != nil || time.Since(pf.completed) > p.opts.TrustFor {
+		return nil
+	}
+	return pf.entry
+}
+
+func (p *profile) drop(gsURL string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.prefetches, gsURL)
+}
+
+// dropPrefix drops the prefetches of every object under the gs:// prefix.
+func (p *profile) dropPrefix(gsURL string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for u := range p.prefetches {
+		if strings.HasPrefix(u, gsURL) {
+			delete(p.prefetches, u)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package fastgcs
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/fastgcs/go/jsonfake"
+)
+
+// newProfileTest returns a FastGCS prefetching the profile of workload "w"
+// kept under root, as New would.
+func newProfileTest(t *testing.T, root string, client *http.Client, opts ProfileOptions) *fastGCS {
+	f := newTestFastGCS(t, WithHTTPClient(client))
+	f.cacheRoot = root
+	WithProfile("w", opts)(f)
+	f.startPrefetching()
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// recordProfile reads the objects through a first process profiling
+// workload "w" under root.
+func recordProfile(t *testing.T, root string, srv *jsonfake.Server, urls ...string) {
+	t.Helper()
+	f := newProfileTest(t, root, srv.Client(), ProfileOptions{})
+	for _, u := range urls {
+		if _, err := f.Read(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitPrefetched waits for the prefetch of gsURL to complete.
+func waitPrefetched(t *testing.T, f *fastGCS, gsURL string) {
+	t.Helper()
+	f.profile.mu.Lock()
+	p := f.profile.prefetches[gsURL]
+	f.profile.mu.Unlock()
+	if p == nil {
+		t.Fatalf("%s not prefetched", gsURL)
+	}
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("prefetch of %s never completed", gsURL)
+	}
+}
+
+func TestProfilePrefetch(t *testing.T) {
+	srv := jsonfake.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("b")
+	srv.Put("b", "a", []byte("a1"))
+	srv.Put("b", "b", []byte("b1"))
+	root := t.TempDir()
+	recordProfile(t, root, srv, "gs://b/a", "gs://b/b")
+
+	f := newProfileTest(t, root, srv.Client(), ProfileOptions{TrustFor: time.Hour})
+	waitPrefetched(t, f, "gs://b/a")
+	waitPrefetched(t, f, "gs://b/b")
+	before := srv.Requests()
+	if got, err := f.Read("gs://b/a"); err != nil || string(got) != "a1" {
+		t.Errorf("Read = %q, %v, want a1", got, err)
+	}
+	if n := srv.Requests() - before; n != 0 {
+		t.Errorf("first read of a prefetched object made %d requests, want none", n)
+	}
+	// Only the first read is served from the prefetch.
+	srv.Put("b", "a", []byte("a2"))
+	if got, err := f.Read("gs://b/a"); err != nil || string(got) != "a2" {
+		t.Errorf("second Read = %q, %v, want a2", got, err)
+	}
+}
+
+func TestProfilePrefetchTrust(t *testing.T) {
+	srv := jsonfake.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("b")
+	srv.Put("b", "a", []byte("a1"))
+	root := t.TempDir()
+	recordProfile(t, root, srv, "gs://b/a")
+
+	f := newProfileTest(t, root, srv.Client(), ProfileOptions{TrustFor: time.Millisecond})
+	waitPrefetched(t, f, "gs://b/a")
+	time.Sleep(10 * time.Millisecond)
+	// A change made since the prefetch is seen once it's no longer
+	// trusted.
+	srv.Put("b", "a", []byte("a2"))
+	if got, err := f.Read("gs://b/a"); err != nil || string(got) != "a2" {
+		t.Errorf("Read of a stale prefetch = %q, %v, want a2", got, err)
+	}
+}
+
+// stallingTransport holds media downloads until their request is
+// cancelled.
+type stallingTransport struct {
+	base    http.RoundTripper
+	started chan struct{}
+}
+
+func (s *stallingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("alt") != "media" {
+		return s.base.RoundTrip(req)
+	}
+	s.started <- struct{}{}
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestProfileClose(t *testing.T) {
+	srv := jsonfake.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("b")
+	var urls []string
+	for _, name := range []string{"a", "b", "c", "d"} {
+		srv.Put("b", name, []byte(name))
+		urls = append(urls, "gs://b/"+name)
+	}
+	root := t.TempDir()
+	recordProfile(t, root, srv, urls...)
+
+	stall := &stallingTransport{base: srv.Client().Transport, started: make(chan struct{}, len(urls))}
+	f := newProfileTest(t, root, &http.Client{Transport: stall}, ProfileOptions{Parallelism: 2})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stall.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("prefetches never started")
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		f.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for downloads that never finish")
+	}
+	tmps, err := filepath.Glob(filepath.Join(root, ".*.tmp*"))
+	if err != nil || len(tmps) != 0 {
+		t.Errorf("temporary files left behind: %q", tmps)
+	}
+	if n := len(stall.started); n != 0 {
+		t.Errorf("%d more prefetches started after Close", n)
+	}
+
+	// Reads fetch what wasn't prefetched themselves.
+	f.client = srv.Client()
+	for _, u := range urls {
+		if got, err := f.Read(u); err != nil || !bytes.Equal(got, []byte(strings.TrimPrefix(u, "gs://b/"))) {
+			t.Errorf("Read(%s) after Close = %q, %v", u, got, err)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package fastgcs
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultReadAheadChunkSize = 8 << 20
+	defaultReadAheadWindow    = 8
+)
+
+// ReadAhead configures the reader returned by Stream.
+type ReadAhead struct {
+	// ChunkSize is the size of each range request. Defaults to 8MiB.
+	ChunkSize int64
+	// Window is the maximum number of chunks fetched ahead of the reader,
+	// in parallel. Defaults to 8.
+	Window int
+	// MaxMemory caps the memory held in chunk buffers, which may shrink the
+	// effective window. Defaults to ChunkSize*Window.
+	MaxMemory int64
+}
+
+func (o ReadAhead) withDefaults() ReadAhead {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = defaultReadAheadChunkSize
+	}
+	if o.Window <= 0 {
+		o.Window = defaultReadAheadWindow
+	}
+	if o.MaxMemory <= 0 {
+		o.MaxMemory = o.ChunkSize * int64(o.Window)
+	}
+	if max := int(o.MaxMemory / o.ChunkSize); max < o.Window {
+		o.Window = max
+	}
+	if o.Window < 1 {
+		o.Window = 1
+	}
+	return o
+}
+
+// Stream returns a reader over the object that bypasses the cache and
+// fetches it in ranges, reading ahead of the consumer. The read-ahead window
+// starts at a single chunk and doubles every time the consumer has to wait
+// for data, up to opts.Window, so that short reads of huge objects stay
+// cheap while long sequential reads saturate the available bandwidth.
+//
+// All ranges are read from the generation that was live when Stream was
+// called. Objects stored with Content-Encoding: gzip are fetched as stored,
+// since GCS ignores ranges when transcoding, and decompressed on the fly.
+func (f *fastGCS) Stream(gsURL string, opts ReadAhead) (io.ReadCloser, error) {
+	attrs, err := f.Stat(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &readAheadReader{
+		f:       f,
+		ctx:     ctx,
+		cancel:  cancel,
+		url:     fmt.Sprintf("%s?alt=media&generation=%d", apiObjectURL(attrs.Bucket, attrs.Name), attrs.Generation),
+		size:    attrs.Size,
+		opts:    opts,
+		window:  1,
+		pool:    make(chan []byte, opts.Window),
+		pending: make(map[int64]*chunk),
+		gzip:    attrs.ContentEncoding == "gzip",
+	}
+	if r.gzip {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrapf(err, "decoding %s", gsURL)
+		}
+		return &gzipStream{Reader: zr, raw: r}, nil
+	}
+	return r, nil
+}
+
+type gzipStream struct {
+	*gzip.Reader
+	raw io.Closer
+}
+
+func (s *gzipStream) Close() error {
+	s.Reader.Close()
+	return s.raw.Close()
+}
+
+type chunk struct {
+	buf  []byte
+	n    int
+	err  error
+	done chan struct{}
+}
+
+type readAheadReader struct {
+	f      *fastGCS
+	ctx    context.Context
+	cancel context.CancelFunc
+	url    string
+	size   int64
+	opts   ReadAhead
+	gzip   bool
+
+	window int
+	pool   chan []byte
+	bufs   int // buffers allocated so far, at most opts.Window
+	wg     sync.WaitGroup
+
+	// Close may be called while a Read waits for a chunk, to interrupt it.
+	// closed keeps Read from starting fetches once it has.
+	mu     sync.Mutex
+	closed bool
+
+	pending map[int64]*chunk // by chunk index
+	cur     *chunk
+	curIdx  int64
+	curOff  int
+	next    int64 // next chunk index to schedule
+	err     error
+}
+
+func (r *readAheadReader) numChunks() int64 {
+	return (r.size + r.opts.ChunkSize - 1) / r.opts.ChunkSize
+}
+
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.ctx.Err() != nil {
+		r.err = errClosedStream
+		return 0, r.err
+	}
+	for r.cur == nil || r.curOff == r.cur.n {
+		if r.cur != nil {
+			r.release(r.cur)
+			r.cur = nil
+			r.curIdx++
+		}
+		if r.curIdx >= r.numChunks() {
+			r.err = io.EOF
+			return 0, r.err
+		}
+		r.schedule()
+		c := r.pending[r.curIdx]
+		if c == nil {
+			r.err = errClosedStream
+			return 0, r.err
+		}
+		select {
+		case <-c.done:
+		default:
+			// We caught up with the network: read further ahead.
+			if r.window < r.opts.Window {
+				r.window *= 2
+				if r.window > r.opts.Window {
+					r.window = r.opts.Window
+				}
+				r.schedule()
+			}
+			<-c.done
+		}
+		delete(r.pending, r.curIdx)
+		if c.err != nil {
+			r.release(c)
+			r.err = c.err
+			return 0, r.err
+		}
+		r.cur, r.curOff = c, 0
+	}
+	n := copy(p, r.cur.buf[r.curOff:r.cur.n])
+	r.curOff += n
+	return n, nil
+}
+
+// schedule starts fetches for every chunk within the window that isn't
+// already in flight.
+func (r *readAheadReader) schedule() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	inFlight := len(r.pending)
+	if r.cur != nil {
+		inFlight++
+	}
+	for r.next < r.numChunks() && r.next < r.curIdx+int64(r.window) && inFlight < r.window {
+		c := &chunk{buf: r.buffer(), done: make(chan struct{})}
+		r.pending[r.next] = c
+		r.wg.Add(1)
+		go r.fetch(r.next, c)
+		r.next++
+		inFlight++
+	}
+}
+
+func (r *readAheadReader) buffer() []byte {
+	select {
+	case buf := <-r.pool:
+		return buf
+	default:
+	}
+	if r.bufs < r.opts.Window {
+		r.bufs++
+		return make([]byte, r.opts.ChunkSize)
+	}
+	return <-r.pool
+}
+
+func (r *readAheadReader) release(c *chunk) {
+	r.pool <- c.buf
+}
+
+func (r *readAheadReader) fetch(idx int64, c *chunk) {
+	defer r.wg.Done()
+	defer close(c.done)
+
+	start := idx * r.opts.ChunkSize
+	end := start + r.opts.ChunkSize
+	if end > r.size {
+		end = r.size
+	}
+
+	req, err := http.NewRequestWithContext(r.ctx, "GET", r.url, nil)
+	if err != nil {
+		c.err = err
+		return
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if r.gzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	res, err := r.f.do(req)
+	if err != nil {
+		c.err = err
+		return
+	}
+	defer res.Body.Close()
+	// A server or proxy ignoring the range would send the object from its
+	// start, which must not pass for the chunk.
+	if res.StatusCode != http.StatusPartialContent {
+		c.err = errors.Errorf("reading bytes %d-%d: got status %d, want %d", start, end-1, res.StatusCode, http.StatusPartialContent)
+		return
+	}
+	var first, last, size int64
+	if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size); err != nil || first != start {
+		c.err = errors.Errorf("reading bytes %d-%d: got Content-Range %q", start, end-1, res.Header.Get("Content-Range"))
+		return
+	}
+
+	c.n, err = io.ReadFull(res.Body, c.buf[:end-start])
+	if err != nil {
+		c.err = errors.Wrapf(err, "reading bytes %d-%d", start, end-1)
+	}
+}
+
+var errClosedStream = errors.New("read from closed stream")
+
+// Close stops the fetches in flight and waits for them. A Read waiting for
+// one of them returns its error.
+func (r *readAheadReader) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
@@ -0,0 +1,289 @@
+package fastgcs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedTransport holds each range request until the test releases it, and
+// tracks how many are in flight.
+type gatedTransport struct {
+	base    http.RoundTripper
+	started chan string // the Range of each request, as it starts
+
+	mu          sync.Mutex
+	gates       map[string]chan struct{} // by Range
+	open        bool
+	inFlight    int
+	maxInFlight int
+}
+
+func newGatedTransport(base http.RoundTripper) *gatedTransport {
+	return &gatedTransport{base: base, started: make(chan string, 100), gates: map[string]chan struct{}{}}
+}
+
+// gate returns the channel whose closing releases requests for rng.
+func (g *gatedTransport) gate(rng string) chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c := g.gates[rng]
+	if c == nil {
+		c = make(chan struct{})
+		if g.open {
+			close(c)
+		}
+		g.gates[rng] = c
+	}
+	return c
+}
+
+// release releases the request for rng.
+func (g *gatedTransport) release(rng string) {
+	close(g.gate(rng))
+}
+
+// releaseAll releases every request, from now on.
+func (g *gatedTransport) releaseAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.open = true
+	for _, c := range g.gates {
+		select {
+		case <-c:
+		default:
+			close(c)
+		}
+	}
+}
+
+func (g *gatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Range") == "" {
+		return g.base.RoundTrip(req)
+	}
+	g.mu.Lock()
+	g.inFlight++
+	if g.inFlight > g.maxInFlight {
+		g.maxInFlight = g.inFlight
+	}
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.inFlight--
+		g.mu.Unlock()
+	}()
+
+	rng := req.Header.Get("Range")
+	g.started <- rng
+	select {
+	case <-g.gate(rng):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return g.base.RoundTrip(req)
+}
+
+// waitStarted returns the ranges of the next n requests to start.
+func (g *gatedTransport) waitStarted(t *testing.T, n int) []string {
+	t.Helper()
+	var ranges []string
+	for len(ranges) < n {
+		select {
+		case r := <-g.started:
+			ranges = append(ranges, r)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got requests for %q, want %d", ranges, n)
+		}
+	}
+	return ranges
+}
+
+func (g *gatedTransport) maxRequests() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.maxInFlight
+}
+
+func newStreamTest(t *testing.T, content []byte) (*fastGCS, *gatedTransport) {
+	f, srv := newJSONTest(t)
+	srv.Put("b", "o", content)
+	g := newGatedTransport(srv.Client().Transport)
+	f.client = &http.Client{Transport: g}
+	return f, g
+}
+
+// readAll reads r to the end in the background.
+func readAll(r io.Reader) <-chan []byte {
+	done := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- data
+	}()
+	return done
+}
+
+func TestReadAheadWindowGrowth(t *testing.T) {
+	content := randomContent(40)
+	f, g := newStreamTest(t, content)
+	r, err := f.Stream("gs://b/o", ReadAhead{ChunkSize: 4, Window: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	done := readAll(r)
+
+	// The reader waits for the first chunk, so the window grows to two.
+	got := g.waitStarted(t, 2)
+	sort.Strings(got)
+	if want := []string{"bytes=0-3", "bytes=4-7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first requests %q, want %q", got, want)
+	}
+	// Once it has the first chunk, it waits for the second, and the window
+	// grows to four: three chunks are fetched behind the second.
+	g.release("bytes=0-3")
+	got = g.waitStarted(t, 3)
+	sort.Strings(got)
+	if want := []string{"bytes=12-15", "bytes=16-19", "bytes=8-11"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("requests once the window grew %q, want %q", got, want)
+	}
+
+	g.releaseAll()
+	var data []byte
+	select {
+	case data = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream never finished")
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("read %d bytes, want the %d of the object", len(data), len(content))
+	}
+	if n := g.maxRequests(); n > 4 {
+		t.Errorf("%d requests in flight, want at most the window of 4", n)
+	}
+}
+
+func TestReadAheadMemoryCap(t *testing.T) {
+	if got := (ReadAhead{ChunkSize: 4, Window: 8, MaxMemory: 10}).withDefaults().Window; got != 2 {
+		t.Errorf("window under a cap of 2.5 chunks = %d, want 2", got)
+	}
+	if got := (ReadAhead{ChunkSize: 4, Window: 8, MaxMemory: 1}).withDefaults().Window; got != 1 {
+		t.Errorf("window under a cap below a chunk = %d, want 1", got)
+	}
+
+	content := randomContent(64)
+	f, g := newStreamTest(t, content)
+	r, err := f.Stream("gs://b/o", ReadAhead{ChunkSize: 4, Window: 8, MaxMemory: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	g.releaseAll()
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("read %d bytes, %v, want the %d of the object", len(got), err, len(content))
+	}
+	rr := r.(*readAheadReader)
+	if n := g.maxRequests(); n > 2 || rr.bufs > 2 {
+		t.Errorf("%d requests in flight and %d buffers, want at most the 2 chunks that fit in memory", n, rr.bufs)
+	}
+}
+
+func TestReadAheadCloseDuringFetch(t *testing.T) {
+	f, g := newStreamTest(t, randomContent(40))
+	r, err := f.Stream("gs://b/o", ReadAhead{ChunkSize: 4, Window: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 4))
+		readErr <- err
+	}()
+	g.waitStarted(t, 2)
+
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for fetches that will never finish")
+	}
+	if err := <-readErr; err == nil {
+		t.Error("Read interrupted by Close succeeded")
+	}
+	if _, err := r.Read(make([]byte, 4)); err == nil {
+		t.Error("Read after Close succeeded")
+	}
+}
+
+// rangeTransport rewrites the Range header of media requests.
+type rangeTransport struct {
+	base    http.RoundTripper
+	rewrite func(string) string
+}
+
+func (rt *rangeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rng := req.Header.Get("Range"); rng != "" {
+		req = req.Clone(req.Context())
+		if rng = rt.rewrite(rng); rng == "" {
+			req.Header.Del("Range")
+		} else {
+			req.Header.Set("Range", rng)
+		}
+	}
+	return rt.base.RoundTrip(req)
+}
+
+func TestReadAheadWrongRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite func(string) string
+	}{
+		{"range ignored", func(string) string { return "" }},
+		{"another range", func(string) string { return "bytes=0-3" }},
+	}
+	for _, tt := range tests {
+		f, srv := newJSONTest(t)
+		srv.Put("b", "o", randomContent(40))
+		f.client = &http.Client{Transport: &rangeTransport{base: srv.Client().Transport, rewrite: tt.rewrite}}
+		r, err := f.Stream("gs://b/o", ReadAhead{ChunkSize: 16, Window: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err == nil {
+			t.Errorf("%s: read %d bytes without an error", tt.name, len(got))
+		}
+	}
+}
+
+func TestReadAheadGzip(t *testing.T) {
+	content := bytes.Repeat([]byte("hello, world\n"), 100)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(content)
+	zw.Close()
+	f, srv := newJSONTest(t)
+	srv.PutEncoded("b", "o", gz.Bytes(), "gzip")
+
+	r, err := f.Stream("gs://b/o", ReadAhead{ChunkSize: 16, Window: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes, %v, want the %d decompressed", len(got), err, len(content))
+	}
+}
@@ -0,0 +1,46 @@
+package fastgcs
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sleep and now are time.Sleep and time.Now, for tests to run polling
+// loops on a fake clock.
+var (
+	sleep = time.Sleep
+	now   = time.Now
+)
+
+// isRetryable reports whether err looks transient: a transport failure, or
+// one of the statuses GCS documents as worth retrying.
+func isRetryable(err error) bool {
+	var herr *HTTPError
+	if !errors.As(err, &herr) {
+		return true
+	}
+	switch herr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return herr.StatusCode >= 500
+}
+
+// withRetries calls fn until it succeeds, fails with a non-retryable error,
+// or has been tried attempts times, backing off exponentially in between.
+func withRetries(attempts int, fn func() error) error {
+	backoff := 250 * time.Millisecond
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = fn(); err == nil || !isRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
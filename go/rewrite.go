@@ -0,0 +1,89 @@
+package fastgcs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RewriteOptions configures Rewrite.
+type RewriteOptions struct {
+	// SourceGeneration, if non-zero, is the generation of the source to
+	// copy. The rewrite fails if it's no longer available.
+	SourceGeneration int64
+	// IfGenerationMatch makes the rewrite fail unless the live generation
+	// of the destination is the given one. Zero means it must not exist.
+	IfGenerationMatch *int64
+	// RewriteToken continues a rewrite a previous call left unfinished. The
+	// other options must be the same as in that call.
+	RewriteToken string
+}
+
+// RewriteStatus is the outcome of a call to Rewrite.
+type RewriteStatus struct {
+	BytesRewritten int64 `json:"totalBytesRewritten,string"`
+	ObjectSize     int64 `json:"objectSize,string"`
+	Done           bool  `json:"done"`
+	// RewriteToken is what the next call takes to continue the rewrite,
+	// until it's Done.
+	RewriteToken string `json:"rewriteToken"`
+	// Resource is the destination object, once the rewrite is Done.
+	Resource *ObjectAttrs `json:"resource"`
+}
+
+// Rewrite copies the object at srcURL to dstURL server side, across buckets,
+// locations and storage classes. Large copies take several calls: as long
+// as the returned status isn't Done, call Rewrite again with its
+// RewriteToken. Tokens outlive the process that got them, so a rewrite can
+// resume after a restart.
+func (f *fastGCS) Rewrite(srcURL, dstURL string, opts RewriteOptions) (*RewriteStatus, error) {
+	srcBucket, srcObject, err := parseGSURL(srcURL)
+	if err != nil {
+		return nil, err
+	}
+	dstBucket, dstObject, err := parseGSURL(dstURL)
+	if err != nil {
+		return nil, err
+	}
+	if srcObject == "" || dstObject == "" {
+		return nil, errors.Errorf("can't rewrite %s to %s: both must be objects", srcURL, dstURL)
+	}
+
+	q := url.Values{}
+	if opts.SourceGeneration != 0 {
+		q.Set("sourceGeneration", fmt.Sprint(opts.SourceGeneration))
+	}
+	if opts.IfGenerationMatch != nil {
+		q.Set("ifGenerationMatch", fmt.Sprint(*opts.IfGenerationMatch))
+	}
+	if opts.RewriteToken != "" {
+		q.Set("rewriteToken", opts.RewriteToken)
+	}
+	u := fmt.Sprintf("%s/rewriteTo/b/%s/o/%s?%s", apiObjectURL(srcBucket, srcObject),
+		url.PathEscape(dstBucket), url.PathEscape(dstObject), q.Encode())
+	req, err := http.NewRequest("POST", u, strings.NewReader("{}"))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := f.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "rewriting %s to %s", srcURL, dstURL)
+	}
+	defer res.Body.Close()
+	var status RewriteStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return nil, errors.Wrap(err, "decoding rewrite response")
+	}
+	if status.Done {
+		if status.Resource == nil {
+			return nil, errors.Errorf("rewriting %s to %s: done without a resource", srcURL, dstURL)
+		}
+		f.noteWrite(status.Resource)
+	}
+	return &status, nil
+}
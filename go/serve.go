@@ -0,0 +1,180 @@
+package fastgcs
+
+import (
+	"crypto/subtle"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ServeOptions configures ServeHandler.
+type ServeOptions struct {
+	// Clients lists who may read what. Without any, every request is
+	// served, which is only fit for a server on a loopback address.
+	Clients []ServeClient
+	// ErrorLog, if set, receives the errors reaching GCS, which clients
+	// only see as a 502. Defaults to the log package's standard logger.
+	ErrorLog *log.Logger
+}
+
+// ServeClient is a client of the server, and what it may read.
+type ServeClient struct {
+	Name string `yaml:"name" json:"name"`
+	// Token, if set, authenticates the client by an "Authorization: Bearer
+	// <token>" header.
+	Token string `yaml:"token" json:"token"`
+	// CommonName, if set, authenticates the client by the subject common
+	// name of its TLS client certificate, which the server must have
+	// verified.
+	CommonName string `yaml:"common_name" json:"common_name"`
+	// Allow lists the gs:// prefixes the client may read, e.g.
+	// gs://bucket/ for a whole bucket or gs://bucket/builds/ for a
+	// directory. Prefixes match as in listings: gs://bucket/build also
+	// allows gs://bucket/builds/x.
+	Allow []string `yaml:"allow" json:"allow"`
+}
+
+func (c *ServeClient) allows(gsURL string) bool {
+	for _, prefix := range c.Allow {
+		if strings.HasPrefix(gsURL, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHandler returns a read-only HTTP handler serving objects from the
+// cache: GET /<bucket>/<object> returns the object's live generation,
+// downloading it into the cache first if needed. Range requests are
+// supported. HEAD /<bucket>/<object> only looks up the object's
+// attributes.
+//
+// With opts.Clients, requests must come from one of them, as told by a
+// verified TLS client certificate or a bearer token, and are refused with
+// 401 otherwise, or with 403 for objects outside the client's allowlist.
+func ServeHandler(fg FastGCS, opts ServeOptions) (http.Handler, error) {
+	clients := make([]ServeClient, len(opts.Clients))
+	for i, c := range opts.Clients {
+		if c.Token == "" && c.CommonName == "" {
+			return nil, errors.Errorf("client %q has neither a token nor a common name", c.Name)
+		}
+		for _, prefix := range c.Allow {
+			if _, _, err := parseGSURL(prefix); err != nil {
+				return nil, errors.Wrapf(err, "client %q", c.Name)
+			}
+		}
+		c.Allow = append([]string(nil), c.Allow...)
+		clients[i] = c
+	}
+	return &serveHandler{fg: fg, clients: clients, errorLog: opts.ErrorLog}, nil
+}
+
+type serveHandler struct {
+	fg       FastGCS
+	clients  []ServeClient
+	errorLog *log.Logger
+}
+
+func (h *serveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	gsURL := "gs://" + parts[0] + "/" + parts[1]
+
+	if len(h.clients) > 0 {
+		c := h.authenticate(r)
+		if c == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fastgcs"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !c.allows(gsURL) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", guessContentType(parts[1]))
+	if r.Method == "HEAD" {
+		attrs, err := h.fg.Stat(gsURL)
+		if err != nil {
+			h.fail(w, gsURL, err)
+			return
+		}
+		// Objects stored gzipped are served decompressed, at a size
+		// only known once read.
+		if attrs.ContentEncoding != "gzip" {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.FormatInt(attrs.Size, 10))
+		}
+		return
+	}
+
+	rc, err := h.fg.Open(gsURL)
+	if err != nil {
+		h.fail(w, gsURL, err)
+		return
+	}
+	defer rc.Close()
+	// Plain cache entries are files, which can serve ranges.
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, rs)
+		return
+	}
+	io.Copy(w, rc)
+}
+
+// fail answers a request for gsURL that failed with err. Errors other than
+// a missing object are logged rather than shown to the client, as they may
+// reveal more of the server than its clients should know.
+func (h *serveHandler) fail(w http.ResponseWriter, gsURL string, err error) {
+	if IsStatus(err, http.StatusNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	h.logf("serving %s: %v", gsURL, err)
+	http.Error(w, "bad gateway", http.StatusBadGateway)
+}
+
+func (h *serveHandler) logf(format string, args ...interface{}) {
+	if h.errorLog != nil {
+		h.errorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// authenticate returns the client that sent r, or nil.
+func (h *serveHandler) authenticate(r *http.Request) *ServeClient {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for i := range h.clients {
+			if h.clients[i].CommonName != "" && h.clients[i].CommonName == cn {
+				return &h.clients[i]
+			}
+		}
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for i := range h.clients {
+		if h.clients[i].Token != "" && subtle.ConstantTimeCompare(token, []byte(h.clients[i].Token)) == 1 {
+			return &h.clients[i]
+		}
+	}
+	return nil
+}
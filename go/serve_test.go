@@ -0,0 +1,214 @@
+package fastgcs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveBucket adds to fakeBucket what ServeHandler uses.
+type serveBucket struct {
+	*fakeBucket
+	openErr error
+	opens   int
+}
+
+func (b *serveBucket) Stat(gsURL string) (*ObjectAttrs, error) {
+	name, err := b.object(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.objects[name]
+	if !ok {
+		return nil, &HTTPError{StatusCode: http.StatusNotFound}
+	}
+	return b.attrs(name, o), nil
+}
+
+func (b *serveBucket) Open(gsURL string) (io.ReadCloser, error) {
+	b.opens++
+	if b.openErr != nil {
+		return nil, b.openErr
+	}
+	name, err := b.object(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.objects[name]
+	if !ok {
+		return nil, &HTTPError{StatusCode: http.StatusNotFound}
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func serveRequest(t *testing.T, h http.Handler, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestServe(t *testing.T) {
+	b := &serveBucket{fakeBucket: newFakeBucket("b")}
+	b.put("dir/hello.txt", "hello")
+	h, err := ServeHandler(b, ServeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveRequest(t, h, "GET", "/b/dir/hello.txt")
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Errorf("GET = %d %q, want 200 hello", rec.Code, rec.Body)
+	}
+	rec = serveRequest(t, h, "HEAD", "/b/dir/hello.txt")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "5" || rec.Body.Len() != 0 {
+		t.Errorf("HEAD = %d, Content-Length %q, %d bytes of body, want 200, 5, none", rec.Code, rec.Header().Get("Content-Length"), rec.Body.Len())
+	}
+	if b.opens != 1 {
+		t.Errorf("HEAD opened the object")
+	}
+	for _, method := range []string{"GET", "HEAD"} {
+		if rec := serveRequest(t, h, method, "/b/missing"); rec.Code != http.StatusNotFound {
+			t.Errorf("%s of a missing object = %d, want 404", method, rec.Code)
+		}
+	}
+	if rec := serveRequest(t, h, "PUT", "/b/dir/hello.txt"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want 405", rec.Code)
+	}
+}
+
+func TestServeHidesErrors(t *testing.T) {
+	b := &serveBucket{fakeBucket: newFakeBucket("b"), openErr: errors.New("token file /secret/path unreadable")}
+	b.put("a", "a")
+	var logged bytes.Buffer
+	h, err := ServeHandler(b, ServeOptions{ErrorLog: log.New(&logged, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := serveRequest(t, h, "GET", "/b/a")
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("GET = %d, want 502", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("response body %q reveals the error", rec.Body)
+	}
+	if !strings.Contains(logged.String(), "/secret/path") {
+		t.Errorf("error log = %q, want the error", logged.String())
+	}
+}
+
+func TestServeAuth(t *testing.T) {
+	b := &serveBucket{fakeBucket: newFakeBucket("b")}
+	b.put("builds/1", "1")
+	b.put("buildscripts/x", "x")
+	b.put("secrets/key", "key")
+	h, err := ServeHandler(b, ServeOptions{Clients: []ServeClient{
+		{Name: "ci", Token: "ci-token", Allow: []string{"gs://b/builds/"}},
+		{Name: "alice", CommonName: "alice.example.com", Allow: []string{"gs://b/build"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := func(cn string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+	}
+	verified := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert(cn)},
+			VerifiedChains:   [][]*x509.Certificate{{cert(cn)}},
+		}
+	}
+	tests := []struct {
+		name  string
+		path  string
+		auth  string
+		tls   *tls.ConnectionState
+		want  int
+		owner string
+	}{
+		{name: "no credentials", path: "/b/builds/1", want: http.StatusUnauthorized},
+		// The handler leaves refusing tokens sent in the clear to whoever
+		// listens: the CLI only does so on loopback addresses.
+		{name: "token over plain HTTP", path: "/b/builds/1", auth: "Bearer ci-token", want: http.StatusOK, owner: "ci"},
+		{name: "token over TLS", path: "/b/builds/1", auth: "Bearer ci-token", tls: &tls.ConnectionState{}, want: http.StatusOK, owner: "ci"},
+		{name: "wrong token", path: "/b/builds/1", auth: "Bearer alice-token", want: http.StatusUnauthorized},
+		{name: "token prefix", path: "/b/builds/1", auth: "Bearer ci-", want: http.StatusUnauthorized},
+		{name: "basic auth", path: "/b/builds/1", auth: "Basic Y2k6Y2ktdG9rZW4=", want: http.StatusUnauthorized},
+		{name: "token outside allowlist", path: "/b/secrets/key", auth: "Bearer ci-token", want: http.StatusForbidden},
+		{name: "directory prefix", path: "/b/buildscripts/x", auth: "Bearer ci-token", want: http.StatusForbidden},
+		{name: "client certificate", path: "/b/builds/1", tls: verified("alice.example.com"), want: http.StatusOK, owner: "alice"},
+		{name: "name prefix", path: "/b/buildscripts/x", tls: verified("alice.example.com"), want: http.StatusOK, owner: "alice"},
+		{name: "certificate outside allowlist", path: "/b/secrets/key", tls: verified("alice.example.com"), want: http.StatusForbidden},
+		{name: "unknown certificate", path: "/b/builds/1", tls: verified("mallory.example.com"), want: http.StatusUnauthorized},
+		{
+			name: "unverified certificate",
+			path: "/b/builds/1",
+			tls:  &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert("alice.example.com")}},
+			want: http.StatusUnauthorized,
+		},
+		{name: "unknown certificate and token", path: "/b/builds/1", auth: "Bearer ci-token", tls: verified("mallory.example.com"), want: http.StatusOK, owner: "ci"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.TLS = tt.tls
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+
+		var owner string
+		if c := h.(*serveHandler).authenticate(req); c != nil {
+			owner = c.Name
+		}
+		if tt.owner != "" && owner != tt.owner {
+			t.Errorf("%s: authenticated as %q, want %q", tt.name, owner, tt.owner)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: GET %s = %d, want %d", tt.name, tt.path, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without a WWW-Authenticate challenge", tt.name)
+		}
+	}
+}
+
+func TestServeClientAllows(t *testing.T) {
+	c := ServeClient{Allow: []string{"gs://b/builds/", "gs://c/"}}
+	tests := []struct {
+		gsURL string
+		want  bool
+	}{
+		{"gs://b/builds/1", true},
+		{"gs://b/builds/a/b", true},
+		{"gs://b/builds", false},
+		{"gs://b/buildscripts/x", false},
+		{"gs://b/secrets/key", false},
+		{"gs://c/anything", true},
+		{"gs://cc/anything", false},
+		{"gs://bb/builds/1", false},
+	}
+	for _, tt := range tests {
+		if got := c.allows(tt.gsURL); got != tt.want {
+			t.Errorf("allows(%s) = %v, want %v", tt.gsURL, got, tt.want)
+		}
+	}
+	if (&ServeClient{}).allows("gs://b/builds/1") {
+		t.Error("a client without an allowlist is allowed to read")
+	}
+}
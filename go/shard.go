@@ -0,0 +1,215 @@
+package fastgcs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Shard identifies the part of a dataset read by one of Count workers.
+//
+// Objects are assigned to workers with a consistent hash of their URL, so
+// the assignment depends only on the URL and Count: it doesn't change between
+// epochs or runs (keeping each worker's local cache warm), and growing Count
+// only moves the objects that need to move. Within a shard, the order is
+// reshuffled every Epoch, deterministically from Seed.
+type Shard struct {
+	Index int // this worker, in [0, Count)
+	Count int // total number of workers
+	Epoch int
+	Seed  int64
+}
+
+func (s Shard) validate() error {
+	if s.Count <= 0 || s.Index < 0 || s.Index >= s.Count {
+		return errors.Errorf("invalid shard %d of %d", s.Index, s.Count)
+	}
+	return nil
+}
+
+// Select returns the URLs assigned to this shard, in this epoch's order.
+func (s Shard) Select(urls []string) ([]string, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	var selected []string
+	for _, u := range urls {
+		if jumpHash(hashString(u), s.Count) == s.Index {
+			selected = append(selected, u)
+		}
+	}
+
+	keys := make(map[string]uint64, len(selected))
+	for _, u := range selected {
+		keys[u] = s.orderKey(u)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		ki, kj := keys[selected[i]], keys[selected[j]]
+		if ki != kj {
+			return ki < kj
+		}
+		return selected[i] < selected[j]
+	})
+	return selected, nil
+}
+
+// Objects lists the objects under the gs:// prefix and returns the URLs
+// assigned to this shard.
+func (s Shard) Objects(fg FastGCS, gsURL string) ([]string, error) {
+	objects, err := fg.List(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, 0, len(objects))
+	for i := range objects {
+		if strings.HasSuffix(objects[i].Name, "/") {
+			continue // directory placeholder
+		}
+		urls = append(urls, objects[i].URL())
+	}
+	return s.Select(urls)
+}
+
+func (s Shard) orderKey(u string) uint64 {
+	h := fnv.New64a()
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(s.Seed))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(s.Epoch))
+	h.Write(buf[:])
+	io.WriteString(h, u)
+	return mix64(h.Sum64())
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, s)
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer. FNV alone spreads names that differ
+// only in their last few characters poorly across the high bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// jumpHash is Lamping and Veach's jump consistent hash.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// ReadManifest parses a dataset manifest: one gs:// URL per line. Blank
+// lines and lines starting with # are ignored.
+func ReadManifest(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, err := parseGSURL(line); err != nil {
+			return nil, err
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+// ShardReader streams a list of objects in order, opening up to a fixed
+// number of them ahead of the caller so that downloads overlap with
+// processing.
+type ShardReader struct {
+	fg      FastGCS
+	pending chan chan shardResult
+	done    chan struct{}
+	wg      sync.WaitGroup
+	closed  sync.Once
+}
+
+type shardResult struct {
+	url string
+	rc  io.ReadCloser
+	err error
+}
+
+// NewShardReader starts fetching urls through fg, keeping up to prefetch
+// objects in flight.
+func NewShardReader(fg FastGCS, urls []string, prefetch int) *ShardReader {
+	if prefetch < 1 {
+		prefetch = 1
+	}
+	r := &ShardReader{
+		fg:      fg,
+		pending: make(chan chan shardResult, prefetch),
+		done:    make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.run(urls)
+	return r
+}
+
+func (r *ShardReader) run(urls []string) {
+	defer r.wg.Done()
+	defer close(r.pending)
+	for _, u := range urls {
+		result := make(chan shardResult, 1)
+		select {
+		case r.pending <- result:
+		case <-r.done:
+			return
+		}
+		r.wg.Add(1)
+		go func(u string) {
+			defer r.wg.Done()
+			rc, err := r.fg.Open(u)
+			result <- shardResult{url: u, rc: rc, err: err}
+		}(u)
+	}
+}
+
+// Next returns the next object. The caller must close the returned reader.
+// At the end of the list, Next returns io.EOF.
+func (r *ShardReader) Next() (string, io.ReadCloser, error) {
+	result, ok := <-r.pending
+	if !ok {
+		return "", nil, io.EOF
+	}
+	res := <-result
+	if res.err != nil {
+		return res.url, nil, errors.Wrapf(res.err, "fetching %s", res.url)
+	}
+	return res.url, res.rc, nil
+}
+
+// Close stops prefetching and releases any objects that were opened but not
+// yet returned by Next.
+func (r *ShardReader) Close() error {
+	r.closed.Do(func() {
+		close(r.done)
+		for result := range r.pending {
+			if res := <-result; res.rc != nil {
+				res.rc.Close()
+			}
+		}
+		r.wg.Wait()
+	})
+	return nil
+}
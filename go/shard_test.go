@@ -0,0 +1,188 @@
+package fastgcs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func datasetURLs(n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("gs://b/data/part-%05d.tfrecord", i)
+	}
+	return urls
+}
+
+// assignment returns the shard each URL is assigned to out of count.
+func assignment(t *testing.T, urls []string, count int, epoch int) map[string]int {
+	t.Helper()
+	assigned := make(map[string]int, len(urls))
+	for i := 0; i < count; i++ {
+		selected, err := Shard{Index: i, Count: count, Epoch: epoch}.Select(urls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range selected {
+			if prev, ok := assigned[u]; ok {
+				t.Fatalf("%s assigned to shards %d and %d", u, prev, i)
+			}
+			assigned[u] = i
+		}
+	}
+	return assigned
+}
+
+func TestShardAssignment(t *testing.T) {
+	urls := datasetURLs(10000)
+	const count = 8
+	assigned := assignment(t, urls, count, 0)
+	if len(assigned) != len(urls) {
+		t.Fatalf("%d of %d URLs assigned", len(assigned), len(urls))
+	}
+	sizes := make([]int, count)
+	for _, i := range assigned {
+		sizes[i]++
+	}
+	for i, n := range sizes {
+		if want := len(urls) / count; n < want*9/10 || n > want*11/10 {
+			t.Errorf("shard %d holds %d URLs, want about %d", i, n, want)
+		}
+	}
+
+	// The assignment doesn't depend on the epoch.
+	if again := assignment(t, urls, count, 3); !reflect.DeepEqual(again, assigned) {
+		t.Error("assignment changed between epochs")
+	}
+
+	// Adding a worker only moves URLs to it, and about its share of them.
+	grown := assignment(t, urls, count+1, 0)
+	moved := 0
+	for u, i := range grown {
+		if i == assigned[u] {
+			continue
+		}
+		moved++
+		if i != count {
+			t.Fatalf("%s moved from shard %d to %d, not to the new shard", u, assigned[u], i)
+		}
+	}
+	if want := len(urls) / (count + 1); moved < want*9/10 || moved > want*11/10 {
+		t.Errorf("%d URLs moved to the new shard, want about %d", moved, want)
+	}
+}
+
+func TestShardOrder(t *testing.T) {
+	urls := datasetURLs(1000)
+	order := func(s Shard) []string {
+		t.Helper()
+		selected, err := s.Select(urls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return selected
+	}
+	s := Shard{Index: 1, Count: 4, Seed: 42}
+	first := order(s)
+	if again := order(s); !reflect.DeepEqual(again, first) {
+		t.Error("same epoch and seed gave a different order")
+	}
+	if reflect.DeepEqual(first, order(Shard{Index: 1, Count: 4, Seed: 43})) {
+		t.Error("another seed gave the same order")
+	}
+	if sort.StringsAreSorted(first) {
+		t.Error("URLs not shuffled")
+	}
+
+	// Every epoch has the same URLs in a different order.
+	s.Epoch = 1
+	next := order(s)
+	if reflect.DeepEqual(next, first) {
+		t.Error("order didn't change between epochs")
+	}
+	sorted := func(urls []string) []string {
+		urls = append([]string(nil), urls...)
+		sort.Strings(urls)
+		return urls
+	}
+	if !reflect.DeepEqual(sorted(next), sorted(first)) {
+		t.Error("shard holds other URLs in another epoch")
+	}
+	// The order doesn't depend on the order of the input.
+	reversed := make([]string, len(urls))
+	for i, u := range urls {
+		reversed[len(urls)-1-i] = u
+	}
+	if got, _ := s.Select(reversed); !reflect.DeepEqual(got, next) {
+		t.Error("order depends on the order URLs were listed in")
+	}
+}
+
+func TestShardInvalid(t *testing.T) {
+	for _, s := range []Shard{{Index: 0, Count: 0}, {Index: -1, Count: 2}, {Index: 2, Count: 2}} {
+		if _, err := s.Select(datasetURLs(1)); err == nil {
+			t.Errorf("shard %d of %d accepted", s.Index, s.Count)
+		}
+	}
+}
+
+func TestShardObjects(t *testing.T) {
+	f, srv := newJSONTest(t)
+	srv.Put("b", "data/", nil)
+	for _, u := range datasetURLs(20) {
+		srv.Put("b", strings.TrimPrefix(u, "gs://b/"), []byte(u))
+	}
+	s := Shard{Index: 0, Count: 1, Seed: 7}
+	got, err := s.Objects(f, "gs://b/data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := s.Select(datasetURLs(20))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Objects = %q, want %q without the directory placeholder", got, want)
+	}
+
+	r := NewShardReader(f, got, 4)
+	for _, u := range want[:10] {
+		gotURL, rc, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if gotURL != u || string(data) != u {
+			t.Errorf("Next = %s holding %q, want %s", gotURL, data, u)
+		}
+	}
+	// Closing part way releases what was prefetched.
+	r.Close()
+
+	r = NewShardReader(f, []string{want[0], "gs://b/data/missing"}, 2)
+	defer r.Close()
+	if _, rc, err := r.Next(); err != nil {
+		t.Fatal(err)
+	} else {
+		rc.Close()
+	}
+	if u, _, err := r.Next(); u != "gs://b/data/missing" || !IsStatus(err, http.StatusNotFound) {
+		t.Errorf("Next of a missing object = %s, %v, want a 404", u, err)
+	}
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	urls, err := ReadManifest(strings.NewReader("# train\ngs://b/a\n\n  gs://b/c  \n"))
+	if err != nil || !reflect.DeepEqual(urls, []string{"gs://b/a", "gs://b/c"}) {
+		t.Errorf("ReadManifest = %q, %v", urls, err)
+	}
+	if _, err := ReadManifest(strings.NewReader("gs://b/a\n/local/path\n")); err == nil {
+		t.Error("manifest with a local path accepted")
+	}
+}
@@ -0,0 +1,566 @@
+package fastgcs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// syncFilePrefix starts the names of the state and temporary files Sync
+	// keeps in the directory, which aren't synced.
+	syncFilePrefix    = ".fastgcs-sync"
+	syncSaveInterval  = 2 * time.Second
+	syncConflictStamp = "20060102-150405"
+)
+
+// ConflictPolicy says how Sync resolves a file that changed on both sides
+// since the last sync.
+type ConflictPolicy string
+
+const (
+	// ConflictKeepBoth keeps the remote version under the file's name and
+	// moves the local one to a conflict copy next to it, e.g.
+	// notes.conflict-20240102-150405.txt, which is uploaded too. A deletion
+	// on one side loses to a change on the other.
+	ConflictKeepBoth ConflictPolicy = "copy"
+	// ConflictLocal makes the local side win, deletions included.
+	ConflictLocal ConflictPolicy = "local"
+	// ConflictRemote makes the remote side win, deletions included.
+	ConflictRemote ConflictPolicy = "remote"
+)
+
+// SyncOp is an operation Sync carries out on a file.
+type SyncOp string
+
+const (
+	SyncUpload       SyncOp = "upload"
+	SyncDownload     SyncOp = "download"
+	SyncDeleteRemote SyncOp = "delete-remote"
+	SyncDeleteLocal  SyncOp = "delete-local"
+	// SyncConflict reports a conflict, before the operations resolving it.
+	SyncConflict SyncOp = "conflict"
+)
+
+// SyncOptions configures Sync.
+type SyncOptions struct {
+	// StatePath is where the generations and hashes of the files as of the
+	// last sync are kept. Defaults to .fastgcs-sync.json in the directory.
+	StatePath string
+	// Conflict is the policy for files changed on both sides. Defaults to
+	// ConflictKeepBoth.
+	Conflict ConflictPolicy
+	// Progress, if set, is called with each operation once it's done, or
+	// failed with err.
+	Progress func(op SyncOp, name string, err error)
+}
+
+// syncState is the content of a Sync state file.
+type syncState struct {
+	Remote string `json:"remote"`
+	// Files maps names relative to the prefix and directory to their state
+	// as of the last sync.
+	Files   map[string]syncedFile `json:"files"`
+	Updated time.Time             `json:"updated"`
+}
+
+type syncedFile struct {
+	Generation int64  `json:"generation"`
+	CRC32C     string `json:"crc32c"`
+	// Size and ModTime are those of the local file, which is only hashed
+	// again when they change.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// localStat is what Sync found of a local file.
+type localStat struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Sync makes the local directory dir and the gs:// prefix hold the same
+// files, propagating changes made on either side since the last sync:
+// created and modified files are copied over, deleted ones deleted. A file
+// that changed on both sides, unless to the same content, is a conflict,
+// resolved according to opts.Conflict.
+//
+// Local files are recognized as changed by their size and modification
+// time, then by their crc32c; objects by their generation. Writes to GCS are
+// conditional on the generation Sync saw, and local files are only replaced
+// if they haven't changed since Sync looked at them, so concurrent changes
+// are never overwritten: the file is left for the next sync and reported
+// as failed.
+//
+// Only regular files are synced. Objects without a safe local path, as
+// defined by LocalPath, are skipped and reported in an InvalidNamesError
+// once everything else is synced. A failure to sync a file doesn't stop the
+// others; Sync returns an error if any failed.
+func Sync(fg FastGCS, gsURL, dir string, opts SyncOptions) error {
+	bucket, prefix, err := parseGSURL(gsURL)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if opts.StatePath == "" {
+		opts.StatePath = filepath.Join(dir, syncFilePrefix+".json")
+	}
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictKeepBoth
+	}
+	switch opts.Conflict {
+	case ConflictKeepBoth, ConflictLocal, ConflictRemote:
+	default:
+		return errors.Errorf("unknown conflict policy %q", opts.Conflict)
+	}
+
+	s := &syncer{fg: fg, bucket: bucket, prefix: prefix, dir: dir, opts: opts}
+	remote := "gs://" + bucket + "/" + prefix
+	if s.state, err = loadSyncState(opts.StatePath); err != nil {
+		return err
+	}
+	if s.state == nil {
+		s.state = &syncState{Remote: remote, Files: map[string]syncedFile{}}
+	}
+	if s.state.Remote != remote {
+		return errors.Errorf("%s holds the state of a sync with %s", opts.StatePath, s.state.Remote)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var objects []ObjectAttrs
+	err = fg.ListPages(remote, ListOptions{}, func(page *ListPage) error {
+		objects = append(objects, page.Objects...)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "listing %s", remote)
+	}
+	t := mapLocalTree(dir, prefix, objects)
+	for _, d := range t.Dirs {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	remotes := map[string]*ObjectAttrs{}
+	for i := range t.Files {
+		remotes[strings.TrimPrefix(t.Files[i].Attrs.Name, prefix)] = &t.Files[i].Attrs
+	}
+	invalid := map[string]bool{}
+	for _, e := range t.Invalid {
+		invalid[strings.TrimPrefix(e.Name, prefix)] = true
+	}
+
+	locals, err := scanSyncDir(dir, opts.StatePath)
+	if err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for name := range s.state.Files {
+		names[name] = true
+	}
+	for name := range remotes {
+		names[name] = true
+	}
+	for name := range locals {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !invalid[name] && !strings.HasPrefix(path.Base(name), syncFilePrefix) {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	s.remotes, s.locals = remotes, locals
+
+	for _, name := range sorted {
+		if err := s.syncFile(name); err != nil {
+			s.failed++
+			if s.firstErr == nil {
+				s.firstErr = errors.Wrap(err, name)
+			}
+		}
+		if err := s.save(false); err != nil {
+			return err
+		}
+	}
+
+	if err := s.save(true); err != nil {
+		return err
+	}
+	if s.failed > 0 {
+		return errors.Wrapf(s.firstErr, "%d files failed to sync, the first", s.failed)
+	}
+	if len(t.Invalid) > 0 {
+		return t.Invalid
+	}
+	return nil
+}
+
+type syncer struct {
+	fg     FastGCS
+	bucket string
+	prefix string
+	dir    string
+	opts   SyncOptions
+
+	state   *syncState
+	saved   time.Time
+	remotes map[string]*ObjectAttrs
+	locals  map[string]*localStat
+
+	failed   int
+	firstErr error
+}
+
+// syncFile brings name up to date on both sides.
+func (s *syncer) syncFile(name string) error {
+	prev, synced := s.state.Files[name]
+	local := s.locals[name]
+	remote := s.remotes[name]
+
+	localChanged, err := s.localChanged(name, prev, synced, local)
+	if err != nil {
+		return err
+	}
+	remoteChanged := remote != nil
+	if synced {
+		remoteChanged = remote == nil || remote.Generation != prev.Generation
+	}
+
+	switch {
+	case !localChanged && !remoteChanged:
+		return nil
+	case !remoteChanged:
+		return s.pushLocal(name, local, remote)
+	case !localChanged:
+		return s.pullRemote(name, local, remote)
+	case local == nil && remote == nil:
+		delete(s.state.Files, name)
+		return nil
+	case local != nil && remote != nil:
+		crc, err := fileCRC32C(s.localPath(name))
+		if err != nil {
+			return err
+		}
+		if crc == remote.CRC32C {
+			s.state.Files[name] = syncedFile{Generation: remote.Generation, CRC32C: crc, Size: local.Size, ModTime: local.ModTime}
+			return nil
+		}
+	}
+
+	s.progress(SyncConflict, name, nil)
+	switch {
+	case s.opts.Conflict == ConflictLocal:
+		return s.pushLocal(name, local, remote)
+	case s.opts.Conflict == ConflictRemote:
+		return s.pullRemote(name, local, remote)
+	case local == nil:
+		return s.pullRemote(name, nil, remote)
+	case remote == nil:
+		return s.pushLocal(name, local, nil)
+	}
+	return s.keepBoth(name, local, remote)
+}
+
+// localChanged reports whether the local file differs from what was last
+// synced, hashing it only if its size or modification time changed.
+func (s *syncer) localChanged(name string, prev syncedFile, synced bool, local *localStat) (bool, error) {
+	switch {
+	case !synced || local == nil:
+		return local != nil || synced, nil
+	case local.Size == prev.Size && local.ModTime.Equal(prev.ModTime):
+		return false, nil
+	}
+	crc, err := fileCRC32C(s.localPath(name))
+	if err != nil {
+		return false, err
+	}
+	if crc != prev.CRC32C {
+		return true, nil
+	}
+	// Touched but not modified: remember the new time to skip hashing.
+	prev.Size, prev.ModTime = local.Size, local.ModTime
+	s.state.Files[name] = prev
+	return false, nil
+}
+
+// pushLocal makes the remote side match the local one, which may be a
+// deletion, provided the object is still the given remote.
+func (s *syncer) pushLocal(name string, local *localStat, remote *ObjectAttrs) error {
+	var gen int64
+	if remote != nil {
+		gen = remote.Generation
+	}
+	if local == nil {
+		if remote == nil {
+			delete(s.state.Files, name)
+			return nil
+		}
+		err := s.fg.Delete(s.url(name), DeleteOptions{IfGenerationMatch: &gen})
+		if IsStatus(err, http.StatusNotFound) {
+			err = nil
+		}
+		if err == nil {
+			delete(s.state.Files, name)
+		}
+		s.progress(SyncDeleteRemote, name, err)
+		return err
+	}
+	err := s.upload(name, local, gen)
+	s.progress(SyncUpload, name, err)
+	return err
+}
+
+func (s *syncer) upload(name string, local *localStat, ifGeneration int64) error {
+	f, err := os.Open(s.localPath(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := s.fg.Create(s.url(name), WriteOptions{IfGenerationMatch: &ifGeneration})
+	if err != nil {
+		return err
+	}
+	crc := crc32.New(castagnoli)
+	if _, err := io.Copy(io.MultiWriter(w, crc), f); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	s.state.Files[name] = syncedFile{
+		Generation: w.Attrs().Generation,
+		CRC32C:     base64.StdEncoding.EncodeToString(crc.Sum(nil)),
+		Size:       local.Size,
+		ModTime:    local.ModTime,
+	}
+	return nil
+}
+
+// pullRemote makes the local side match the remote one, which may be a
+// deletion, provided the local file is still as scanned.
+func (s *syncer) pullRemote(name string, local *localStat, remote *ObjectAttrs) error {
+	if remote == nil {
+		if local == nil {
+			delete(s.state.Files, name)
+			return nil
+		}
+		err := s.checkUnchanged(name, local)
+		if err == nil {
+			err = os.Remove(s.localPath(name))
+		}
+		if err == nil {
+			delete(s.state.Files, name)
+		}
+		s.progress(SyncDeleteLocal, name, err)
+		return err
+	}
+	err := s.download(name, local, remote)
+	s.progress(SyncDownload, name, err)
+	return err
+}
+
+// download replaces the local file, as it was scanned, with the object.
+// Whichever generation is live gets downloaded; if it's newer than remote,
+// the state's hash won't match it, and the next sync downloads it again.
+func (s *syncer) download(name string, local *localStat, remote *ObjectAttrs) error {
+	dst := s.localPath(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), syncFilePrefix+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := s.fg.Copy(remote.URL(), tmp.Name()); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(dst); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	crc, err := fileCRC32C(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if err := s.checkUnchanged(name, local); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	s.state.Files[name] = syncedFile{Generation: remote.Generation, CRC32C: crc, Size: info.Size(), ModTime: info.ModTime()}
+	return nil
+}
+
+// keepBoth resolves a conflict by moving the local file to a conflict copy,
+// which is uploaded, and downloading the remote one in its place.
+func (s *syncer) keepBoth(name string, local *localStat, remote *ObjectAttrs) error {
+	copyName := s.conflictName(name)
+	if err := s.checkUnchanged(name, local); err != nil {
+		return err
+	}
+	if err := os.Rename(s.localPath(name), s.localPath(copyName)); err != nil {
+		return err
+	}
+	s.locals[copyName] = local
+	err := s.upload(copyName, local, 0)
+	s.progress(SyncUpload, copyName, err)
+	if err != nil {
+		return err
+	}
+	return s.pullRemote(name, nil, remote)
+}
+
+// conflictName returns a name for the conflict copy of name that's in use
+// on neither side.
+func (s *syncer) conflictName(name string) string {
+	ext := path.Ext(name)
+	if ext == path.Base(name) {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext) + ".conflict-" + time.Now().Format(syncConflictStamp)
+	for i := 1; ; i++ {
+		n := stem + ext
+		if i > 1 {
+			n = fmt.Sprintf("%s-%d%s", stem, i, ext)
+		}
+		_, synced := s.state.Files[n]
+		if _, err := os.Lstat(s.localPath(n)); os.IsNotExist(err) && !synced && s.remotes[n] == nil {
+			return n
+		}
+	}
+}
+
+// checkUnchanged makes sure the local file is still as it was scanned, or
+// still missing if local is nil.
+func (s *syncer) checkUnchanged(name string, local *localStat) error {
+	info, err := os.Lstat(s.localPath(name))
+	switch {
+	case local == nil && os.IsNotExist(err):
+		return nil
+	case local == nil && err == nil:
+		return errors.New("created locally during the sync")
+	case err != nil:
+		return err
+	case !info.Mode().IsRegular() || info.Size() != local.Size || !info.ModTime().Equal(local.ModTime):
+		return errors.New("changed locally during the sync")
+	}
+	return nil
+}
+
+func (s *syncer) url(name string) string {
+	return "gs://" + s.bucket + "/" + s.prefix + name
+}
+
+func (s *syncer) localPath(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *syncer) progress(op SyncOp, name string, err error) {
+	if s.opts.Progress != nil {
+		s.opts.Progress(op, name, err)
+	}
+}
+
+// save writes the state file, unless it was written recently and force
+// isn't set.
+func (s *syncer) save(force bool) error {
+	if !force && time.Since(s.saved) < syncSaveInterval {
+		return nil
+	}
+	s.saved = time.Now()
+	s.state.Updated = s.saved.UTC()
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.opts.StatePath, data, 0644)
+}
+
+func loadSyncState(path string) (*syncState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state syncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrapf(err, "parsing sync state %s", path)
+	}
+	if state.Files == nil {
+		state.Files = map[string]syncedFile{}
+	}
+	return &state, nil
+}
+
+// scanSyncDir returns the regular files under dir by name relative to it,
+// with "/" as the separator, leaving out the state file and Sync's own
+// temporary files.
+func scanSyncDir(dir, statePath string) (map[string]*localStat, error) {
+	locals := map[string]*localStat{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), syncFilePrefix) || p == statePath {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		locals[filepath.ToSlash(rel)] = &localStat{Size: info.Size(), ModTime: info.ModTime()}
+		return nil
+	})
+	return locals, err
+}
+
+// fileCRC32C returns the crc32c of the file at path, encoded as GCS does.
+func fileCRC32C(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	crc := crc32.New(castagnoli)
+	if _, err := io.Copy(crc, f); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(crc.Sum(nil)), nil
+}
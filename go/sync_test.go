@@ -0,0 +1,524 @@
+package fastgcs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBucket is a FastGCS that keeps the objects of a bucket in memory. It
+// implements what Sync uses; anything else panics on the nil FastGCS.
+type fakeBucket struct {
+	FastGCS
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	gen     int64
+}
+
+type fakeObject struct {
+	data []byte
+	gen  int64
+}
+
+func newFakeBucket(bucket string) *fakeBucket {
+	return &fakeBucket{bucket: bucket, objects: map[string]*fakeObject{}}
+}
+
+// put creates or replaces an object, as another client would.
+func (b *fakeBucket) put(name, data string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.putLocked(name, []byte(data))
+}
+
+func (b *fakeBucket) putLocked(name string, data []byte) *ObjectAttrs {
+	b.gen++
+	o := &fakeObject{data: data, gen: b.gen}
+	b.objects[name] = o
+	return b.attrs(name, o)
+}
+
+func (b *fakeBucket) remove(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, name)
+}
+
+// contents returns the data of every object under prefix, by name relative
+// to it.
+func (b *fakeBucket) contents(prefix string) map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := map[string]string{}
+	for name, o := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			out[strings.TrimPrefix(name, prefix)] = string(o.data)
+		}
+	}
+	return out
+}
+
+func (b *fakeBucket) attrs(name string, o *fakeObject) *ObjectAttrs {
+	return &ObjectAttrs{
+		Bucket:     b.bucket,
+		Name:       name,
+		Size:       int64(len(o.data)),
+		Generation: o.gen,
+		CRC32C:     testCRC32C(o.data),
+	}
+}
+
+func (b *fakeBucket) object(gsURL string) (string, error) {
+	bucket, name, err := parseGSURL(gsURL)
+	if err != nil {
+		return "", err
+	}
+	if bucket != b.bucket {
+		return "", &HTTPError{StatusCode: http.StatusNotFound, Body: "no bucket " + bucket}
+	}
+	return name, nil
+}
+
+func (b *fakeBucket) ListPages(gsURL string, opts ListOptions, fn func(*ListPage) error) error {
+	prefix, err := b.object(gsURL)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	page := &ListPage{}
+	for name, o := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			page.Objects = append(page.Objects, *b.attrs(name, o))
+		}
+	}
+	b.mu.Unlock()
+	sort.Slice(page.Objects, func(i, j int) bool { return page.Objects[i].Name < page.Objects[j].Name })
+	return fn(page)
+}
+
+func (b *fakeBucket) Copy(gsURL, path string) error {
+	name, err := b.object(gsURL)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	o, ok := b.objects[name]
+	b.mu.Unlock()
+	if !ok {
+		return &HTTPError{StatusCode: http.StatusNotFound}
+	}
+	return ioutil.WriteFile(path, o.data, 0644)
+}
+
+func (b *fakeBucket) Delete(gsURL string, opts DeleteOptions) error {
+	name, err := b.object(gsURL)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.objects[name]
+	switch {
+	case !ok:
+		return &HTTPError{StatusCode: http.StatusNotFound}
+	case opts.IfGenerationMatch != nil && *opts.IfGenerationMatch != o.gen:
+		return &HTTPError{StatusCode: http.StatusPreconditionFailed}
+	}
+	delete(b.objects, name)
+	return nil
+}
+
+func (b *fakeBucket) Create(gsURL string, opts WriteOptions) (*Writer, error) {
+	name, err := b.object(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	up := &fakeUpload{b: b, name: name, ifGeneration: opts.IfGenerationMatch}
+	return &Writer{upload: up, w: up}, nil
+}
+
+type fakeUpload struct {
+	b            *fakeBucket
+	name         string
+	ifGeneration *int64
+	buf          bytes.Buffer
+}
+
+func (u *fakeUpload) Write(p []byte) (int, error) {
+	return u.buf.Write(p)
+}
+
+func (u *fakeUpload) finish() (*ObjectAttrs, error) {
+	u.b.mu.Lock()
+	defer u.b.mu.Unlock()
+	if u.ifGeneration != nil {
+		var gen int64
+		if o, ok := u.b.objects[u.name]; ok {
+			gen = o.gen
+		}
+		if gen != *u.ifGeneration {
+			return nil, &HTTPError{StatusCode: http.StatusPreconditionFailed}
+		}
+	}
+	return u.b.putLocked(u.name, u.buf.Bytes()), nil
+}
+
+func (u *fakeUpload) abort() {}
+
+func testCRC32C(data []byte) string {
+	sum := crc32.Checksum(data, castagnoli)
+	return base64.StdEncoding.EncodeToString([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+}
+
+// readTree returns the content of the files under dir, by slash-separated
+// name relative to it, leaving out Sync's own files.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	locals, err := scanSyncDir(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := map[string]string{}
+	for name := range locals {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[name] = string(data)
+	}
+	return out
+}
+
+var conflictStamp = regexp.MustCompile(`\.conflict-\d{8}-\d{6}(-\d+)?`)
+
+// withoutStamps replaces the time in the names of conflict copies.
+func withoutStamps(files map[string]string) map[string]string {
+	out := map[string]string{}
+	for name, data := range files {
+		out[conflictStamp.ReplaceAllString(name, ".conflict")] = data
+	}
+	return out
+}
+
+// runSync syncs and returns the operations it reported.
+func runSync(t *testing.T, fg FastGCS, dir string, policy ConflictPolicy) []string {
+	t.Helper()
+	var ops []string
+	err := Sync(fg, "gs://b/sync", dir, SyncOptions{
+		Conflict: policy,
+		Progress: func(op SyncOp, name string, err error) {
+			if err != nil {
+				t.Errorf("%s %s: %v", op, name, err)
+			}
+			ops = append(ops, string(op)+" "+conflictStamp.ReplaceAllString(name, ".conflict"))
+		},
+	})
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	return ops
+}
+
+// A side's change to f.txt between syncs: "" for none, "delete", "touch" to
+// only change its modification time, or new content.
+func changeLocal(t *testing.T, dir, change string) {
+	path := filepath.Join(dir, "f.txt")
+	var err error
+	switch change {
+	case "":
+	case "delete":
+		err = os.Remove(path)
+	case "touch":
+		later := time.Now().Add(time.Hour)
+		err = os.Chtimes(path, later, later)
+	default:
+		err = ioutil.WriteFile(path, []byte(change), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func changeRemote(b *fakeBucket, change string) {
+	switch change {
+	case "":
+	case "delete":
+		b.remove("sync/f.txt")
+	default:
+		b.put("sync/f.txt", change)
+	}
+}
+
+func TestSync(t *testing.T) {
+	tests := []struct {
+		name string
+		// first skips the initial sync of f.txt holding "v1", so that the
+		// changes are made with no sync state.
+		first         bool
+		local, remote string
+		policy        ConflictPolicy
+		wantOps       []string
+		wantFiles     map[string]string
+	}{
+		{
+			name:      "unchanged",
+			wantFiles: map[string]string{"f.txt": "v1"},
+		},
+		{
+			name:      "touched but unchanged",
+			local:     "touch",
+			wantFiles: map[string]string{"f.txt": "v1"},
+		},
+		{
+			name:      "modified locally",
+			local:     "local v2",
+			wantOps:   []string{"upload f.txt"},
+			wantFiles: map[string]string{"f.txt": "local v2"},
+		},
+		{
+			name:      "deleted locally",
+			local:     "delete",
+			wantOps:   []string{"delete-remote f.txt"},
+			wantFiles: map[string]string{},
+		},
+		{
+			name:      "modified remotely",
+			remote:    "remote v2",
+			wantOps:   []string{"download f.txt"},
+			wantFiles: map[string]string{"f.txt": "remote v2"},
+		},
+		{
+			name:      "deleted remotely",
+			remote:    "delete",
+			wantOps:   []string{"delete-local f.txt"},
+			wantFiles: map[string]string{},
+		},
+		{
+			name:      "deleted on both sides",
+			local:     "delete",
+			remote:    "delete",
+			wantFiles: map[string]string{},
+		},
+		{
+			name:      "modified alike on both sides",
+			local:     "v2",
+			remote:    "v2",
+			wantFiles: map[string]string{"f.txt": "v2"},
+		},
+		{
+			name:    "modified on both sides, keeping both",
+			local:   "local v2",
+			remote:  "remote v2",
+			wantOps: []string{"conflict f.txt", "upload f.conflict.txt", "download f.txt"},
+			wantFiles: map[string]string{
+				"f.txt":          "remote v2",
+				"f.conflict.txt": "local v2",
+			},
+		},
+		{
+			name:      "modified on both sides, local wins",
+			local:     "local v2",
+			remote:    "remote v2",
+			policy:    ConflictLocal,
+			wantOps:   []string{"conflict f.txt", "upload f.txt"},
+			wantFiles: map[string]string{"f.txt": "local v2"},
+		},
+		{
+			name:      "modified on both sides, remote wins",
+			local:     "local v2",
+			remote:    "remote v2",
+			policy:    ConflictRemote,
+			wantOps:   []string{"conflict f.txt", "download f.txt"},
+			wantFiles: map[string]string{"f.txt": "remote v2"},
+		},
+		{
+			name:      "deleted locally, modified remotely, keeping both",
+			local:     "delete",
+			remote:    "remote v2",
+			wantOps:   []string{"conflict f.txt", "download f.txt"},
+			wantFiles: map[string]string{"f.txt": "remote v2"},
+		},
+		{
+			name:      "modified locally, deleted remotely, keeping both",
+			local:     "local v2",
+			remote:    "delete",
+			wantOps:   []string{"conflict f.txt", "upload f.txt"},
+			wantFiles: map[string]string{"f.txt": "local v2"},
+		},
+		{
+			name:      "deleted locally, modified remotely, local wins",
+			local:     "delete",
+			remote:    "remote v2",
+			policy:    ConflictLocal,
+			wantOps:   []string{"conflict f.txt", "delete-remote f.txt"},
+			wantFiles: map[string]string{},
+		},
+		{
+			name:      "modified locally, deleted remotely, remote wins",
+			local:     "local v2",
+			remote:    "delete",
+			policy:    ConflictRemote,
+			wantOps:   []string{"conflict f.txt", "delete-local f.txt"},
+			wantFiles: map[string]string{},
+		},
+		{
+			name:      "first sync, local only",
+			first:     true,
+			local:     "local",
+			wantOps:   []string{"upload f.txt"},
+			wantFiles: map[string]string{"f.txt": "local"},
+		},
+		{
+			name:      "first sync, remote only",
+			first:     true,
+			remote:    "remote",
+			wantOps:   []string{"download f.txt"},
+			wantFiles: map[string]string{"f.txt": "remote"},
+		},
+		{
+			name:      "first sync, alike on both sides",
+			first:     true,
+			local:     "same",
+			remote:    "same",
+			wantFiles: map[string]string{"f.txt": "same"},
+		},
+		{
+			name:    "first sync, different on both sides",
+			first:   true,
+			local:   "local",
+			remote:  "remote",
+			wantOps: []string{"conflict f.txt", "upload f.conflict.txt", "download f.txt"},
+			wantFiles: map[string]string{
+				"f.txt":          "remote",
+				"f.conflict.txt": "local",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newFakeBucket("b")
+			dir := t.TempDir()
+			if !tt.first {
+				b.put("sync/f.txt", "v1")
+				runSync(t, b, dir, tt.policy)
+			}
+			changeLocal(t, dir, tt.local)
+			changeRemote(b, tt.remote)
+
+			ops := runSync(t, b, dir, tt.policy)
+			if !reflect.DeepEqual(ops, tt.wantOps) {
+				t.Errorf("ops = %q, want %q", ops, tt.wantOps)
+			}
+			if got := withoutStamps(readTree(t, dir)); !reflect.DeepEqual(got, tt.wantFiles) {
+				t.Errorf("local files = %q, want %q", got, tt.wantFiles)
+			}
+			if got := withoutStamps(b.contents("sync/")); !reflect.DeepEqual(got, tt.wantFiles) {
+				t.Errorf("objects = %q, want %q", got, tt.wantFiles)
+			}
+			if ops := runSync(t, b, dir, tt.policy); len(ops) > 0 {
+				t.Errorf("sync after sync: ops = %q, want none", ops)
+			}
+		})
+	}
+}
+
+// TestSyncTouched checks that a file whose modification time changed but
+// whose content didn't has its new time recorded, so it's hashed only once.
+func TestSyncTouched(t *testing.T) {
+	b := newFakeBucket("b")
+	b.put("sync/f.txt", "v1")
+	dir := t.TempDir()
+	runSync(t, b, dir, "")
+	changeLocal(t, dir, "touch")
+	runSync(t, b, dir, "")
+
+	state, err := loadSyncState(filepath.Join(dir, syncFilePrefix+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "f.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Files["f.txt"].ModTime; !got.Equal(info.ModTime()) {
+		t.Errorf("recorded modification time %v, want %v", got, info.ModTime())
+	}
+}
+
+// TestSyncRaces checks that changes made by someone else after Sync looked
+// are never overwritten.
+func TestSyncRaces(t *testing.T) {
+	b := newFakeBucket("b")
+	b.put("sync/f.txt", "v1")
+	dir := t.TempDir()
+	runSync(t, b, dir, "")
+	changeLocal(t, dir, "local v2")
+
+	// Sync lists before it scans: replace the object in between, as
+	// another client uploading right then would.
+	racing := &racingBucket{fakeBucket: b, race: func() { b.put("sync/f.txt", "remote v2") }}
+	err := Sync(racing, "gs://b/sync", dir, SyncOptions{})
+	if !IsStatus(err, http.StatusPreconditionFailed) {
+		t.Errorf("Sync = %v, want a precondition failure", err)
+	}
+	if got := b.contents("sync/")["f.txt"]; got != "remote v2" {
+		t.Errorf("object = %q, want the concurrent write", got)
+	}
+	if got := readTree(t, dir)["f.txt"]; got != "local v2" {
+		t.Errorf("local file = %q, want it untouched", got)
+	}
+}
+
+// racingBucket runs race after listing.
+type racingBucket struct {
+	*fakeBucket
+	race func()
+}
+
+func (b *racingBucket) ListPages(gsURL string, opts ListOptions, fn func(*ListPage) error) error {
+	defer b.race()
+	return b.fakeBucket.ListPages(gsURL, opts, fn)
+}
+
+func TestSyncState(t *testing.T) {
+	b := newFakeBucket("b")
+	dir := t.TempDir()
+	runSync(t, b, dir, "")
+	err := Sync(b, "gs://b/other", dir, SyncOptions{})
+	if err == nil || !strings.Contains(err.Error(), "gs://b/sync/") {
+		t.Errorf("Sync with another prefix = %v, want an error naming the synced one", err)
+	}
+	if err := Sync(b, "gs://b/sync", dir, SyncOptions{Conflict: "newest"}); err == nil {
+		t.Error("Sync with an unknown policy succeeded")
+	}
+}
+
+// TestSyncInvalidNames checks that objects without a safe local path are
+// skipped and reported, without stopping the others.
+func TestSyncInvalidNames(t *testing.T) {
+	b := newFakeBucket("b")
+	b.put("sync/ok.txt", "ok")
+	b.put("sync/a/../escape", "no")
+	dir := t.TempDir()
+	err := Sync(b, "gs://b/sync", dir, SyncOptions{})
+	invalid, ok := err.(InvalidNamesError)
+	if !ok || len(invalid) != 1 || invalid[0].Name != "sync/a/../escape" {
+		t.Fatalf("Sync = %v, want an InvalidNamesError for sync/a/../escape", err)
+	}
+	if got, want := readTree(t, dir), map[string]string{"ok.txt": "ok"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("local files = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,307 @@
+package fastgcs
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const uploadBase = "https://storage.googleapis.com/upload/storage/v1"
+
+// WriteOptions configures an upload.
+type WriteOptions struct {
+	// ContentType defaults to a guess from the object name's extension.
+	ContentType string
+	// Gzip compresses the content on the fly and stores it with
+	// Content-Encoding: gzip. Readers that don't accept gzip get the
+	// content transparently decompressed by GCS.
+	Gzip bool
+	// ContentEncoding is stored as the object's Content-Encoding, for
+	// content the caller encoded itself. Gzip overrides it.
+	ContentEncoding string
+	// CacheControl, ContentDisposition and ContentLanguage are stored as
+	// the object's headers of the same names.
+	CacheControl       string
+	ContentDisposition string
+	ContentLanguage    string
+	// Metadata is stored as the object's custom metadata.
+	Metadata map[string]string
+	// IfGenerationMatch makes the upload fail unless the live generation of
+	// the object is the given one. Zero means the object must not exist.
+	IfGenerationMatch *int64
+
+	// Multipart, if set, uploads through the XML API's multipart upload
+	// instead of a single JSON API request: the content is cut into parts
+	// that are uploaded in parallel and retried individually.
+	Multipart *MultipartOptions
+}
+
+// Writer uploads an object's content as it's written. The object is only
+// created once Close returns successfully.
+type Writer struct {
+	upload uploader
+	gz     *gzip.Writer
+	w      io.Writer
+	attrs  *ObjectAttrs
+}
+
+// uploader is an upload strategy.
+type uploader interface {
+	io.Writer
+	// finish completes the upload and returns the created object.
+	finish() (*ObjectAttrs, error)
+	// abort cancels the upload, leaving the object untouched.
+	abort()
+}
+
+// Create starts uploading the object at gsURL.
+func (f *fastGCS) Create(gsURL string, opts WriteOptions) (*Writer, error) {
+	bucket, object, err := parseGSURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.ValidString(object) {
+		return nil, errors.Errorf("invalid object name %q: not UTF-8", object)
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = guessContentType(object)
+	}
+
+	var up uploader
+	switch {
+	case opts.Multipart != nil:
+		up, err = f.startMultipartUpload(bucket, object, opts)
+	case f.grpc != nil:
+		up, err = f.startGRPCUpload(bucket, object, opts)
+	default:
+		up, err = f.startSimpleUpload(bucket, object, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{upload: up, w: up}
+	if opts.Gzip {
+		w.gz = gzip.NewWriter(up)
+		w.w = w.gz
+	}
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Close finishes the upload and waits for GCS to confirm it.
+func (w *Writer) Close() error {
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			w.upload.abort()
+			return err
+		}
+	}
+	attrs, err := w.upload.finish()
+	if err != nil {
+		return err
+	}
+	w.attrs = attrs
+	return nil
+}
+
+// Abort cancels the upload. The object is left untouched.
+func (w *Writer) Abort() {
+	w.upload.abort()
+}
+
+// Attrs returns the attributes of the created object, after a successful
+// Close.
+func (w *Writer) Attrs() *ObjectAttrs {
+	return w.attrs
+}
+
+// Upload uploads the local file at path to gsURL.
+func (f *fastGCS) Upload(path, gsURL string, opts WriteOptions) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	w, err := f.Create(gsURL, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// simpleUpload streams the content to a single multipart/related JSON API
+// request.
+type simpleUpload struct {
+	pw   *io.PipeWriter
+	mw   *multipart.Writer
+	w    io.Writer
+	done chan struct{}
+
+	attrs *ObjectAttrs
+	err   error
+}
+
+type uploadMetadata struct {
+	Name               string            `json:"name"`
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ContentLanguage    string            `json:"contentLanguage,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// contentEncoding returns the Content-Encoding the object is stored with.
+func (opts *WriteOptions) contentEncoding() string {
+	if opts.Gzip {
+		return "gzip"
+	}
+	return opts.ContentEncoding
+}
+
+func (f *fastGCS) startSimpleUpload(bucket, object string, opts WriteOptions) (*simpleUpload, error) {
+	meta := uploadMetadata{
+		Name:               object,
+		ContentType:        opts.ContentType,
+		ContentEncoding:    opts.contentEncoding(),
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		ContentLanguage:    opts.ContentLanguage,
+		Metadata:           opts.Metadata,
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{"uploadType": {"multipart"}}
+	if opts.IfGenerationMatch != nil {
+		q.Set("ifGenerationMatch", fmt.Sprint(*opts.IfGenerationMatch))
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/b/%s/o?%s", uploadBase, url.PathEscape(bucket), q.Encode()), pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/related; boundary="+mw.Boundary())
+
+	u := &simpleUpload{pw: pw, mw: mw, done: make(chan struct{})}
+	go u.send(f, req)
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err == nil {
+		_, err = part.Write(metaJSON)
+	}
+	if err == nil {
+		u.w, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {meta.ContentType}})
+	}
+	if err != nil {
+		pw.CloseWithError(err)
+		<-u.done
+		return nil, u.failure(err)
+	}
+	return u, nil
+}
+
+func (u *simpleUpload) send(f *fastGCS, req *http.Request) {
+	defer close(u.done)
+	res, err := f.do(req)
+	if err != nil {
+		u.err = err
+		u.pw.CloseWithError(err)
+		return
+	}
+	defer res.Body.Close()
+	var attrs ObjectAttrs
+	if err := json.NewDecoder(res.Body).Decode(&attrs); err != nil {
+		u.err = errors.Wrap(err, "decoding upload response")
+		return
+	}
+	u.attrs = &attrs
+	f.noteWrite(u.attrs)
+}
+
+// failure prefers the error the upload request failed with, which explains
+// a broken pipe on our side.
+func (u *simpleUpload) failure(err error) error {
+	if u.err != nil {
+		return u.err
+	}
+	return err
+}
+
+func (u *simpleUpload) Write(p []byte) (int, error) {
+	n, err := u.w.Write(p)
+	if err != nil {
+		select {
+		case <-u.done:
+			return n, u.failure(err)
+		default:
+		}
+	}
+	return n, err
+}
+
+func (u *simpleUpload) finish() (*ObjectAttrs, error) {
+	err := u.mw.Close()
+	if err != nil {
+		u.pw.CloseWithError(err)
+	} else {
+		u.pw.Close()
+	}
+	<-u.done
+	if err != nil || u.err != nil {
+		return nil, u.failure(err)
+	}
+	return u.attrs, nil
+}
+
+func (u *simpleUpload) abort() {
+	u.pw.CloseWithError(errors.New("upload aborted"))
+	<-u.done
+}
+
+func guessContentType(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// GzipExtensions returns a predicate for WriteOptions.Gzip that matches
+// local or object names ending in one of the comma-separated extensions,
+// e.g. "json,log,txt".
+func GzipExtensions(list string) func(name string) bool {
+	exts := map[string]bool{}
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.TrimPrefix(strings.TrimSpace(ext), ".")
+		if ext != "" {
+			exts[strings.ToLower(ext)] = true
+		}
+	}
+	return func(name string) bool {
+		return exts[strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))]
+	}
+}
@@ -0,0 +1,176 @@
+package fastgcs
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWatchInterval = 10 * time.Second
+	defaultWatchDebounce = 2 * time.Second
+	watchRetries         = 5
+)
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	// Interval is how often GCS is polled for new generations. Defaults to
+	// 10 seconds.
+	Interval time.Duration
+	// Debounce is how long the watched objects must stay unchanged after a
+	// change before it's reported, so that a burst of changes is reported
+	// once. While changes are pending, GCS is polled every Debounce if
+	// that's shorter than Interval. Defaults to 2 seconds.
+	Debounce time.Duration
+}
+
+func (o WatchOptions) withDefaults() WatchOptions {
+	if o.Interval <= 0 {
+		o.Interval = defaultWatchInterval
+	}
+	if o.Debounce <= 0 {
+		o.Debounce = defaultWatchDebounce
+	}
+	return o
+}
+
+// Change is a change to a watched object.
+type Change struct {
+	URL string
+	// Generation is the new live generation of the object, or 0 if it was
+	// deleted.
+	Generation int64
+}
+
+// Watch polls the objects at urls for new generations until fn returns an
+// error, which Watch then returns. A URL ending with "/" watches every
+// object under the prefix, including objects created later.
+//
+// Once a burst of changes has settled, the new generations are downloaded
+// into the cache and fn is called with the changes, sorted by URL. Polling
+// pauses while fn runs; changes made meanwhile are reported on the next
+// call.
+func Watch(fg FastGCS, urls []string, opts WatchOptions, fn func([]Change) error) error {
+	opts = opts.withDefaults()
+	for _, u := range urls {
+		if _, _, err := parseGSURL(u); err != nil {
+			return err
+		}
+	}
+
+	prev, err := pollGenerations(fg, urls)
+	if err != nil {
+		return err
+	}
+	pending := map[string]Change{}
+	var lastChange time.Time
+	for {
+		wait := opts.Interval
+		if len(pending) > 0 && opts.Debounce < wait {
+			wait = opts.Debounce
+		}
+		sleep(wait)
+
+		cur, err := pollGenerations(fg, urls)
+		if err != nil {
+			return err
+		}
+		if changes := diffGenerations(prev, cur); len(changes) > 0 {
+			for _, c := range changes {
+				pending[c.URL] = c
+			}
+			prev, lastChange = cur, now()
+			continue
+		}
+		if len(pending) == 0 || now().Sub(lastChange) < opts.Debounce {
+			continue
+		}
+
+		changes := make([]Change, 0, len(pending))
+		for _, c := range pending {
+			changes = append(changes, c)
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].URL < changes[j].URL })
+		pending = map[string]Change{}
+		if err := refreshCache(fg, changes); err != nil {
+			return err
+		}
+		if err := fn(changes); err != nil {
+			return err
+		}
+	}
+}
+
+// pollGenerations returns the live generation of every object urls cover.
+// Missing objects are left out.
+func pollGenerations(fg FastGCS, urls []string) (map[string]int64, error) {
+	gens := map[string]int64{}
+	for _, u := range urls {
+		if strings.HasSuffix(u, "/") {
+			err := withRetries(watchRetries, func() error {
+				return fg.ListPages(u, ListOptions{}, func(page *ListPage) error {
+					for i := range page.Objects {
+						gens[page.Objects[i].URL()] = page.Objects[i].Generation
+					}
+					return nil
+				})
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "listing %s", u)
+			}
+			continue
+		}
+
+		var attrs *ObjectAttrs
+		err := withRetries(watchRetries, func() error {
+			var err error
+			attrs, err = fg.Stat(u)
+			return err
+		})
+		switch {
+		case IsStatus(err, http.StatusNotFound):
+		case err != nil:
+			return nil, errors.Wrapf(err, "getting %s", u)
+		default:
+			gens[u] = attrs.Generation
+		}
+	}
+	return gens, nil
+}
+
+func diffGenerations(prev, cur map[string]int64) []Change {
+	var changes []Change
+	for u, gen := range cur {
+		if prev[u] != gen {
+			changes = append(changes, Change{URL: u, Generation: gen})
+		}
+	}
+	for u := range prev {
+		if _, ok := cur[u]; !ok {
+			changes = append(changes, Change{URL: u})
+		}
+	}
+	return changes
+}
+
+// refreshCache downloads the changed objects into the cache. An object
+// deleted since it was polled is left for the next poll to report.
+func refreshCache(fg FastGCS, changes []Change) error {
+	for _, c := range changes {
+		if c.Generation == 0 {
+			continue
+		}
+		rc, err := fg.Open(c.URL)
+		if IsStatus(err, http.StatusNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rc.Close()
+	}
+	return nil
+}
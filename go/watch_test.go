@@ -0,0 +1,100 @@
+package fastgcs
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useFakeClock runs polling loops on a clock that only moves when they
+// sleep, calling onSleep with the number of the sleep, from 1, once the
+// clock has moved. It returns what they were asked to wait.
+func useFakeClock(t *testing.T, onSleep func(n int)) func() []time.Duration {
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var waits []time.Duration
+	sleep = func(d time.Duration) {
+		clock = clock.Add(d)
+		waits = append(waits, d)
+		onSleep(len(waits))
+	}
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { sleep, now = time.Sleep, time.Now })
+	return func() []time.Duration { return waits }
+}
+
+func TestWatch(t *testing.T) {
+	f, srv := newJSONTest(t)
+	srv.Put("b", "dir/a", []byte("a1"))
+	srv.Put("b", "single", []byte("s"))
+	var a3, created int64
+	waits := useFakeClock(t, func(n int) {
+		switch n {
+		case 1:
+			srv.Put("b", "dir/a", []byte("a2"))
+		case 2:
+			// Still settling: the change is reported once, with the last
+			// generation.
+			a3 = srv.Put("b", "dir/a", []byte("a3"))
+		case 3:
+			created = srv.Put("b", "dir/new", []byte("new"))
+			srv.Delete("b", "single")
+		case 5:
+			srv.Put("b", "elsewhere", []byte("x"))
+		case 6:
+			srv.Delete("b", "dir/a")
+		case 20:
+			t.Fatal("changes never reported")
+		}
+	})
+
+	errStop := errors.New("stop")
+	var calls [][]Change
+	err := Watch(f, []string{"gs://b/dir/", "gs://b/single"}, WatchOptions{Interval: 10 * time.Second, Debounce: 2 * time.Second}, func(changes []Change) error {
+		calls = append(calls, changes)
+		for _, c := range changes {
+			if c.Generation == 0 {
+				continue
+			}
+			path, err := f.cachePath(c.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta := readCacheMeta(path); meta == nil || meta.Generation != c.Generation {
+				t.Errorf("%s reported before its generation %d was cached", c.URL, c.Generation)
+			}
+		}
+		if len(calls) == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Fatalf("Watch = %v, want the error fn returned", err)
+	}
+
+	want := [][]Change{
+		{{URL: "gs://b/dir/a", Generation: a3}, {URL: "gs://b/dir/new", Generation: created}, {URL: "gs://b/single"}},
+		{{URL: "gs://b/dir/a"}},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("changes reported %v, want %v", calls, want)
+	}
+	s, l := 2*time.Second, 10*time.Second
+	if got, want := waits(), []time.Duration{l, s, s, s, l, l, s}; !reflect.DeepEqual(got, want) {
+		t.Errorf("waited %v, want %v", got, want)
+	}
+}
+
+func TestDiffGenerations(t *testing.T) {
+	prev := map[string]int64{"gs://b/same": 1, "gs://b/changed": 1, "gs://b/deleted": 1}
+	cur := map[string]int64{"gs://b/same": 1, "gs://b/changed": 2, "gs://b/created": 3}
+	got := map[string]int64{}
+	for _, c := range diffGenerations(prev, cur) {
+		got[c.URL] = c.Generation
+	}
+	want := map[string]int64{"gs://b/changed": 2, "gs://b/created": 3, "gs://b/deleted": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffGenerations = %v, want %v", got, want)
+	}
+}